@@ -0,0 +1,222 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"goLearning/pkg/utils"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// ---- 目录/多文件上传：边打 tar 包边发，不落临时文件 ----
+
+// archiveName 上传后在服务器上的名字：单个目录用目录名，多个文件用 files-<id>
+func archiveName(paths []string, id string, gz bool) string {
+	name := "files-" + id
+	if len(paths) == 1 {
+		name = filepath.Base(filepath.Clean(paths[0]))
+	}
+	if gz {
+		return name + ".tar.gz"
+	}
+	return name + ".tar"
+}
+
+// contentSize 统计要打包的文件内容总大小，用来显示进度；顺便检查路径都存在
+func contentSize(paths []string) (int64, error) {
+	var total int64
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() {
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				total += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// archiveUpload 把 paths 打成 tar（可选 gzip）流式上传
+// 包的大小事先不知道，文件头里 size 写 -1，发完再发 FILE_END|<id>
+// progress 报的是已经打包的文件内容字节数，和 contentSize 对应
+func archiveUpload(paths []string, name, id string, gz bool, conn net.Conn, aeskey []byte, acks *ackBox, cancel <-chan struct{}, progress func(int64)) error {
+	if err := startUpload(conn, aeskey, acks, id, fmt.Sprintf("FILE|%s|-1|%s", name, id), cancel); err != nil {
+		return err
+	}
+
+	var packed atomic.Int64
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(pw, paths, gz, &packed))
+	}()
+	defer pr.Close() // 取消或出错时让打包的 goroutine 退出
+
+	done := acks.wait(id)
+	if _, err := sendData(pr, id, conn, aeskey, !gz, cancel, func(int64) { progress(packed.Load()) }); err != nil {
+		acks.forget(id)
+		return err
+	}
+	if err := utils.SecureWriteFrame(conn, aeskey, []byte("FILE_END|"+id)); err != nil {
+		acks.forget(id)
+		return fmt.Errorf("send end: %w", err)
+	}
+	return waitDone(acks, id, done, cancel)
+}
+
+// writeTar 把 paths 依次写进 tar 包，每个路径在包里以自己的名字为根
+func writeTar(w io.Writer, paths []string, gz bool, packed *atomic.Int64) error {
+	if gz {
+		zw := gzip.NewWriter(w)
+		defer zw.Close()
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+
+	for _, root := range paths {
+		root = filepath.Clean(root)
+		parent := filepath.Dir(root)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			var link string
+			if d.Type()&fs.ModeSymlink != 0 {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			} else if !d.IsDir() && !d.Type().IsRegular() {
+				return nil // 设备文件、socket 之类的跳过
+			}
+
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(parent, path)
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(rel)
+			if d.IsDir() {
+				hdr.Name += "/"
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			n, err := io.Copy(tw, f)
+			packed.Add(n)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ---- 下载的包在本地解开 ----
+
+func isArchive(name string) bool {
+	return strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// extractArchive 把 tar / tar.gz 解到同目录下的一个新文件夹里，返回文件夹路径
+// 只解普通文件和目录；绝对路径、带 .. 的条目、链接都跳过，防止写到目标目录外面
+func extractArchive(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// 看前两个字节是不是 gzip 的魔数，不靠扩展名
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	base := filepath.Base(path)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar"} {
+		if trimmed, ok := strings.CutSuffix(base, ext); ok {
+			base = trimmed
+			break
+		}
+	}
+	// Mkdir 已存在会失败，不会解到别人先建好的文件夹里
+	dest, err := reservePath(filepath.Dir(path), base, func(p string) error { return os.Mkdir(p, 0755) })
+	if err != nil {
+		return "", err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return dest, nil
+		}
+		if err != nil {
+			return dest, err
+		}
+		name := filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/"))
+		if name == "" || !filepath.IsLocal(name) {
+			continue
+		}
+		target := filepath.Join(dest, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return dest, err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return dest, err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm()|0600)
+			if err != nil {
+				return dest, err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return dest, err
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		src := t.TempDir()
+		root := filepath.Join(src, "photos")
+		os.MkdirAll(filepath.Join(root, "2026"), 0755)
+		os.WriteFile(filepath.Join(root, "a.txt"), []byte("alpha"), 0644)
+		os.WriteFile(filepath.Join(root, "2026", "b.txt"), []byte("beta"), 0644)
+
+		var buf bytes.Buffer
+		var packed atomic.Int64
+		if err := writeTar(&buf, []string{root}, gz, &packed); err != nil {
+			t.Fatal(err)
+		}
+		if packed.Load() != int64(len("alpha")+len("beta")) {
+			t.Errorf("gz=%v: packed %d bytes", gz, packed.Load())
+		}
+
+		dl := t.TempDir()
+		path := filepath.Join(dl, archiveName([]string{root}, "id1", gz))
+		os.WriteFile(path, buf.Bytes(), 0644)
+		dest, err := extractArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dest != filepath.Join(dl, "photos") {
+			t.Errorf("gz=%v: extracted to %s", gz, dest)
+		}
+		for name, want := range map[string]string{"photos/a.txt": "alpha", "photos/2026/b.txt": "beta"} {
+			if got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name))); err != nil || string(got) != want {
+				t.Errorf("gz=%v: %s = %q, %v", gz, name, got, err)
+			}
+		}
+
+		// 再解一次换个文件夹，不往已有的里面写
+		again, err := extractArchive(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != filepath.Join(dl, "photos (1)") {
+			t.Errorf("gz=%v: second extract went to %s", gz, again)
+		}
+	}
+}
+
+func TestExtractStaysInsideDest(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	file := func(name, body string) {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body))})
+		tw.Write([]byte(body))
+	}
+	file("../escape.txt", "x")
+	file("/abs.txt", "x")
+	file("ok/../../escape2.txt", "x")
+	tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: ".."})
+	file("link/escape3.txt", "x")
+	file("fine.txt", "fine")
+	tw.Close()
+
+	dir := t.TempDir()
+	dl := filepath.Join(dir, "downloads")
+	os.Mkdir(dl, 0755)
+	path := filepath.Join(dl, "evil.tar")
+	os.WriteFile(path, buf.Bytes(), 0644)
+	dest, err := extractArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{
+		filepath.Join(dl, "escape.txt"), filepath.Join(dir, "escape.txt"),
+		filepath.Join(dl, "escape2.txt"), filepath.Join(dl, "escape3.txt"),
+	} {
+		if _, err := os.Lstat(p); err == nil {
+			t.Errorf("%s was written", p)
+		}
+	}
+	// 链接不建，后面写进 link/ 的只是个普通文件夹
+	if info, err := os.Lstat(filepath.Join(dest, "link")); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		t.Error("symlink extracted")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "fine.txt")); string(got) != "fine" {
+		t.Errorf("fine.txt = %q", got)
+	}
+}
+
+// 打包前统计大小要走一遍目录，不能在 Update 里做：面板上先显示大小未知，错误从 cmd 报回来
+func TestUploadSizesInBackground(t *testing.T) {
+	m := newModel(nil, nil, testModel(t).ident, 80, 24, filepath.Join(t.TempDir(), "history"))
+	dir := t.TempDir()
+	m.input.SetValue("/upload " + filepath.Join(dir, "missing1") + " " + filepath.Join(dir, "missing2"))
+	next, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	m = next.(model)
+	if len(m.transfers) != 1 || m.transfers[0].size != -1 {
+		t.Fatalf("transfers = %+v, want one of unknown size", m.transfers)
+	}
+	for _, line := range m.lines {
+		if strings.Contains(line, "upload error") {
+			t.Fatalf("Update walked the paths itself: %q", line)
+		}
+	}
+	if cmd == nil {
+		t.Fatal("no upload cmd")
+	}
+	cmd()
+	done, ok := (<-m.incoming).(transferDoneMsg)
+	if !ok || done.id != m.transfers[0].id || !strings.Contains(done.text, "upload error") {
+		t.Errorf("cmd reported %+v", done)
+	}
+}
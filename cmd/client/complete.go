@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ---- Tab 补全：命令名、昵称、服务器文件名、本地路径，连按 Tab 轮流换 ----
+
+type catalogMsg struct{ names []string }
+
+// completion 一次补全；base 是输入框里不动的那部分，candidates 轮流接在它后面
+type completion struct {
+	base       string
+	candidates []string
+	index      int
+}
+
+// complete 处理 Tab（dir=1）和 Shift+Tab（dir=-1）
+func (m *model) complete(dir int) {
+	if m.comp == nil {
+		base, candidates := m.candidates(m.input.Value())
+		if len(candidates) == 0 {
+			return
+		}
+		m.comp = &completion{base: base, candidates: candidates, index: -1}
+		if dir < 0 {
+			m.comp.index = 0 // 下面再减一，就是最后一个
+		}
+	}
+	c := m.comp
+	n := len(c.candidates)
+	c.index = (c.index + dir + n) % n
+
+	value := c.base + c.candidates[c.index]
+	// 只有一个候选就补完整，顺手加个空格；目录后面不加，方便接着补
+	if n == 1 && !strings.HasSuffix(value, string(os.PathSeparator)) {
+		value += " "
+	}
+	m.input.SetValue(value)
+	m.input.CursorEnd()
+}
+
+// candidates 根据输入框当前内容决定补什么
+func (m model) candidates(value string) (base string, out []string) {
+	// 还在输命令名
+	if strings.HasPrefix(value, "/") && !strings.Contains(value, " ") {
+		for _, c := range commands {
+			name, _, _ := strings.Cut(c.usage, " ")
+			if strings.HasPrefix(name, value) {
+				out = append(out, name)
+			}
+		}
+		return "", out
+	}
+
+	cmd, arg, _ := strings.Cut(value, " ")
+	switch cmd {
+	case "/download", "/rm":
+		// 文件名可能带空格，整个参数一起补
+		arg = strings.TrimLeft(arg, " ")
+		base = value[:len(value)-len(arg)]
+		for _, name := range m.catalog {
+			if strings.HasPrefix(name, arg) {
+				out = append(out, name)
+			}
+		}
+		return base, out
+	case "/upload", "/extract":
+		i := strings.LastIndex(value, " ") + 1
+		return value[:i], localPaths(value[i:])
+	}
+
+	// 其他情况补最后一个词为昵称，@ 开头的补成 @昵称
+	i := strings.LastIndex(value, " ") + 1
+	word := value[i:]
+	at := strings.HasPrefix(word, "@")
+	word = strings.ToLower(strings.TrimPrefix(word, "@"))
+	for _, u := range m.roster {
+		if u.Name == m.self || !strings.HasPrefix(strings.ToLower(u.Name), word) {
+			continue
+		}
+		if at {
+			out = append(out, "@"+u.Name)
+		} else {
+			out = append(out, u.Name)
+		}
+	}
+	sort.Strings(out)
+	return value[:i], out
+}
+
+// localPaths 本地文件补全，目录后面带上分隔符；没输点就不列隐藏文件
+func localPaths(word string) []string {
+	dir, prefix := filepath.Split(word)
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+	entries, err := os.ReadDir(readDir)
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(prefix, ".") {
+			continue
+		}
+		if e.IsDir() {
+			name += string(os.PathSeparator)
+		}
+		out = append(out, dir+name)
+	}
+	return out
+}
+
+// hint 候选不止一个时显示在底部，当前选中的加括号
+func (c *completion) hint(width int) string {
+	parts := make([]string, len(c.candidates))
+	for i, cand := range c.candidates {
+		if i == c.index {
+			cand = "[" + cand + "]"
+		}
+		parts[i] = cand
+	}
+	return shorten("Tab: "+strings.Join(parts, "  "), bigger(10, width))
+}
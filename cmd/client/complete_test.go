@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"goLearning/pkg/utils"
+)
+
+func completeModel(t *testing.T) model {
+	t.Helper()
+	m := newModel(nil, nil, testModel(t).ident, 80, 24, filepath.Join(t.TempDir(), "history"))
+	m.self = "me"
+	m.roster = []utils.Member{{Name: "me"}, {Name: "Alice"}, {Name: "alex"}, {Name: "bob"}}
+	m.catalog = []string{"report 2026.pdf", "report.txt", "notes.md"}
+	return m
+}
+
+func TestCandidates(t *testing.T) {
+	m := completeModel(t)
+	tests := []struct {
+		value string
+		base  string
+		want  []string
+	}{
+		{"/dow", "", []string{"/download"}},
+		{"/zzz", "", nil},
+		{"/download rep", "/download ", []string{"report 2026.pdf", "report.txt"}},
+		{"/download report 2", "/download ", []string{"report 2026.pdf"}}, // 文件名里有空格
+		{"/rm  no", "/rm  ", []string{"notes.md"}},
+		{"hi al", "hi ", []string{"Alice", "alex"}}, // 昵称不分大小写，排好序
+		{"hi @AL", "hi ", []string{"@Alice", "@alex"}},
+		{"hi m", "hi ", nil}, // 不补自己
+	}
+	for _, tt := range tests {
+		base, got := m.candidates(tt.value)
+		if base != tt.base || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("candidates(%q) = %q, %q; want %q, %q", tt.value, base, got, tt.base, tt.want)
+		}
+	}
+}
+
+func TestLocalPaths(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "photos"), 0755)
+	os.WriteFile(filepath.Join(dir, "photo.jpg"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, ".profile"), nil, 0644)
+	sep := string(os.PathSeparator)
+
+	got := localPaths(dir + sep + "pho")
+	want := []string{dir + sep + "photo.jpg", dir + sep + "photos" + sep}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("localPaths = %q, want %q", got, want)
+	}
+	// 没输点不列隐藏文件
+	for _, p := range localPaths(dir + sep) {
+		if strings.Contains(p, ".profile") {
+			t.Errorf("hidden file listed: %q", p)
+		}
+	}
+	if got := localPaths(dir + sep + "."); len(got) != 1 || !strings.HasSuffix(got[0], ".profile") {
+		t.Errorf("localPaths(.) = %q", got)
+	}
+	if got := localPaths(filepath.Join(dir, "missing") + sep); got != nil {
+		t.Errorf("missing dir = %q", got)
+	}
+
+	t.Chdir(dir) // 相对路径从当前目录找
+	if got := localPaths("photos"); !reflect.DeepEqual(got, []string{"photos" + sep}) {
+		t.Errorf("relative localPaths = %q", got)
+	}
+}
+
+func TestCompleteCycles(t *testing.T) {
+	m := completeModel(t)
+	m.input.SetValue("/download rep")
+	m.complete(1)
+	if got := m.input.Value(); got != "/download report 2026.pdf" {
+		t.Fatalf("first tab = %q", got)
+	}
+	m.complete(1)
+	if got := m.input.Value(); got != "/download report.txt" {
+		t.Fatalf("second tab = %q", got)
+	}
+	m.complete(1) // 转回第一个
+	if got := m.input.Value(); got != "/download report 2026.pdf" {
+		t.Fatalf("third tab = %q", got)
+	}
+	if h := m.comp.hint(80); !strings.Contains(h, "[report 2026.pdf]") || !strings.Contains(h, "  report.txt") {
+		t.Errorf("hint = %q", h)
+	}
+
+	// Shift+Tab 从最后一个开始
+	m.comp = nil
+	m.input.SetValue("hi al")
+	m.complete(-1)
+	if got := m.input.Value(); got != "hi alex" {
+		t.Errorf("shift+tab = %q", got)
+	}
+
+	// 只有一个候选就补完整，加个空格
+	m.comp = nil
+	m.input.SetValue("/dow")
+	m.complete(1)
+	if got := m.input.Value(); got != "/download " {
+		t.Errorf("single candidate = %q", got)
+	}
+
+	// 没有候选什么都不动
+	m.comp = nil
+	m.input.SetValue("/zzz")
+	m.complete(1)
+	if got := m.input.Value(); got != "/zzz" || m.comp != nil {
+		t.Errorf("no candidates: value %q, comp %+v", got, m.comp)
+	}
+}
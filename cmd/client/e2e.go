@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"goLearning/pkg/utils"
+)
+
+// ---- 端到端加密：聊天内容在本地加密，服务器只转发密文（协议见 utils/e2e.go）----
+// 身份密钥存在 identity.json（0600），收到的发送者密钥也存在里面，重新连上以后聊天记录还能解开；
+// 进房间之前别人发的消息没有密钥，显示成一把锁
+
+type senderKeyMsg struct{ sk utils.SenderKey }
+type directMsg struct{ d utils.Direct }
+type keyInfoMsg struct{ info utils.KeyInfo }
+
+// 身份文件里最多存多少把发送者密钥，多了丢最老的
+const maxKeyring = 2000
+
+type identityFile struct {
+	Private []byte              `json:"private"`
+	Keys    map[string]roomKey  `json:"keys"`                 // keyId -> 发送者密钥，别人发来的和自己的都在
+	Known   map[string]knownKey `json:"known,omitempty"`      // 名字 -> 见过的身份公钥，见 trust.go
+	Direct  map[string][]int64  `json:"directSeqs,omitempty"` // 公钥 -> 收到过的私信序号，见 sign.go
+}
+
+// roomKey 某个人在某个房间用的一把发送者密钥
+type roomKey struct {
+	Room  string    `json:"room"`
+	From  string    `json:"from"`
+	Key   []byte    `json:"key"`
+	Added time.Time `json:"added"`
+}
+
+// senderKey 自己在一个房间正在用的发送者密钥，sent 记着发给过谁（名字 -> 当时他的公钥）
+type senderKey struct {
+	id   string
+	from string
+	key  []byte
+	sent map[string]string
+}
+
+type identity struct {
+	path   string
+	priv   *ecdh.PrivateKey
+	keys   map[string]roomKey
+	known  map[string]knownKey
+	mine   map[string]*senderKey // 房间 -> 自己的发送者密钥，不存盘，重新连上换新的
+	peers  map[string]string     // /key 查到的公钥，不在线的人也能发私信
+	queued map[string][]string   // 等 /key 回复的私信
+
+	lastSeq int64              // 自己签名用过的最大序号，见 nextSeq
+	seqs    map[string]string  // 验过的 "公钥|序号" -> 用在哪条消息上（私信是空串），见 sign.go
+	newest  map[string]int64   // 消息 id -> 见过的最大序号
+	direct  map[string][]int64 // 公钥 -> 收到过的私信序号（排好序），存盘，见 freshDirect
+}
+
+// identityPath 身份文件放在主题配置旁边；同一台机器开两个客户端可以用 CHAT_IDENTITY_FILE 分开
+func identityPath() string {
+	if p := os.Getenv("CHAT_IDENTITY_FILE"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "chatclient", "identity.json")
+}
+
+// loadIdentity 读身份文件，没有就生成一个新的身份
+func loadIdentity(path string) (*identity, error) {
+	id := &identity{path: path, keys: map[string]roomKey{}, known: map[string]knownKey{}, mine: map[string]*senderKey{},
+		peers: map[string]string{}, queued: map[string][]string{}, seqs: map[string]string{}, newest: map[string]int64{}, direct: map[string][]int64{}}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		_ = os.Chmod(path, 0600) // 老版本写的可能别人也能读
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var f identityFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if id.priv, err = ecdh.X25519().NewPrivateKey(f.Private); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if f.Keys != nil {
+			id.keys = f.Keys
+		}
+		if f.Known != nil {
+			id.known = f.Known
+		}
+		if f.Direct != nil {
+			id.direct = f.Direct
+		}
+		return id, nil
+	case errors.Is(err, os.ErrNotExist):
+		if id.priv, err = utils.NewIdentity(); err != nil {
+			return nil, err
+		}
+		return id, id.save()
+	default:
+		return nil, err
+	}
+}
+
+// save 写回身份文件，私钥只给自己读
+func (id *identity) save() error {
+	if over := len(id.keys) - maxKeyring; over > 0 {
+		ids := make([]string, 0, len(id.keys))
+		for k := range id.keys {
+			ids = append(ids, k)
+		}
+		sort.Slice(ids, func(i, j int) bool { return id.keys[ids[i]].Added.Before(id.keys[ids[j]].Added) })
+		for _, k := range ids[:over] {
+			delete(id.keys, k)
+		}
+	}
+	data, err := json.MarshalIndent(identityFile{Private: id.priv.Bytes(), Keys: id.keys, Known: id.known, Direct: id.direct}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(id.path), 0700); err != nil {
+		return err
+	}
+	return writePrivateFile(id.path, data)
+}
+
+func (id *identity) publicKey() string {
+	return utils.PublicIdentity(id.priv)
+}
+
+// nextSeq 签名用的序号：按毫秒时间戳往上走，重启以后不用记着上次用到哪
+func (id *identity) nextSeq() int64 {
+	seq := time.Now().UnixMilli()
+	if seq <= id.lastSeq {
+		seq = id.lastSeq + 1
+	}
+	id.lastSeq = seq
+	return seq
+}
+
+// open 解开一条房间消息，密钥要是这个人在这个房间发来的才算
+func (id *identity) open(msg *utils.Message) bool {
+	room := msg.Room
+	if room == "" {
+		room = utils.DefaultRoom
+	}
+	k, ok := id.keys[msg.KeyID]
+	if !ok || k.From != msg.From || k.Room != room {
+		return false
+	}
+	text, err := utils.OpenMessage(k.Key, msg.Cipher, utils.MessageAAD(room, msg.From, msg.KeyID))
+	if err != nil {
+		return false
+	}
+	msg.Text = text
+	return true
+}
+
+// decrypt 加密的消息能解就解，解不开 Text 还是空的，显示的时候换成一把锁
+func (m *model) decrypt(msg *utils.Message) {
+	if msg.Encrypted() && !msg.Deleted {
+		m.ident.open(msg)
+	}
+}
+
+// keyOf 某人的身份公钥：在线列表里的优先，其次是 /key 查到的
+func (m model) keyOf(name string) string {
+	for _, u := range m.roster {
+		if u.Name == name && u.Key != "" {
+			return u.Key
+		}
+	}
+	return m.ident.peers[name]
+}
+
+// roomPeers 现在和自己在同一个房间、有公钥的人
+func (m model) roomPeers() map[string]string {
+	peers := map[string]string{}
+	for _, u := range m.roster {
+		if u.Name != m.self && u.Room == m.room && u.Status != utils.StatusOffline && u.Key != "" {
+			peers[u.Name] = u.Key
+		}
+	}
+	return peers
+}
+
+// senderKey 自己在当前房间的发送者密钥；改了名、房间里有人进出或者换了公钥，就换一把新的：
+// 走了的人解不开以后的消息，新来的人拿到的密钥也解不开以前的
+func (m *model) senderKey(peers map[string]string) (*senderKey, error) {
+	if sk := m.ident.mine[m.room]; sk != nil && sk.from == m.self && len(sk.sent) == len(peers) {
+		fresh := true
+		for name, pub := range sk.sent {
+			if peers[name] != pub {
+				fresh = false
+				break
+			}
+		}
+		if fresh {
+			return sk, nil
+		}
+	}
+	keyID, key, err := utils.NewSenderKey()
+	if err != nil {
+		return nil, err
+	}
+	sk := &senderKey{id: keyID, from: m.self, key: key, sent: map[string]string{}}
+	m.ident.mine[m.room] = sk
+	m.ident.keys[keyID] = roomKey{Room: m.room, From: m.self, Key: key, Added: time.Now()}
+	return sk, m.ident.save()
+}
+
+// sendSealed 加密发一条消息（edit 不空就是编辑那条）；还没拿到这把密钥的人先各发一份。
+// 回复谁、改哪条都签在里面，所以先在本地换成服务器最后存的那个 id
+func (m *model) sendSealed(parent, edit, text string) error {
+	if i, ok := m.byID[parent]; ok && m.entries[i].msg.Parent != "" { // 回复的回复挂到线程开头
+		parent = m.entries[i].msg.Parent
+	}
+	if edit == "last" {
+		if edit = m.lastOwn(); edit == "" {
+			return fmt.Errorf("no message of yours here to edit, use /edit <id>")
+		}
+	}
+	peers := m.roomPeers()
+	sk, err := m.senderKey(peers)
+	if err != nil {
+		return err
+	}
+	for name, pub := range peers {
+		if sk.sent[name] == pub {
+			continue
+		}
+		box, err := utils.SealFor(m.ident.priv, pub, sk.key, utils.SenderKeyAAD(m.room, m.self, name, sk.id))
+		if err != nil {
+			continue // 公钥不对的人收不到，他那边显示成锁
+		}
+		if err := utils.SecureWriteFrame(m.conn, m.aesKey, utils.SenderKeyFrame(utils.SenderKey{To: name, KeyID: sk.id, Box: box})); err != nil {
+			return err
+		}
+		sk.sent[name] = pub
+	}
+	cipher, err := utils.SealMessage(sk.key, text, utils.MessageAAD(m.room, m.self, sk.id))
+	if err != nil {
+		return err
+	}
+	seq := m.ident.nextSeq()
+	s := utils.Sealed{Parent: parent, Edit: edit, Mentions: utils.ParseMentions(text, m.rosterNames()), KeyID: sk.id, Cipher: cipher, Seq: seq,
+		Sig: utils.Sign(m.ident.priv, utils.MessageEnvelope(m.room, m.self, seq, parent, edit, sk.id, cipher))}
+	return utils.SecureWriteText(m.conn, m.aesKey, utils.SealedFrame(s))
+}
+
+// lastOwn 当前房间里自己最近一条没删的消息
+func (m model) lastOwn() string {
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if msg := m.entries[i].msg; msg != nil && msg.From == m.self && !msg.Deleted {
+			return msg.ID
+		}
+	}
+	return ""
+}
+
+func (m model) rosterNames() []string {
+	names := make([]string, 0, len(m.roster))
+	for _, u := range m.roster {
+		names = append(names, u.Name)
+	}
+	return names
+}
+
+// addSenderKey 收到别人的发送者密钥，存起来，之前解不开的消息再试一遍
+func (m *model) addSenderKey(sk utils.SenderKey) error {
+	pub := m.keyOf(sk.From)
+	if pub == "" {
+		return fmt.Errorf("got a message key from %s but don't know their public key", sk.From)
+	}
+	key, err := utils.OpenFrom(m.ident.priv, pub, sk.Box, utils.SenderKeyAAD(sk.Room, sk.From, sk.To, sk.KeyID))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("bad message key from %s", sk.From)
+	}
+	m.ident.keys[sk.KeyID] = roomKey{Room: sk.Room, From: sk.From, Key: key, Added: time.Now()}
+	changed := false
+	for i, e := range m.entries {
+		if e.msg != nil && e.msg.KeyID == sk.KeyID && e.msg.Text == "" && m.ident.open(e.msg) {
+			m.lines[i] = m.theme.render(e, m.self)
+			changed = true
+		}
+	}
+	if changed {
+		m.refresh()
+	}
+	return m.ident.save()
+}
+
+// sendDirect 加密的私信；不知道对方公钥先 /key 查，回来了再发
+func (m *model) sendDirect(to, text string) error {
+	pub := m.keyOf(to)
+	if pub == "" {
+		m.ident.queued[to] = append(m.ident.queued[to], text)
+		return utils.SecureWriteFrame(m.conn, m.aesKey, []byte("/key "+to))
+	}
+	cipher, err := utils.SealFor(m.ident.priv, pub, utils.PackText(text), utils.DirectAAD(m.self, to))
+	if err != nil {
+		return err
+	}
+	m.ident.peers[to] = pub // 回显的时候要用它解
+	seq := m.ident.nextSeq()
+	sig := utils.Sign(m.ident.priv, utils.DirectEnvelope(m.self, to, seq, cipher))
+	return utils.SecureWriteText(m.conn, m.aesKey, utils.DirectFrame(utils.Direct{To: to, Cipher: cipher, Seq: seq, Sig: sig}))
+}
+
+// keyInfo /key 的回复：把等着的私信发出去，对方没有公钥就不发；自己敲的 /key 直接显示
+func (m *model) keyInfo(k utils.KeyInfo) {
+	m.observeKey(k.Name, k.Key)
+	queued := m.ident.queued[k.Name]
+	delete(m.ident.queued, k.Name)
+	if len(queued) == 0 {
+		if k.Key == "" {
+			m.appendLine(fmt.Sprintf("[local] %s has no public key\n", k.Name))
+		} else {
+			m.appendLine(fmt.Sprintf("[local] %s's public key: %s (fingerprint %s)\n", k.Name, k.Key, utils.Fingerprint(k.Key)))
+		}
+		return
+	}
+	if k.Key == "" {
+		m.appendLine(fmt.Sprintf("[local] %s has no encryption key (not registered, or never used an encrypting client), %d message(s) not sent; /msg -plain %s <text> sends it unencrypted\n",
+			k.Name, len(queued), k.Name))
+		return
+	}
+	m.ident.peers[k.Name] = k.Key
+	for _, text := range queued {
+		if err := m.sendDirect(k.Name, text); err != nil {
+			m.appendLine(fmt.Sprintf("[send error] %v\n", err))
+		}
+	}
+}
+
+// openDirect 解开一条私信，格式和服务器转发的明文私信一样
+func (m model) openDirect(d utils.Direct) string {
+	label, peer := fmt.Sprintf("[DM] %s: ", d.From), d.Key
+	if d.From == m.self {
+		label, peer = fmt.Sprintf("[DM] -> %s: ", d.To), m.keyOf(d.To)
+	} else if peer == "" {
+		peer = m.keyOf(d.From)
+	}
+	box, err := utils.OpenFrom(m.ident.priv, peer, d.Cipher, utils.DirectAAD(d.From, d.To))
+	if err != nil {
+		return label + "[encrypted message, cannot decrypt it]\n"
+	}
+	text, err := utils.UnpackText(box)
+	if err != nil {
+		return label + "[encrypted message, cannot decrypt it]\n"
+	}
+	return label + text + m.directSig(d).note() + "\n"
+}
+
+// send 输入框里的一行：聊天、回复、编辑、私信在本地加密，其他命令原样发给服务器
+func (m *model) send(line string) error {
+	switch {
+	case !strings.HasPrefix(line, "/"):
+		return m.sendSealed("", "", line)
+	case strings.HasPrefix(line, "/reply "), strings.HasPrefix(line, "/edit "):
+		cmd, rest, _ := strings.Cut(line, " ")
+		id, text, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		if text = strings.TrimSpace(text); id == "" || text == "" {
+			break // 让服务器回用法
+		}
+		if cmd == "/reply" {
+			return m.sendSealed(id, "", text)
+		}
+		return m.sendSealed("", id, text)
+	case strings.HasPrefix(line, "/msg -plain "): // 明文私信，对方没有加密的客户端时用
+		return utils.SecureWriteText(m.conn, m.aesKey, []byte("/msg "+strings.TrimPrefix(line, "/msg -plain ")+"\n"))
+	case strings.HasPrefix(line, "/msg "):
+		to, text, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "/msg ")), " ")
+		if text = strings.TrimSpace(text); to == "" || text == "" {
+			break
+		}
+		return m.sendDirect(to, text)
+	}
+	return utils.SecureWriteFrame(m.conn, m.aesKey, []byte(line+"\n"))
+}
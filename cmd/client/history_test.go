@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestSaveHistoryIsPrivate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chatclient", "history")
+	os.MkdirAll(filepath.Dir(path), 0700)
+	os.WriteFile(path, []byte("old\n"), 0644) // 老版本留下的
+
+	var hist []string
+	for i := 0; i < 510; i++ {
+		hist = append(hist, fmt.Sprintf("line %d", i))
+	}
+	if err := saveHistory(path, hist); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("history file mode = %v, want 0600", info.Mode().Perm())
+	}
+	got := loadHistory(path)
+	if len(got) != 500 || got[0] != "line 10" || got[499] != "line 509" {
+		t.Errorf("kept %d lines, %q .. %q", len(got), got[0], got[len(got)-1])
+	}
+	if left, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".history.*")); len(left) != 0 {
+		t.Errorf("temp files left behind: %v", left)
+	}
+}
+
+func TestMigrateHistory(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	old := filepath.Join(os.TempDir(), "chatclient.history")
+	os.WriteFile(old, []byte("/files\n/login bob hunter2\nhello\n"), 0644)
+
+	path := filepath.Join(t.TempDir(), "history")
+	migrateHistory(path)
+	if got := loadHistory(path); !reflect.DeepEqual(got, []string{"/files", "hello"}) {
+		t.Errorf("migrated %q", got)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("the shared history file was not removed")
+	}
+}
+
+func TestHasPassword(t *testing.T) {
+	secret := []string{"/login bob hunter2", "/register hunter2", "/room password s3cret", "/admin 0123abcd", "/join ops s3cret"}
+	for _, line := range secret {
+		if !hasPassword(line) {
+			t.Errorf("%q would be saved in the history", line)
+		}
+	}
+	for _, line := range []string{"/join ops", "/files", "hello /admin", "/adminhelp", "/rooms"} {
+		if hasPassword(line) {
+			t.Errorf("%q kept out of the history", line)
+		}
+	}
+}
+
+// keys.json 原来是 0644 的，存一次就收紧
+func TestSaveKeyTightensMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	t.Setenv("CHAT_KEYS_FILE", path)
+	os.WriteFile(path, []byte("{}"), 0644)
+	if err := saveKey("h:1", "k"); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("keys.json mode = %v, want 0600", info.Mode().Perm())
+	}
+	if keys, err := loadSavedKeys(); err != nil || keys["h:1"].Key != "k" {
+		t.Errorf("saved keys = %v, %v", keys, err)
+	}
+}
+
+func TestIdentityFileIsPrivate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.json")
+	id, err := loadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(path, 0644) // 老版本留下的
+	reloaded, err := loadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.publicKey() != id.publicKey() {
+		t.Error("identity changed on reload")
+	}
+	if info, _ := os.Stat(path); runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("identity mode after load = %v, want 0600", info.Mode().Perm())
+	}
+
+	os.Chmod(path, 0644)
+	if err := reloaded.save(); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("identity mode after save = %v, want 0600", info.Mode().Perm())
+	}
+	if left, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".*.tmp")); len(left) != 0 {
+		t.Errorf("temp files left behind: %v", left)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// ---- key 从哪来：写在命令行上会留在 shell 历史和 ps 里，按下面的顺序找：
+//   命令行第三个参数（老写法，要加 -insecure-key-arg 才认，还会警告）
+//   -key-file <文件> 或者环境变量 CHAT_KEY_FILE，比如服务器写出来的 server.key
+//   -key-stdin：从标准输入读一行，比如 pass show chat | ./client -key-stdin host port
+//   环境变量 CHAT_KEY
+//   以前 -remember 存下的，每个服务器一条，存在 keys.json（0600）
+//   都没有就在终端里问，输入不回显
+// key 和口令都一样对待，ParseKey 认不出来的就当口令 ----
+
+// keySource 找到的 key（或口令），和它是从哪来的
+type keySource struct {
+	key   string
+	from  string // 连不上的时候提示用
+	stdin bool   // 从标准输入读的，TUI 得另外打开终端读键盘
+	saved bool   // keys.json 里存的
+}
+
+// savedKey keys.json 里的一条
+type savedKey struct {
+	Key   string    `json:"key"`
+	Saved time.Time `json:"saved"`
+}
+
+func keysPath() string {
+	if p := os.Getenv("CHAT_KEYS_FILE"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "chatclient", "keys.json")
+}
+
+// findKey server 是 "host:port"，arg 是命令行上的 key（可能为空）
+func findKey(server, arg, file string, fromStdin bool) (keySource, error) {
+	if arg != "" {
+		fmt.Fprintln(os.Stderr, "warning: a key on the command line ends up in shell history and ps; use -key-file, -key-stdin, CHAT_KEY or the prompt instead")
+		return keySource{key: arg, from: "the command line"}, nil
+	}
+	if file == "" {
+		file = os.Getenv("CHAT_KEY_FILE")
+	}
+	if file != "" {
+		key, err := readKeyFile(file)
+		return keySource{key: key, from: file}, err
+	}
+	if fromStdin {
+		key, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return keySource{}, err
+		}
+		if key = strings.TrimSpace(key); key == "" {
+			return keySource{}, errors.New("no key on stdin")
+		}
+		return keySource{key: key, from: "stdin", stdin: true}, nil
+	}
+	if key := os.Getenv("CHAT_KEY"); key != "" {
+		return keySource{key: key, from: "CHAT_KEY"}, nil
+	}
+	keys, err := loadSavedKeys()
+	if err != nil {
+		return keySource{}, err
+	}
+	if k, ok := keys[server]; ok {
+		return keySource{key: k.Key, from: "the key saved in " + keysPath(), saved: true}, nil
+	}
+	return promptKey(server)
+}
+
+// readKeyFile 只取第一行；别人也能读的话提醒一下，和 ssh 私钥一个道理
+func readKeyFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		fmt.Fprintf(os.Stderr, "warning: %s is readable by other users (chmod 600 %s)\n", path, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key, _, _ := strings.Cut(string(data), "\n")
+	if key = strings.TrimSpace(key); key == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return key, nil
+}
+
+// promptKey 在终端里问，不回显
+func promptKey(server string) (keySource, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return keySource{}, errors.New("no key given: use -key-file, -key-stdin or CHAT_KEY, or run in a terminal to be asked")
+	}
+	fmt.Fprintf(os.Stderr, "key or passphrase for %s: ", server)
+	b, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return keySource{}, err
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return keySource{}, errors.New("no key entered")
+	}
+	return keySource{key: key, from: "the prompt"}, nil
+}
+
+func loadSavedKeys() (map[string]savedKey, error) {
+	keys := map[string]savedKey{}
+	data, err := os.ReadFile(keysPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", keysPath(), err)
+	}
+	return keys, nil
+}
+
+// saveKey -remember：连上以后把 key 存下来，key 为空表示删掉（-forget）
+func saveKey(server, key string) error {
+	keys, err := loadSavedKeys()
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		delete(keys, server)
+	} else {
+		keys[server] = savedKey{Key: key, Saved: time.Now()}
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := keysPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writePrivateFile(path, data)
+}
+
+// writePrivateFile 只有自己能读的文件（历史、key、身份）：先写到同目录的临时文件（CreateTemp 就是 0600），
+// 再改名盖过去。直接 WriteFile 的话，原来的文件要是 0644 就还是 0644，写到一半崩了文件也只剩半截
+func writePrivateFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // 改名成功后这里删不到东西
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
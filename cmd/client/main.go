@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
@@ -11,15 +13,19 @@ import (
 
 	"goLearning/pkg/utils"
 
+	"github.com/charmbracelet/bubbles/progress"
 	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
 	"github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
 )
 
 // ---- async msgs ----
 type netMsg struct{ text string }
 type netErr struct{ err error }
 type localMsg struct{ text string }
+type chatMsg struct{ msg utils.Message }
+type msgEventMsg struct{ ev utils.MessageEvent }
 
 type model struct {
 	vp    viewport.Model
@@ -27,48 +33,107 @@ type model struct {
 
 	conn   net.Conn
 	aesKey []byte
+	ident  *identity // 端到端加密的身份密钥和收到的发送者密钥
 
-	lines []string
+	entries []entry        // 消息原文
+	lines   []string       // 渲染好的，和 entries 一一对应
+	byID    map[string]int // 聊天消息 id -> entries 下标，编辑/删除时原地更新
+
+	thread     string // 打开的线程（父消息 id），空串是主面板
+	threadFrom int    // 打开线程时 entries 的长度，之后的系统消息在线程视图里也显示
+	theme      theme
 
 	incoming chan tea.Msg
+	acks     *ackBox // 服务器对上传文件头的回复：FILE_OK / FILE_REJECT
+
+	transfers   []*transfer // 正在进行的上传/下载
+	bar         progress.Model
+	lastArchive string // 最近下载的 tar 包，/extract 默认解它
+
+	roster    []utils.Member // 在线用户，侧边栏显示
+	self      string         // 服务器分配/改过的自己的名字
+	room      string         // 现在在哪个房间
+	showUsers bool           // Ctrl+O 切换侧边栏
+
+	typing     map[string]time.Time // 正在输入的人 -> 到什么时候算停了
+	lastTyping time.Time            // 上次告诉服务器自己在输入
+
+	catalog []string    // 服务器上的文件名，补全 /download 用
+	comp    *completion // 正在进行的 Tab 补全，按别的键就清掉
+
+	width  int
+	height int
 
 	history   []string
 	histIndex int
 	histPath  string
 
+	unread int // 没看到的 @ 提醒，按键或者终端窗口重新获得焦点就清零
+
+	cursors  map[string]string // 房间里每个人读到哪条，显示 seen by
+	divider  string            // "新消息"分隔线画在这条之后，连上/改名时定下来，自己发了消息就去掉
+	lastRead string            // 上次告诉服务器的已读位置
+	focused  bool              // 终端窗口有没有焦点，没焦点时收到的不算看过
+
+	marked  string      // /goto 跳到的那条，前面画个箭头
+	offsets map[int]int // refresh 时记下每条在 viewport 里从第几行开始
+
+	startup []string // 连上以后自动发的命令（配置里的 /setName、/join）
+
 	quitting bool
 }
 
-func newModel(conn net.Conn, aesKey []byte, w, h int, histPath string) model {
+func newModel(conn net.Conn, aesKey []byte, ident *identity, w, h int, histPath string) model {
 	ti := textinput.New()                                   //输入框（textinput）
 	ti.Placeholder = "Type a message… (/help for commands)" //提示字符
 	ti.Focus()
 	ti.CharLimit = 0 //不限制长度
 	ti.Width = bigger(10, w-2)
 
-	vph := h - 3 //viewport高度-3，分别是输入框、空行（UI 间隔）、提示信息
-	if vph < 1 { //至少要有 1 行能显示消息
-		vph = 1
-	}
-	vp := viewport.New(w, vph) //消息滚动区（viewport）
-	vp.SetContent("")          //初始化内容为空,后面每次收到消息都会 SetContent(...)
+	vp := viewport.New(w, 1) //消息滚动区（viewport），高度在 layout 里算
+	vp.SetContent("")        //初始化内容为空,后面每次收到消息都会 SetContent(...)
 
 	hist := loadHistory(histPath)
 
 	m := model{
-		vp:       vp,
-		input:    ti,
-		conn:     conn,
-		aesKey:   aesKey,
-		lines:    make([]string, 0, 512),
-		incoming: make(chan tea.Msg, 256), //Bubble Tea 通过 listen(incoming) 把它转成 Msg,这就是“异步消息不污染输入框”的关键通道
-		history:  hist,
-		histPath: histPath,
+		vp:        vp,
+		input:     ti,
+		conn:      conn,
+		aesKey:    aesKey,
+		ident:     ident,
+		lines:     make([]string, 0, 512),
+		theme:     loadTheme(""),
+		byID:      map[string]int{},
+		typing:    map[string]time.Time{},
+		cursors:   map[string]string{},
+		focused:   true,                    // 不支持焦点事件的终端就当一直有焦点
+		incoming:  make(chan tea.Msg, 256), //Bubble Tea 通过 listen(incoming) 把它转成 Msg,这就是“异步消息不污染输入框”的关键通道
+		acks:      &ackBox{},
+		bar:       newProgressBar(w),
+		showUsers: true,
+		width:     w,
+		height:    h,
+		history:   hist,
+		histPath:  histPath,
+		room:      utils.DefaultRoom,
 	}
 	m.histIndex = len(m.history)
+	m.layout()
 	return m
 }
 
+// layout 按窗口大小和传输面板的行数重新分配 viewport 高度
+func (m *model) layout() {
+	vph := m.height - 3 - len(m.transfers) //viewport高度-3，分别是输入框、空行（UI 间隔）、提示信息，再减去传输面板
+	if vph < 1 {                           //至少要有 1 行能显示消息
+		vph = 1
+	}
+	m.vp.Width = m.width - m.sidebarWidth() //右边留给用户列表
+	m.vp.Height = vph
+	m.input.Width = bigger(10, m.width-2)
+	m.bar.Width = progressWidth(m.width)
+}
+
 // 把一个 Go 的 channel，包装成 Bubble Tea 能调度的 tea.Cmd
 func listen(ch <-chan tea.Msg) tea.Cmd {
 	return func() tea.Msg {
@@ -83,23 +148,171 @@ func listen(ch <-chan tea.Msg) tea.Cmd {
 func (m model) Init() tea.Cmd {
 	// 网络读循环：收到的内容通过 m.incoming 发给 UI
 	go func() {
+		// 正在进行的下载只在这个 goroutine 里访问
+		downloads := map[string]*download{}
+		report := map[string]func(int64){}
+		defer func() {
+			for _, d := range downloads {
+				d.abort()
+			}
+		}()
+
+		// 先要一份服务器文件目录，Tab 补全文件名用；之后文件有增删服务器会主动推
+		_ = utils.SecureWriteFrame(m.conn, m.aesKey, []byte("/files"))
+		// 公钥发给服务器，它放进在线列表告诉大家
+		_ = utils.SecureWriteFrame(m.conn, m.aesKey, utils.KeyFrame(m.ident.publicKey()))
+		for _, line := range m.startup {
+			_ = utils.SecureWriteFrame(m.conn, m.aesKey, []byte(line+"\n"))
+		}
+
 		for {
 			byteString, err := utils.SecureReadFrame(m.conn, m.aesKey)
 			if err != nil {
 				m.incoming <- netErr{err: err}
-				close(m.incoming)
 				return
 			}
+
+			// 文件数据帧：按 id 写到对应的下载里
+			if id, chunk, ok := utils.ParseDataFrame(byteString); ok {
+				d := downloads[id]
+				if d == nil {
+					continue // 已经取消/出错的下载，剩下的帧丢掉
+				}
+				done, err := d.write(chunk)
+				if err != nil {
+					delete(downloads, id)
+					d.abort()
+					_ = utils.SecureWriteFrame(m.conn, m.aesKey, []byte("FILE_CANCEL|"+id))
+					m.incoming <- transferDoneMsg{id: id, text: fmt.Sprintf("[download error] %s: %v\n", d.name, err)}
+					continue
+				}
+				report[id](d.got)
+				if done {
+					delete(downloads, id)
+					delete(report, id)
+					m.incoming <- finishDownload(d)
+				}
+				continue
+			}
 			message := string(byteString)
 
-			// 服务器发来文件：FILE|name|size
+			// 上传文件头的回复和最后的确认，交给正在等待的上传
+			if rest, ok := strings.CutPrefix(message, "FILE_OK|"); ok {
+				m.acks.deliver(rest, message)
+				continue
+			}
+			if rest, ok := strings.CutPrefix(message, "FILE_DONE|"); ok {
+				m.acks.deliver(rest, message)
+				continue
+			}
+			if rest, ok := strings.CutPrefix(message, "FILE_REJECT|"); ok {
+				id, _, _ := strings.Cut(rest, "|")
+				m.acks.deliver(id, message)
+				continue
+			}
+
+			// 大小未知的下载发完了
+			if id, ok := strings.CutPrefix(message, "FILE_END|"); ok {
+				if d := downloads[id]; d != nil {
+					delete(downloads, id)
+					delete(report, id)
+					m.incoming <- finishDownload(d)
+				}
+				continue
+			}
+
+			// 对方取消了传输：FILE_CANCEL|id[|reason]
+			if rest, ok := strings.CutPrefix(message, "FILE_CANCEL|"); ok {
+				id, reason, _ := strings.Cut(rest, "|")
+				if d := downloads[id]; d != nil {
+					delete(downloads, id)
+					delete(report, id)
+					d.abort()
+					m.incoming <- transferDoneMsg{id: id, text: fmt.Sprintf("[download cancelled] %s\n", d.name)}
+				} else {
+					// 上传被服务器取消：先让 UI 显示原因，再叫醒可能在等 FILE_DONE 的上传
+					m.incoming <- transferCancelMsg{id: id, reason: reason}
+					m.acks.deliver(id, message)
+				}
+				continue
+			}
+
+			// 服务器发来文件：FILE|name|size|id
 			if strings.HasPrefix(message, "FILE|") {
-				m.incoming <- localMsg{text: "[local] downloading file…\n"}
-				if err := ReceiveFile(message, m.conn, m.aesKey); err != nil {
+				d, err := ReceiveFile(message, downloadDir())
+				if err != nil {
+					if parts := strings.Split(message, "|"); len(parts) == 4 {
+						_ = utils.SecureWriteFrame(m.conn, m.aesKey, []byte("FILE_CANCEL|"+parts[3]))
+					}
 					m.incoming <- localMsg{text: fmt.Sprintf("[download error] %v\n", err)}
-				} else {
-					m.incoming <- localMsg{text: "[download success]\n"}
+					continue
+				}
+				if d.size == 0 { // 空文件没有数据帧
+					m.incoming <- finishDownload(d)
+					continue
 				}
+				downloads[d.id] = d
+				report[d.id] = progressReporter(m.incoming, d.id)
+				m.incoming <- transferStartMsg{id: d.id, name: d.name, size: d.size}
+				continue
+			}
+
+			if room, ok := utils.ParseRoom(message); ok {
+				m.incoming <- roomMsg{room: room}
+				continue
+			}
+			if msgs, ok := utils.ParseHistory(message); ok {
+				m.incoming <- historyMsg{msgs: msgs}
+				continue
+			}
+			if msg, ok := utils.ParseMessage(message); ok {
+				m.incoming <- chatMsg{msg: msg}
+				continue
+			}
+			if ev, ok := utils.ParseMessageEvent(message); ok {
+				m.incoming <- msgEventMsg{ev: ev}
+				continue
+			}
+			if names, ok := utils.ParseCatalog(message); ok {
+				m.incoming <- catalogMsg{names: names}
+				continue
+			}
+
+			// 在线用户列表
+			if r, ok := utils.ParseRoster(message); ok {
+				m.incoming <- rosterMsg{roster: r}
+				continue
+			}
+			if ev, ok := utils.ParsePresence(message); ok {
+				m.incoming <- presenceMsg{ev: ev}
+				continue
+			}
+			if s, ok := utils.ParseReadState(message); ok {
+				m.incoming <- readStateMsg{state: s}
+				continue
+			}
+			if c, ok := utils.ParseReadCursor(message); ok {
+				m.incoming <- readCursorMsg{cursor: c}
+				continue
+			}
+			if sk, ok := utils.ParseSenderKey(message); ok {
+				m.incoming <- senderKeyMsg{sk: sk}
+				continue
+			}
+			if d, ok := utils.ParseDirect(message); ok {
+				m.incoming <- directMsg{d: d}
+				continue
+			}
+			if k, ok := utils.ParseKeyInfo(message); ok {
+				m.incoming <- keyInfoMsg{info: k}
+				continue
+			}
+			if r, ok := utils.ParseSearch(message); ok {
+				m.incoming <- searchMsg{result: r}
+				continue
+			}
+			if name, ok := utils.ParseTyping(message); ok {
+				m.incoming <- typingMsg{name: name}
 				continue
 			}
 
@@ -110,12 +323,43 @@ func (m model) Init() tea.Cmd {
 	return listen(m.incoming)
 }
 
+func finishDownload(d *download) transferDoneMsg {
+	path, err := d.finish()
+	if err != nil {
+		return transferDoneMsg{id: d.id, text: fmt.Sprintf("[download error] %s: %v\n", d.name, err)}
+	}
+	if isArchive(path) {
+		return transferDoneMsg{id: d.id, archive: path,
+			text: fmt.Sprintf("[download success] saved to %s\n[local] this is an archive, /extract to unpack it\n", path)}
+	}
+	return transferDoneMsg{id: d.id, text: fmt.Sprintf("[download success] saved to %s\n", path)}
+}
+
+// appendLine 加一条客户端自己的消息
 func (m *model) appendLine(s string) {
-	m.lines = append(m.lines, s)
-	m.vp.SetContent(strings.Join(m.lines, ""))
+	m.appendEntry(entry{at: time.Now(), text: s, local: true})
+}
+
+// appendNet 加一条服务器发来的消息
+func (m *model) appendNet(s string) {
+	m.appendEntry(entry{at: time.Now(), text: s})
+}
+
+func (m *model) appendEntry(e entry) {
+	m.entries = append(m.entries, e)
+	m.lines = append(m.lines, m.theme.render(e, m.self))
+	m.refresh()
 	m.vp.GotoBottom()
 }
 
+// rerender 换了主题或者自己改了名，全部重新渲染
+func (m *model) rerender() {
+	for i, e := range m.entries {
+		m.lines[i] = m.theme.render(e, m.self)
+	}
+	m.refresh()
+}
+
 func (m model) saveAndQuit() (tea.Model, tea.Cmd) {
 	_ = saveHistory(m.histPath, m.history)
 	_ = m.conn.Close()
@@ -125,43 +369,226 @@ func (m model) saveAndQuit() (tea.Model, tea.Cmd) {
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
-	case tea.WindowSizeMsg:
-		m.vp.Width = msg.Width
-		m.input.Width = bigger(10, msg.Width-2)
-		vph := msg.Height - 3
-		if vph < 1 {
-			vph = 1
+	case chatMsg:
+		delete(m.typing, msg.msg.From) // 发出来了就不是在输入了
+		m.decrypt(&msg.msg)
+		// 自己说话了，前面的肯定看过了；正看着而且之前没有新消息的，这条也不用分隔线
+		if msg.msg.From == m.self || (m.focused && m.vp.AtBottom() && !m.anyNew()) {
+			m.divider = "" // 下面 addChat 会重新拼
+		}
+		mentioned := m.addChat(msg.msg)
+		m.markRead()
+		if mentioned {
+			m.unread++
+			return m, tea.Batch(listen(m.incoming), notifyCmd(msg.msg))
 		}
-		m.vp.Height = vph
-		m.vp.SetContent(strings.Join(m.lines, ""))
+		return m, listen(m.incoming)
+
+	case msgEventMsg:
+		if i, ok := m.byID[msg.ev.ID]; ok {
+			m.entries[i].msg.Apply(msg.ev)
+			m.decrypt(m.entries[i].msg)
+			m.entries[i].sig = m.checkSig(*m.entries[i].msg)
+			m.lines[i] = m.theme.render(m.entries[i], m.self)
+			m.refresh()
+		}
+		return m, listen(m.incoming)
+
+	case historyMsg:
+		// 聊天记录只显示，不算未读也不提醒
+		for _, hm := range msg.msgs {
+			m.decrypt(&hm)
+			m.addChat(hm)
+		}
+		m.markRead()
+		return m, listen(m.incoming)
+
+	case readStateMsg:
+		// 连上或者改名以后：分隔线画在自己读到的位置后面，已读位置重新报一次
+		m.cursors = msg.state.Cursors
+		m.divider, m.lastRead = m.cursors[m.self], ""
+		m.refresh()
+		m.markRead()
+		return m, listen(m.incoming)
+
+	case roomMsg:
+		m.enterRoom(msg.room)
+		return m, listen(m.incoming)
+
+	case searchMsg:
+		for i := range msg.result.Results {
+			m.decrypt(&msg.result.Results[i])
+		}
+		m.appendLine(renderSearch(msg.result))
+		return m, listen(m.incoming)
+
+	case readCursorMsg:
+		if msg.cursor.ID == "" {
+			delete(m.cursors, msg.cursor.User)
+		} else {
+			m.cursors[msg.cursor.User] = msg.cursor.ID
+		}
+		m.refresh()
+		return m, listen(m.incoming)
+
+	case tea.FocusMsg:
+		m.unread = 0
+		m.focused = true
+		m.markRead()
+		return m, nil
+
+	case tea.BlurMsg:
+		m.focused = false
+		if !m.anyNew() { // 切走以后来的消息前面画分隔线
+			m.divider = m.lastRead
+		}
+		return m, nil
+
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.layout()
+		m.refresh()
 		m.vp.GotoBottom()
+		m.markRead()
 		return m, nil
 
+	case senderKeyMsg:
+		if err := m.addSenderKey(msg.sk); err != nil {
+			m.appendLine(fmt.Sprintf("[e2e] %v\n", err))
+		}
+		return m, listen(m.incoming)
+
+	case directMsg:
+		m.observeKey(msg.d.From, msg.d.Key)
+		m.appendEntry(entry{at: msg.d.Time, text: m.openDirect(msg.d)})
+		return m, listen(m.incoming)
+
+	case keyInfoMsg:
+		m.keyInfo(msg.info)
+		return m, listen(m.incoming)
+
 	case netMsg:
-		m.appendLine(msg.text)
+		m.appendNet(msg.text)
 		return m, listen(m.incoming)
 
 	case localMsg:
 		m.appendLine(msg.text)
 		return m, listen(m.incoming)
 
+	case rosterMsg:
+		m.roster, m.self = msg.roster.Users, msg.roster.Self
+		m.rerender()
+		m.observeRoster(m.roster)
+		return m, listen(m.incoming)
+
+	case presenceMsg:
+		self := m.self
+		m.applyPresence(msg.ev)
+		if m.self != self {
+			m.rerender()
+		}
+		m.observeKey(msg.ev.Name, msg.ev.Key)
+		return m, listen(m.incoming)
+
+	case typingMsg:
+		return m, tea.Batch(listen(m.incoming), m.noteTyping(msg.name))
+
+	case typingExpireMsg:
+		m.expireTyping()
+		return m, nil
+
+	case catalogMsg:
+		m.catalog = msg.names
+		return m, listen(m.incoming)
+
+	case transferStartMsg:
+		m.transfers = append(m.transfers, &transfer{id: msg.id, name: msg.name, size: msg.size, start: time.Now()})
+		m.layout()
+		return m, listen(m.incoming)
+
+	case transferSizeMsg:
+		if t := m.findTransfer(msg.id); t != nil {
+			t.size, t.start = msg.size, time.Now()
+		}
+		return m, listen(m.incoming)
+
+	case transferProgressMsg:
+		if t := m.findTransfer(msg.id); t != nil {
+			t.done = msg.done
+		}
+		return m, listen(m.incoming)
+
+	case transferDoneMsg:
+		if msg.archive != "" {
+			m.lastArchive = msg.archive
+		}
+		m.removeTransfer(msg.id)
+		m.layout()
+		m.appendLine(msg.text)
+		return m, listen(m.incoming)
+
+	case transferCancelMsg:
+		// 服务器那边出错取消了上传，让上传 goroutine 停下，它会自己报 transferDoneMsg
+		if t := m.findTransfer(msg.id); t != nil && t.upload {
+			t.cancelUpload()
+			if msg.reason != "" {
+				m.appendLine(fmt.Sprintf("[upload error] %s: %s\n", t.name, msg.reason))
+			}
+		}
+		return m, listen(m.incoming)
+
 	case netErr:
 		m.appendLine(fmt.Sprintf("\n[net error] %v\n", msg.err))
 		return m, tea.Quit
 
 	case tea.KeyMsg:
+		m.unread = 0 // 在打字就当看到了
+		if k := msg.String(); k != "tab" && k != "shift+tab" {
+			m.comp = nil // 按了别的键，补全重新开始
+		}
 		switch msg.String() {
+		case "tab":
+			m.complete(1)
+			return m, nil
+
+		case "shift+tab":
+			m.complete(-1)
+			return m, nil
+
 		case "ctrl+c":
 			return m.saveAndQuit()
 
+		case "ctrl+o":
+			m.showUsers = !m.showUsers
+			m.layout()
+			m.refresh()
+			return m, nil
+
+		case "ctrl+t":
+			// 打开最近有回复的线程，已经在线程里就关掉
+			if m.thread != "" {
+				m.closeThread()
+			} else if id := m.latestThread(); id != "" {
+				_ = m.openThread(id)
+			} else {
+				m.appendLine("[local] no threads yet, use /reply <id> <text> or /thread <id>\n")
+			}
+			return m, nil
+
+		case "esc":
+			if m.thread != "" {
+				m.closeThread()
+				return m, nil
+			}
+
 		case "enter":
 			line := strings.TrimSpace(m.input.Value())
 			if line == "" {
 				return m, nil
 			}
 
-			// history（避免连续重复）
-			if len(m.history) == 0 || m.history[len(m.history)-1] != line {
+			// history（避免连续重复）；带密码的命令不记，历史是明文存在磁盘上的
+			if !hasPassword(line) && (len(m.history) == 0 || m.history[len(m.history)-1] != line) {
 				m.history = append(m.history, line)
 			}
 			m.histIndex = len(m.history)
@@ -173,17 +600,139 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.input.SetValue("")
 				return m, nil
 
+			case line == "/thread" || strings.HasPrefix(line, "/thread "):
+				id := strings.TrimSpace(strings.TrimPrefix(line, "/thread"))
+				m.input.SetValue("")
+				if id == "" {
+					id = m.latestThread()
+				}
+				if id == "" {
+					m.appendLine("[local] usage: /thread <id>\n")
+				} else if err := m.openThread(id); err != nil {
+					m.appendLine(fmt.Sprintf("[local] %v\n", err))
+				}
+				return m, nil
+
+			case line == "/goto" || strings.HasPrefix(line, "/goto "):
+				id := strings.TrimSpace(strings.TrimPrefix(line, "/goto"))
+				m.input.SetValue("")
+				if id == "" {
+					m.appendLine("[local] usage: /goto <id>\n")
+				} else if err := m.jumpTo(id); err != nil {
+					m.appendLine(fmt.Sprintf("[local] %v\n", err))
+				}
+				return m, nil
+
+			case line == "/theme" || strings.HasPrefix(line, "/theme "):
+				name := strings.TrimSpace(strings.TrimPrefix(line, "/theme"))
+				m.input.SetValue("")
+				if name == "" {
+					m.appendLine(fmt.Sprintf("[local] theme: %s (available: %s; config: %s)\n",
+						m.theme.Name, strings.Join(themeNames(), ", "), themePath()))
+					return m, nil
+				}
+				if _, ok := themes[name]; !ok {
+					m.appendLine(fmt.Sprintf("[local] no such theme: %q (available: %s)\n", name, strings.Join(themeNames(), ", ")))
+					return m, nil
+				}
+				m.theme = loadTheme(name)
+				m.rerender()
+				if err := saveThemeName(name); err != nil {
+					m.appendLine(fmt.Sprintf("[local] theme not saved: %v\n", err))
+				}
+				return m, nil
+
+			case line == "/fingerprint" || strings.HasPrefix(line, "/fingerprint "):
+				m.input.SetValue("")
+				m.appendLine(m.fingerprint(strings.TrimSpace(strings.TrimPrefix(line, "/fingerprint"))))
+				return m, nil
+
+			case line == "/verify" || strings.HasPrefix(line, "/verify "):
+				name := strings.TrimSpace(strings.TrimPrefix(line, "/verify"))
+				m.input.SetValue("")
+				if name == "" {
+					m.appendLine("[local] usage: /verify <user>\n")
+				} else if err := m.verify(name); err != nil {
+					m.appendLine(fmt.Sprintf("[local] %v\n", err))
+				}
+				return m, nil
+
 			case strings.HasPrefix(line, "/upload "):
 				arg := strings.TrimSpace(strings.TrimPrefix(line, "/upload "))
+				m.input.SetValue("")
+				gz := false
+				if rest, ok := strings.CutPrefix(arg, "-z "); ok {
+					gz, arg = true, strings.TrimSpace(rest)
+				}
 				if arg == "" {
-					m.appendLine("[local] usage: /upload <filepath>\n")
-					m.input.SetValue("")
+					m.appendLine("[local] usage: /upload [-z] <path> [path...]\n")
+					return m, nil
+				}
+
+				// 整个参数是一个存在的路径就当一个（路径里可能有空格），否则按空格拆成多个
+				paths := []string{arg}
+				if _, err := os.Stat(arg); err != nil {
+					paths = strings.Fields(arg)
+				}
+				id, _ := utils.RandomString(6)
+				t := &transfer{id: id, upload: true, start: time.Now(), cancel: make(chan struct{})}
+
+				// 上传放到异步 cmd，避免 UI 卡死；进度显示在传输面板里
+				var cmd tea.Cmd
+				if info, err := os.Stat(paths[0]); err == nil && len(paths) == 1 && !info.IsDir() {
+					t.name, t.size = filepath.Base(arg), info.Size()
+					cmd = m.uploadCmd(t, func(progress func(int64)) error {
+						return fileUpload(arg, id, m.conn, m.aesKey, m.acks, t.cancel, progress)
+					})
+				} else {
+					// 目录或多个文件：边打 tar 包边传
+					for i := range paths {
+						if abs, err := filepath.Abs(paths[i]); err == nil {
+							paths[i] = abs
+						}
+					}
+					// 大目录走一遍要一会儿，放到 cmd 里算，算完用 transferSizeMsg 报上来，之前面板上显示大小未知
+					t.name, t.size = archiveName(paths, id, gz), -1
+					cmd = m.uploadCmd(t, func(progress func(int64)) error {
+						size, err := contentSize(paths)
+						if err != nil {
+							return err
+						}
+						m.incoming <- transferSizeMsg{id: id, size: size}
+						return archiveUpload(paths, t.name, id, gz, m.conn, m.aesKey, m.acks, t.cancel, progress)
+					})
+				}
+				m.transfers = append(m.transfers, t)
+				m.layout()
+				return m, cmd
+
+			case strings.HasPrefix(line, "/extract"):
+				path := strings.TrimSpace(strings.TrimPrefix(line, "/extract"))
+				m.input.SetValue("")
+				if path == "" {
+					path = m.lastArchive
+				}
+				if path == "" {
+					m.appendLine("[local] usage: /extract <archive>\n")
 					return m, nil
 				}
-				// 不做进度条，只提示开始/结果；上传放到异步 cmd，避免 UI 卡死
-				m.appendLine(fmt.Sprintf("[local] uploading %s …\n", arg))
+				return m, extractCmd(path)
+
+			case strings.HasPrefix(line, "/cancel"):
+				id := strings.TrimSpace(strings.TrimPrefix(line, "/cancel"))
 				m.input.SetValue("")
-				return m, uploadCmd(m.conn, m.aesKey, arg)
+				t := m.findTransfer(id)
+				if t == nil {
+					m.appendLine(fmt.Sprintf("[local] no such transfer: %q\n", id))
+					return m, nil
+				}
+				if t.upload {
+					t.cancelUpload()
+				} else if err := utils.SecureWriteFrame(m.conn, m.aesKey, []byte("FILE_CANCEL|"+id)); err != nil {
+					// 下载：让服务器停下，它回 FILE_CANCEL 后读循环删掉半截文件
+					m.appendLine(fmt.Sprintf("[send error] %v\n", err))
+				}
+				return m, nil
 
 			case line == "/exit":
 				// 仍然通知服务器
@@ -191,11 +740,18 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m.saveAndQuit()
 			}
 
-			// 聊天内容原样发给服务器
-			if err := utils.SecureWriteFrame(m.conn, m.aesKey, []byte(line+"\n")); err != nil {
+			// 线程视图里打字就是回复这个线程
+			if m.thread != "" && !strings.HasPrefix(line, "/") {
+				line = fmt.Sprintf("/reply %s %s", m.thread, line)
+			}
+
+			// 聊天内容加密了再发，命令原样发给服务器
+			if err := m.send(line); err != nil {
 				m.appendLine(fmt.Sprintf("[send error] %v\n", err))
 			}
 			m.input.SetValue("")
+			m.lastTyping = time.Time{} // 下一条一开始打字就能发
+			m.marked = ""              // 接着聊了，/goto 的箭头不要了
 			return m, nil
 
 		case "up":
@@ -217,6 +773,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "down":
 			if strings.TrimSpace(m.input.Value()) == "" {
 				m.vp.LineDown(1)
+				m.markRead() // 滚到底就算看完了
 				return m, nil
 			}
 			if len(m.history) == 0 {
@@ -237,6 +794,9 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	// 默认：交给 input 处理输入
 	var cmd tea.Cmd
 	m.input, cmd = m.input.Update(msg)
+	if _, ok := msg.(tea.KeyMsg); ok { // 光标闪烁之类的不算在输入
+		m.sendTyping()
+	}
 	return m, cmd
 }
 
@@ -244,32 +804,115 @@ func (m model) View() string {
 	if m.quitting {
 		return "Bye!\n"
 	}
-	help := "Enter: 发送消息 • ↑↓: 滚动消息面板 • (typing + ↑↓): 历史记录 • Ctrl+C: 断开链接"
-	return fmt.Sprintf("%s\n\n> %s\n%s\n", m.vp.View(), m.input.View(), help)
+	help := "Enter: 发送消息 • ↑↓: 滚动消息面板 • (typing + ↑↓): 历史记录 • Ctrl+O: 用户列表 • Ctrl+C: 断开链接"
+	if t := m.typingLine(); t != "" {
+		help = fg(m.theme.System).Italic(true).Render(t)
+	}
+	if m.unread > 0 {
+		help = mentionBadge.Render(fmt.Sprintf(" @%d ", m.unread)) + " " + help
+	}
+	if changed := m.changedKeys(); len(changed) > 0 { // 公钥变了的警告比什么都重要，一直挂着直到 /verify
+		help = warnStyle.Render(fmt.Sprintf(" ⚠ key changed: %s ", strings.Join(changed, ", "))) +
+			fmt.Sprintf(" /fingerprint %s, then /verify %s", changed[0], changed[0])
+	}
+	if m.comp != nil && len(m.comp.candidates) > 1 {
+		help = m.comp.hint(m.width)
+	}
+	// 三块：左边消息、右边用户列表，下面传输面板和输入框
+	main := m.vp.View()
+	if w := m.sidebarWidth(); w > 0 {
+		main = lipgloss.JoinHorizontal(lipgloss.Top, main, m.sidebarView(w, m.vp.Height))
+	}
+	// 最后不能再加换行，否则总行数比窗口多一行，最上面一行消息会被挤掉
+	return fmt.Sprintf("%s\n%s\n> %s\n%s", main, m.transfersView(), m.input.View(), help)
+}
+
+// uploadCmd 在后台上传，进度和结果都通过 incoming 交给 UI
+func (m model) uploadCmd(t *transfer, upload func(progress func(int64)) error) tea.Cmd {
+	return func() tea.Msg {
+		err := upload(progressReporter(m.incoming, t.id))
+		switch {
+		case errors.Is(err, errCancelled):
+			m.incoming <- transferDoneMsg{id: t.id, text: fmt.Sprintf("[upload cancelled] %s\n", t.name)}
+		case err != nil:
+			m.incoming <- transferDoneMsg{id: t.id, text: fmt.Sprintf("[upload error] %s: %v\n", t.name, err)}
+		default:
+			m.incoming <- transferDoneMsg{id: t.id, text: fmt.Sprintf("[upload success] %s\n", t.name)}
+		}
+		return nil
+	}
 }
 
-func uploadCmd(conn net.Conn, key []byte, path string) tea.Cmd {
+// extractCmd 在后台解包，结果作为一行本地消息返回
+func extractCmd(path string) tea.Cmd {
 	return func() tea.Msg {
-		// 复用 file_transfer.go 的 fileUpload(path, conn, aesKey)
-		if err := fileUpload(path, conn, key); err != nil {
-			return localMsg{text: fmt.Sprintf("[upload error] %v\n", err)}
+		dest, err := extractArchive(path)
+		if err != nil {
+			return localMsg{text: fmt.Sprintf("[extract error] %v\n", err)}
 		}
-		return localMsg{text: "[upload success]\n"}
+		return localMsg{text: fmt.Sprintf("[extract success] %s\n", dest)}
 	}
 }
 
+// commands 命令列表，/help 和 Tab 补全都用它
+var commands = []struct{ usage, desc string }{
+	{"/help", "查看命令列表"},
+	{"/onlineUsers", "查看当前在线用户列表"},
+	{"/setName <yourName>", "设置你的网名"},
+	{"/register <password>", "把现在的名字注册成账号（离线时的私信和 @ 会替你存着）"},
+	{"/login <name> <password>", "登录账号，顺便收离线消息"},
+	{"/msg [-plain] <name> <text>", "私信（端到端加密，对方没有公钥时加 -plain 发明文）"},
+	{"/fingerprint [name]", "查看自己或某人的公钥指纹，和对方的安全码"},
+	{"/verify <name>", "当面/电话对过指纹以后，把对方的公钥标成已验证"},
+	{"/upload [-z] <path>...", "上传文件；目录或多个文件打成 tar 包（-z 压缩）"},
+	{"/fileList", "查看服务器文件列表"},
+	{"/download <filename>", "下载文件"},
+	{"/extract [archive]", "解开下载的 tar 包（默认最近一个）"},
+	{"/cancel <id>", "取消传输（id 见传输面板）"},
+	{"/export <room> [since] [md|jsonl|html]", "导出聊天记录（since: 2026-01-02 或 24h/7d），存到下载目录"},
+	{"/rm <filename>", "删除服务器上的文件（上传者或管理员）"},
+	{"/rooms", "房间列表（上锁的房间只有成员看得到）"},
+	{"/join <room> [password|token]", "进房间（上锁的要密码或者邀请）"},
+	{"/create <room>", "建一个房间并进去（登录了的话你是房主）"},
+	{"/room password <pw|off>", "房主给当前房间设/去掉密码"},
+	{"/room invite-only <on|off>", "房主把当前房间改成只能凭邀请进"},
+	{"/invite <account>", "邀请某个注册用户进当前房间（一次性，会过期，成员才能发）"},
+	{"/invite-link", "生成一个谁都能用一次的邀请"},
+	{"/reply <id> <text>", "回复一条消息（开一个线程）"},
+	{"/thread [id]", "打开线程视图（默认最近的，Ctrl+T 也行，Esc 返回）"},
+	{"/react <id> <emoji>", "给消息点表情，再点一次取消"},
+	{"/search <words> [in:room] [from:user] [before:/after:date] [page:N]", "搜索聊天记录"},
+	{"/goto <id>", "跳到某条消息（搜索结果里的 #号）"},
+	{"/edit <id|last> <text>", "编辑自己发的消息（id 是消息前面的 #号）"},
+	{"/delete <id|last>", "删除自己发的消息"},
+	{"/away [reason]", "设为离开（闲置一段时间也会自动离开）"},
+	{"/busy [reason]", "设为忙碌"},
+	{"/back", "回到在线"},
+	{"/admin <token>", "管理员验证"},
+	{"/metrics", "查看在线人数和压缩统计"},
+	{"/theme [name]", "查看/切换配色主题"},
+	{"/exit", "断开链接"},
+}
+
 func renderHelp() string {
-	return strings.Join([]string{
-		"\n================= Command List =================\n",
-		"/help                     查看命令列表\n",
-		"/onlineUsers              查看当前在线用户列表\n",
-		"/setName <yourName>       设置你的网名\n",
-		"/upload <filepath>        上传文件\n",
-		"/fileList                 查看服务器文件列表\n",
-		"/download <filename>      下载文件\n",
-		"/exit                     断开链接\n",
-		"================================================\n\n",
-	}, "")
+	var sb strings.Builder
+	sb.WriteString("\n================= Command List =================\n")
+	for _, c := range commands {
+		sb.WriteString(fmt.Sprintf("%-25s %s\n", c.usage, c.desc))
+	}
+	sb.WriteString("Tab: 补全命令、昵称、文件名\n")
+	sb.WriteString("================================================\n\n")
+	return sb.String()
+}
+
+// hasPassword 带密码、管理员 token 的命令，不记进历史
+func hasPassword(line string) bool {
+	for _, prefix := range []string{"/login ", "/register ", "/room password ", "/admin "} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return strings.HasPrefix(line, "/join ") && len(strings.Fields(line)) > 2 // 带了密码或者邀请
 }
 
 func loadHistory(path string) []string {
@@ -290,13 +933,44 @@ func loadHistory(path string) []string {
 	return out
 }
 
-func saveHistory(path string, history []string) error {
-	_ = os.MkdirAll(filepath.Dir(path), 0755)
-	f, err := os.Create(path)
+// historyPath 输入历史放在配置目录里，只有自己能读；以前放在大家共用的临时目录
+func historyPath() string {
+	if p := os.Getenv("CHAT_HISTORY_FILE"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
 	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "chatclient", "history")
+}
+
+// migrateHistory 把老位置的历史搬过来，带密码的行不要，老文件删掉
+func migrateHistory(path string) {
+	old := filepath.Join(os.TempDir(), "chatclient.history")
+	if old == path {
+		return
+	}
+	if _, err := os.Stat(path); err == nil {
+		_ = os.Remove(old)
+		return
+	}
+	var kept []string
+	for _, line := range loadHistory(old) {
+		if !hasPassword(line) {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) > 0 && saveHistory(path, kept) != nil {
+		return
+	}
+	_ = os.Remove(old)
+}
+
+func saveHistory(path string, history []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 		return err
 	}
-	defer f.Close()
 
 	// keep last N
 	const N = 500
@@ -304,12 +978,11 @@ func saveHistory(path string, history []string) error {
 	if len(history) > N {
 		start = len(history) - N
 	}
+	var sb strings.Builder
 	for _, h := range history[start:] {
-		if _, err := fmt.Fprintln(f, h); err != nil {
-			return err
-		}
+		sb.WriteString(h + "\n")
 	}
-	return nil
+	return writePrivateFile(path, []byte(sb.String()))
 }
 
 func bigger(a, b int) int {
@@ -319,40 +992,182 @@ func bigger(a, b int) int {
 	return b
 }
 
+// passphraseKey 口令模式：握手之前拿服务器的 KDF 参数，从口令算出 AES key
+func passphraseKey(conn net.Conn, passphrase string) ([]byte, error) {
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	params, err := utils.FetchKDF(conn)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("deriving key from passphrase (%s)...\n", params)
+	return params.DeriveKey(passphrase)
+}
+
+// handshake 发 "Infernity"，顺带协商压缩方式
+// 环境变量 CHAT_COMPRESSION 指定偏好顺序，比如 "gzip,deflate"；"none" 表示不压缩
+func handshake(conn net.Conn, aesKey []byte) error {
+	offer := os.Getenv("CHAT_COMPRESSION")
+	if offer == "" {
+		offer = strings.Join(utils.SupportedCompression, ",")
+	}
+	if offer == utils.CompressNone {
+		return utils.SecureWriteFrame(conn, aesKey, []byte("Infernity"))
+	}
+	if err := utils.SecureWriteFrame(conn, aesKey, []byte("Infernity|"+offer)); err != nil {
+		return err
+	}
+
+	// 服务器回 COMPRESS|<mode>，这一帧本身不压缩
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reply, err := utils.SecureReadFrame(conn, aesKey)
+	if err != nil {
+		return err
+	}
+	mode, ok := strings.CutPrefix(string(reply), "COMPRESS|")
+	if !ok {
+		return fmt.Errorf("unexpected reply: %q", reply)
+	}
+	return utils.SetCompression(conn, mode)
+}
+
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("usage: ./client <host> <port> <key(base64)>")
+	keyFile := flag.String("key-file", "", "read the key (or passphrase) from this file, e.g. the server's server.key")
+	keyStdin := flag.Bool("key-stdin", false, "read the key (or passphrase) from the first line of stdin")
+	remember := flag.Bool("remember", false, "save the key for this server after connecting")
+	forget := flag.Bool("forget", false, "delete the saved key for this server first")
+	insecureKeyArg := flag.Bool("insecure-key-arg", false, "accept the key as a third argument (it ends up in shell history and ps)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: ./client [flags] <host> <port>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       ./client [flags] [profile]    (no profile: pick one from "+profilesPath()+")")
+		fmt.Fprintln(flag.CommandLine.Output(), "the key comes from -key-file, -key-stdin, CHAT_KEY_FILE, CHAT_KEY, a saved key or a prompt")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+
+	// 没给 host/port 就用 profiles.json 里的：给了名字直接连，没给弹列表选
+	var prof *profile
+	if len(args) < 2 {
+		profiles, err := loadProfiles()
+		if err != nil {
+			fmt.Println("load profiles failed:", err)
+			return
+		}
+		switch {
+		case len(args) == 1:
+			p, ok := findProfile(profiles, args[0])
+			if !ok {
+				fmt.Printf("no profile named %q in %s\n", args[0], profilesPath())
+				return
+			}
+			prof = &p
+		case len(profiles) == 0:
+			flag.Usage()
+			return
+		default:
+			if prof, err = pickProfile(profiles); err != nil {
+				fmt.Println("TUI error:", err)
+				return
+			}
+			if prof == nil {
+				return
+			}
+		}
+		args = []string{prof.Host, prof.Port}
+	}
+	if len(args) > 3 {
+		flag.Usage()
 		return
 	}
-	host := os.Args[1]
-	port := os.Args[2]
-	keyStr := os.Args[3]
+	host := args[0]
+	port := args[1]
+	server := net.JoinHostPort(host, port)
+	keyArg := ""
+	if len(args) == 3 {
+		if !*insecureKeyArg { // 老写法：key 会留在 shell 历史和 ps 里，得明说才认
+			fmt.Println("a key on the command line ends up in shell history and ps; use -key-file, -key-stdin, CHAT_KEY or the prompt (or -insecure-key-arg if you really must)")
+			return
+		}
+		keyArg = args[2]
+	}
 
-	aesKey, err := utils.ParseKey(keyStr)
+	if *forget {
+		if err := saveKey(server, ""); err != nil {
+			fmt.Println("forget key failed:", err)
+			return
+		}
+		fmt.Println("forgot the saved key for", server)
+	}
+	var src keySource
+	var err error
+	if prof != nil && *keyFile == "" && !*keyStdin { // 命令行上指定的 key 优先
+		src, err = prof.findKey()
+	} else {
+		src, err = findKey(server, keyArg, *keyFile, *keyStdin)
+	}
 	if err != nil {
-		panic(err)
+		fmt.Println("key error:", err)
+		return
 	}
+	keyStr := src.key
 
-	conn, err := net.Dial("tcp", host+":"+port)
+	conn, err := net.Dial("tcp", server)
 	if err != nil {
 		panic(err)
 	}
 
+	// 不是 base64/hex 的 key 就当口令，向服务器要 scrypt 参数算 key
+	aesKey, err := utils.ParseKey(keyStr)
+	passphrase := errors.Is(err, utils.ErrPassphrase)
+	if passphrase {
+		aesKey, err = passphraseKey(conn, keyStr)
+	}
+	if err != nil {
+		fmt.Println("key error:", err)
+		_ = conn.Close()
+		return
+	}
+
 	// handshake加密握手
-	if err := utils.SecureWriteFrame(conn, aesKey, []byte("Infernity")); err != nil {
+	if err := handshake(conn, aesKey); err != nil {
+		if passphrase { // key 不对服务器解不开握手，直接断开，只能看到 EOF
+			err = fmt.Errorf("%w (wrong passphrase?)", err)
+		}
 		fmt.Println("handshake failed:", err)
+		if src.saved { // 服务器重启会换随机 key，存下的就不对了
+			fmt.Printf("the key saved for %s did not work (new server key?); ./client -forget %s %s drops it\n", server, host, port)
+		}
 		_ = conn.Close()
 		return
 	}
 	_ = conn.SetDeadline(time.Time{})
+	if *remember {
+		if err := saveKey(server, keyStr); err != nil {
+			fmt.Println("save key failed:", err)
+		} else {
+			fmt.Printf("saved the key for %s in %s\n", server, keysPath())
+		}
+	}
 
-	histPath := filepath.Join(os.TempDir(), "chatclient.history")
+	histPath := historyPath()
+	migrateHistory(histPath)
 
-	p := tea.NewProgram(
-		newModel(conn, aesKey, 80, 24, histPath),
-		tea.WithAltScreen(),
-		tea.WithMouseCellMotion(),
-	)
+	ident, err := loadIdentity(identityPath())
+	if err != nil {
+		fmt.Println("load identity failed:", err)
+		_ = conn.Close()
+		return
+	}
+
+	opts := []tea.ProgramOption{tea.WithAltScreen(), tea.WithMouseCellMotion(), tea.WithReportFocus()}
+	if src.stdin { // stdin 已经被 key 用掉了，键盘从终端读
+		opts = append(opts, tea.WithInputTTY())
+	}
+	m := newModel(conn, aesKey, ident, 80, 24, histPath)
+	if prof != nil {
+		m.startup = prof.startup()
+	}
+	p := tea.NewProgram(m, opts...)
 	if _, err := p.Run(); err != nil {
 		fmt.Println("TUI error:", err)
 	}
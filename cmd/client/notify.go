@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"goLearning/pkg/utils"
+
+	"github.com/charmbracelet/bubbletea"
+)
+
+// ---- 有人 @ 自己时提醒 ----
+
+// 提醒方式，环境变量 CHAT_NOTIFY 选，默认不提醒：
+//
+//	bell    响铃（终端一般会在标签页上标记）
+//	osc9    OSC 9 桌面通知（iTerm2、Windows Terminal、kitty 等）
+//	osc777  OSC 777 桌面通知（rxvt、foot、部分 VTE 终端）
+func notifyMode() string {
+	return strings.ToLower(os.Getenv("CHAT_NOTIFY"))
+}
+
+// notifyCmd 按配置发提醒；写的都是不移动光标的控制序列，不会弄乱界面
+func notifyCmd(msg utils.Message) tea.Cmd {
+	var seq string
+	body := sanitize(fmt.Sprintf("%s: %s", msg.From, msg.Text))
+	switch notifyMode() {
+	case "bell":
+		seq = "\a"
+	case "osc9":
+		seq = "\x1b]9;" + body + "\a"
+	case "osc777":
+		seq = "\x1b]777;notify;" + sanitize("mentioned by "+msg.From) + ";" + body + "\a"
+	default:
+		return nil
+	}
+	return func() tea.Msg {
+		_, _ = os.Stdout.WriteString(seq)
+		return nil
+	}
+}
+
+// sanitize 别人发的内容要放进控制序列里，去掉控制字符（尤其是 ESC 和 BEL），
+// 分号会被 OSC 777 当成分隔符，也换掉；太长的截断
+func sanitize(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0):
+			return ' '
+		case r == ';':
+			return ','
+		}
+		return r
+	}, s)
+	return shorten(s, 200)
+}
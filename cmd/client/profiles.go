@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/list"
+	"github.com/charmbracelet/bubbletea"
+)
+
+// ---- 服务器配置：常连的服务器写进 profiles.json，不用每次敲 host、port、key：
+//   ./client            不带参数弹出列表选一个
+//   ./client <名字>      直接连这个
+// 连上以后自动 /setName 和 /join。key 不写在配置里，只写从哪拿：
+//   "file:<路径>"  文件第一行，比如服务器的 server.key；~ 开头是家目录
+//   "env:<变量>"   环境变量
+//   "saved"       -remember 存下的
+//   "prompt"      每次都问
+//   不写就和命令行一样按顺序找（CHAT_KEY、存下的、问）----
+
+// profile profiles.json 里的一个服务器
+type profile struct {
+	Name  string   `json:"name"`
+	Host  string   `json:"host"`
+	Port  string   `json:"port"`
+	Key   string   `json:"key,omitempty"`   // key 从哪拿，见上面
+	Nick  string   `json:"nick,omitempty"`  // 连上以后 /setName
+	Rooms []string `json:"rooms,omitempty"` // 连上以后按顺序 /join，最后停在最后一个；带密码的写成 "room password"
+}
+
+type profilesFile struct {
+	Profiles []profile `json:"profiles"`
+}
+
+func profilesPath() string {
+	if p := os.Getenv("CHAT_PROFILES_FILE"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "chatclient", "profiles.json")
+}
+
+// loadProfiles 文件不存在不算错误，返回空列表
+func loadProfiles() ([]profile, error) {
+	data, err := os.ReadFile(profilesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f profilesFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", profilesPath(), err)
+	}
+	for i, p := range f.Profiles {
+		if p.Name == "" || p.Host == "" || p.Port == "" {
+			return nil, fmt.Errorf("%s: profile #%d needs name, host and port", profilesPath(), i+1)
+		}
+	}
+	return f.Profiles, nil
+}
+
+func findProfile(profiles []profile, name string) (profile, bool) {
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return profile{}, false
+}
+
+func (p profile) server() string {
+	return net.JoinHostPort(p.Host, p.Port)
+}
+
+// startup 握手以后自动发的命令
+func (p profile) startup() []string {
+	var cmds []string
+	if p.Nick != "" {
+		cmds = append(cmds, "/setName "+p.Nick)
+	}
+	for _, room := range p.Rooms {
+		if room = strings.TrimSpace(room); room != "" {
+			cmds = append(cmds, "/join "+room)
+		}
+	}
+	return cmds
+}
+
+// findKey 按配置里写的来源拿 key
+func (p profile) findKey() (keySource, error) {
+	server := p.server()
+	kind, arg, _ := strings.Cut(p.Key, ":")
+	switch kind {
+	case "":
+		return findKey(server, "", "", false)
+	case "file":
+		path := expandHome(arg)
+		key, err := readKeyFile(path)
+		return keySource{key: key, from: path}, err
+	case "env":
+		if key := os.Getenv(arg); key != "" {
+			return keySource{key: key, from: arg}, nil
+		}
+		return keySource{}, fmt.Errorf("profile %s: $%s is not set", p.Name, arg)
+	case "saved":
+		keys, err := loadSavedKeys()
+		if err != nil {
+			return keySource{}, err
+		}
+		if k, ok := keys[server]; ok {
+			return keySource{key: k.Key, from: "the key saved in " + keysPath(), saved: true}, nil
+		}
+		return keySource{}, fmt.Errorf("profile %s: no key saved for %s (connect once with -remember)", p.Name, server)
+	case "prompt":
+		return promptKey(server)
+	}
+	return keySource{}, fmt.Errorf("profile %s: unknown key source %q (file:<path>, env:<var>, saved or prompt)", p.Name, p.Key)
+}
+
+func expandHome(path string) string {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, rest)
+}
+
+// ---- 选服务器的列表，不带参数启动时用 ----
+
+func (p profile) Title() string { return p.Name }
+
+func (p profile) Description() string {
+	desc := p.server()
+	if p.Nick != "" {
+		desc += " · " + p.Nick
+	}
+	if len(p.Rooms) > 0 {
+		names := make([]string, 0, len(p.Rooms))
+		for _, room := range p.Rooms {
+			name, _, _ := strings.Cut(strings.TrimSpace(room), " ") // 密码不显示
+			names = append(names, "#"+name)
+		}
+		desc += " · " + strings.Join(names, " ")
+	}
+	return desc
+}
+
+func (p profile) FilterValue() string { return p.Name + " " + p.Host }
+
+type pickerModel struct {
+	list   list.Model
+	chosen *profile
+}
+
+func (m pickerModel) Init() tea.Cmd { return nil }
+
+func (m pickerModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.list.SetSize(msg.Width, msg.Height)
+	case tea.KeyMsg:
+		if m.list.FilterState() == list.Filtering { // 正在输入过滤词，回车是确认过滤
+			break
+		}
+		switch msg.String() {
+		case "enter":
+			if p, ok := m.list.SelectedItem().(profile); ok {
+				m.chosen = &p
+			}
+			return m, tea.Quit
+		case "esc":
+			if m.list.FilterState() == list.FilterApplied { // 先清掉过滤
+				break
+			}
+			return m, tea.Quit
+		case "ctrl+c":
+			return m, tea.Quit
+		}
+	}
+	var cmd tea.Cmd
+	m.list, cmd = m.list.Update(msg)
+	return m, cmd
+}
+
+func (m pickerModel) View() string { return m.list.View() }
+
+// pickProfile 弹出列表，没选（Esc/q）返回 nil
+func pickProfile(profiles []profile) (*profile, error) {
+	items := make([]list.Item, len(profiles))
+	for i, p := range profiles {
+		items[i] = p
+	}
+	l := list.New(items, list.NewDefaultDelegate(), 0, 0)
+	l.Title = "Connect to"
+	l.SetShowStatusBar(false)
+
+	res, err := tea.NewProgram(pickerModel{list: l}, tea.WithAltScreen()).Run()
+	if err != nil {
+		return nil, err
+	}
+	return res.(pickerModel).chosen, nil
+}
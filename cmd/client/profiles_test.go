@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeProfiles 把 profiles.json 写到临时目录，CHAT_PROFILES_FILE 指过去
+func writeProfiles(t *testing.T, content string) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	t.Setenv("CHAT_PROFILES_FILE", path)
+	if content != "" {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	writeProfiles(t, "")
+	if profiles, err := loadProfiles(); err != nil || profiles != nil {
+		t.Fatalf("missing file = %v, %v", profiles, err)
+	}
+
+	writeProfiles(t, `{"profiles":[
+		{"name":"home","host":"10.0.0.2","port":"8080","nick":"alice","rooms":["general","ops secret"]},
+		{"name":"work","host":"::1","port":"9000","key":"env:WORK_KEY"}
+	]}`)
+	profiles, err := loadProfiles()
+	if err != nil || len(profiles) != 2 {
+		t.Fatalf("loadProfiles = %v, %v", profiles, err)
+	}
+	p, ok := findProfile(profiles, "work")
+	if !ok || p.server() != "[::1]:9000" {
+		t.Errorf("findProfile(work) = %+v, %v", p, ok)
+	}
+	if _, ok := findProfile(profiles, "Work"); ok {
+		t.Error("profile names matched case-insensitively")
+	}
+
+	for _, bad := range []string{
+		`not json`,
+		`{"profiles":[{"name":"x","host":"h"}]}`,
+		`{"profiles":[{"host":"h","port":"1"}]}`,
+	} {
+		writeProfiles(t, bad)
+		if _, err := loadProfiles(); err == nil {
+			t.Errorf("loadProfiles accepted %s", bad)
+		}
+	}
+}
+
+func TestProfileStartup(t *testing.T) {
+	p := profile{Name: "home", Host: "h", Port: "1", Nick: "alice", Rooms: []string{"general", " ", " ops secret "}}
+	want := []string{"/setName alice", "/join general", "/join ops secret"}
+	if got := p.startup(); !reflect.DeepEqual(got, want) {
+		t.Errorf("startup = %q, want %q", got, want)
+	}
+	if got := (profile{Name: "bare"}).startup(); len(got) != 0 {
+		t.Errorf("empty profile startup = %q", got)
+	}
+	// 列表里不显示房间密码
+	if d := p.Description(); strings.Contains(d, "secret") || !strings.Contains(d, "#ops") {
+		t.Errorf("description = %q", d)
+	}
+}
+
+func TestProfileFindKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "server.key")
+	os.WriteFile(keyFile, []byte("  filekey  \nsecond line\n"), 0600)
+	t.Setenv("WORK_KEY", "envkey")
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"file:" + keyFile, "filekey"},
+		{"env:WORK_KEY", "envkey"},
+	}
+	for _, tt := range tests {
+		p := profile{Name: "p", Host: "h", Port: "1", Key: tt.key}
+		ks, err := p.findKey()
+		if err != nil || ks.key != tt.want {
+			t.Errorf("findKey(%s) = %q, %v; want %q", tt.key, ks.key, err, tt.want)
+		}
+	}
+
+	for _, key := range []string{"env:NO_SUCH_KEY_VAR", "file:" + filepath.Join(dir, "missing"), "vault:x"} {
+		p := profile{Name: "p", Host: "h", Port: "1", Key: key}
+		if _, err := p.findKey(); err == nil {
+			t.Errorf("findKey(%s) succeeded", key)
+		}
+	}
+}
+
+func TestExpandHome(t *testing.T) {
+	t.Setenv("HOME", "/home/test")
+	if got := expandHome("~/keys/server.key"); got != filepath.Join("/home/test", "keys/server.key") {
+		t.Errorf("expandHome = %q", got)
+	}
+	for _, path := range []string{"/etc/key", "rel/key", "~other/key"} {
+		if got := expandHome(path); got != path {
+			t.Errorf("expandHome(%q) = %q", path, got)
+		}
+	}
+}
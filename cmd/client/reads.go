@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"goLearning/pkg/utils"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// ---- 已读：服务器记着每个人读到了哪条。连上（或改名）时自己读到的位置之后的第一条前面
+// 画一条"新消息"分隔线，切走窗口的时候也从当时读到的地方重新开始画；
+// 最后一条消息下面显示谁已经看过。窗口有焦点而且滚到底才算看到了 ----
+
+type readStateMsg struct{ state utils.ReadState }
+type readCursorMsg struct{ cursor utils.ReadCursor }
+
+// markRead 看到最底下了就把自己的已读位置推到最新一条
+func (m *model) markRead() {
+	if !m.focused || !m.vp.AtBottom() {
+		return
+	}
+	latest := ""
+	for _, e := range m.entries {
+		if e.msg != nil && utils.CompareID(e.msg.ID, latest) > 0 {
+			latest = e.msg.ID
+		}
+	}
+	if utils.CompareID(latest, m.lastRead) <= 0 {
+		return
+	}
+	m.lastRead = latest
+	_ = utils.SecureWriteFrame(m.conn, m.aesKey, utils.ReadAck(latest))
+}
+
+// isNew 分隔线画在第一条 isNew 的消息前面；自己发的不算
+func (m model) isNew(e entry) bool {
+	return m.divider != "" && e.msg != nil && e.msg.From != m.self && utils.CompareID(e.msg.ID, m.divider) > 0
+}
+
+// anyNew 现在有没有画分隔线
+func (m model) anyNew() bool {
+	for _, e := range m.entries {
+		if m.isNew(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m model) dividerLine() string {
+	label := " new messages "
+	side := max((m.vp.Width-lipgloss.Width(label))/2, 2)
+	return fg(m.theme.Self).Render(strings.Repeat("─", side) + label + strings.Repeat("─", side))
+}
+
+// seenLine 谁看过 msg 了（作者和自己不算），没人看过是空串
+func (m model) seenLine(msg utils.Message) string {
+	var names []string
+	for user, id := range m.cursors {
+		if user != msg.From && user != m.self && utils.CompareID(id, msg.ID) >= 0 {
+			names = append(names, user)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	text := fmt.Sprintf("✓ seen by %d", len(names))
+	if len(names) <= 3 {
+		text = "✓ seen by " + strings.Join(names, ", ")
+	}
+	return fg(m.theme.System).Faint(true).Render("  " + text)
+}
@@ -0,0 +1,18 @@
+package main
+
+import "fmt"
+
+// ---- 房间：/join 换房间以后服务器先发 ROOM|，消息区清空，接着收新房间的已读位置和聊天记录 ----
+
+type roomMsg struct{ room string }
+
+// enterRoom 换到 room：上一个房间的消息、线程、已读都不要了
+func (m *model) enterRoom(room string) {
+	m.room = room
+	m.entries, m.lines = m.entries[:0], m.lines[:0]
+	m.byID = map[string]int{}
+	m.thread, m.threadFrom, m.marked = "", 0, ""
+	m.cursors = map[string]string{}
+	m.divider, m.lastRead = "", ""
+	m.appendLine(fmt.Sprintf("[local] now in #%s (/rooms lists rooms, /join lobby goes back)\n", room))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"goLearning/pkg/utils"
+)
+
+// ---- 搜索：/search 发给服务器，结果作为一段本地消息显示；/goto <id> 跳到那条 ----
+
+type searchMsg struct{ result utils.SearchResult }
+
+// renderSearch 结果列表，最后提示怎么翻页和跳转
+func renderSearch(r utils.SearchResult) string {
+	var sb strings.Builder
+	if r.Total == 0 {
+		return fmt.Sprintf("[search] %q: no results\n", r.Query)
+	}
+	sb.WriteString(fmt.Sprintf("[search] %q: %d results, page %d/%d\n", r.Query, r.Total, r.Page, r.Pages))
+	for _, msg := range r.Results {
+		room := msg.Room
+		if room == "" {
+			room = utils.DefaultRoom
+		}
+		text := shorten(msg.Text, 80)
+		if msg.Encrypted() && msg.Text == "" {
+			text = "🔒 [encrypted]"
+		}
+		sb.WriteString(fmt.Sprintf("  #%s %s · %s · #%s  %s\n",
+			msg.ID, msg.From, msg.Time.Local().Format("01-02 15:04"), room, text))
+	}
+	hint := "/goto <id> to jump"
+	if r.Page < r.Pages {
+		hint = fmt.Sprintf("/search %s page:%d for more · %s", withoutPage(r.Query), r.Page+1, hint)
+	}
+	sb.WriteString("  " + hint + "\n")
+	return sb.String()
+}
+
+// withoutPage 去掉查询里的 page:N，拼下一页用
+func withoutPage(q string) string {
+	var keep []string
+	for _, f := range strings.Fields(q) {
+		if !strings.HasPrefix(strings.ToLower(f), "page:") {
+			keep = append(keep, f)
+		}
+	}
+	return strings.Join(keep, " ")
+}
+
+// jumpTo 把 id 这条滚到最上面并标出来；回复在线程里，先打开它的线程
+func (m *model) jumpTo(id string) error {
+	id = strings.TrimPrefix(id, "#")
+	i, ok := m.byID[id]
+	if !ok {
+		return fmt.Errorf("#%s is not loaded here (older history or another room, /join it first)", id)
+	}
+	m.marked = id
+	if m.isReply(m.entries[i].msg) {
+		if err := m.openThread(id); err != nil {
+			return err
+		}
+	} else if m.thread != "" {
+		m.closeThread()
+	} else {
+		m.refresh()
+	}
+	m.vp.SetYOffset(m.offsets[i])
+	return nil
+}
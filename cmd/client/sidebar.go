@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"goLearning/pkg/utils"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// ---- 右边的在线用户侧边栏，内容由服务器推的 ROSTER / PRESENCE 帧维护 ----
+
+type rosterMsg struct{ roster utils.Roster }
+type presenceMsg struct{ ev utils.PresenceEvent }
+
+// 窗口太窄就不显示侧边栏，把地方留给消息
+const minWidthForSidebar = 60
+
+var (
+	sidebarStyle = lipgloss.NewStyle().
+			BorderStyle(lipgloss.NormalBorder()).
+			BorderLeft(true).
+			PaddingLeft(1)
+	sidebarTitle = lipgloss.NewStyle().Bold(true)
+	sidebarDim   = lipgloss.NewStyle().Faint(true)
+)
+
+// sidebarWidth 侧边栏占的列数（含边框），不显示时为 0
+func (m model) sidebarWidth() int {
+	if !m.showUsers || m.width < minWidthForSidebar {
+		return 0
+	}
+	return min(bigger(m.width/4, 18), 28)
+}
+
+// applyPresence 把一次在线状态变化应用到用户列表上
+func (m *model) applyPresence(ev utils.PresenceEvent) {
+	switch ev.Event {
+	case utils.PresenceJoin:
+		m.removeMember(ev.Name) // 之前离开过的话列表里还有一条 offline 的
+		m.roster = append(m.roster, ev.Member)
+	case utils.PresenceLeave:
+		// 离开的人留在列表里，显示最后在线时间
+		delete(m.typing, ev.Name)
+		m.removeMember(ev.Name)
+		m.roster = append(m.roster, ev.Member)
+	case utils.PresenceUpdate:
+		old := ev.Name
+		if ev.Old != "" {
+			old = ev.Old
+			delete(m.typing, old)
+			if old != ev.Name {
+				m.removeMember(ev.Name) // 改成了一个离开的人的名字
+			}
+		}
+		if old == m.self {
+			m.self = ev.Name
+		}
+		for i := range m.roster {
+			if m.roster[i].Name == old {
+				m.roster[i] = ev.Member
+				return
+			}
+		}
+		m.roster = append(m.roster, ev.Member)
+	}
+}
+
+func (m *model) removeMember(name string) {
+	for i := range m.roster {
+		if m.roster[i].Name == name {
+			m.roster = append(m.roster[:i], m.roster[i+1:]...)
+			return
+		}
+	}
+}
+
+func statusIcon(status string) string {
+	switch status {
+	case "online":
+		return "●"
+	case "away":
+		return "◐"
+	case "busy":
+		return "⊘"
+	case "offline":
+		return "·"
+	default:
+		return "○"
+	}
+}
+
+// statusLine 名字下面那行：状态和原因，离开的人显示最后在线时间
+func statusLine(u utils.Member) string {
+	if u.Status == utils.StatusOffline {
+		if u.LastSeen.IsZero() {
+			return "  offline"
+		}
+		at, now := u.LastSeen.Local(), time.Now()
+		layout := "15:04"
+		if at.YearDay() != now.YearDay() || at.Year() != now.Year() { // 不是今天的带上日期
+			layout = "01-02 15:04"
+		}
+		return "  last seen " + at.Format(layout)
+	}
+	status := u.Status
+	if u.Reason != "" {
+		status += ": " + u.Reason
+	}
+	if u.Room == "" { // 进不去的房间，服务器不告诉我们是哪个
+		return "  " + status
+	}
+	return fmt.Sprintf("  %s · #%s", status, u.Room)
+}
+
+// sidebarView 渲染侧边栏，高度和消息面板一样；在线的在前，离开的在后
+func (m model) sidebarView(width, height int) string {
+	inner := width - 2 // 边框和左边距
+	users := append([]utils.Member(nil), m.roster...)
+	sort.SliceStable(users, func(i, j int) bool {
+		a, b := users[i].Status == utils.StatusOffline, users[j].Status == utils.StatusOffline
+		if a != b {
+			return b
+		}
+		return users[i].LastSeen.After(users[j].LastSeen) // 离开的人最近的在前
+	})
+	online := 0
+	for _, u := range users {
+		if u.Status != utils.StatusOffline {
+			online++
+		}
+	}
+	lines := []string{sidebarTitle.Render(shorten(fmt.Sprintf("#%s · 在线 (%d)", m.room, online), inner))}
+	for _, u := range users {
+		name := u.Name
+		if name == m.self {
+			name += " (you)"
+		}
+		name += m.trustMark(u.Name)
+		if _, ok := m.typing[u.Name]; ok {
+			name += " ✎"
+		}
+		head := shorten(statusIcon(u.Status)+" "+name, inner)
+		if u.Status == utils.StatusOffline {
+			head = sidebarDim.Render(head)
+		}
+		lines = append(lines, head, sidebarDim.Render(shorten(statusLine(u), inner)))
+	}
+	if len(lines) > height { // 放不下就截断，最后一行提示还有
+		lines = append(lines[:height-1], sidebarDim.Render("…"))
+	}
+	// Width 含左边距不含边框
+	return sidebarStyle.Width(width - 1).Height(height).Render(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"goLearning/pkg/utils"
+)
+
+func TestApplyPresence(t *testing.T) {
+	m := testModel(t)
+	m.roster = []utils.Member{{Name: "me", Status: utils.StatusOnline}}
+
+	m.applyPresence(utils.PresenceEvent{Event: utils.PresenceJoin, Member: utils.Member{Name: "alice", Status: utils.StatusOnline}})
+	seen := time.Now()
+	m.applyPresence(utils.PresenceEvent{Event: utils.PresenceLeave, Member: utils.Member{Name: "alice", Status: utils.StatusOffline, LastSeen: seen}})
+	if len(m.roster) != 2 || m.roster[1].Status != utils.StatusOffline || !m.roster[1].LastSeen.Equal(seen) {
+		t.Fatalf("after leave roster = %+v", m.roster)
+	}
+	// 回来了：offline 那条换成在线的，不会出现两次
+	m.applyPresence(utils.PresenceEvent{Event: utils.PresenceJoin, Member: utils.Member{Name: "alice", Status: utils.StatusOnline}})
+	if len(m.roster) != 2 || m.roster[1].Status != utils.StatusOnline {
+		t.Fatalf("after rejoin roster = %+v", m.roster)
+	}
+
+	// 自己改名，self 跟着变
+	m.applyPresence(utils.PresenceEvent{Event: utils.PresenceUpdate, Old: "me", Member: utils.Member{Name: "bob", Status: utils.StatusOnline}})
+	if m.self != "bob" || m.roster[0].Name != "bob" {
+		t.Fatalf("self = %q, roster = %+v", m.self, m.roster)
+	}
+
+	// 改成了一个离开的人的名字，离开的那条就没了
+	m.applyPresence(utils.PresenceEvent{Event: utils.PresenceLeave, Member: utils.Member{Name: "carol", Status: utils.StatusOffline, LastSeen: seen}})
+	m.applyPresence(utils.PresenceEvent{Event: utils.PresenceUpdate, Old: "alice", Member: utils.Member{Name: "carol", Status: utils.StatusAway}})
+	var names []string
+	for _, u := range m.roster {
+		names = append(names, u.Name+"/"+u.Status)
+	}
+	if got := strings.Join(names, " "); got != "bob/online carol/away" {
+		t.Errorf("roster = %s", got)
+	}
+}
+
+func TestStatusLine(t *testing.T) {
+	today := time.Now()
+	tests := []struct {
+		u    utils.Member
+		want string
+	}{
+		{utils.Member{Status: utils.StatusOnline, Room: "lobby"}, "  online · #lobby"},
+		{utils.Member{Status: utils.StatusAway, Reason: "lunch", Room: "ops"}, "  away: lunch · #ops"},
+		{utils.Member{Status: utils.StatusBusy}, "  busy"}, // 进不去的房间不显示
+		{utils.Member{Status: utils.StatusOffline}, "  offline"},
+		{utils.Member{Status: utils.StatusOffline, LastSeen: today}, "  last seen " + today.Local().Format("15:04")},
+		{utils.Member{Status: utils.StatusOffline, LastSeen: today.AddDate(0, 0, -3)}, "  last seen " + today.AddDate(0, 0, -3).Local().Format("01-02 15:04")},
+	}
+	for _, tt := range tests {
+		if got := statusLine(tt.u); got != tt.want {
+			t.Errorf("statusLine(%+v) = %q, want %q", tt.u, got, tt.want)
+		}
+	}
+}
+
+func TestSidebarWidth(t *testing.T) {
+	m := testModel(t)
+	m.showUsers, m.width = true, minWidthForSidebar-1
+	if w := m.sidebarWidth(); w != 0 {
+		t.Errorf("narrow window sidebar width = %d", w)
+	}
+	for _, width := range []int{minWidthForSidebar, 100, 400} {
+		m.width = width
+		if w := m.sidebarWidth(); w < 18 || w > 28 {
+			t.Errorf("width %d: sidebar width = %d", width, w)
+		}
+	}
+	m.showUsers = false // ctrl+o 关掉了
+	if w := m.sidebarWidth(); w != 0 {
+		t.Errorf("hidden sidebar width = %d", w)
+	}
+}
+
+func TestSidebarView(t *testing.T) {
+	m := testModel(t)
+	m.room = "lobby"
+	m.typing = map[string]time.Time{"alice": time.Now()}
+	now := time.Now()
+	m.roster = []utils.Member{
+		{Name: "old", Status: utils.StatusOffline, LastSeen: now.Add(-time.Hour)},
+		{Name: "me", Status: utils.StatusOnline, Room: "lobby"},
+		{Name: "recent", Status: utils.StatusOffline, LastSeen: now.Add(-time.Minute)},
+		{Name: "alice", Status: utils.StatusAway, Room: "lobby"},
+	}
+	view := m.sidebarView(28, 20)
+	if !strings.Contains(view, "#lobby · 在线 (2)") {
+		t.Errorf("title missing online count:\n%s", view)
+	}
+	if !strings.Contains(view, "me (you)") || !strings.Contains(view, "alice ✎") {
+		t.Errorf("missing (you) or typing mark:\n%s", view)
+	}
+	// 在线的在前，离开的按最后在线时间，最近的在前
+	order := []string{"● me", "◐ alice", "· recent", "· old"}
+	last := -1
+	for _, s := range order {
+		i := strings.Index(view, s)
+		if i < last {
+			t.Fatalf("%q out of order:\n%s", s, view)
+		}
+		last = i
+	}
+
+	// 放不下：截断，最后一行是 …
+	short := m.sidebarView(28, 4)
+	if lines := strings.Split(short, "\n"); len(lines) != 4 || !strings.Contains(lines[3], "…") {
+		t.Errorf("truncated sidebar:\n%s", short)
+	}
+}
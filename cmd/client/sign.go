@@ -0,0 +1,197 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+
+	"goLearning/pkg/utils"
+)
+
+// ---- 签名：自己发的加密消息和私信都签上名，收到的拿作者的公钥验一遍。
+// 服务器说是谁发的不算数，签名对得上才算；明文消息（网页、/msg -plain、老客户端）没有签名，标出来 ----
+
+type sigState int
+
+const (
+	sigNone       sigState = iota // 不用验：删掉的消息
+	sigValid                      // 签名对得上作者现在的公钥
+	sigUnsigned                   // 没有签名
+	sigUnknown                    // 有签名，但是不知道作者的公钥，验不了
+	sigServerKey                  // 签名对得上，但公钥只有服务器存的那把，自己没见过（第一次见面只能先信着）
+	sigLegacy                     // 老客户端的签名，没有序号，服务器重放了也看不出来
+	sigOtherKey                   // 签名对得上，但用的不是作者现在的公钥（换过设备，或者有人冒充）
+	sigReplayed                   // 签名对得上，但这个序号已经用在别的消息上了：服务器拿旧内容又发了一遍
+	sigRolledBack                 // 签名对得上，但比之前见过的版本旧：服务器把编辑换回去了
+	sigInvalid                    // 签名不对
+)
+
+// note 私信后面跟的说明，和消息的标记一个意思
+func (s sigState) note() string {
+	switch s {
+	case sigUnsigned:
+		return " [unsigned]"
+	case sigUnknown:
+		return " [signature not checked, no key]"
+	case sigServerKey:
+		return " [signed with a key only the server vouches for]"
+	case sigLegacy:
+		return " [old signature format, replays not detected]"
+	case sigOtherKey:
+		return " [signed with another key]"
+	case sigReplayed:
+		return " ⚠ [replayed: this signature was already used]"
+	case sigRolledBack:
+		return " ⚠ [older version than the one shown before]"
+	case sigInvalid:
+		return " ⚠ [invalid signature]"
+	}
+	return ""
+}
+
+// renderSig 消息后面的签名标记，验过的不显示
+func (t theme) renderSig(s sigState) string {
+	switch s {
+	case sigNone, sigValid:
+		return ""
+	case sigInvalid:
+		return " " + warnStyle.Render("⚠ invalid signature")
+	case sigReplayed:
+		return " " + warnStyle.Render("⚠ replayed")
+	case sigRolledBack:
+		return " " + warnStyle.Render("⚠ rolled back")
+	}
+	return fg(t.System).Faint(true).Render(s.note())
+}
+
+// trustedKey 验签名用的公钥：自己的、在线列表里的、/key 查到的，最后是以前见过的
+func (m model) trustedKey(name string) string {
+	if name == m.self {
+		return m.ident.publicKey()
+	}
+	if key := m.keyOf(name); key != "" {
+		return key
+	}
+	return m.ident.known[name].Key
+}
+
+// checkSig 验一条房间消息；没见过作者的公钥只能先信服务器存的那把（和第一次见面一个道理）
+func (m model) checkSig(msg utils.Message) sigState {
+	if msg.Deleted {
+		return sigNone
+	}
+	s, signer := m.verifyWith(m.trustedKey(msg.From), msg.Key, msg.Envelope(), msg.Sig)
+	return m.ident.fresh(s, signer, msg.Seq, msg.ID)
+}
+
+// directSig 验一条私信，服务器带来的 key 就是发的人当时的公钥
+func (m model) directSig(d utils.Direct) sigState {
+	s, signer := m.verifyWith(m.trustedKey(d.From), d.Key, d.Envelope(), d.Sig)
+	return m.ident.freshDirect(s, signer, d.Seq)
+}
+
+// verifyWith 验签名，返回结果和对得上的那把公钥（没对上是空串）
+func (m model) verifyWith(trusted, claimed, envelope, sig string) (sigState, string) {
+	switch {
+	case sig == "":
+		return sigUnsigned, ""
+	case trusted != "" && utils.VerifySignature(trusted, envelope, sig):
+		return sigValid, trusted
+	case claimed == "" || claimed == trusted:
+		if trusted == "" {
+			return sigUnknown, ""
+		}
+		return sigInvalid, ""
+	case !utils.VerifySignature(claimed, envelope, sig):
+		return sigInvalid, ""
+	case trusted == "":
+		return sigServerKey, claimed
+	}
+	return sigOtherKey, claimed
+}
+
+// fresh 签名对得上以后再看序号：同一个序号出现在另一条消息（或者又一条私信）上是重放，
+// 同一条消息的序号比见过的小是被换回了旧版本。只记这次运行里见过的，私信另外存盘（freshDirect）
+func (id *identity) fresh(s sigState, signer string, seq int64, msgID string) sigState {
+	if signer == "" {
+		return s
+	}
+	if seq == 0 {
+		if s == sigValid {
+			return sigLegacy
+		}
+		return s
+	}
+	key := signer + "|" + strconv.FormatInt(seq, 10)
+	if prev, ok := id.seqs[key]; ok && (msgID == "" || prev != msgID) {
+		return sigReplayed
+	}
+	if msgID != "" && seq < id.newest[msgID] {
+		return sigRolledBack
+	}
+	id.seqs[key] = msgID
+	if msgID != "" {
+		id.newest[msgID] = seq
+	}
+	return s
+}
+
+const (
+	maxDirectSeqs  = 256 // 每把公钥记住最近多少条私信的序号
+	maxDirectPeers = 500 // 最多记多少把公钥，多了扔掉最久没发过私信的
+)
+
+// freshDirect 私信的 fresh。房间消息每次连上都会重放历史，重启以后 seqs 能重新攒起来；
+// 私信不会重放，所以序号记在身份文件里，重启以后服务器再发一遍老私信也认得出来。
+// 比记着的都旧、又已经记满了的，分不清是不是重放，也当重放
+func (id *identity) freshDirect(s sigState, signer string, seq int64) sigState {
+	if signer == "" || seq == 0 {
+		return id.fresh(s, signer, seq, "")
+	}
+	seen := id.direct[signer]
+	i, found := slices.BinarySearch(seen, seq)
+	if found || (len(seen) >= maxDirectSeqs && i == 0) {
+		return sigReplayed
+	}
+	if s = id.fresh(s, signer, seq, ""); s == sigReplayed {
+		return s
+	}
+	seen = slices.Insert(seen, i, seq)
+	if over := len(seen) - maxDirectSeqs; over > 0 {
+		seen = seen[over:]
+	}
+	id.direct[signer] = seen
+	id.pruneDirect()
+	_ = id.save() // 存不下来只是重启以后认不出重放，这一条照样显示
+	return s
+}
+
+// pruneDirect 公钥太多的时候扔掉最近一条私信最早的（序号是毫秒时间戳，可以直接比）
+func (id *identity) pruneDirect() {
+	for len(id.direct) > maxDirectPeers {
+		oldest, at := "", int64(0)
+		for k, seqs := range id.direct {
+			if last := seqs[len(seqs)-1]; oldest == "" || last < at {
+				oldest, at = k, last
+			}
+		}
+		delete(id.direct, oldest)
+	}
+}
+
+// recheckSigs name 的公钥变了（或者刚知道），他的消息重新验一遍
+func (m *model) recheckSigs(name string) {
+	changed := false
+	for i, e := range m.entries {
+		if e.msg == nil || e.msg.From != name {
+			continue
+		}
+		if s := m.checkSig(*e.msg); s != e.sig {
+			m.entries[i].sig = s
+			m.lines[i] = m.theme.render(m.entries[i], m.self)
+			changed = true
+		}
+	}
+	if changed {
+		m.refresh()
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"goLearning/pkg/utils"
+)
+
+func testModel(t *testing.T) model {
+	t.Helper()
+	id, err := loadIdentity(filepath.Join(t.TempDir(), "identity.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return model{ident: id, self: "me", byID: map[string]int{}}
+}
+
+func newPeer(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	priv, err := utils.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+// signAs 像服务器存的那样：作者当时的公钥和签名都在消息上
+func signAs(priv *ecdh.PrivateKey, msg utils.Message) utils.Message {
+	msg.Key = utils.PublicIdentity(priv)
+	msg.Sig = utils.Sign(priv, msg.Envelope())
+	return msg
+}
+
+func TestCheckSigFlagsReplayAndRollback(t *testing.T) {
+	m := testModel(t)
+	alice := newPeer(t)
+	m.roster = []utils.Member{{Name: "alice", Key: utils.PublicIdentity(alice)}}
+
+	msg := signAs(alice, utils.Message{ID: "5", From: "alice", KeyID: "k", Cipher: "c", Seq: 100})
+	for range 2 { // 同一条再验一遍（换主题、换公钥以后会重验）没事
+		if s := m.checkSig(msg); s != sigValid {
+			t.Fatalf("checkSig = %v, want sigValid", s)
+		}
+	}
+	// 服务器把签过名的内容换个 id 再发一遍：签名本身还是对的
+	replay := msg
+	replay.ID = "6"
+	if s := m.checkSig(replay); s != sigReplayed {
+		t.Errorf("replay under a new id = %v, want sigReplayed", s)
+	}
+
+	edited := signAs(alice, utils.Message{ID: "5", From: "alice", KeyID: "k", Cipher: "c2", Seq: 200, Edited: true})
+	if s := m.checkSig(edited); s != sigValid {
+		t.Fatalf("edit = %v", s)
+	}
+	// 编辑以后服务器又把旧版本发回来
+	if s := m.checkSig(msg); s != sigRolledBack {
+		t.Errorf("older version after the edit = %v, want sigRolledBack", s)
+	}
+}
+
+func TestCheckSigMarkers(t *testing.T) {
+	m := testModel(t)
+	alice := newPeer(t)
+
+	// 没见过 alice 的公钥，只有服务器存的那把
+	msg := signAs(alice, utils.Message{ID: "1", From: "alice", KeyID: "k", Cipher: "c", Seq: 1})
+	if s := m.checkSig(msg); s != sigServerKey {
+		t.Errorf("key only from the server = %v, want sigServerKey", s)
+	}
+
+	m.roster = []utils.Member{{Name: "alice", Key: utils.PublicIdentity(alice)}}
+	legacy := signAs(alice, utils.Message{ID: "2", From: "alice", KeyID: "k", Cipher: "c"})
+	if s := m.checkSig(legacy); s != sigLegacy {
+		t.Errorf("signature without seq = %v, want sigLegacy", s)
+	}
+
+	forged := signAs(newPeer(t), utils.Message{ID: "3", From: "alice", KeyID: "k", Cipher: "c", Seq: 2})
+	forged.Key = utils.PublicIdentity(alice)
+	if s := m.checkSig(forged); s != sigInvalid {
+		t.Errorf("forged = %v, want sigInvalid", s)
+	}
+
+	d := utils.Direct{From: "alice", To: "me", Cipher: "c", Seq: 3}
+	d.Sig = utils.Sign(alice, d.Envelope())
+	if s := m.directSig(d); s != sigValid {
+		t.Fatalf("direct message = %v", s)
+	}
+	if s := m.directSig(d); s != sigReplayed {
+		t.Errorf("the same direct message again = %v, want sigReplayed", s)
+	}
+}
+
+func TestSigningHalfCountsAsKeyChange(t *testing.T) {
+	m := testModel(t)
+	alice := newPeer(t)
+	full := utils.PublicIdentity(alice)
+	raw, _ := base64.StdEncoding.DecodeString(full)
+	oldKey := base64.StdEncoding.EncodeToString(raw[:32]) // 老客户端只有 X25519 的 32 字节
+	m.roster = []utils.Member{{Name: "alice", Status: utils.StatusOnline, Key: oldKey, Account: true}}
+	m.observeKey("alice", oldKey)
+	if err := m.verify("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一把加密公钥后面多了签名的一半：可能是升级了，也可能是服务器接上了自己的
+	m.roster[0].Key = full
+	m.observeKey("alice", full)
+	k := m.ident.known["alice"]
+	if !k.Changed || k.Verified {
+		t.Fatalf("known = %+v, want changed and not verified", k)
+	}
+	last := m.entries[len(m.entries)-1]
+	if !last.warn || !strings.Contains(last.text, "identity key changed") {
+		t.Errorf("no warning, last entry %q", last.text)
+	}
+}
+
+// 私信的序号存在身份文件里，重启以后服务器再发一遍也认得出来
+func TestDirectReplayAfterRestart(t *testing.T) {
+	m := testModel(t)
+	alice := newPeer(t)
+	d := utils.Direct{From: "alice", To: "me", Cipher: "c", Seq: 1000}
+	d.Sig = utils.Sign(alice, d.Envelope())
+	d.Key = utils.PublicIdentity(alice)
+	if s := m.directSig(d); s != sigServerKey {
+		t.Fatalf("direct message = %v", s)
+	}
+
+	id, err := loadIdentity(m.ident.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ident = id
+	if s := m.directSig(d); s != sigReplayed {
+		t.Errorf("the same direct message after a restart = %v, want sigReplayed", s)
+	}
+	next := utils.Direct{From: "alice", To: "me", Cipher: "c2", Seq: 1001, Key: d.Key}
+	next.Sig = utils.Sign(alice, next.Envelope())
+	if s := m.directSig(next); s != sigServerKey {
+		t.Errorf("a new direct message after a restart = %v", s)
+	}
+}
+
+func TestDirectSeqsAreCapped(t *testing.T) {
+	m := testModel(t)
+	for i := 0; i < maxDirectSeqs+10; i++ {
+		m.ident.freshDirect(sigValid, "k", int64(100+i))
+	}
+	if n := len(m.ident.direct["k"]); n != maxDirectSeqs {
+		t.Fatalf("kept %d seqs, want %d", n, maxDirectSeqs)
+	}
+	// 比记着的都旧，分不清是不是重放
+	if s := m.ident.freshDirect(sigValid, "k", 50); s != sigReplayed {
+		t.Errorf("seq older than everything kept = %v, want sigReplayed", s)
+	}
+
+	for i := 0; i < maxDirectPeers+5; i++ {
+		m.ident.direct[strconv.Itoa(i)] = []int64{int64(i + 1)}
+	}
+	m.ident.pruneDirect()
+	if _, ok := m.ident.direct["0"]; ok || len(m.ident.direct) != maxDirectPeers {
+		t.Errorf("kept %d keys, the oldest still there: %v", len(m.ident.direct), ok)
+	}
+}
+
+// 游客的名字谁都能用：换了个人不报警；登录账号的和验证过的名字换了钥匙照样报
+func TestGuestNickReuseIsNotAKeyChange(t *testing.T) {
+	m := testModel(t)
+	first, second := utils.PublicIdentity(newPeer(t)), utils.PublicIdentity(newPeer(t))
+	warnings := func() int {
+		n := 0
+		for _, e := range m.entries {
+			if e.warn {
+				n++
+			}
+		}
+		return n
+	}
+
+	m.roster = []utils.Member{{Name: "guest", Status: utils.StatusOnline, Key: first}}
+	m.observeKey("guest", first)
+	if _, ok := m.ident.known["guest"]; ok {
+		t.Error("pinned a guest nick")
+	}
+	m.roster[0].Key = second
+	m.observeKey("guest", second)
+	if warnings() != 0 || len(m.changedKeys()) != 0 {
+		t.Error("guest nick reused by someone else raised a key-change warning")
+	}
+
+	// 老版本记下的游客名字，下次见到别的钥匙就丢掉
+	m.ident.known["old"] = knownKey{Key: first, Seen: time.Now()}
+	m.observeKey("old", second)
+	if _, ok := m.ident.known["old"]; ok || warnings() != 0 {
+		t.Errorf("stale guest pin kept or warned: %+v", m.ident.known["old"])
+	}
+
+	// 登录的账号记下来，换了钥匙要报
+	m.roster = []utils.Member{{Name: "alice", Status: utils.StatusOnline, Key: first, Account: true}}
+	m.observeKey("alice", first)
+	if k := m.ident.known["alice"]; k.Key != first || !k.Account {
+		t.Fatalf("account pin = %+v", k)
+	}
+	m.roster = nil // 下线以后收到的私信换了钥匙也算
+	m.observeKey("alice", second)
+	if k := m.ident.known["alice"]; !k.Changed || warnings() != 1 {
+		t.Errorf("account key change: known %+v, %d warnings", k, warnings())
+	}
+
+	// 验证过的游客名字也一样
+	m.roster = []utils.Member{{Name: "carol", Status: utils.StatusOnline, Key: first}}
+	if err := m.verify("carol"); err != nil {
+		t.Fatal(err)
+	}
+	m.roster[0].Key = second
+	m.observeKey("carol", second)
+	if k := m.ident.known["carol"]; !k.Changed || warnings() != 2 {
+		t.Errorf("verified guest key change: known %+v, %d warnings", k, warnings())
+	}
+}
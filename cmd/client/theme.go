@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"goLearning/pkg/utils"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// ---- 消息面板的样式：时间戳、昵称颜色、系统消息变暗、提到自己的行高亮 ----
+
+// theme 颜色写 lipgloss 认的格式："#ff8800"、"205" 都行，空字符串表示不上色
+type theme struct {
+	Name       string   `json:"name"`
+	TimeFormat string   `json:"timeFormat"` // Go 的时间格式，"-" 表示不显示时间
+	Time       string   `json:"time"`
+	System     string   `json:"system"`
+	Local      string   `json:"local"`
+	Self       string   `json:"self"`
+	Mention    string   `json:"mention"` // 提到自己的行的背景色
+	Nicks      []string `json:"nicks"`   // 其他人的昵称按名字哈希从这里挑颜色
+}
+
+var themes = map[string]theme{
+	"dark": {
+		Name: "dark", TimeFormat: "15:04",
+		Time: "241", System: "245", Local: "109", Self: "214", Mention: "237",
+		Nicks: []string{"39", "42", "170", "203", "81", "149", "177", "216", "75", "114"},
+	},
+	"light": {
+		Name: "light", TimeFormat: "15:04",
+		Time: "246", System: "243", Local: "24", Self: "130", Mention: "229",
+		Nicks: []string{"25", "28", "90", "124", "31", "64", "127", "166", "19", "29"},
+	},
+	"mono": {Name: "mono", TimeFormat: "15:04"},
+}
+
+const defaultTheme = "dark"
+
+// 主题配置文件：{"name":"light"} 选内置主题，其他字段写了就覆盖内置的
+func themePath() string {
+	if p := os.Getenv("CHAT_THEME_FILE"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "chatclient", "theme.json")
+}
+
+// loadTheme 读主题配置，读不到就用默认主题；name 非空时覆盖配置里选的主题
+func loadTheme(name string) theme {
+	var custom theme
+	if data, err := os.ReadFile(themePath()); err == nil {
+		_ = json.Unmarshal(data, &custom)
+	}
+	if name == "" {
+		name = custom.Name
+	}
+	t, ok := themes[name]
+	if !ok {
+		t = themes[defaultTheme]
+	}
+
+	if custom.TimeFormat != "" {
+		t.TimeFormat = custom.TimeFormat
+	}
+	for _, f := range []struct{ dst, src *string }{
+		{&t.Time, &custom.Time}, {&t.System, &custom.System}, {&t.Local, &custom.Local},
+		{&t.Self, &custom.Self}, {&t.Mention, &custom.Mention},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	if len(custom.Nicks) > 0 {
+		t.Nicks = custom.Nicks
+	}
+	return t
+}
+
+// saveThemeName 记住 /theme 选的主题，配置文件里其他自定义的字段保留
+func saveThemeName(name string) error {
+	path := themePath()
+	cfg := map[string]any{}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	cfg["name"] = name
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func themeNames() []string {
+	names := make([]string, 0, len(themes))
+	for name := range themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 底部未读提醒的小标记
+var mentionBadge = lipgloss.NewStyle().Bold(true).Reverse(true)
+
+func fg(color string) lipgloss.Style {
+	if color == "" {
+		return lipgloss.NewStyle()
+	}
+	return lipgloss.NewStyle().Foreground(lipgloss.Color(color))
+}
+
+// nickColor 同一个名字每次都是同一个颜色
+func (t theme) nickColor(name string) string {
+	if len(t.Nicks) == 0 {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return t.Nicks[h.Sum32()%uint32(len(t.Nicks))]
+}
+
+// entry 消息面板里的一条，存原文，换主题、改名后整个重新渲染
+type entry struct {
+	at      time.Time
+	text    string
+	local   bool           // 客户端自己产生的（命令结果、传输状态），不是服务器发来的
+	msg     *utils.Message // 聊天消息，其他的是纯文本
+	replies int            // 收到的回复数，显示在消息后面
+	warn    bool           // 要让人一眼看到的警告（公钥变了）
+	sig     sigState       // 聊天消息的签名验过没有，见 sign.go
+}
+
+// render 渲染一条消息，self 是自己现在的名字
+func (t theme) render(e entry, self string) string {
+	text := strings.TrimSuffix(e.text, "\n")
+
+	var line string
+	switch {
+	case e.msg != nil:
+		line = t.renderMessage(*e.msg, e.replies, self) + t.renderSig(e.sig)
+	case e.warn:
+		line = warnStyle.Render(text)
+	case e.local:
+		if strings.HasPrefix(strings.TrimLeft(text, "\n"), "[") {
+			line = fg(t.Local).Render(text)
+		} else {
+			line = text // /help 之类的大段文字不上色
+		}
+	case strings.HasPrefix(text, "[SYSTEM] "):
+		line = fg(t.System).Faint(true).Render(text)
+	default:
+		line = text
+	}
+
+	if t.TimeFormat != "-" {
+		line = fg(t.Time).Render(e.at.Format(t.TimeFormat)) + " " + line
+	}
+	return line
+}
+
+// renderMessage 前面带上 #id 方便 /edit、/delete；昵称上色；@ 了自己的整行加背景色
+func (t theme) renderMessage(msg utils.Message, replies int, self string) string {
+	dim := fg(t.System).Faint(true)
+	id := dim.Render("#" + msg.ID)
+	if msg.Parent != "" {
+		id += dim.Render(" ↳#" + msg.Parent)
+	}
+	suffix := ""
+	if replies > 0 {
+		suffix = dim.Render(fmt.Sprintf(" [%d replies]", replies))
+	}
+	if msg.Deleted {
+		return id + " " + dim.Render(msg.From+": [message deleted]") + suffix
+	}
+	if msg.Encrypted() && msg.Text == "" { // 没有这条的密钥：进房间之前发的，或者密钥还没到
+		return id + " " + dim.Render(msg.From+": 🔒 [encrypted, no key for this message]") + suffix + t.renderReactions(msg, self)
+	}
+
+	base := lipgloss.NewStyle()
+	if mentionsMe(msg, self) && t.Mention != "" {
+		base = base.Background(lipgloss.Color(t.Mention))
+	}
+	color := t.nickColor(msg.From)
+	if msg.From == self {
+		color = t.Self
+	}
+	nick := base.Bold(true)
+	if color != "" {
+		nick = nick.Foreground(lipgloss.Color(color))
+	}
+	line := id + " " + nick.Render(msg.From) + base.Render(": "+msg.Text)
+	if msg.Edited {
+		line += dim.Render(" (edited)")
+	}
+	return line + suffix + t.renderReactions(msg, self)
+}
+
+// renderReactions 消息后面的表情和人数，自己点过的反色
+func (t theme) renderReactions(msg utils.Message, self string) string {
+	var sb strings.Builder
+	for _, emoji := range msg.ReactionKeys() {
+		chip := fmt.Sprintf("%s %d", emoji, len(msg.Reactions[emoji]))
+		style := fg(t.System)
+		if msg.ReactedBy(emoji, self) {
+			style = style.Reverse(true)
+		}
+		sb.WriteString(" " + style.Render(chip))
+	}
+	return sb.String()
+}
+
+// mentionsMe 别人 @ 了自己（自己 @all 不算）
+func mentionsMe(msg utils.Message, self string) bool {
+	return self != "" && msg.From != self && msg.MentionsName(self)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"goLearning/pkg/utils"
+)
+
+// writeTheme 把 theme.json 写到临时目录，CHAT_THEME_FILE 指过去
+func writeTheme(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "theme.json")
+	t.Setenv("CHAT_THEME_FILE", path)
+	if content != "" {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestLoadTheme(t *testing.T) {
+	writeTheme(t, "")
+	if got := loadTheme(""); got.Name != defaultTheme {
+		t.Errorf("no config = %q, want %q", got.Name, defaultTheme)
+	}
+	if got := loadTheme("light"); !reflect.DeepEqual(got, themes["light"]) {
+		t.Errorf("loadTheme(light) = %+v", got)
+	}
+	if got := loadTheme("neon"); got.Name != defaultTheme {
+		t.Errorf("unknown theme = %q", got.Name)
+	}
+
+	// 配置里写了的字段覆盖内置主题，没写的不动
+	writeTheme(t, `{"name":"light","timeFormat":"15:04:05","self":"#ff8800"}`)
+	got := loadTheme("")
+	if got.Name != "light" || got.TimeFormat != "15:04:05" || got.Self != "#ff8800" {
+		t.Errorf("custom theme = %+v", got)
+	}
+	if got.Time != themes["light"].Time || !slices.Equal(got.Nicks, themes["light"].Nicks) {
+		t.Errorf("unset fields changed: %+v", got)
+	}
+	// /theme 选的主题优先，自定义的颜色照样用
+	if got := loadTheme("mono"); got.Name != "mono" || got.Self != "#ff8800" || got.Time != "" {
+		t.Errorf("loadTheme(mono) with custom = %+v", got)
+	}
+
+	writeTheme(t, `not json`)
+	if got := loadTheme(""); got.Name != defaultTheme {
+		t.Errorf("broken config = %q", got.Name)
+	}
+}
+
+func TestSaveThemeNameKeepsCustomFields(t *testing.T) {
+	path := writeTheme(t, `{"name":"dark","self":"#ff8800"}`)
+	if err := saveThemeName("light"); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadTheme(""); got.Name != "light" || got.Self != "#ff8800" {
+		t.Errorf("after save = %+v", got)
+	}
+
+	os.WriteFile(path, []byte("not json"), 0644)
+	if err := saveThemeName("dark"); err == nil {
+		t.Error("overwrote a config it could not parse")
+	}
+
+	writeTheme(t, "")
+	if err := saveThemeName("mono"); err != nil || loadTheme("").Name != "mono" {
+		t.Errorf("save without config: %v", err)
+	}
+}
+
+func TestNickColor(t *testing.T) {
+	dark := themes["dark"]
+	for _, name := range []string{"alice", "bob", "张三"} {
+		c := dark.nickColor(name)
+		if !slices.Contains(dark.Nicks, c) {
+			t.Errorf("nickColor(%q) = %q, not in the palette", name, c)
+		}
+		if dark.nickColor(name) != c {
+			t.Errorf("nickColor(%q) not stable", name)
+		}
+	}
+	if c := themes["mono"].nickColor("alice"); c != "" {
+		t.Errorf("mono nickColor = %q", c)
+	}
+}
+
+func TestRenderEntry(t *testing.T) {
+	at := time.Date(2026, 3, 4, 9, 5, 7, 0, time.Local)
+	th := themes["mono"]
+
+	if got := th.render(entry{at: at, text: "[SYSTEM] bob joined\n"}, "me"); got != "09:05 [SYSTEM] bob joined" {
+		t.Errorf("system line = %q", got)
+	}
+	th.TimeFormat = "-"
+	if got := th.render(entry{at: at, text: "plain\n"}, "me"); got != "plain" {
+		t.Errorf("no timestamp = %q", got)
+	}
+
+	msg := utils.Message{ID: "7", From: "bob", Text: "hi @me", Mentions: []string{"me"}, Edited: true}
+	got := th.render(entry{at: at, msg: &msg, replies: 2}, "me")
+	for _, want := range []string{"#7", "bob", ": hi @me", "(edited)", "[2 replies]"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("message line %q missing %q", got, want)
+		}
+	}
+	deleted := utils.Message{ID: "8", From: "bob", Text: "secret", Deleted: true}
+	if got := th.render(entry{at: at, msg: &deleted}, "me"); strings.Contains(got, "secret") || !strings.Contains(got, "[message deleted]") {
+		t.Errorf("deleted message = %q", got)
+	}
+}
+
+func TestMentionsMe(t *testing.T) {
+	tests := []struct {
+		msg  utils.Message
+		self string
+		want bool
+	}{
+		{utils.Message{From: "bob", Mentions: []string{"me"}}, "me", true},
+		{utils.Message{From: "bob", Mentions: []string{utils.MentionAll}}, "me", true},
+		{utils.Message{From: "me", Mentions: []string{utils.MentionAll}}, "me", false}, // 自己 @all 不算
+		{utils.Message{From: "bob", Mentions: []string{"alice"}}, "me", false},
+		{utils.Message{From: "bob", Mentions: []string{"me"}}, "", false},
+	}
+	for _, tt := range tests {
+		if got := mentionsMe(tt.msg, tt.self); got != tt.want {
+			t.Errorf("mentionsMe(%+v, %q) = %v", tt.msg, tt.self, got)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"goLearning/pkg/utils"
+)
+
+// ---- 线程：回复不显示在主面板里，挂在被回复的消息下面，只显示个数；
+// Ctrl+T 或 /thread <id> 打开线程视图，在里面直接打字就是回复 ----
+
+type historyMsg struct{ msgs []utils.Message }
+
+// addChat 加一条聊天消息；回复的话给线程开头那条的计数加一，返回它是不是 @ 了自己
+func (m *model) addChat(msg utils.Message) bool {
+	if p, ok := m.byID[msg.Parent]; ok && msg.Parent != "" {
+		m.entries[p].replies++
+		m.lines[p] = m.theme.render(m.entries[p], m.self)
+	}
+	m.byID[msg.ID] = len(m.entries)
+	m.appendEntry(entry{at: msg.Time, msg: &msg, sig: m.checkSig(msg)})
+	return mentionsMe(msg, m.self)
+}
+
+// isReply 回复而且被回复的那条在本地（不在的话只能直接显示在主面板）
+func (m model) isReply(msg *utils.Message) bool {
+	if msg == nil || msg.Parent == "" {
+		return false
+	}
+	_, ok := m.byID[msg.Parent]
+	return ok
+}
+
+// inView 第 i 条现在要不要显示
+func (m model) inView(i int) bool {
+	e := m.entries[i]
+	if m.thread == "" {
+		return !m.isReply(e.msg)
+	}
+	if e.msg == nil { // 打开线程以后的系统消息、命令结果还是要看到
+		return i >= m.threadFrom
+	}
+	return e.msg.ID == m.thread || e.msg.Parent == m.thread
+}
+
+// refresh 按当前视图重新拼 viewport 的内容
+func (m *model) refresh() {
+	shown := make([]string, 0, len(m.lines))
+	if m.thread != "" {
+		replies := 0
+		if i, ok := m.byID[m.thread]; ok {
+			replies = m.entries[i].replies
+		}
+		shown = append(shown, fg(m.theme.System).Faint(true).Render(
+			fmt.Sprintf("── thread #%s · %d replies · Esc 返回 ──", m.thread, replies)))
+	}
+	m.offsets = map[int]int{}
+	lineNo := len(shown) // 现在拼到 viewport 的第几行
+	divided := false
+	lastMsg, at := -1, 0 // 最后一条聊天消息的下标和它在 shown 里的下一行
+	for i := range m.entries {
+		if !m.inView(i) {
+			continue
+		}
+		if !divided && m.isNew(m.entries[i]) {
+			shown = append(shown, m.dividerLine())
+			lineNo++
+			divided = true
+		}
+		line := m.lines[i]
+		if msg := m.entries[i].msg; msg != nil && msg.ID == m.marked {
+			line = fg(m.theme.Self).Render("▶ ") + line
+		}
+		m.offsets[i] = lineNo
+		lineNo += strings.Count(line, "\n") + 1
+		shown = append(shown, line)
+		if m.entries[i].msg != nil {
+			lastMsg, at = i, len(shown)
+		}
+	}
+	// 最后一条消息下面显示谁看过了
+	if lastMsg >= 0 {
+		if seen := m.seenLine(*m.entries[lastMsg].msg); seen != "" {
+			shown = append(shown[:at], append([]string{seen}, shown[at:]...)...)
+		}
+	}
+	m.vp.SetContent(strings.Join(shown, "\n"))
+}
+
+// openThread 打开 id 所在的线程（id 是回复的话打开它的父消息）
+func (m *model) openThread(id string) error {
+	i, ok := m.byID[id]
+	if !ok {
+		return fmt.Errorf("no such message: %s", id)
+	}
+	if p := m.entries[i].msg.Parent; m.isReply(m.entries[i].msg) {
+		id = p
+	}
+	m.thread, m.threadFrom = id, len(m.entries)
+	m.refresh()
+	m.vp.GotoBottom()
+	return nil
+}
+
+func (m *model) closeThread() {
+	m.thread = ""
+	m.refresh()
+	m.vp.GotoBottom()
+}
+
+// latestThread 最近有动静的线程：最后一条回复所在的，没有回复就是空串
+func (m model) latestThread() string {
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		if msg := m.entries[i].msg; m.isReply(msg) {
+			return msg.Parent
+		}
+	}
+	return ""
+}
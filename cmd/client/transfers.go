@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/progress"
+	"github.com/charmbracelet/bubbletea"
+)
+
+// ---- 传输面板 ----
+
+// transfer 面板里的一项上传/下载
+type transfer struct {
+	id     string
+	name   string
+	upload bool
+	size   int64
+	done   int64
+	start  time.Time
+
+	// 只有上传有：/cancel 时关闭，上传 goroutine 看到就停下
+	cancel    chan struct{}
+	cancelled bool
+}
+
+// 下载开始（读循环收到文件头）
+type transferStartMsg struct {
+	id   string
+	name string
+	size int64
+}
+
+// 上传的 tar 包算出了要打包的内容有多大
+type transferSizeMsg struct {
+	id   string
+	size int64
+}
+
+type transferProgressMsg struct {
+	id   string
+	done int64
+}
+
+// 传输结束（成功/失败/取消），从面板移除并输出 text
+type transferDoneMsg struct {
+	id      string
+	text    string
+	archive string // 下载到的是 tar 包时记下路径，给 /extract 用
+}
+
+// 服务器取消了我们的上传
+type transferCancelMsg struct {
+	id     string
+	reason string
+}
+
+// 进度消息最多每隔这么久发一次，免得刷爆 UI
+const progressInterval = 100 * time.Millisecond
+
+// progressReporter 返回一个节流的进度回调，把进度通过 incoming 交给 UI
+func progressReporter(ch chan<- tea.Msg, id string) func(int64) {
+	var last time.Time
+	return func(done int64) {
+		if time.Since(last) < progressInterval {
+			return
+		}
+		last = time.Now()
+		ch <- transferProgressMsg{id: id, done: done}
+	}
+}
+
+func (m *model) findTransfer(id string) *transfer {
+	for _, t := range m.transfers {
+		if t.id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+func (m *model) removeTransfer(id string) {
+	for i, t := range m.transfers {
+		if t.id == id {
+			m.transfers = append(m.transfers[:i], m.transfers[i+1:]...)
+			return
+		}
+	}
+}
+
+// cancelUpload 关闭上传的 cancel channel，重复调用没关系
+func (t *transfer) cancelUpload() {
+	if !t.cancelled {
+		t.cancelled = true
+		close(t.cancel)
+	}
+}
+
+// transfersView 渲染传输面板，没有传输时返回空串
+func (m model) transfersView() string {
+	if len(m.transfers) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for _, t := range m.transfers {
+		arrow := "↓"
+		if t.upload {
+			arrow = "↑"
+		}
+		percent := 1.0
+		if t.size > 0 {
+			percent = float64(t.done) / float64(t.size)
+		} else if t.size < 0 { // 大小未知
+			percent = 0
+		}
+
+		elapsed := time.Since(t.start).Seconds()
+		var rate float64
+		if elapsed > 0 {
+			rate = float64(t.done) / elapsed
+		}
+		eta := "--"
+		if rate > 0 && t.size >= 0 {
+			eta = (time.Duration(float64(t.size-t.done)/rate) * time.Second).Round(time.Second).String()
+		}
+
+		sb.WriteString(fmt.Sprintf("[%s] %s %-16s %s  %s/s  ETA %s\n",
+			t.id, arrow, shorten(t.name, 16), m.bar.ViewAs(percent), humanBytes(int64(rate)), eta))
+	}
+	return sb.String()
+}
+
+func newProgressBar(width int) progress.Model {
+	bar := progress.New(progress.WithDefaultGradient())
+	bar.Width = progressWidth(width)
+	return bar
+}
+
+// 进度条占屏幕剩下的宽度，其他字段大概 60 列
+func progressWidth(width int) int {
+	return bigger(10, width-60)
+}
+
+func shorten(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"goLearning/pkg/utils"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// ---- 指纹和验证：第一次见到某人的公钥就记下来（先信着），以后变了就大声警告，
+// 可能是对方换了电脑，也可能是服务器在中间换了钥匙。当面或者电话里对过 /fingerprint 以后
+// 用 /verify 标成已验证；记录和身份密钥存在一起。
+// 游客的名字下线以后谁都能用，只记登录账号的名字和验证过的，不然换个人用同一个名字也要报"换钥匙" ----
+
+// knownKey 信任记录里的一个人
+type knownKey struct {
+	Key      string    `json:"key"`
+	Verified bool      `json:"verified,omitempty"` // 对过指纹了
+	Changed  bool      `json:"changed,omitempty"`  // 见过以后换过，还没重新验证
+	Account  bool      `json:"account,omitempty"`  // 记下的时候这个名字是登录的账号
+	Seen     time.Time `json:"seen"`               // 第一次见到这把公钥
+}
+
+var warnStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("15")).Background(lipgloss.Color("160"))
+
+// observeKey 服务器告诉我们 name 的公钥是 key：第一次见就记下，和记下的不一样就警告。
+// 老客户端升级以后公钥后面会多出签名用的一半，这也算换了：服务器也能给一把没签名的老公钥接上自己的签名公钥
+func (m *model) observeKey(name, key string) {
+	if name == "" || key == "" || name == m.self {
+		return
+	}
+	k, ok := m.ident.known[name]
+	if ok && k.Key == key {
+		return
+	}
+	defer m.recheckSigs(name)
+	account := m.isAccount(name)
+	if !account && !k.Verified && !k.Account {
+		// 游客的名字：不记，以前的版本记下的也丢掉，换了人不报警
+		if ok {
+			delete(m.ident.known, name)
+			m.saveTrust()
+		}
+		return
+	}
+	m.ident.known[name] = knownKey{Key: key, Changed: ok, Account: account || k.Account, Seen: time.Now()}
+	m.saveTrust()
+	if !ok {
+		return
+	}
+	was := ""
+	if k.Verified {
+		was = " You had verified the old one."
+	}
+	m.appendEntry(entry{at: time.Now(), local: true, warn: true, text: fmt.Sprintf(
+		"⚠ %s's identity key changed! A new device, or someone in the middle reading along.%s\n  Compare /fingerprint %s with them over another channel, then /verify %s\n",
+		name, was, name, name)})
+}
+
+// isAccount 在线列表里 name 是不是登录的账号
+func (m model) isAccount(name string) bool {
+	for _, u := range m.roster {
+		if u.Name == name && u.Status != utils.StatusOffline {
+			return u.Account
+		}
+	}
+	return false
+}
+
+func (m *model) saveTrust() {
+	if err := m.ident.save(); err != nil {
+		m.appendLine(fmt.Sprintf("[local] trust store not saved: %v\n", err))
+	}
+}
+
+// observeRoster 在线列表里带的公钥都过一遍
+func (m *model) observeRoster(users []utils.Member) {
+	for _, u := range users {
+		m.observeKey(u.Name, u.Key)
+	}
+}
+
+// changedKeys 换了公钥还没重新验证的人
+func (m model) changedKeys() []string {
+	var names []string
+	for name, k := range m.ident.known {
+		if k.Changed {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// trustMark 侧边栏名字后面的标记
+func (m model) trustMark(name string) string {
+	k, ok := m.ident.known[name]
+	switch {
+	case !ok || name == m.self:
+		return ""
+	case k.Changed:
+		return " ⚠"
+	case k.Verified && k.Key == m.keyOf(name):
+		return " ✓"
+	}
+	return ""
+}
+
+// fingerprint /fingerprint [user]：自己的指纹，或者某人的指纹和两人的安全码
+func (m model) fingerprint(name string) string {
+	mine := m.ident.publicKey()
+	if name == "" || name == m.self {
+		return fmt.Sprintf("[local] your fingerprint: %s\n", utils.Fingerprint(mine))
+	}
+	key := m.keyOf(name)
+	if key == "" {
+		key = m.ident.known[name].Key
+	}
+	if key == "" {
+		return fmt.Sprintf("[local] no key known for %s (/key %s asks the server)\n", name, name)
+	}
+	state := "not verified"
+	if k := m.ident.known[name]; k.Key == key && k.Changed {
+		state = "⚠ changed, not verified"
+	} else if k.Key == key && k.Verified {
+		state = "verified"
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("[local] %s's fingerprint: %s (%s)\n", name, utils.Fingerprint(key), state))
+	sb.WriteString(fmt.Sprintf("        safety number: %s\n", utils.SafetyNumber(mine, key)))
+	sb.WriteString(fmt.Sprintf("        %s sees the same safety number with /fingerprint %s; if it matches, /verify %s\n", name, m.self, name))
+	return sb.String()
+}
+
+// verify /verify <user>：现在的公钥标成已验证
+func (m *model) verify(name string) error {
+	key := m.keyOf(name)
+	if key == "" {
+		key = m.ident.known[name].Key
+	}
+	if key == "" {
+		return fmt.Errorf("no key known for %s (/key %s asks the server)", name, name)
+	}
+	m.ident.known[name] = knownKey{Key: key, Verified: true, Account: m.isAccount(name) || m.ident.known[name].Account, Seen: time.Now()}
+	if err := m.ident.save(); err != nil {
+		return err
+	}
+	m.appendLine(fmt.Sprintf("[local] %s's key %s is now verified\n", name, utils.Fingerprint(key)))
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"goLearning/pkg/utils"
+
+	"github.com/charmbracelet/bubbletea"
+)
+
+// ---- "X 正在输入…"：输入框不空就隔一会儿告诉服务器一次，别人的显示在底栏，
+// 一段时间没再收到就当停了 ----
+
+type typingMsg struct{ name string }
+type typingExpireMsg struct{}
+
+// noteTyping 记下 name 在输入，过了 TypingTimeout 再检查一次要不要去掉
+func (m *model) noteTyping(name string) tea.Cmd {
+	if name == m.self {
+		return nil
+	}
+	m.typing[name] = time.Now().Add(utils.TypingTimeout)
+	return tea.Tick(utils.TypingTimeout, func(time.Time) tea.Msg { return typingExpireMsg{} })
+}
+
+// expireTyping 去掉过期的
+func (m *model) expireTyping() {
+	now := time.Now()
+	for name, until := range m.typing {
+		if now.After(until) {
+			delete(m.typing, name)
+		}
+	}
+}
+
+// sendTyping 按键后输入框里有字（不是命令）就告诉服务器，TypingInterval 内最多一次
+func (m *model) sendTyping() {
+	value := strings.TrimSpace(m.input.Value())
+	if value == "" || strings.HasPrefix(value, "/") || time.Since(m.lastTyping) < utils.TypingInterval {
+		return
+	}
+	m.lastTyping = time.Now()
+	_ = utils.SecureWriteFrame(m.conn, m.aesKey, []byte(utils.TypingPing))
+}
+
+// typingLine 底栏上显示的，没人在输入就是空串
+func (m model) typingLine() string {
+	names := make([]string, 0, len(m.typing))
+	for name := range m.typing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0] + " is typing…"
+	case 2:
+		return names[0] + " and " + names[1] + " are typing…"
+	default:
+		return fmt.Sprintf("%s and %d others are typing…", names[0], len(names)-1)
+	}
+}
@@ -1,19 +1,63 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"goLearning/pkg/utils"
 	"io"
+	"io/fs"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-func fileUpload(localpath string, conn net.Conn, aeskey []byte) error {
-	//先发一帧：FILE|<filename>|<size>（这是文件头，文本）
-	//再发若干帧：每帧是一段文件二进制（例如 32KB）
+// 等服务器回复文件头的最长时间
+const ackTimeout = 30 * time.Second
+
+// errCancelled 用户 /cancel 或者服务器取消了传输
+var errCancelled = errors.New("cancelled")
+
+// ackBox 按传输 id 把服务器的 FILE_OK / FILE_REJECT 交给正在等待的上传
+type ackBox struct {
+	mu sync.Mutex
+	m  map[string]chan string
+}
+
+func (a *ackBox) wait(id string) <-chan string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.m == nil {
+		a.m = map[string]chan string{}
+	}
+	ch := make(chan string, 1)
+	a.m[id] = ch
+	return ch
+}
+
+func (a *ackBox) forget(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.m, id)
+}
+
+// deliver 没人在等这个 id 就丢掉
+func (a *ackBox) deliver(id, message string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ch, ok := a.m[id]; ok {
+		ch <- message
+		delete(a.m, id)
+	}
+}
+
+func fileUpload(localpath, id string, conn net.Conn, aeskey []byte, acks *ackBox, cancel <-chan struct{}, progress func(int64)) error {
+	//先发一帧：FILE|<filename>|<size>|<id>（这是文件头，文本）
+	//等服务器回 FILE_OK|<id>（超限、类型不允许会回 FILE_REJECT|<id>|<原因>）
+	//再发若干帧：每帧是 \x00<id>| 加一段文件二进制（例如 32KB），见 utils.DataFrame
 	//接收端按照 size 累计写入，收满结束（不需要 FILE_END）
 
 	f, err := os.Open(localpath) //只读打开
@@ -38,84 +82,212 @@ func fileUpload(localpath string, conn net.Conn, aeskey []byte) error {
 	// 只把文件名（不带路径）发给服务端，避免路径穿越
 	filename := filepath.Base(localpath)
 
-	// 1) 发送“文件头”一帧（文本）
-	header := fmt.Sprintf("FILE|%s|%d", filename, size)
+	// 1) 发送“文件头”一帧（文本），等服务器同意
+	if err := startUpload(conn, aeskey, acks, id, fmt.Sprintf("FILE|%s|%d|%s", filename, size, id), cancel); err != nil {
+		return err
+	}
+
+	// 2) 分块发送文件内容
+	done := acks.wait(id)
+	sent, err := sendData(f, id, conn, aeskey, utils.Compressible(filename), cancel, progress)
+	if err != nil {
+		acks.forget(id)
+		return err
+	}
+	if sent != size {
+		acks.forget(id)
+		_ = utils.SecureWriteFrame(conn, aeskey, []byte("FILE_CANCEL|"+id))
+		return fmt.Errorf("sent %d bytes, want %d", sent, size)
+	}
+	return waitDone(acks, id, done, cancel)
+}
+
+// waitDone 数据发完后等服务器确认保存成功（FILE_DONE），服务器出错会回 FILE_CANCEL
+func waitDone(acks *ackBox, id string, done <-chan string, cancel <-chan struct{}) error {
+	select {
+	case reply := <-done:
+		if strings.HasPrefix(reply, "FILE_DONE|") {
+			return nil
+		}
+		return errCancelled
+	case <-cancel:
+		acks.forget(id)
+		return errCancelled
+	case <-time.After(ackTimeout):
+		acks.forget(id)
+		return fmt.Errorf("no reply from server")
+	}
+}
+
+// startUpload 发文件头，等服务器回 FILE_OK；被拒绝、超时、用户取消都返回错误
+func startUpload(conn net.Conn, aeskey []byte, acks *ackBox, id, header string, cancel <-chan struct{}) error {
+	ack := acks.wait(id)
 	if err := utils.SecureWriteFrame(conn, aeskey, []byte(header)); err != nil {
+		acks.forget(id)
 		return fmt.Errorf("send header: %w", err)
 	}
 
-	// 2) 分块发送文件内容：每块一个 frame（二进制）
-	buf := make([]byte, 32*1024)
+	// 服务器按配额/类型检查文件头，被拒绝就不用再发数据了
+	select {
+	case reply := <-ack:
+		if reason, ok := strings.CutPrefix(reply, "FILE_REJECT|"+id+"|"); ok {
+			return fmt.Errorf("rejected by server: %s", reason)
+		}
+		return nil
+	case <-cancel:
+		acks.forget(id)
+		_ = utils.SecureWriteFrame(conn, aeskey, []byte("FILE_CANCEL|"+id))
+		return errCancelled
+	case <-time.After(ackTimeout):
+		acks.forget(id)
+		return fmt.Errorf("no reply from server")
+	}
+}
+
+// sendData 把 r 读完，每块一个 DATA 帧（二进制），返回发送的字节数
+// compressible=false 时（图片、压缩包）跳过帧压缩
+func sendData(r io.Reader, id string, conn net.Conn, aeskey []byte, compressible bool, cancel <-chan struct{}, progress func(int64)) (int64, error) {
+	buf := make([]byte, utils.ChunkSize)
 	var sent int64
 
 	for { //依然循环发送，一大堆异常处理
-		n, rerr := f.Read(buf)
+		select {
+		case <-cancel:
+			// 告诉服务器删掉半截文件
+			_ = utils.SecureWriteFrame(conn, aeskey, []byte("FILE_CANCEL|"+id))
+			return sent, errCancelled
+		default:
+		}
+
+		n, rerr := r.Read(buf)
 		if n > 0 {
-			if err := utils.SecureWriteFrame(conn, aeskey, buf[:n]); err != nil {
-				return fmt.Errorf("send chunk: %w", err)
+			if err := utils.SecureWriteData(conn, aeskey, utils.DataFrame(id, buf[:n]), compressible); err != nil {
+				return sent, fmt.Errorf("send chunk: %w", err)
 			}
 			sent += int64(n)
+			progress(sent)
 		}
 		if rerr == io.EOF {
-			break
+			return sent, nil
 		}
 		if rerr != nil {
-			return fmt.Errorf("read file: %w", rerr)
+			_ = utils.SecureWriteFrame(conn, aeskey, []byte("FILE_CANCEL|"+id))
+			return sent, fmt.Errorf("read file: %w", rerr)
 		}
 	}
+}
 
-	if sent != size {
-		return fmt.Errorf("sent %d bytes, want %d", sent, size)
-	}
-	return nil
+// download 一个正在从服务器下载的文件，数据帧由读循环按 id 分发过来
+type download struct {
+	id   string
+	name string
+	dir  string
+	size int64
+	got  int64
+	f    *os.File
 }
 
-func ReceiveFile(massage string, conn net.Conn, aeskey []byte) error {
+// ReceiveFile 处理服务器发来的文件头，在 dir 里建好临时文件
+func ReceiveFile(massage string, dir string) (*download, error) {
 	// massage 是 ReadFrame(conn) 读到的那一帧
-	// 格式：FILE|filename|size
+	// 格式：FILE|filename|size|id，size 为 -1 表示大小未知，以 FILE_END|id 结束
 
 	parts := strings.Split(massage, "|")
-	if len(parts) != 3 || parts[0] != "FILE" {
-		return fmt.Errorf("bad file header: %q", massage)
+	if len(parts) != 4 || parts[0] != "FILE" {
+		return nil, fmt.Errorf("bad file header: %q", massage)
 	}
 	filename := filepath.Base(parts[1])
 
 	size, err := strconv.ParseInt(parts[2], 10, 64)
-	if err != nil || size < 0 {
-		return fmt.Errorf("bad size in header: %v", parts[2])
+	if err != nil || size < -1 {
+		return nil, fmt.Errorf("bad size in header: %v", parts[2])
+	}
+	if filename == "." || filename == string(filepath.Separator) {
+		filename = "download"
 	}
 
-	//写文件，开一个文件句柄
-	writerHandler, err := os.Create(filename)
+	// 先写到下载目录里的隐藏临时文件，收完再改名；失败就删掉，不留垃圾
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create dir err: %w", err)
+	}
+	writerHandler, err := os.CreateTemp(dir, "."+filename+".*.part")
 	if err != nil {
-		// 如果创建失败：仍然要把后续 size 字节的“数据帧”消费掉，否则协议会乱
-		// 这里的消费方式：不断 ReadFrame，然后累计丢弃，直到丢弃够 size
-		var discarded int64
-		for discarded < size {
-			chunk, rerr := utils.SecureReadFrame(conn, aeskey)
-			if rerr != nil {
-				return fmt.Errorf("discard chunks err: %w", rerr)
-			}
-			discarded += int64(len(chunk))
-		}
-		return fmt.Errorf("create file err: %w", err)
+		return nil, fmt.Errorf("create file err: %w", err)
 	}
-	defer writerHandler.Close()
+	return &download{id: parts[3], name: filename, dir: dir, size: size, f: writerHandler}, nil
+}
 
-	// 循环收 chunk，直到写够 size 字节
-	var got int64
-	for got < size {
-		chunk, err := utils.SecureReadFrame(conn, aeskey)
-		if err != nil {
-			return fmt.Errorf("read chunk: %w (got %d/%d)", err, got, size)
-		}
+// write 写一块数据，收满 size 字节返回 done=true
+func (d *download) write(chunk []byte) (done bool, err error) {
+	if d.size >= 0 && d.got+int64(len(chunk)) > d.size {
+		return false, fmt.Errorf("too much data (got %d/%d)", d.got+int64(len(chunk)), d.size)
+	}
+	n, err := d.f.Write(chunk) //写文件内容
+	d.got += int64(n)
+	if err != nil {
+		return false, fmt.Errorf("write file: %w", err)
+	}
+	return d.got == d.size, nil
+}
 
-		n, err := writerHandler.Write(chunk) //写文件内容
-		if err != nil {
-			return fmt.Errorf("write file: %w", err)
+// finish 收完了：改成正式文件名，返回最终保存的路径
+func (d *download) finish() (string, error) {
+	tmpPath := d.f.Name()
+	defer os.Remove(tmpPath) // 改名成功后这里删不到东西
+
+	_ = d.f.Chmod(0644) // CreateTemp 建的是 0600
+	if err := d.f.Close(); err != nil {
+		return "", fmt.Errorf("close file: %w", err)
+	}
+	// 先用 O_EXCL 占住名字再改名盖过去，不会先查后改被别的程序抢先建了同名文件
+	dstPath, err := reservePath(d.dir, d.name, func(path string) error {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
 		}
-		got += int64(n)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("create file: %w", err)
+	}
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		os.Remove(dstPath) // 占位的空文件
+		return "", fmt.Errorf("rename file: %w", err)
+	}
+	return dstPath, nil
+}
+
+// abort 取消或出错：删掉半截文件
+func (d *download) abort() {
+	d.f.Close()
+	os.Remove(d.f.Name())
+}
+
+// downloadDir 下载目录：环境变量 CHAT_DOWNLOAD_DIR > ~/Downloads > 当前目录下的 downloads
+func downloadDir() string {
+	if dir := os.Getenv("CHAT_DOWNLOAD_DIR"); dir != "" {
+		return dir
 	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, "Downloads")
+	}
+	return "downloads"
+}
 
-	return nil
+// reservePath 用 create 建 filename，已存在就换成 "name (1).ext"、"name (2).ext"…，不覆盖旧文件
+// create 必须是原子的（O_EXCL、Mkdir），已存在时返回 fs.ErrExist；返回建好的路径
+func reservePath(dir, filename string, create func(path string) error) (string, error) {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	path := filepath.Join(dir, filename)
+	for i := 1; ; i++ {
+		err := create(path)
+		if err == nil {
+			return path, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
 }
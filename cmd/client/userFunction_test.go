@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func receive(t *testing.T, dir, name, data string) string {
+	t.Helper()
+	d, err := ReceiveFile("FILE|"+name+"|"+strconv.Itoa(len(data))+"|id1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := d.write([]byte(data))
+	if err != nil || !done {
+		t.Fatalf("write: done=%v err=%v", done, err)
+	}
+	path, err := d.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDownloadDoesNotOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("mine"), 0644)
+
+	path := receive(t, dir, "a.txt", "from server")
+	if want := filepath.Join(dir, "a (1).txt"); path != want {
+		t.Fatalf("saved to %s, want %s", path, want)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(b) != "mine" {
+		t.Fatalf("existing file overwritten: %q", b)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "from server" {
+		t.Fatalf("saved %q", b)
+	}
+	// 服务器给的名字带路径也只能落在下载目录里
+	if path := receive(t, dir, "../../etc/passwd", "x"); filepath.Dir(path) != dir {
+		t.Fatalf("saved outside the download dir: %s", path)
+	}
+	// 临时文件都删掉了
+	matches, _ := filepath.Glob(filepath.Join(dir, ".*.part"))
+	if len(matches) != 0 {
+		t.Fatalf("temp files left: %v", matches)
+	}
+}
+
+// 同时收好几个同名文件，每个都得有自己的名字
+func TestConcurrentDownloadsGetDistinctNames(t *testing.T) {
+	dir := t.TempDir()
+	const n = 8
+	paths := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			paths[i] = receive(t, dir, "same.bin", "data")
+		}()
+	}
+	wg.Wait()
+	sort.Strings(paths)
+	for i := 1; i < n; i++ {
+		if paths[i] == paths[i-1] {
+			t.Fatalf("two downloads saved to %s", paths[i])
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != n {
+		t.Fatalf("%d files in dir, want %d", len(entries), n)
+	}
+}
+
+func TestReceiveFileBadHeader(t *testing.T) {
+	dir := t.TempDir()
+	for _, h := range []string{"FILE|a|1", "FILE|a|x|id", "FILE|a|-2|id", "NOPE|a|1|id"} {
+		if _, err := ReceiveFile(h, dir); err == nil {
+			t.Errorf("ReceiveFile(%q) accepted", h)
+		}
+	}
+	d, err := ReceiveFile("FILE|a|2|id", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.write([]byte("abc")); err == nil {
+		t.Fatal("more data than the header said accepted")
+	}
+	d.abort()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("abort left %d files", len(entries))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 注册的账号存在 accounts.json：名字 -> 盐和 PBKDF2 哈希，不存明文密码
+// 注册过的名字别人不能 /setName 占用，离线时收到的私信和 @ 会存进信箱
+const accountsPath = "accounts.json"
+
+const (
+	pbkdf2Iterations  = 200_000
+	minPasswordLength = 6
+)
+
+type account struct {
+	Salt    []byte    `json:"salt"`
+	Hash    []byte    `json:"hash"`
+	Created time.Time `json:"created"`
+	Key     string    `json:"key,omitempty"` // 最近一次登录时的身份公钥，不在线也能给他发加密私信
+}
+
+var (
+	accountsMu sync.Mutex
+	accounts   = map[string]account{}
+)
+
+func loadAccounts() {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	data, err := readPrivateFile(accountsPath)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		fmt.Println("load accounts error:", err)
+	}
+}
+
+// saveAccountsLocked 调用方必须持有 accountsMu；有密码哈希，只给自己读，写到一半崩了也不会把所有人的哈希弄丢
+func saveAccountsLocked() error {
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(accountsPath, data)
+}
+
+func hashPassword(password string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, 32)
+}
+
+// register 把 name 注册成账号
+func register(name, password string) error {
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return err
+	}
+
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	if _, ok := accounts[name]; ok {
+		return fmt.Errorf("%s is already registered", name)
+	}
+	accounts[name] = account{Salt: salt, Hash: hash, Created: time.Now()}
+	return saveAccountsLocked()
+}
+
+// checkLogin 名字和密码对不对
+func checkLogin(name, password string) bool {
+	accountsMu.Lock()
+	acc, ok := accounts[name]
+	accountsMu.Unlock()
+	if !ok {
+		return false
+	}
+	hash, err := hashPassword(password, acc.Salt)
+	return err == nil && hmac.Equal(hash, acc.Hash)
+}
+
+func isRegistered(name string) bool {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	_, ok := accounts[name]
+	return ok
+}
+
+func registeredNames() []string {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setAccountKey 记下账号的身份公钥
+func setAccountKey(name, key string) {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	acc, ok := accounts[name]
+	if !ok || key == "" || acc.Key == key {
+		return
+	}
+	acc.Key = key
+	accounts[name] = acc
+	if err := saveAccountsLocked(); err != nil {
+		fmt.Println("save accounts error:", err)
+	}
+}
+
+func accountKey(name string) string {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	return accounts[name].Key
+}
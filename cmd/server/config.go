@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goLearning/pkg/utils"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 默认配置文件路径，可以用第二个命令行参数覆盖：./server <port> [config.json]
+const defaultConfigPath = "server.json"
+
+// Config 服务器配置，从 JSON 文件读取；文件不存在时全部用默认值
+type Config struct {
+	AdminToken  string          `json:"adminToken"`  // 为空时启动时随机生成，写进 admin.token（0600）
+	Passphrase  string          `json:"passphrase"`  // 不为空就开口令模式：AES key 由它过 scrypt 算出来，客户端也可以拿口令连
+	KeyFile     string          `json:"keyFile"`     // 启动时把 AES key 写到这个文件（0600），为空表示默认的 server.key
+	Compression []string        `json:"compression"` // 允许协商的压缩方式，为空表示全部支持的
+	HistorySize int             `json:"historySize"` // 新连接重放最近多少条消息，0 表示默认值，负数表示不重放
+	IdleMinutes int             `json:"idleMinutes"` // 闲置多少分钟自动变成 away，0 表示默认值，负数表示不自动
+	InviteHours float64         `json:"inviteHours"` // /invite 生成的邀请多久过期，0 表示默认 24 小时
+	Upload      UploadPolicy    `json:"upload"`
+	Retention   RetentionPolicy `json:"retention"`
+	Mailbox     MailboxPolicy   `json:"mailbox"`
+}
+
+var config Config
+
+// loadConfig 读取配置文件，文件不存在不算错误
+func loadConfig(path string) (Config, error) {
+	cfg := Config{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+const defaultHistorySize = 100
+
+func (c Config) historySize() int {
+	if c.HistorySize == 0 {
+		return defaultHistorySize
+	}
+	return max(c.HistorySize, 0)
+}
+
+const defaultIdleMinutes = 10
+
+func (c Config) idleTimeout() time.Duration {
+	if c.IdleMinutes == 0 {
+		return defaultIdleMinutes * time.Minute
+	}
+	return time.Duration(max(c.IdleMinutes, 0)) * time.Minute
+}
+
+const defaultKeyFile = "server.key"
+
+func (c Config) keyFile() string {
+	if c.KeyFile == "" {
+		return defaultKeyFile
+	}
+	return c.KeyFile
+}
+
+// writePrivateFile 只有自己能读的文件（账号、已读位置这些）：先写到同目录的临时文件（CreateTemp 就是 0600），
+// 再改名盖过去。直接 WriteFile 的话，原来的文件要是 0644，写的时候别人照样能读
+func writePrivateFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // 改名成功后这里删不到东西
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readPrivateFile 读 writePrivateFile 写的文件；老版本写成 0644 的顺手收紧
+func readPrivateFile(path string) ([]byte, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		_ = os.Chmod(path, 0600)
+	}
+	return os.ReadFile(path)
+}
+
+// writeKeyFile 每次启动覆盖写；写的是新文件再改名，原来的文件权限再宽新 key 也不会被别人读到
+func writeKeyFile(path, keyB64 string) error {
+	return writePrivateFile(path, []byte(keyB64+"\n"))
+}
+
+// adminTokenFile 随机生成的管理员口令写在这里，不打印（和 key 一样，会留在日志里）
+const adminTokenFile = "admin.token"
+
+const defaultInviteTTL = 24 * time.Hour
+
+func (c Config) inviteTTL() time.Duration {
+	if c.InviteHours <= 0 {
+		return defaultInviteTTL
+	}
+	return time.Duration(c.InviteHours * float64(time.Hour))
+}
+
+// allowedCompression 服务器允许的压缩方式
+func (c Config) allowedCompression() []string {
+	if len(c.Compression) == 0 {
+		return utils.SupportedCompression
+	}
+	return c.Compression
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWriteKeyFileReplacesLooseFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// 老版本留下的 0644 文件：新 key 不能先写进去再改权限
+	if err := os.WriteFile("server.key", []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.Stat("server.key")
+	if err := writeKeyFile("server.key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat("server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := after.Mode().Perm(); perm != 0600 {
+		t.Errorf("key file mode %o, want 600", perm)
+	}
+	if os.SameFile(before, after) {
+		t.Error("key written into the old file instead of a new one")
+	}
+	if data, _ := os.ReadFile("server.key"); string(data) != "new\n" {
+		t.Errorf("key file = %q", data)
+	}
+	if entries, _ := os.ReadDir("."); len(entries) != 1 {
+		t.Errorf("temp files left behind: %v", entries)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"goLearning/pkg/utils"
+	"net"
+	"strings"
+	"time"
+)
+
+// 端到端加密的消息服务器只管转发：E2E| 照常分配 id、存、广播，但是只有密文；
+// SKEY| 和 DM| 只转给收件人。要看内容的功能（搜索、导出、离线 @ 的摘要）对加密消息只剩元数据。
+// 签名不对的不收，拿发消息的这个连接报过的公钥验（同名的连接可能有好几个）；序号用过的也不收。
+// 签名和作者当时的公钥跟着消息一起存，导出的记录可以拿 ./server verify 验。
+// 身份公钥跟着在线列表发给大家，登录过的人的公钥也存进账号，不在线也能 /key 查到
+
+// setKey conn 发来了自己的身份公钥，告诉大家（侧边栏的 key 字段）
+func setKey(conn net.Conn, key string) error {
+	if _, err := utils.ParsePublicKey(key); err != nil {
+		return err
+	}
+	account := ""
+	userMu.Lock()
+	for i := range UserList {
+		if u := &UserList[i]; u.Conn == conn {
+			u.Key, account = key, u.Account
+			broadcastPresenceLocked(utils.PresenceEvent{Event: utils.PresenceUpdate, Member: u.member()}, nil)
+			break
+		}
+	}
+	userMu.Unlock()
+	if account != "" {
+		setAccountKey(account, key)
+	}
+	return nil
+}
+
+// keyOf name 的身份公钥：在线的优先，不在线的查账号，都没有是空串
+func keyOf(name string) string {
+	userMu.Lock()
+	for _, user := range UserList {
+		if user.Name == name && user.Key != "" {
+			userMu.Unlock()
+			return user.Key
+		}
+	}
+	userMu.Unlock()
+	return accountKey(name)
+}
+
+// relaySenderKey 把发送者密钥转给同一个房间里的 to，from 和 room 以服务器为准
+func relaySenderKey(conn net.Conn, from string, sk utils.SenderKey) {
+	sk.From, sk.Room = from, userRoom(conn)
+	frame := utils.SenderKeyFrame(sk)
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if user.Name != sk.To || user.Room != sk.Room {
+			continue
+		}
+		if err := send(user.Conn, frame); err != nil {
+			fmt.Println("write error:", err)
+		}
+	}
+}
+
+// sendSealed 加密的新消息或者编辑；@ 谁是客户端算的，这里只留下真有这个人的
+func sendSealed(conn net.Conn, name string, s utils.Sealed) {
+	if s.KeyID == "" || s.Cipher == "" {
+		_ = send(conn, []byte("[SYSTEM] 发送失败：empty encrypted message\n"))
+		return
+	}
+	u := userOf(conn)
+	key := u.Key
+	if s.Sig != "" {
+		envelope := utils.LegacyMessageEnvelope(u.Room, name, s.KeyID, s.Cipher)
+		if s.Seq != 0 {
+			envelope = utils.MessageEnvelope(u.Room, name, s.Seq, s.Parent, s.Edit, s.KeyID, s.Cipher)
+		}
+		if !utils.VerifySignature(key, envelope, s.Sig) {
+			_ = send(conn, []byte("[SYSTEM] 发送失败：bad signature\n"))
+			return
+		}
+	}
+	if s.Sig != "" && s.Seq != 0 {
+		if s.Edit == "last" { // 签名里是 "last"，存下来的消息验不过
+			_ = send(conn, []byte("[SYSTEM] 发送失败：a signed edit must name the message id\n"))
+			return
+		}
+		if err := store.claimSeq(key, s.Seq, false); err != nil {
+			_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 发送失败：%v\n", err)))
+			return
+		}
+	}
+	mentions := knownMentions(s.Mentions)
+	if s.Edit != "" {
+		changeMessage(conn, utils.MessageEvent{Op: utils.MessageEdit, ID: s.Edit, KeyID: s.KeyID, Cipher: s.Cipher, Key: key, Sig: s.Sig, Seq: s.Seq, Mentions: mentions, By: name})
+		return
+	}
+	sendMessage(conn, utils.Message{Parent: s.Parent, From: name, KeyID: s.KeyID, Cipher: s.Cipher, Key: key, Sig: s.Sig, Seq: s.Seq, Time: time.Now(), Mentions: mentions})
+}
+
+// knownMentions 去掉不存在的名字，大小写按服务器知道的来
+func knownMentions(names []string) []string {
+	var out []string
+	known := append(mentionNames(), utils.MentionAll)
+	for _, n := range names {
+		for _, k := range known {
+			if strings.EqualFold(n, k) {
+				out = append(out, k)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// sendSealedDirect 加密的私信：在线就转过去再给发的人回一份，不在线的注册用户存进信箱
+func sendSealedDirect(conn net.Conn, from string, d utils.Direct) {
+	if d.To == "" || d.Cipher == "" {
+		_ = send(conn, []byte("[SYSTEM] 用法：DM|{\"to\":...,\"cipher\":...}\n"))
+		return
+	}
+	d.From, d.Key, d.Time = from, userOf(conn).Key, time.Now()
+	if d.Sig != "" && !utils.VerifySignature(d.Key, d.Envelope(), d.Sig) {
+		_ = send(conn, []byte("[SYSTEM] 发送失败：bad signature\n"))
+		return
+	}
+	if d.Sig != "" && d.Seq != 0 {
+		if err := store.claimSeq(d.Key, d.Seq, true); err != nil {
+			_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 发送失败：%v\n", err)))
+			return
+		}
+	}
+	frame := utils.DirectFrame(d)
+	switch {
+	case unicast(d.To, string(frame)):
+		_ = send(conn, frame)
+	case isRegistered(d.To):
+		enqueueMail(d.To, mail{Kind: mailDM, From: from, Key: d.Key, Cipher: d.Cipher, Sig: d.Sig, Seq: d.Seq, Time: d.Time})
+		_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] %s 不在线，登录后会收到\n", d.To)))
+	default:
+		_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] %s 不在线，也没有注册，消息没有发出去\n", d.To)))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"goLearning/pkg/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClaimSeqRejectsReplays(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.claimSeq("k1", 10, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range []int64{10, 9} {
+		if err := s.claimSeq("k1", seq, false); err == nil {
+			t.Errorf("seq %d accepted after 10", seq)
+		}
+	}
+	// 每把公钥各算各的
+	if err := s.claimSeq("k2", 5, false); err != nil {
+		t.Errorf("another key's seq rejected: %v", err)
+	}
+
+	// 存下来的消息和编辑重启以后还算用过
+	u := User{Name: "alice", Session: "s1"}
+	msg, err := s.add(utils.Message{From: "alice", Room: defaultRoom, KeyID: "x", Cipher: "c", Key: "k3", Sig: "sig", Seq: 20, Time: time.Now()}, u.owner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.change(utils.MessageEvent{Op: utils.MessageEdit, ID: msg.ID, KeyID: "x", Cipher: "c2", Key: "k3", Sig: "sig2", Seq: 30, By: "alice"}, u, defaultRoom); err != nil {
+		t.Fatal(err)
+	}
+	s = reopen(t, s)
+	if err := s.claimSeq("k3", 30, false); err == nil {
+		t.Error("seq of a stored edit accepted again after a restart")
+	}
+	if err := s.claimSeq("k3", 31, false); err != nil {
+		t.Error(err)
+	}
+	if h := s.msgs[msg.ID].History; len(h) != 1 || h[0].Seq != 20 {
+		t.Errorf("history lost the old seq: %+v", h)
+	}
+}
+
+// 私信不进日志，序号单独记一行，重启以后还挡得住
+func TestDirectSeqSurvivesRestart(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.claimSeq("k1", 100, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.claimSeq("k2", 7, false); err != nil {
+		t.Fatal(err)
+	}
+	s = reopen(t, s)
+	if err := s.claimSeq("k1", 100, true); err == nil {
+		t.Error("DM seq accepted again after a restart")
+	}
+	if err := s.claimSeq("k1", 101, true); err != nil {
+		t.Error(err)
+	}
+	// 没写进日志的（房间消息靠消息本身）重启就忘了
+	if err := s.claimSeq("k2", 7, false); err != nil {
+		t.Errorf("unpersisted seq remembered: %v", err)
+	}
+	if len(s.order) != 0 {
+		t.Errorf("seq records replayed as messages: %v", s.order)
+	}
+}
+
+func TestSignedReplyIsNotRethreaded(t *testing.T) {
+	s := newTestStore(t)
+	u := User{Name: "alice", Session: "s1"}
+	root := post(t, s, u, "root")
+	reply, err := s.add(utils.Message{Parent: root.ID, From: "alice", Text: "reply", Room: defaultRoom}, u.owner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 明文的回复的回复照旧挂到线程开头
+	plain, err := s.add(utils.Message{Parent: reply.ID, From: "alice", Text: "again", Room: defaultRoom}, u.owner())
+	if err != nil || plain.Parent != root.ID {
+		t.Fatalf("plain reply: parent %q, err %v", plain.Parent, err)
+	}
+	// 签过名的 parent 改了就验不过，不收
+	if _, err := s.add(utils.Message{Parent: reply.ID, From: "alice", Cipher: "c", Sig: "sig", Seq: 1, Room: defaultRoom}, u.owner()); err == nil {
+		t.Fatal("signed reply to a reply was re-threaded")
+	}
+}
+
+// onlineAs 把 conn 当成一个在线的用户，store 用临时的
+func onlineAs(t *testing.T, u User) {
+	t.Helper()
+	s := newTestStore(t)
+	oldStore, oldUsers := store, UserList
+	store = s
+	userMu.Lock()
+	UserList = []User{u}
+	userMu.Unlock()
+	t.Cleanup(func() {
+		store = oldStore
+		userMu.Lock()
+		UserList = oldUsers
+		userMu.Unlock()
+	})
+}
+
+func TestSendSealed(t *testing.T) {
+	server, client := pipeOutbox(t)
+	frames := drain(t, client)
+	priv, _ := utils.NewIdentity()
+	key := utils.PublicIdentity(priv)
+	onlineAs(t, User{Name: "alice", Session: "s1", Conn: server, Room: defaultRoom, Key: key})
+
+	sealed := func(seq int64, signer string) utils.Sealed {
+		s := utils.Sealed{KeyID: "k", Cipher: "c", Seq: seq}
+		s.Sig = utils.Sign(priv, utils.MessageEnvelope(signer, "alice", seq, "", "", s.KeyID, s.Cipher))
+		return s
+	}
+	next := func() string {
+		select {
+		case f := <-frames:
+			return f
+		case <-time.After(2 * time.Second):
+			t.Fatal("no reply")
+		}
+		return ""
+	}
+
+	sendSealed(server, "alice", sealed(5, defaultRoom))
+	msg, ok := utils.ParseMessage(next())
+	if !ok || msg.Text != "" || msg.Cipher != "c" || msg.Key != key || msg.Seq != 5 {
+		t.Fatalf("stored %+v", msg)
+	}
+	// 签的是别的房间
+	sendSealed(server, "alice", sealed(6, "ops"))
+	if f := next(); !strings.Contains(f, "bad signature") {
+		t.Errorf("wrong room: %q", f)
+	}
+	// 原样再发一遍
+	sendSealed(server, "alice", sealed(5, defaultRoom))
+	if f := next(); !strings.Contains(f, "already used") {
+		t.Errorf("replay: %q", f)
+	}
+	if n := len(store.order); n != 1 {
+		t.Errorf("%d messages stored, want 1", n)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goLearning/pkg/utils"
+	"html/template"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 导出聊天记录：聊天里 /export <room> [since] [format] 生成一份文件，走下载的路子发回去；
+// 管理员也可以在服务器上直接跑 ./server export [-o file] <room> [since] [format]。
+// 格式有 Markdown、JSON lines 和单文件 HTML，编辑过的消息带上改之前的版本，
+// 最后附上这段时间里上传的文件（只有元信息，文件本身还是用 /download 拿）
+
+const (
+	exportMarkdown = "md"
+	exportJSON     = "jsonl"
+	exportHTML     = "html"
+)
+
+var exportFormats = map[string]string{
+	"md": exportMarkdown, "markdown": exportMarkdown,
+	"json": exportJSON, "jsonl": exportJSON,
+	"html": exportHTML,
+}
+
+const exportUsage = "usage: /export <room> [since] [md|jsonl|html]  (since: 2026-01-02, 2026-01-02T15:04 or 24h/7d)"
+
+type exportOptions struct {
+	room   string
+	since  time.Time // 零值表示从头开始
+	format string
+	audit  bool // 删掉的消息也导出原文，只给管理员和服务器命令行
+}
+
+// parseExport 解析 /export 后面的参数，room 必填，since 和格式顺序随意
+func parseExport(args string) (exportOptions, error) {
+	opt := exportOptions{format: exportMarkdown}
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return opt, errors.New(exportUsage)
+	}
+	opt.room = strings.TrimPrefix(fields[0], "#")
+	for _, f := range fields[1:] {
+		if format, ok := exportFormats[strings.ToLower(f)]; ok {
+			opt.format = format
+			continue
+		}
+		since, err := parseSince(f)
+		if err != nil {
+			return opt, fmt.Errorf("%s: %v\n%s", f, err, exportUsage)
+		}
+		opt.since = since
+	}
+	if opt.room == "" {
+		return opt, errors.New(exportUsage)
+	}
+	return opt, nil
+}
+
+// parseSince 日期（同 /search 的 after:）或者往前多久：30m、24h、7d
+func parseSince(s string) (time.Time, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return time.Now().Add(-d), nil
+	}
+	return parseDate(s)
+}
+
+// exportedMessage 导出的一条，带上编辑/删除前的版本
+type exportedMessage struct {
+	utils.Message
+	History []version `json:"history,omitempty"`
+}
+
+type transcript struct {
+	Room     string
+	Since    time.Time
+	Exported time.Time
+	Messages []exportedMessage
+	Files    []fileMeta
+}
+
+// transcript 按条件取出一个房间的记录，从旧到新
+func (s *messageStore) transcript(opt exportOptions) transcript {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := transcript{Room: opt.room, Since: opt.since, Exported: time.Now()}
+	for _, id := range s.order {
+		m := s.msgs[id]
+		if !strings.EqualFold(msgRoom(m.Message), opt.room) || m.Time.Before(opt.since) {
+			continue
+		}
+		em := exportedMessage{Message: m.snapshot(), History: append([]version(nil), m.History...)}
+		if m.Deleted && !opt.audit { // 谁在什么时候删的可以看，删掉的内容不给
+			for i := range em.History {
+				em.History[i].Text, em.History[i].KeyID, em.History[i].Cipher, em.History[i].Sig = "", "", "", ""
+			}
+		}
+		t.Messages = append(t.Messages, em)
+	}
+	t.Files = uploadsSince(opt.room, opt.since)
+	return t
+}
+
+// uploadsSince since 以后在 room 里上传、现在还在的文件，按上传时间排；别的房间的文件连名字都不给
+func uploadsSince(room string, since time.Time) []fileMeta {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	var files []fileMeta
+	for _, m := range index {
+		if strings.EqualFold(m.room(), room) && !m.Time.Before(since) {
+			m.Owner = "" // 账号、连接编号不写进导出的文件
+			files = append(files, m)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Time.Before(files[j].Time) })
+	return files
+}
+
+// exportName 导出文件名，比如 transcript-lobby-20261019-1504.md
+func exportName(opt exportOptions, now time.Time) string {
+	room := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '|' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, opt.room)
+	return fmt.Sprintf("transcript-%s-%s.%s", room, now.Format("20060102-1504"), opt.format)
+}
+
+// render 按格式写出去
+func (t transcript) render(w io.Writer, format string) error {
+	switch format {
+	case exportJSON:
+		return t.renderJSON(w)
+	case exportHTML:
+		return htmlTranscript.Execute(w, t)
+	default:
+		return t.renderMarkdown(w)
+	}
+}
+
+const exportTimeLayout = "2006-01-02 15:04"
+
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return "the beginning"
+	}
+	return t.Local().Format(exportTimeLayout)
+}
+
+// reactionSummary "👍 2 (alice, bob), 🎉 1 (carol)"
+func reactionSummary(m utils.Message) string {
+	var parts []string
+	for _, emoji := range m.ReactionKeys() {
+		users := m.Reactions[emoji]
+		parts = append(parts, fmt.Sprintf("%s %d (%s)", emoji, len(users), strings.Join(users, ", ")))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// versionSummary "edited 2026-10-19 15:05 by bob, was: ..."
+func versionSummary(v version) string {
+	op := "edited"
+	if v.Op == utils.MessageDelete {
+		op = "deleted"
+	}
+	s := fmt.Sprintf("%s %s by %s", op, exportTime(v.Time), v.By)
+	if v.Text != "" {
+		s += ", was: " + v.Text
+	} else if v.Cipher != "" {
+		s += ", was encrypted"
+	}
+	return s
+}
+
+func sizeString(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (t transcript) renderMarkdown(w io.Writer) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# #%s transcript\n\n", t.Room)
+	fmt.Fprintf(&b, "- Exported: %s\n- Since: %s\n- Messages: %d\n", exportTime(t.Exported), exportTime(t.Since), len(t.Messages))
+	b.WriteString("- Signatures: export as jsonl and run `./server verify <file>` to check them\n\n---\n\n")
+	for _, m := range t.Messages {
+		fmt.Fprintf(&b, "**%s** · %s · #%s", m.From, exportTime(m.Time), m.ID)
+		if m.Parent != "" {
+			fmt.Fprintf(&b, " · reply to #%s", m.Parent)
+		}
+		if m.Sig != "" {
+			b.WriteString(" · signed")
+		}
+		b.WriteString("\n\n")
+		if m.Deleted {
+			b.WriteString("*message deleted*\n\n")
+		} else if m.Encrypted() { // 服务器只有密文，jsonl 里有原样的密文可以拿客户端解
+			b.WriteString("*end-to-end encrypted*\n\n")
+		} else {
+			b.WriteString(m.Text + "\n\n")
+		}
+		for _, v := range m.History {
+			fmt.Fprintf(&b, "> %s\n", versionSummary(v))
+		}
+		if r := reactionSummary(m.Message); r != "" {
+			fmt.Fprintf(&b, "> reactions: %s\n", r)
+		}
+		if len(m.History) > 0 || len(m.Reactions) > 0 {
+			b.WriteString("\n")
+		}
+	}
+	if len(t.Files) > 0 {
+		b.WriteString("## Attachments\n\n| File | Size | Uploaded by | Time |\n|---|---|---|---|\n")
+		cell := strings.NewReplacer("|", `\|`).Replace
+		for _, f := range t.Files {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", cell(f.Name), sizeString(f.Size), cell(f.Uploader), exportTime(f.Time))
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// renderJSON 第一行是概要，后面每行一条消息或一个文件，用 type 区分
+func (t transcript) renderJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	header := struct {
+		Type     string    `json:"type"`
+		Room     string    `json:"room"`
+		Since    time.Time `json:"since,omitzero"`
+		Exported time.Time `json:"exported"`
+		Messages int       `json:"messages"`
+		Files    int       `json:"files"`
+	}{"transcript", t.Room, t.Since, t.Exported, len(t.Messages), len(t.Files)}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for _, m := range t.Messages {
+		line := struct {
+			Type string `json:"type"`
+			exportedMessage
+		}{"message", m}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	for _, f := range t.Files {
+		line := struct {
+			Type string `json:"type"`
+			fileMeta
+		}{"file", f}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 单文件 HTML，样式写在里面，离线也能打开；内容都由 html/template 转义
+var htmlTranscript = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"time":      exportTime,
+	"reactions": reactionSummary,
+	"version":   versionSummary,
+	"size":      sizeString,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>#{{.Room}} transcript</title>
+<style>
+body { font: 15px/1.5 system-ui, sans-serif; max-width: 860px; margin: 32px auto; padding: 0 16px; color: #1e1b16; background: #f4efe6; }
+.meta { color: #5b5b5b; }
+.msg { margin: 10px 0; padding: 10px 14px; border-radius: 12px; background: #fff; }
+.msg:target { box-shadow: inset 0 0 0 2px #d26935; }
+.msg.deleted .text, .msg.encrypted .text { color: #5b5b5b; font-style: italic; }
+.head { font-size: 13px; color: #5b5b5b; }
+.head b { color: #1e1b16; }
+.text { white-space: pre-wrap; }
+.history, .reactions { font-size: 13px; color: #5b5b5b; }
+.history { margin: 6px 0 0; padding-left: 18px; }
+table { border-collapse: collapse; width: 100%; background: #fff; }
+th, td { padding: 6px 10px; border-bottom: 1px solid #e1e7df; text-align: left; }
+</style>
+</head>
+<body>
+<h1>#{{.Room}} transcript</h1>
+<p class="meta">Exported {{time .Exported}} · since {{time .Since}} · {{len .Messages}} messages</p>
+{{range .Messages}}<div class="msg{{if .Deleted}} deleted{{else if .Encrypted}} encrypted{{end}}" id="m{{.ID}}">
+<div class="head"><b>{{.From}}</b> · {{time .Time}} · <a href="#m{{.ID}}">#{{.ID}}</a>{{if .Parent}} · reply to <a href="#m{{.Parent}}">#{{.Parent}}</a>{{end}}{{if .Sig}} · signed{{end}}</div>
+<div class="text">{{if .Deleted}}message deleted{{else if .Encrypted}}end-to-end encrypted{{else}}{{.Text}}{{end}}</div>
+{{with .History}}<ul class="history">{{range .}}<li>{{version .}}</li>{{end}}</ul>
+{{end}}{{with reactions .Message}}<div class="reactions">{{.}}</div>
+{{end}}</div>
+{{end}}{{with .Files}}<h2>Attachments</h2>
+<table>
+<tr><th>File</th><th>Size</th><th>Uploaded by</th><th>Time</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{size .Size}}</td><td>{{.Uploader}}</td><td>{{time .Time}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// sendExport 生成导出文件，按下载的格式发给 conn
+func sendExport(opt exportOptions, id string, conn net.Conn, cancel <-chan struct{}) error {
+	var buf bytes.Buffer
+	if err := store.transcript(opt).render(&buf, opt.format); err != nil {
+		return fmt.Errorf("render transcript: %w", err)
+	}
+	return streamFile(exportName(opt, time.Now()), int64(buf.Len()), &buf, id, conn, cancel)
+}
+
+// runExport 服务器命令行：./server export [-o file] <room> [since] [format]，不写 -o 就打到标准输出
+func runExport(args []string) error {
+	out := ""
+	if len(args) >= 2 && args[0] == "-o" {
+		out, args = args[1], args[2:]
+	}
+	opt, err := parseExport(strings.Join(args, " "))
+	if err != nil {
+		return errors.New(strings.ReplaceAll(err.Error(), "/export", "./server export [-o file]"))
+	}
+	opt.audit = true
+	if _, err := os.Stat(messageLogPath); err != nil { // 别在错的目录里建一个空日志
+		return fmt.Errorf("no chat log here: %w", err)
+	}
+	loadIndex()
+	if store, err = openStore(messageLogPath); err != nil {
+		return err
+	}
+	defer store.f.Close()
+
+	w := io.Writer(os.Stdout)
+	if out != "" {
+		f, err := os.OpenFile(out, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	t := store.transcript(opt)
+	if err := t.render(w, opt.format); err != nil {
+		return err
+	}
+	if out != "" {
+		fmt.Printf("exported %d messages and %d files from #%s to %s\n", len(t.Messages), len(t.Files), opt.room, out)
+	}
+	return nil
+}
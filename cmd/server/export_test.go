@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"goLearning/pkg/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExport(t *testing.T) {
+	opt, err := parseExport(" #ops 2024-05-01 jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt.room != "ops" || opt.format != exportJSON || opt.since.IsZero() {
+		t.Fatalf("got %+v", opt)
+	}
+	if _, err := parseExport(""); err == nil {
+		t.Fatal("missing room accepted")
+	}
+}
+
+// 导出一个房间只带这个房间传的文件，也不带上传者的账号、连接
+func TestTranscriptFilesOnlyFromRoom(t *testing.T) {
+	setupUploads(t, UploadPolicy{})
+	s, err := openStore(messageLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.f.Close()
+	alice := User{Name: "alice", Session: "s1"}
+	s.add(utils.Message{From: "alice", Text: "in ops", Room: "ops", Time: time.Now()}, alice.owner())
+	s.add(utils.Message{From: "alice", Text: "in lobby", Room: defaultRoom, Time: time.Now()}, alice.owner())
+	recordUpload("alice", alice.owner(), "ops", "plan.pdf", 10)
+	recordUpload("alice", alice.owner(), "secret", "secret-plan.pdf", 10)
+	index["old.txt"] = fileMeta{Name: "old.txt", Uploader: "bob", Size: 1, Time: time.Now()} // 老索引没有房间
+
+	tr := s.transcript(exportOptions{room: "ops", format: exportJSON})
+	if len(tr.Messages) != 1 || len(tr.Files) != 1 || tr.Files[0].Name != "plan.pdf" {
+		t.Fatalf("ops: %d messages, files %+v", len(tr.Messages), tr.Files)
+	}
+	var buf bytes.Buffer
+	if err := tr.render(&buf, exportJSON); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Contains(out, "secret") || strings.Contains(out, "conn:") {
+		t.Fatalf("export leaked other rooms or owners:\n%s", out)
+	}
+
+	lobby := s.transcript(exportOptions{room: defaultRoom})
+	if len(lobby.Files) != 1 || lobby.Files[0].Name != "old.txt" {
+		t.Fatalf("lobby files %+v", lobby.Files)
+	}
+	if later := s.transcript(exportOptions{room: "ops", since: time.Now().Add(time.Hour)}); len(later.Files) != 0 {
+		t.Fatalf("since ignored: %+v", later.Files)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy uploads/ 的保留策略，0 表示不限制
+type RetentionPolicy struct {
+	MaxAgeDays    float64 `json:"maxAgeDays"`    // 超过 N 天的文件删除
+	MaxTotalGB    float64 `json:"maxTotalGB"`    // 总大小超过 N GB 时从最老的开始删
+	CheckInterval int     `json:"checkInterval"` // 检查间隔（分钟），默认 10
+}
+
+// removeFile 处理 /rm：只有上传者（按账号或连接认，不按名字）或管理员能删；返回文件在哪个房间，通知只发给那里的人
+func removeFile(filename string, u User) (string, error) {
+	filename = filepath.Base(filename)
+	if filename == "" || filename == "." || strings.HasPrefix(filename, ".") {
+		return "", fmt.Errorf("usage: /rm <filename>")
+	}
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	path := filepath.Join(uploadDir, filename)
+	info, err := os.Stat(path)
+	m, ok := index[filename]
+	if err != nil || info.IsDir() || !canEnter(u, m.room()) { // 进不去的房间的文件当作不存在
+		return "", fmt.Errorf("no such file: %s", filename)
+	}
+	// 不在索引里的老文件没有上传者记录，只能管理员删
+	if !u.Admin && (!ok || !u.owns(m.owner())) {
+		return "", fmt.Errorf("only the uploader or an admin can delete %s", filename)
+	}
+	if err := os.Remove(path); err != nil {
+		return "", err
+	}
+	delete(index, filename)
+	return m.room(), saveIndexLocked()
+}
+
+// janitor 后台定期按保留策略清理 uploads/
+func janitor() {
+	for {
+		p := config.Retention
+		interval := time.Duration(p.CheckInterval) * time.Minute
+		if interval <= 0 {
+			interval = 10 * time.Minute
+		}
+		if p.MaxAgeDays > 0 || p.MaxTotalGB > 0 {
+			expired := expireFiles(p, time.Now())
+			for _, m := range expired {
+				broadcastMembers(m.room(), fmt.Sprintf("file expired and was removed: %s\n", m.Name))
+			}
+			if len(expired) > 0 {
+				broadcastCatalog()
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// expireFiles 删掉过期和超出总量的文件，返回被删的文件（名字和房间，不在索引里的算大厅）
+func expireFiles(p RetentionPolicy, now time.Time) []fileMeta {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	items, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return nil
+	}
+
+	type entry struct {
+		name string
+		size int64
+		time time.Time
+	}
+	var files []entry
+	var total int64
+	for _, item := range items {
+		if item.IsDir() || strings.HasPrefix(item.Name(), ".") {
+			continue
+		}
+		info, err := item.Info()
+		if err != nil {
+			continue
+		}
+		// 优先用索引里的上传时间，老文件用修改时间
+		t := info.ModTime()
+		if m, ok := index[item.Name()]; ok {
+			t = m.Time
+		}
+		files = append(files, entry{name: item.Name(), size: info.Size(), time: t})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].time.Before(files[j].time) })
+
+	maxAge := time.Duration(p.MaxAgeDays * float64(24*time.Hour))
+	maxTotal := int64(p.MaxTotalGB * (1 << 30))
+
+	var removed []fileMeta
+	for _, f := range files {
+		expired := maxAge > 0 && now.Sub(f.time) > maxAge
+		overQuota := maxTotal > 0 && total > maxTotal
+		if !expired && !overQuota {
+			continue
+		}
+		if err := os.Remove(filepath.Join(uploadDir, f.name)); err != nil {
+			fmt.Println("janitor remove error:", err)
+			continue
+		}
+		total -= f.size
+		removed = append(removed, fileMeta{Name: f.name, Room: index[f.name].Room})
+		delete(index, f.name)
+	}
+
+	if len(removed) > 0 {
+		if err := saveIndexLocked(); err != nil {
+			fmt.Println("save index error:", err)
+		}
+	}
+	return removed
+}
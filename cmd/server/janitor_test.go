@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func writeUpload(t *testing.T, name string, size int) {
+	t.Helper()
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(uploadDir, name), make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func names(files []fileMeta) []string {
+	var out []string
+	for _, m := range files {
+		out = append(out, m.Name)
+	}
+	return out
+}
+
+func TestRemoveFileChecksOwnerNotName(t *testing.T) {
+	setupUploads(t, UploadPolicy{})
+	alice := User{Name: "alice", Session: "s1"}
+	writeUpload(t, "a.txt", 10)
+	recordUpload(alice.Name, alice.owner(), defaultRoom, "a.txt", 10)
+
+	// 别人改成 alice 的名字也删不了
+	spoof := User{Name: "alice", Session: "s2"}
+	if _, err := removeFile("a.txt", spoof); err == nil {
+		t.Fatal("/rm spoofed by taking the uploader's name")
+	}
+	renamed := alice
+	renamed.Name = "someone-else"
+	if _, err := removeFile("a.txt", renamed); err != nil {
+		t.Fatalf("uploader could not delete after a rename: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, "a.txt")); !os.IsNotExist(err) {
+		t.Fatal("file still there")
+	}
+	if _, ok := index["a.txt"]; ok {
+		t.Fatal("index entry still there")
+	}
+}
+
+func TestRemoveFileLegacyAndAdmin(t *testing.T) {
+	setupUploads(t, UploadPolicy{})
+	writeUpload(t, "old.txt", 10)
+	writeUpload(t, "orphan.txt", 10)
+	index["old.txt"] = fileMeta{Name: "old.txt", Uploader: "carol", Size: 10}
+
+	if _, err := removeFile("old.txt", User{Name: "carol", Session: "s1"}); err == nil {
+		t.Fatal("guest named carol deleted the account's file")
+	}
+	if _, err := removeFile("old.txt", User{Name: "x", Account: "carol", Session: "s2"}); err != nil {
+		t.Fatalf("account could not delete its legacy file: %v", err)
+	}
+	if _, err := removeFile("orphan.txt", User{Name: "y", Session: "s3"}); err == nil {
+		t.Fatal("file without an uploader record deleted by a user")
+	}
+	if _, err := removeFile("orphan.txt", User{Name: "root", Session: "s4", Admin: true}); err != nil {
+		t.Fatalf("admin could not delete: %v", err)
+	}
+	for _, bad := range []string{"", ".index.json", "missing.txt"} {
+		if _, err := removeFile(bad, User{Admin: true}); err == nil {
+			t.Errorf("removeFile(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestExpireFiles(t *testing.T) {
+	setupUploads(t, UploadPolicy{})
+	now := time.Now()
+	writeUpload(t, "old.bin", 10)
+	writeUpload(t, "mid.bin", 600)
+	writeUpload(t, "new.bin", 600)
+	index["old.bin"] = fileMeta{Name: "old.bin", Size: 10, Time: now.Add(-72 * time.Hour)}
+	index["mid.bin"] = fileMeta{Name: "mid.bin", Size: 600, Time: now.Add(-2 * time.Hour)}
+	index["new.bin"] = fileMeta{Name: "new.bin", Size: 600, Time: now.Add(-time.Hour)}
+
+	removed := names(expireFiles(RetentionPolicy{MaxAgeDays: 2}, now))
+	if !slices.Equal(removed, []string{"old.bin"}) {
+		t.Fatalf("expired %v, want [old.bin]", removed)
+	}
+	// 超过总量从最老的开始删
+	removed = names(expireFiles(RetentionPolicy{MaxTotalGB: 1000.0 / (1 << 30)}, now))
+	if !slices.Equal(removed, []string{"mid.bin"}) {
+		t.Fatalf("over quota removed %v, want [mid.bin]", removed)
+	}
+	if _, ok := index["mid.bin"]; ok {
+		t.Fatal("index entry of a removed file kept")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"goLearning/pkg/utils"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailboxPolicy 离线信箱：注册用户不在线时收到的私信和 @ 存起来，下次登录时一起发给他
+type MailboxPolicy struct {
+	MaxMessages int     `json:"maxMessages"` // 每人最多存多少条，存满了丢最老的，0 表示默认 100
+	MaxAgeDays  float64 `json:"maxAgeDays"`  // 存多久，0 表示默认 7 天
+}
+
+const (
+	defaultMailboxSize   = 100
+	defaultMailboxMaxAge = 7 * 24 * time.Hour
+)
+
+func (p MailboxPolicy) maxMessages() int {
+	if p.MaxMessages <= 0 {
+		return defaultMailboxSize
+	}
+	return p.MaxMessages
+}
+
+func (p MailboxPolicy) maxAge() time.Duration {
+	if p.MaxAgeDays <= 0 {
+		return defaultMailboxMaxAge
+	}
+	return time.Duration(p.MaxAgeDays * float64(24*time.Hour))
+}
+
+const mailboxPath = "mailbox.json"
+
+const (
+	mailDM      = "dm"
+	mailMention = "mention"
+)
+
+// mail 信箱里的一条
+type mail struct {
+	Kind   string    `json:"kind"`
+	From   string    `json:"from"`
+	Text   string    `json:"text"`
+	Key    string    `json:"key,omitempty"`    // 加密私信：发的人的公钥
+	Cipher string    `json:"cipher,omitempty"` // 加密私信的密文，Text 是空的
+	Sig    string    `json:"sig,omitempty"`    // 加密私信的签名
+	Seq    int64     `json:"seq,omitempty"`    // 签名里的序号
+	Room   string    `json:"room,omitempty"`   // @ 的是哪个房间的消息
+	MsgID  string    `json:"msgId,omitempty"`  // @ 的是哪条消息
+	Time   time.Time `json:"time"`
+}
+
+type mailbox struct {
+	Mails   []mail `json:"mails"`
+	Dropped int    `json:"dropped"` // 存满以后丢掉的条数，登录时告诉他
+}
+
+var (
+	mailMu    sync.Mutex
+	mailboxes = map[string]*mailbox{}
+)
+
+func loadMailboxes() {
+	mailMu.Lock()
+	defer mailMu.Unlock()
+
+	data, err := readPrivateFile(mailboxPath)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &mailboxes); err != nil {
+		fmt.Println("load mailbox error:", err)
+	}
+}
+
+// saveMailboxesLocked 调用方必须持有 mailMu；私信内容只给自己读
+func saveMailboxesLocked() error {
+	data, err := json.MarshalIndent(mailboxes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(mailboxPath, data)
+}
+
+// expireLocked 删掉过期的，调用方必须持有 mailMu
+func (b *mailbox) expireLocked() {
+	cutoff := time.Now().Add(-config.Mailbox.maxAge())
+	keep := b.Mails[:0]
+	for _, m := range b.Mails {
+		if m.Time.After(cutoff) {
+			keep = append(keep, m)
+		}
+	}
+	b.Mails = keep
+}
+
+// enqueueMail 给不在线的 to 存一条，满了丢最老的
+func enqueueMail(to string, m mail) {
+	mailMu.Lock()
+	defer mailMu.Unlock()
+
+	b := mailboxes[to]
+	if b == nil {
+		b = &mailbox{}
+		mailboxes[to] = b
+	}
+	b.expireLocked()
+	b.Mails = append(b.Mails, m)
+	if over := len(b.Mails) - config.Mailbox.maxMessages(); over > 0 {
+		b.Mails = b.Mails[over:]
+		b.Dropped += over
+	}
+	if err := saveMailboxesLocked(); err != nil {
+		fmt.Println("save mailbox error:", err)
+	}
+}
+
+// takeMail 取出 to 的信箱（取完就清空）
+func takeMail(to string) mailbox {
+	mailMu.Lock()
+	defer mailMu.Unlock()
+
+	b := mailboxes[to]
+	if b == nil {
+		return mailbox{}
+	}
+	b.expireLocked()
+	delete(mailboxes, to)
+	if err := saveMailboxesLocked(); err != nil {
+		fmt.Println("save mailbox error:", err)
+	}
+	return *b
+}
+
+// deliverMail 登录以后把信箱里的东西发给他，前面先来一句总结
+func deliverMail(conn net.Conn, to string) {
+	b := takeMail(to)
+	if len(b.Mails) == 0 && b.Dropped == 0 {
+		return
+	}
+	dms := 0
+	for _, m := range b.Mails {
+		if m.Kind == mailDM {
+			dms++
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("[SYSTEM] %d messages while you were away (%d direct, %d mentions)",
+		len(b.Mails), dms, len(b.Mails)-dms))
+	if b.Dropped > 0 {
+		sb.WriteString(fmt.Sprintf(", %d older ones dropped because the mailbox was full", b.Dropped))
+	}
+	sb.WriteString("\n")
+	var sealed []utils.Direct // 加密的私信原样发 DM| 帧，客户端自己解
+	for _, m := range b.Mails {
+		at := m.Time.Local().Format("01-02 15:04")
+		if m.Cipher != "" {
+			sealed = append(sealed, utils.Direct{From: m.From, Key: m.Key, To: to, Cipher: m.Cipher, Sig: m.Sig, Seq: m.Seq, Time: m.Time})
+			continue
+		}
+		if m.Kind == mailDM {
+			sb.WriteString(fmt.Sprintf("[DM %s] %s: %s\n", at, m.From, m.Text))
+		} else {
+			sb.WriteString(fmt.Sprintf("[mention %s] %s in #%s (#%s): %s\n", at, m.From, m.Room, m.MsgID, m.Text))
+		}
+	}
+	if err := send(conn, []byte(sb.String())); err != nil {
+		fmt.Println("write error:", err)
+	}
+	for _, d := range sealed {
+		_ = send(conn, utils.DirectFrame(d))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"goLearning/pkg/utils"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupMailbox(t *testing.T, p MailboxPolicy) {
+	t.Chdir(t.TempDir())
+	old := config
+	config.Mailbox = p
+	mailboxes = map[string]*mailbox{}
+	accounts = map[string]account{}
+	t.Cleanup(func() { config = old })
+}
+
+func TestAccounts(t *testing.T) {
+	setupMailbox(t, MailboxPolicy{})
+	if err := register("alice", "short"); err == nil {
+		t.Error("short password accepted")
+	}
+	if err := register("alice", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := register("alice", "secret2"); err == nil {
+		t.Error("name registered twice")
+	}
+	if !checkLogin("alice", "secret1") || checkLogin("alice", "secret2") || checkLogin("bob", "secret1") {
+		t.Error("checkLogin wrong")
+	}
+
+	// 重启以后从文件读回来
+	accounts = map[string]account{}
+	loadAccounts()
+	if !isRegistered("alice") || !checkLogin("alice", "secret1") {
+		t.Error("account lost on reload")
+	}
+}
+
+func TestMailboxLimits(t *testing.T) {
+	setupMailbox(t, MailboxPolicy{MaxMessages: 2, MaxAgeDays: 1})
+	enqueueMail("bob", mail{Kind: mailDM, From: "old", Text: "stale", Time: time.Now().Add(-48 * time.Hour)})
+	for _, text := range []string{"one", "two", "three"} {
+		enqueueMail("bob", mail{Kind: mailDM, From: "alice", Text: text, Time: time.Now()})
+	}
+
+	// 重启以后还在
+	mailboxes = map[string]*mailbox{}
+	loadMailboxes()
+	b := takeMail("bob")
+	var texts []string
+	for _, m := range b.Mails {
+		texts = append(texts, m.Text)
+	}
+	// 过期的那条不算丢的，满了丢的是最老的
+	if strings.Join(texts, ",") != "two,three" || b.Dropped != 1 {
+		t.Errorf("mailbox = %v, dropped %d", texts, b.Dropped)
+	}
+	if again := takeMail("bob"); len(again.Mails) != 0 || again.Dropped != 0 {
+		t.Error("takeMail did not empty the mailbox")
+	}
+}
+
+func TestDeliverMail(t *testing.T) {
+	setupMailbox(t, MailboxPolicy{})
+	server, client := pipeOutbox(t)
+	frames := drain(t, client)
+	enqueueMail("bob", mail{Kind: mailDM, From: "alice", Text: "hi", Time: time.Now()})
+	enqueueMail("bob", mail{Kind: mailMention, From: "carol", Text: "@bob look", Room: "dev", MsgID: "7", Time: time.Now()})
+	enqueueMail("bob", mail{Kind: mailDM, From: "alice", Key: "k", Cipher: "c", Sig: "s", Seq: 9, Time: time.Now()})
+
+	deliverMail(server, "bob")
+	summary := <-frames
+	for _, want := range []string{"3 messages while you were away (2 direct, 1 mentions)", "alice: hi", "carol in #dev (#7): @bob look"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary missing %q:\n%s", want, summary)
+		}
+	}
+	// 加密的私信原样转成 DM| 帧，签名和序号都带着
+	var sealed string
+	for sealed == "" {
+		select {
+		case f := <-frames:
+			if strings.HasPrefix(f, "DM|") {
+				sealed = f
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no DM| frame")
+		}
+	}
+	d, ok := utils.ParseDirect(sealed)
+	if !ok || d.From != "alice" || d.To != "bob" || d.Cipher != "c" || d.Sig != "s" || d.Seq != 9 {
+		t.Errorf("sealed mail delivered as %q", sealed)
+	}
+}
+
+// 老版本留下的 0644 文件，存一次就收紧；写的时候先写临时文件再改名，不会留下半截
+func TestAccountsAndMailboxArePrivate(t *testing.T) {
+	setupMailbox(t, MailboxPolicy{})
+	os.WriteFile(accountsPath, []byte("{}"), 0644)
+	os.WriteFile(mailboxPath, []byte("{}"), 0644)
+
+	if err := register("alice", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	enqueueMail("alice", mail{Kind: mailDM, From: "bob", Text: "hi", Time: time.Now()})
+	for _, path := range []string{accountsPath, mailboxPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+			t.Errorf("%s mode = %v, want 0600", path, info.Mode().Perm())
+		}
+	}
+	if left, _ := filepath.Glob(".*.tmp"); len(left) != 0 {
+		t.Errorf("temp files left behind: %v", left)
+	}
+	accounts = map[string]account{}
+	loadAccounts()
+	if !checkLogin("alice", "secret1") {
+		t.Error("account lost on reload")
+	}
+}
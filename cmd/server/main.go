@@ -1,40 +1,154 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"goLearning/pkg/utils"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 type User struct {
-	Name string
-	IP   string
-	Port string
-	Conn net.Conn
+	Name    string
+	IP      string
+	Port    string
+	Conn    net.Conn
+	Admin   bool   // 用 /admin <token> 验证过
+	Account string // /login 或 /register 过的账号，没登录是空串
+	Status  string // 在线状态，推给客户端的侧边栏
+	Reason  string // /away、/busy 后面写的原因
+	Room    string
+	Guest   map[string]bool // 没登录时凭密码/邀请进过的房间，只在这个连接上算数
+	Key     string          // 端到端加密的身份公钥，客户端连上以后发 KEY|
+	Session string          // 连接的随机编号，没登录的人传的文件算在它名下
+
+	LastActive time.Time // 最后一次收到这个连接发的东西，判断闲置用
+	AutoAway   bool      // 闲置自动 away 的，一有动静就改回 online
+}
+
+// owner 配额、文件、消息算谁的：登录了是账号，没登录是这个连接。
+// 不能按名字算，/setName 谁都能改成别人（没注册）的名字
+func (u User) owner() string {
+	if u.Account != "" {
+		return "acct:" + u.Account
+	}
+	return u.connOwner()
+}
+
+// connOwner 这个连接本身，登录之前留下的东西算在它名下
+func (u User) connOwner() string {
+	return "conn:" + u.Session
+}
+
+// owns owner 是不是 u：登录之前在这个连接上留下的也算
+func (u User) owns(owner string) bool {
+	return owner != "" && (owner == u.owner() || owner == u.connOwner())
+}
+
+// legacyOwner 老记录里只有名字，当作同名账号的；没注册的名字谁也认领不了
+func legacyOwner(name string) string {
+	return "acct:" + name
 }
 
 var UserList []User
+var userMu sync.Mutex // UserList 会被多个连接和后台 janitor 同时访问
 var aesKey []byte
+var kdfParams utils.KDFParams // 口令模式的参数，没开的话是零值
 
 func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("usage: ./server <port> [config.json]")
+		fmt.Println("       ./server export [-o file] <room> [since] [md|jsonl|html]")
+		fmt.Println("       ./server verify <transcript.jsonl>")
+		return
+	}
+	if os.Args[1] == "export" { // 管理员在服务器上导出聊天记录，不启动服务
+		if err := runExport(os.Args[2:]); err != nil {
+			fmt.Println("export error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if os.Args[1] == "verify" { // 验导出的 jsonl 里的签名，哪台机器上都能跑
+		if err := runVerify(os.Args[2:]); err != nil {
+			fmt.Println("verify error:", err)
+			os.Exit(1)
+		}
+		return
+	}
 	selfPort := os.Args[1]
+
+	configPath := defaultConfigPath
+	if len(os.Args) > 2 {
+		configPath = os.Args[2]
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		panic(err)
+	}
+	config = cfg
+	loadIndex()
+	loadReads()
+	loadAccounts()
+	loadMailboxes()
+	loadRooms()
+	if store, err = openStore(messageLogPath); err != nil {
+		panic(err)
+	}
+
 	ln, err := net.Listen("tcp", ":"+selfPort) // 监听所有网卡的 xxxx 端口
 	if err != nil {
 		panic(err)
 	}
 	defer ln.Close()
 
-	// 生成 32 字节 AES key，并打印 base64 给 client 用
+	// 生成 32 字节 AES key，base64 写到 key 文件给 client 用；配了口令的话 key 从口令算出来
 	key, keyB64, err := utils.NewRandomKeyBase64(32)
 	if err != nil {
 		panic(err)
 	}
+	if config.Passphrase != "" {
+		if kdfParams, err = utils.NewKDFParams(); err != nil {
+			panic(err)
+		}
+		if key, err = kdfParams.DeriveKey(config.Passphrase); err != nil {
+			panic(err)
+		}
+		keyB64 = base64.StdEncoding.EncodeToString(key)
+	}
 	aesKey = key
+	// key 不打印到终端（会留在日志和 scrollback 里），写进只有自己能读的文件
+	if err := writeKeyFile(config.keyFile(), keyB64); err != nil {
+		panic(err)
+	}
+
+	// 没配置管理员口令就现生成一个，写进只有自己能读的文件
+	tokenNote := "admin token: the adminToken in " + configPath
+	if config.AdminToken == "" {
+		config.AdminToken, err = utils.RandomString(16)
+		if err != nil {
+			panic(err)
+		}
+		if err := writeKeyFile(adminTokenFile, config.AdminToken); err != nil {
+			panic(err)
+		}
+		tokenNote = "admin token written to " + adminTokenFile + ", use it with /admin <token>"
+	}
 
 	fmt.Println("listening on :" + selfPort)
-	fmt.Println("AES key (base64):", keyB64)
+	fmt.Printf("AES key (base64) written to %s, connect with: ./client -key-file %s <host> %s\n", config.keyFile(), config.keyFile(), selfPort)
+	if kdfParams.Alg != "" {
+		fmt.Println("passphrase mode:", kdfParams)
+	}
+	fmt.Println(tokenNote)
+
+	go janitor()
+	go idleWatcher()
 
 	for {
 		conn, err := ln.Accept() // 阻塞等待新连接
@@ -51,124 +165,740 @@ func main() {
 func handle(conn net.Conn) {
 	fmt.Println("new connection from", conn.RemoteAddr())
 
-	// 握手：client 必须先发一条加密的 "Infernity"
-	hello, err := utils.SecureReadFrame(conn, aesKey)
-	if err != nil || string(hello) != "Infernity" {
+	// 握手：client 必须先发一条加密的 "Infernity"，可以带上想用的压缩方式 "Infernity|zstd,gzip"；
+	// 拿口令连的先发明文的 "KDF" 要参数（见 utils/kdf.go）
+	first, err := utils.ReadFrame(conn)
+	if err == nil && string(first) == utils.KDFRequest {
+		if err = utils.WriteFrame(conn, utils.KDFFrame(kdfParams)); err == nil {
+			first, err = utils.ReadFrame(conn)
+		}
+	}
+	var hello []byte
+	if err == nil {
+		hello, err = utils.OpenFrame(aesKey, first)
+	}
+	helloStr := string(hello)
+	if err != nil || (helloStr != "Infernity" && !strings.HasPrefix(helloStr, "Infernity|")) {
 		_ = conn.Close()
 		return
 	}
+	defer utils.ClearCompression(conn)
+	if offered, ok := strings.CutPrefix(helloStr, "Infernity|"); ok {
+		// 回复选中的压缩方式（这一帧本身不压缩），之后的帧都按它来
+		mode := utils.NegotiateCompression(strings.Split(offered, ","), config.allowedCompression())
+		if err := utils.SecureWriteFrame(conn, aesKey, []byte("COMPRESS|"+mode)); err != nil {
+			_ = conn.Close()
+			return
+		}
+		_ = utils.SetCompression(conn, mode)
+	}
+
+	// 从这里开始所有的写都走发件队列（见 outbox.go）
+	openOutbox(conn)
 
 	// 获取名字，写入列表
 	name, _ := utils.RandomString(5)
 	addUser(name, conn)
 
+	// rename 改名，/setName 和 /login 都走这里；account 是登录的账号，改成别的名字就不算登录了
+	rename := func(nickname, account string) {
+		var before, after User
+		userMu.Lock()
+		for i := range UserList { //要用下标改，用range 里拿到的 user 是切片元素的拷贝（副本），你改的是副本的 Name，不会写回 UserList
+			if UserList[i].Conn == conn {
+				before = UserList[i]
+				UserList[i].Name = nickname
+				UserList[i].Account = account
+				delete(lastSeen, nickname) // 用了一个离开的人的名字，离开记录就不要了
+				// 告诉所有人（包括自己）改名了，侧边栏跟着更新
+				broadcastPresenceLocked(utils.PresenceEvent{Event: utils.PresenceUpdate, Old: name, Member: UserList[i].member()}, nil)
+				name = nickname //全局变量也要改
+				after = UserList[i]
+				break
+			}
+		}
+		userMu.Unlock()
+		renameReads(conn, before, after) // 换了名字，已读位置也换成这个名字的
+	}
+
+	// 这个连接上正在进行的传输
+	uploads := map[string]*incomingFile{}
+	var downloads cancelSet
+
 	defer func() {
 		// 这里做统一清理：无论怎么退出都删
-		UserList = removeUser(UserList, conn)
+		for _, in := range uploads { // 没传完的上传删掉半截文件
+			in.abort()
+		}
+		downloads.cancelAll()
+		forgetReads(userOf(conn))
+		if removeUser(conn) {
+			leave(name)
+		}
 		broadcast(fmt.Sprintf("%s 离开了房间。\n", name))
+		closeOutbox(conn)
 		_ = conn.Close()
 	}()
 
 	for {
 		massageByte, err := utils.SecureReadFrame(conn, aesKey)
-		massage := string(massageByte) //无语，和你说不下去，典型的强类型语言思维
 		if err != nil {
 			fmt.Println("read error:", err)
 			return
 		}
 
+		// 文件数据帧是二进制，先按 id 交给对应的上传，不转字符串
+		if id, chunk, ok := utils.ParseDataFrame(massageByte); ok {
+			in := uploads[id]
+			if in == nil {
+				continue // 已经取消/出错的上传，剩下的帧直接丢掉
+			}
+			done, err := in.write(chunk)
+			if err != nil {
+				fmt.Println("upload error:", err)
+				delete(uploads, id)
+				in.fail(err.Error())
+				continue
+			}
+			if done {
+				delete(uploads, id)
+				if err := in.finish(); err != nil {
+					fmt.Println("upload error:", err)
+				}
+			}
+			continue
+		}
+		// 文件数据不算，发消息、敲命令才算活跃
+		touch(conn)
+		massage := string(massageByte) //无语，和你说不下去，典型的强类型语言思维
+
+		// 正在输入：转给别人就完了，不存也不回
+		if massage == utils.TypingPing {
+			broadcastTyping(conn, name)
+			continue
+		}
+		// 已读位置往后走
+		if id, ok := utils.ParseReadAck(massage); ok {
+			u := userOf(conn)
+			advanceRead(u, u.Room, id)
+			continue
+		}
+		// 端到端加密：公钥、发送者密钥、加密的消息和私信，服务器看不到内容，只管转发
+		if key, ok := utils.ParseKeyFrame(massage); ok {
+			if err := setKey(conn, key); err != nil {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 公钥不对：%v\n", err)))
+			}
+			continue
+		}
+		if sk, ok := utils.ParseSenderKey(massage); ok {
+			relaySenderKey(conn, name, sk)
+			continue
+		}
+		if s, ok := utils.ParseSealed(massage); ok {
+			sendSealed(conn, name, s)
+			continue
+		}
+		if d, ok := utils.ParseDirect(massage); ok {
+			sendSealedDirect(conn, name, d)
+			continue
+		}
+
 		//命令判定
 		if strings.HasPrefix(massage, "/onlineUsers") { //获取在线用户列表
 			var sb strings.Builder
 
+			userMu.Lock()
 			total := len(UserList)
 			sb.WriteString(fmt.Sprintf("当前在线人数：%d\n", total))
 
 			for i, user := range UserList {
 				sb.WriteString(fmt.Sprintf("%d) %s  %s\n", i+1, user.Name, user.IP))
 			}
+			userMu.Unlock()
 
-			if err := utils.SecureWriteFrame(conn, aesKey, []byte(sb.String())); err != nil {
+			if err := send(conn, []byte(sb.String())); err != nil {
 				fmt.Println("write error:", err)
 			}
 		} else if strings.HasPrefix(massage, "/setName") { //设置用户名
 			nickname := strings.TrimSpace(strings.TrimPrefix(massage, "/setName "))
-			for i := range UserList { //要用下标改，用range 里拿到的 user 是切片元素的拷贝（副本），你改的是副本的 Name，不会写回 UserList
-				if UserList[i].Conn == conn {
-					UserList[i].Name = nickname
-					name = nickname //全局变量也要改
-					break
+			account := accountOf(conn)
+			if account != nickname {
+				if isRegistered(nickname) { // 注册过的名字要登录才能用
+					_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] %s 已经注册了，请用 /login <name> <password>\n", nickname)))
+					continue
 				}
+				account = ""
+			}
+			rename(nickname, account)
+			_ = send(conn, []byte("[SYSTEM] 修改成功！\n"))
+		} else if strings.HasPrefix(massage, "/register") { // 注册现在的名字：/register <password>
+			password := strings.TrimSpace(strings.TrimPrefix(massage, "/register"))
+			if err := register(name, password); err != nil {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 注册失败：%v\n", err)))
+				continue
+			}
+			setAccount(conn, name)
+			setAccountKey(name, userOf(conn).Key)
+			_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 注册成功！下次用 /login %s <password> 登录\n", name)))
+		} else if strings.HasPrefix(massage, "/login") { // 登录：/login <name> <password>，名字里可以有空格，密码不行
+			arg := strings.TrimSpace(strings.TrimPrefix(massage, "/login"))
+			i := strings.LastIndex(arg, " ")
+			if i < 0 {
+				_ = send(conn, []byte("[SYSTEM] 用法：/login <name> <password>\n"))
+				continue
 			}
-			_ = utils.SecureWriteFrame(conn, aesKey, []byte("[SYSTEM] 修改成功！\n"))
+			user, password := strings.TrimSpace(arg[:i]), arg[i+1:]
+			if !checkLogin(user, password) {
+				_ = send(conn, []byte("[SYSTEM] 用户名或密码错误\n"))
+				continue
+			}
+			rename(user, user)
+			setAccountKey(user, userOf(conn).Key)
+			_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 登录成功，欢迎回来 %s\n", user)))
+			deliverMail(conn, user) // 不在的时候收到的私信和 @
+		} else if strings.HasPrefix(massage, "/key") { // 查某人的身份公钥：/key <name>，回 KEYS| 帧
+			who := strings.TrimSpace(strings.TrimPrefix(massage, "/key"))
+			_ = send(conn, utils.KeyInfoFrame(utils.KeyInfo{Name: who, Key: keyOf(who)}))
+		} else if strings.HasPrefix(massage, "/msg") { // 私信：/msg <name> <text>
+			to, text, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(massage, "/msg")), " ")
+			text = strings.TrimSpace(text)
+			if to == "" || text == "" {
+				_ = send(conn, []byte("[SYSTEM] 用法：/msg <name> <text>\n"))
+				continue
+			}
+			sendDirect(conn, name, to, text)
 		} else if strings.HasPrefix(massage, "FILE|") { // 上传文件，这里是给服务器看的
-			if err := ReceiveFile(massage, conn, name); err != nil {
+			in, err := ReceiveFile(massage, conn, userOf(conn), uploads)
+			if err != nil {
 				fmt.Println("upload error:", err)
+				continue
+			}
+			if in.size == 0 { // 空文件没有数据帧，直接完成
+				if err := in.finish(); err != nil {
+					fmt.Println("upload error:", err)
+				}
+				continue
+			}
+			uploads[in.id] = in
+		} else if strings.HasPrefix(massage, "FILE_END|") { // 大小未知的上传发完了
+			id := strings.TrimPrefix(massage, "FILE_END|")
+			in := uploads[id]
+			if in == nil {
+				continue
+			}
+			delete(uploads, id)
+			if in.size >= 0 && in.got != in.size {
+				in.fail("short file")
+				fmt.Println("upload error: short file", in.name)
+				continue
+			}
+			if err := in.finish(); err != nil {
+				fmt.Println("upload error:", err)
+			}
+		} else if strings.HasPrefix(massage, "FILE_CANCEL|") { // 客户端取消上传或下载
+			id, _, _ := strings.Cut(strings.TrimPrefix(massage, "FILE_CANCEL|"), "|")
+			if in := uploads[id]; in != nil {
+				delete(uploads, id)
+				in.abort()
+				fmt.Println("upload cancelled:", in.name)
+			} else {
+				downloads.cancel(id) // 下载的 goroutine 自己会回 FILE_CANCEL
 			}
 		} else if strings.HasPrefix(massage, "/fileList") { // 获取上传文件列表
-			list, err := fileList()
+			list, err := fileList(userOf(conn))
 			if err != nil {
 				fmt.Println("fileList error:", err)
 			}
 			if len(list) == 0 {
-				_ = utils.SecureWriteFrame(conn, aesKey, []byte("文件列表为空！\n"))
+				_ = send(conn, []byte("文件列表为空！\n"))
 			}
-			if err := utils.SecureWriteFrame(conn, aesKey, []byte(list)); err != nil {
+			if err := send(conn, []byte(list)); err != nil {
 				fmt.Println("write error:", err)
 			}
+		} else if strings.HasPrefix(massage, "/files") { // 文件目录（给客户端补全用，机器读的）
+			_ = send(conn, utils.CatalogFrame(fileNames(userOf(conn))))
 		} else if strings.HasPrefix(massage, "/download") { //下载文件
 			filename := strings.TrimSpace(strings.TrimPrefix(massage, "/download ")) //去掉前缀，去掉特殊换行符
-			if err := fileUpload(filename, conn); err != nil {
-				fmt.Println("upload error:", err)
+			id, _ := utils.RandomString(6)
+			cancel := downloads.add(id)
+			// 放到单独的 goroutine 里发，这样发文件的时候还能收到 /cancel 和聊天消息
+			go func() {
+				defer downloads.done(id)
+				if err := fileUpload(filename, id, conn, cancel); errors.Is(err, errCancelled) {
+					fmt.Println("upload cancelled:", filename)
+				} else if err != nil {
+					fmt.Println("upload error:", err)
+					_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 下载失败：%v\n", err)))
+				} else {
+					fmt.Println("upload success")
+				}
+			}()
+		} else if strings.HasPrefix(massage, "/export") { // 导出聊天记录：/export <room> [since] [format]，按下载发回去
+			opt, err := parseExport(strings.TrimPrefix(massage, "/export"))
+			if err != nil {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] %v\n", err)))
+				continue
+			}
+			opt.audit = isAdmin(conn)
+			if u := userOf(conn); !canEnter(u, opt.room) { // 进不去的房间当作不存在
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] no such room: #%s\n", opt.room)))
+				continue
+			}
+			id, _ := utils.RandomString(6)
+			cancel := downloads.add(id)
+			go func() {
+				defer downloads.done(id)
+				if err := sendExport(opt, id, conn, cancel); err != nil && !errors.Is(err, errCancelled) {
+					fmt.Println("export error:", err)
+					_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 导出失败：%v\n", err)))
+				}
+			}()
+		} else if strings.HasPrefix(massage, "/rm") { // 删除服务器上的文件（上传者或管理员）
+			filename := strings.TrimSpace(strings.TrimPrefix(massage, "/rm"))
+			if room, err := removeFile(filename, userOf(conn)); err != nil {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 删除失败：%v\n", err)))
 			} else {
-				fmt.Println("upload success")
+				broadcastMembers(room, fmt.Sprintf("%s deleted a file: %s\n", name, filepath.Base(filename)))
+				broadcastCatalog()
 			}
+		} else if strings.HasPrefix(massage, "/admin") { // 管理员验证
+			token := strings.TrimSpace(strings.TrimPrefix(massage, "/admin"))
+			if token == "" || token != config.AdminToken {
+				_ = send(conn, []byte("[SYSTEM] 管理员口令错误！\n"))
+				continue
+			}
+			setAdmin(conn)
+			_ = send(conn, []byte("[SYSTEM] 你现在是管理员。\n"))
+		} else if strings.HasPrefix(massage, "/reply") { // 回复：/reply <id> <text>
+			parent, text, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(massage, "/reply")), " ")
+			text = strings.TrimSpace(text)
+			if parent == "" || text == "" {
+				_ = send(conn, []byte("[SYSTEM] 用法：/reply <id> <text>\n"))
+				continue
+			}
+			sendMessage(conn, utils.Message{Parent: parent, From: name, Text: text, Time: time.Now(), Mentions: utils.ParseMentions(text, mentionNames())})
+		} else if strings.HasPrefix(massage, "/react") { // 表情：/react <id> <emoji>，再点一次取消
+			id, emoji, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(massage, "/react")), " ")
+			emoji = strings.TrimSpace(emoji)
+			if id == "" || emoji == "" || len(emoji) > 32 || strings.ContainsAny(emoji, " \t|") {
+				_ = send(conn, []byte("[SYSTEM] 用法：/react <id> <emoji>\n"))
+				continue
+			}
+			room := userRoom(conn)
+			ev, err := store.react(id, userOf(conn), emoji, room)
+			if err != nil {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 表情失败：%v\n", err)))
+				continue
+			}
+			broadcastRoomFrame(room, utils.MessageEventFrame(ev))
+		} else if strings.HasPrefix(massage, "/edit") { // 编辑消息：/edit <id|last> <text>
+			id, text, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(massage, "/edit")), " ")
+			text = strings.TrimSpace(text)
+			if id == "" || text == "" {
+				_ = send(conn, []byte("[SYSTEM] 用法：/edit <id|last> <text>\n"))
+				continue
+			}
+			ev := utils.MessageEvent{Op: utils.MessageEdit, ID: id, Text: text, Mentions: utils.ParseMentions(text, mentionNames()), By: name}
+			changeMessage(conn, ev)
+		} else if strings.HasPrefix(massage, "/delete") { // 删除消息：/delete <id|last>
+			id := strings.TrimSpace(strings.TrimPrefix(massage, "/delete"))
+			if id == "" {
+				_ = send(conn, []byte("[SYSTEM] 用法：/delete <id|last>\n"))
+				continue
+			}
+			changeMessage(conn, utils.MessageEvent{Op: utils.MessageDelete, ID: id, By: name})
+		} else if strings.HasPrefix(massage, "/away") || strings.HasPrefix(massage, "/busy") { // 状态：/away [reason]、/busy [reason]
+			status, reason, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(massage, "/")), " ")
+			reason = strings.TrimSpace(reason)
+			setStatus(conn, status, reason, false)
+			if reason != "" {
+				status += "（" + reason + "）"
+			}
+			_ = send(conn, []byte("[SYSTEM] 状态："+status+"\n"))
+		} else if strings.HasPrefix(massage, "/back") { // 回来了
+			setStatus(conn, utils.StatusOnline, "", false)
+			_ = send(conn, []byte("[SYSTEM] 状态：online\n"))
+		} else if strings.HasPrefix(massage, "/search") { // 搜索聊天记录，结果是 SEARCH| 帧
+			raw := strings.TrimSpace(strings.TrimPrefix(massage, "/search"))
+			q, err := parseSearch(raw)
+			if err != nil {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] %v\n", err)))
+				continue
+			}
+			u := userOf(conn)
+			_ = send(conn, utils.SearchFrame(store.search(raw, q, func(room string) bool { return canEnter(u, room) })))
+		} else if strings.HasPrefix(massage, "/join") { // 进房间：/join <room> [password|token]
+			arg, secret, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(massage, "/join")), " ")
+			room, err := checkRoomName(arg)
+			if err != nil {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] %v\n", err)))
+				continue
+			}
+			if u := userOf(conn); !canEnter(u, room) {
+				if err := unlock(room, u, strings.TrimSpace(secret)); err != nil {
+					_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] %v\n", err)))
+					continue
+				}
+				grant(conn, room)
+			}
+			enterRoom(conn, room)
+		} else if strings.HasPrefix(massage, "/create") { // 建房间：/create <room>，登录了的是房主
+			room, err := checkRoomName(strings.TrimSpace(strings.TrimPrefix(massage, "/create")))
+			if err != nil {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] %v\n", err)))
+				continue
+			}
+			u := userOf(conn)
+			if !createRoom(room, u.Account) {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] #%s 这个名字已经被占了\n", room)))
+				continue
+			}
+			grant(conn, room)
+			enterRoom(conn, room) // 先进去再发，客户端收到 ROOM| 会清屏
+			note := fmt.Sprintf("[SYSTEM] 建好了 #%s，你是房主，可以用 /room password、/room invite-only 锁上\n", room)
+			if u.Account == "" {
+				note = fmt.Sprintf("[SYSTEM] 建好了 #%s；没登录建的房间没有房主，想上锁先 /register\n", room)
+			}
+			_ = send(conn, []byte(note))
+		} else if strings.HasPrefix(massage, "/rooms") { // 房间列表，上锁的只有成员看得到
+			_ = send(conn, []byte(roomList(userOf(conn), userRoom(conn), roomCounts())))
+		} else if strings.HasPrefix(massage, "/room") { // 房主改当前房间：/room password <pw|off>、/room invite-only <on|off>
+			setting, value, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(massage, "/room")), " ")
+			value = strings.TrimSpace(value)
+			u := userOf(conn)
+			var err error
+			switch {
+			case setting == "password" && value == "off":
+				err = setRoomPassword(u, u.Room, "")
+			case setting == "password" && value != "":
+				err = setRoomPassword(u, u.Room, value)
+			case setting == "invite-only" && (value == "on" || value == "off"):
+				err = setInviteOnly(u, u.Room, value == "on")
+			default:
+				err = fmt.Errorf("用法：/room password <password|off>、/room invite-only <on|off>")
+			}
+			if err != nil {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] %v\n", err)))
+				continue
+			}
+			_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] #%s 已更新，现在在里面的人不受影响\n", u.Room)))
+		} else if strings.HasPrefix(massage, "/invite-link") { // 谁拿到都能用一次的邀请
+			u := userOf(conn)
+			room := u.Room
+			token, inv, err := newInvite(u, room, "")
+			if err != nil {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 邀请失败：%v\n", err)))
+				continue
+			}
+			_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 邀请（只能用一次，%s 前有效）：/join %s %s\n",
+				inv.Expires.Local().Format("01-02 15:04"), room, token)))
+		} else if strings.HasPrefix(massage, "/invite") { // 邀请某个账号：/invite <account>，只有登录了这个账号的人能用
+			to := strings.TrimSpace(strings.TrimPrefix(massage, "/invite"))
+			if to == "" {
+				_ = send(conn, []byte("[SYSTEM] 用法：/invite <account>\n"))
+				continue
+			}
+			u := userOf(conn)
+			token, inv, err := newInvite(u, u.Room, to)
+			if err != nil {
+				_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 邀请失败：%v\n", err)))
+				continue
+			}
+			sendInvite(conn, name, to, token, inv)
+		} else if strings.HasPrefix(massage, "/metrics") { // 服务器统计
+			_ = send(conn, []byte(metrics()))
 		} else if strings.HasPrefix(massage, "/exit") { // 断开链接
-			UserList = removeUser(UserList, conn)
-			_ = utils.SecureWriteFrame(conn, aesKey, []byte("Bye!"))
+			forgetReads(userOf(conn))
+			if removeUser(conn) {
+				leave(name)
+			}
+			_ = send(conn, []byte("Bye!"))
+			closeOutbox(conn) // 先把 Bye! 发出去再关
 			conn.Close()
 		} else {
-			broadcast(fmt.Sprintf("%s say: %s", name, massage)) //massage自带换行，不用加
+			// 聊天消息包成 MSG| 信封，顺便解析 @ 了谁；先存起来拿到 id 再广播
+			text := strings.TrimRight(massage, "\n") //massage自带换行，信封里不要
+			sendMessage(conn, utils.Message{From: name, Text: text, Time: time.Now(), Mentions: utils.ParseMentions(text, mentionNames())})
 		}
 	}
 }
 
+// metrics 服务器统计信息
+func metrics() string {
+	var sb strings.Builder
+	userMu.Lock()
+	sb.WriteString(fmt.Sprintf("在线人数：%d\n", len(UserList)))
+	userMu.Unlock()
+
+	raw, wire := utils.CompressionStats()
+	sb.WriteString(fmt.Sprintf("压缩前字节数：%d\n", raw))
+	sb.WriteString(fmt.Sprintf("实际传输字节数：%d\n", wire))
+	if raw > 0 {
+		sb.WriteString(fmt.Sprintf("压缩节省：%d bytes (%.1f%%)\n", raw-wire, float64(raw-wire)*100/float64(raw)))
+	}
+	return sb.String()
+}
+
 // 添加用户
 func addUser(name string, conn net.Conn) {
 	parts := strings.Split(conn.RemoteAddr().String(), ":") //冒号分隔字符串
-	user := User{Name: name, IP: parts[0], Port: parts[1], Conn: conn}
+	session, _ := utils.RandomString(16)
+	user := User{Name: name, IP: parts[0], Port: parts[1], Conn: conn, Status: utils.StatusOnline, Room: defaultRoom, Session: session, LastActive: time.Now()}
+	userMu.Lock()
 	UserList = append(UserList, user)
+	// 新人拿完整列表、已读位置和之前的聊天记录，其他人只收一条 join
+	// 都在锁里放进发件队列，新消息的广播不会插到聊天记录前面
+	sendRosterLocked(conn, name)
+	sendReads(conn, user.Room)
+	if n := config.historySize(); n > 0 {
+		_ = send(conn, utils.HistoryFrame(store.recent(n, user.Room)))
+	}
+	broadcastPresenceLocked(utils.PresenceEvent{Event: utils.PresenceJoin, Member: user.member()}, conn)
+	userMu.Unlock()
 
 	broadcast(fmt.Sprintf("%s 加入了房间。\n", name))
 }
 
-// 删除用户
-func removeUser(users []User, c net.Conn) []User {
-	for i := range users {
-		if users[i].Conn == c {
-			return append(users[:i], users[i+1:]...)
+// 删除用户，返回是否真的删了（/exit 之后连接关闭还会再调一次）
+func removeUser(c net.Conn) bool {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for i := range UserList {
+		if UserList[i].Conn == c {
+			UserList = append(UserList[:i], UserList[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func isAdmin(c net.Conn) bool {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if user.Conn == c {
+			return user.Admin
+		}
+	}
+	return false
+}
+
+// userOf conn 对应的用户（拷一份）
+func userOf(c net.Conn) User {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if user.Conn == c {
+			return user
+		}
+	}
+	return User{Room: defaultRoom}
+}
+
+func accountOf(c net.Conn) string {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if user.Conn == c {
+			return user.Account
+		}
+	}
+	return ""
+}
+
+func setAccount(c net.Conn, account string) {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for i := range UserList {
+		if UserList[i].Conn == c {
+			UserList[i].Account = account
+			return
+		}
+	}
+}
+
+func setAdmin(c net.Conn) {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for i := range UserList {
+		if UserList[i].Conn == c {
+			UserList[i].Admin = true
+			return
 		}
 	}
-	return users
 }
 
 // 广播发送消息
 func broadcast(massage string) {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if err := send(user.Conn, []byte("[SYSTEM] "+massage)); err != nil {
+			fmt.Println("write error:", err)
+		}
+	}
+}
+
+// broadcastFrame 原样发给所有人（MSG|、FILES| 这些结构化的帧）
+func broadcastFrame(frame []byte) {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if err := send(user.Conn, frame); err != nil {
+			fmt.Println("write error:", err)
+		}
+	}
+}
+
+// broadcastRoomFrame 只发给 room 里的人
+func broadcastRoomFrame(room string, frame []byte) {
+	roomcast(room, frame, send)
+}
+
+// broadcastRoomText 发一条聊天消息给 room 里的人，帧里只有这一个人的消息，可以压缩
+func broadcastRoomText(room string, frame []byte) {
+	roomcast(room, frame, sendText)
+}
+
+func roomcast(room string, frame []byte, write func(net.Conn, []byte) error) {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if user.Room != room {
+			continue
+		}
+		if err := write(user.Conn, frame); err != nil {
+			fmt.Println("write error:", err)
+		}
+	}
+}
+
+// sendMessage 存下来拿到 id 再广播给房间里的人，存不了就告诉发送的人
+func sendMessage(conn net.Conn, msg utils.Message) {
+	u := userOf(conn)
+	msg.Room = u.Room
+	msg, err := store.add(msg, u.owner())
+	if err != nil {
+		fmt.Println("store error:", err)
+		_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 发送失败：%v\n", err)))
+		return
+	}
+	broadcastRoomText(msg.Room, utils.MessageFrame(msg))
+
+	// @ 了不在线的注册用户，存进他的信箱；加密的消息服务器看不到内容，只说一声去哪看
+	text := msg.Text
+	if msg.Encrypted() {
+		text = "[encrypted message]"
+	}
+	for _, to := range msg.Mentions {
+		if to != utils.MentionAll && isRegistered(to) && !isOnline(to) {
+			enqueueMail(to, mail{Kind: mailMention, From: msg.From, Text: text, Room: msg.Room, MsgID: msg.ID, Time: msg.Time})
+		}
+	}
+}
+
+// changeMessage 编辑/删除当前房间的消息，成功就广播给房间里的人，失败只告诉操作的人
+func changeMessage(conn net.Conn, ev utils.MessageEvent) {
+	u := userOf(conn)
+	room := u.Room
+	ev, err := store.change(ev, u, room)
+	if err != nil {
+		_ = send(conn, []byte(fmt.Sprintf("[SYSTEM] 修改失败：%v\n", err)))
+		return
+	}
+	broadcastRoomFrame(room, utils.MessageEventFrame(ev))
+}
+
+func isOnline(name string) bool {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if user.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// mentionNames 能被 @ 的名字：在线的人加上注册过的（不在线也能收到）
+func mentionNames() []string {
+	names := onlineNames()
+	seen := map[string]bool{}
+	for _, n := range names {
+		seen[n] = true
+	}
+	for _, n := range registeredNames() {
+		if !seen[n] {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+func onlineNames() []string {
+	userMu.Lock()
+	defer userMu.Unlock()
+	names := make([]string, 0, len(UserList))
 	for _, user := range UserList {
-		if err := utils.SecureWriteFrame(user.Conn, aesKey, []byte("[SYSTEM] "+massage)); err != nil {
+		names = append(names, user.Name)
+	}
+	return names
+}
+
+// broadcastMembers 系统消息发给进得去 room 的人（不光是现在在里面的），私密房间的文件名不外传
+func broadcastMembers(room, massage string) {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if !canEnter(user, room) {
+			continue
+		}
+		if err := send(user.Conn, []byte("[SYSTEM] "+massage)); err != nil {
 			fmt.Println("write error:", err)
 		}
 	}
 }
 
-// 单独发送消息(私聊)
-func unicast(name string, massage string) {
+// broadcastCatalog 文件有增删时把新的目录推给所有人，每个人只看得到自己进得去的房间里的文件
+func broadcastCatalog() {
+	files := fileRooms()
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if err := send(user.Conn, utils.CatalogFrame(visibleFiles(user, files))); err != nil {
+			fmt.Println("write error:", err)
+		}
+	}
+}
+
+// 单独发送消息(私聊)，同一个名字开了几个连接都发；返回有没有人收到
+func unicast(name string, massage string) bool {
+	userMu.Lock()
+	defer userMu.Unlock()
+	sent := false
 	for _, user := range UserList {
 		if user.Name == name {
-			if err := utils.SecureWriteFrame(user.Conn, aesKey, []byte(massage)); err != nil {
+			if err := send(user.Conn, []byte(massage)); err != nil {
 				fmt.Println("write error:", err)
+				continue
 			}
-			break
+			sent = true
 		}
 	}
+	return sent
+}
+
+// sendDirect 私信：在线就直接发；不在线的注册用户存进信箱，登录时收到；都不是就告诉发的人
+func sendDirect(conn net.Conn, from, to, text string) {
+	var reply string
+	switch {
+	case unicast(to, fmt.Sprintf("[DM] %s: %s\n", from, text)):
+		reply = fmt.Sprintf("[DM] -> %s: %s\n", to, text)
+	case isRegistered(to):
+		enqueueMail(to, mail{Kind: mailDM, From: from, Text: text, Time: time.Now()})
+		reply = fmt.Sprintf("[SYSTEM] %s 不在线，登录后会收到\n", to)
+	default:
+		reply = fmt.Sprintf("[SYSTEM] %s 不在线，也没有注册，消息没有发出去\n", to)
+	}
+	_ = send(conn, []byte(reply))
 }
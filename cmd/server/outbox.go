@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"goLearning/pkg/utils"
+	"net"
+	"sync"
+	"time"
+)
+
+// ---- 发件队列：每个连接一个 goroutine 往 socket 里写，别的地方只往队列里放。
+// 广播的时候拿着 userMu，要是直接写，一个网慢（或者故意不读）的客户端就能把所有人卡住。
+// 队列满了说明对方一直不读，直接断开它。
+// 发文件的数据帧单独一个小队列，满了就等，不会因为下载大文件被当成慢客户端断开 ----
+
+const (
+	outboxSize     = 1024            // 普通帧最多攒多少，超过就断开
+	outboxDataSize = 4               // 文件数据帧最多攒多少，超过就等
+	outboxFlush    = 5 * time.Second // 连接关闭前最多等这么久把剩下的发完
+)
+
+var errSlowClient = errors.New("client is not reading, disconnected")
+var errConnClosed = errors.New("connection closed")
+
+type outFrame struct {
+	b            []byte
+	compressible bool // 文件数据帧：内容值不值得压
+	text         bool // 只有一个人自己的一条消息，可以压（见 utils.SecureWriteText）
+}
+
+type outbox struct {
+	conn net.Conn
+	ctrl chan outFrame
+	data chan outFrame
+	quit chan struct{} // 关闭以后不再收新的
+	done chan struct{} // writer 退出了
+	once sync.Once
+}
+
+var (
+	outboxMu sync.Mutex
+	outboxes = map[net.Conn]*outbox{}
+)
+
+// openOutbox 握手完成以后调用，之后这个连接的所有写都走 send/sendData
+func openOutbox(conn net.Conn) {
+	o := &outbox{
+		conn: conn,
+		ctrl: make(chan outFrame, outboxSize),
+		data: make(chan outFrame, outboxDataSize),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	outboxMu.Lock()
+	outboxes[conn] = o
+	outboxMu.Unlock()
+	go o.run()
+}
+
+// closeOutbox 把排着的普通帧发完（最多等 outboxFlush），调用方接着关连接；重复调用没关系
+func closeOutbox(conn net.Conn) {
+	outboxMu.Lock()
+	o := outboxes[conn]
+	delete(outboxes, conn)
+	outboxMu.Unlock()
+	if o == nil {
+		return
+	}
+	o.once.Do(func() { close(o.quit) })
+	select {
+	case <-o.done:
+	case <-time.After(outboxFlush):
+	}
+}
+
+func outboxOf(conn net.Conn) *outbox {
+	outboxMu.Lock()
+	defer outboxMu.Unlock()
+	return outboxes[conn]
+}
+
+// send 把一帧放进 conn 的队列，不会阻塞，拿着锁也能调
+func send(conn net.Conn, frame []byte) error {
+	return enqueue(conn, outFrame{b: frame})
+}
+
+// sendText 和 send 一样，不过帧会压缩，只给单条聊天消息用
+func sendText(conn net.Conn, frame []byte) error {
+	return enqueue(conn, outFrame{b: frame, text: true})
+}
+
+func enqueue(conn net.Conn, f outFrame) error {
+	o := outboxOf(conn)
+	if o == nil { // 还没握手完或者已经关了
+		return errConnClosed
+	}
+	select {
+	case <-o.quit:
+		return errConnClosed
+	default:
+	}
+	select {
+	case o.ctrl <- f:
+		return nil
+	default:
+		fmt.Println("slow client:", conn.RemoteAddr())
+		o.kill()
+		return errSlowClient
+	}
+}
+
+// sendData 发文件用的，队列满了就等；cancel 关闭或者连接断了就返回
+func sendData(conn net.Conn, frame []byte, compressible bool, cancel <-chan struct{}) error {
+	o := outboxOf(conn)
+	if o == nil {
+		return errConnClosed
+	}
+	select {
+	case o.data <- outFrame{b: frame, compressible: compressible}:
+		return nil
+	case <-o.quit:
+		return errConnClosed
+	case <-cancel:
+		return errCancelled
+	}
+}
+
+// kill 出错或者太慢：不再发了，直接关连接，读的那边会收到错误走正常的清理
+func (o *outbox) kill() {
+	o.once.Do(func() { close(o.quit) })
+	_ = o.conn.Close()
+}
+
+func (o *outbox) run() {
+	defer close(o.done)
+	for {
+		var f outFrame
+		select { // 普通帧优先，聊天不用排在一大堆文件数据后面
+		case f = <-o.ctrl:
+		default:
+			select {
+			case f = <-o.ctrl:
+			case f = <-o.data:
+			case <-o.quit:
+				o.flush()
+				return
+			}
+		}
+		if err := f.write(o.conn); err != nil {
+			fmt.Println("write error:", err)
+			o.kill()
+			return
+		}
+	}
+}
+
+// flush 关闭前把剩下的普通帧（比如 "Bye!"）发出去，文件数据就不要了
+func (o *outbox) flush() {
+	for {
+		select {
+		case f := <-o.ctrl:
+			if err := f.write(o.conn); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (f outFrame) write(conn net.Conn) error {
+	if f.text {
+		return utils.SecureWriteText(conn, aesKey, f.b)
+	}
+	return utils.SecureWriteData(conn, aesKey, f.b, f.compressible)
+}
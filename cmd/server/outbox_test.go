@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"goLearning/pkg/utils"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pipeOutbox(t *testing.T) (server, client net.Conn) {
+	t.Helper()
+	if aesKey == nil {
+		aesKey = make([]byte, 32)
+	}
+	server, client = net.Pipe()
+	openOutbox(server)
+	t.Cleanup(func() {
+		client.Close()
+		closeOutbox(server)
+		server.Close()
+	})
+	return server, client
+}
+
+func TestSendKeepsOrder(t *testing.T) {
+	server, client := pipeOutbox(t)
+	for _, s := range []string{"one", "two", "three"} {
+		if err := send(server, []byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		got, err := utils.SecureReadFrame(client, aesKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+// 对方一直不读：send 不能卡住，队列满了就断开
+func TestSendDropsSlowClient(t *testing.T) {
+	server, _ := pipeOutbox(t)
+	start := time.Now()
+	var err error
+	for i := 0; i < outboxSize+2 && err == nil; i++ {
+		err = send(server, []byte("hello"))
+	}
+	if !errors.Is(err, errSlowClient) {
+		t.Fatalf("send to a stuck client returned %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("send blocked")
+	}
+	if err := send(server, []byte("again")); !errors.Is(err, errConnClosed) {
+		t.Fatalf("send after disconnect returned %v", err)
+	}
+}
+
+func TestSendDataWaitsAndCancels(t *testing.T) {
+	server, _ := pipeOutbox(t)
+	cancel := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for {
+			if err := sendData(server, []byte("chunk"), false, cancel); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("sendData returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(cancel)
+	if err := <-done; !errors.Is(err, errCancelled) {
+		t.Fatalf("sendData returned %v, want errCancelled", err)
+	}
+	// 等着发文件的时候普通帧还能进队列
+	if err := send(server, []byte("chat")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseOutboxFlushes(t *testing.T) {
+	server, client := pipeOutbox(t)
+	_ = send(server, []byte("Bye!"))
+	got := make(chan string)
+	go func() {
+		b, _ := utils.SecureReadFrame(client, aesKey)
+		got <- string(b)
+	}()
+	closeOutbox(server)
+	if s := <-got; s != "Bye!" {
+		t.Fatalf("got %q before close", s)
+	}
+	if err := send(server, []byte("late")); !errors.Is(err, errConnClosed) {
+		t.Fatalf("send after close returned %v", err)
+	}
+}
+
+// 单条聊天消息走 sendText，开了压缩的连接上会压
+func TestSendTextCompresses(t *testing.T) {
+	server, client := pipeOutbox(t)
+	utils.SetCompression(server, utils.CompressZstd)
+	utils.SetCompression(client, utils.CompressZstd)
+	t.Cleanup(func() { utils.ClearCompression(server); utils.ClearCompression(client) })
+
+	frame := utils.MessageFrame(utils.Message{From: "alice", Text: strings.Repeat("go: downloading module ", 50)})
+	raw0, wire0 := utils.CompressionStats()
+	if err := sendText(server, frame); err != nil {
+		t.Fatal(err)
+	}
+	got, err := utils.SecureReadFrame(client, aesKey)
+	if err != nil || string(got) != string(frame) {
+		t.Fatalf("got %.30q, %v", got, err)
+	}
+	raw, wire := utils.CompressionStats()
+	if raw-raw0 <= wire-wire0 {
+		t.Errorf("no savings: raw %d, wire %d", raw-raw0, wire-wire0)
+	}
+}
+
+// 一个人不读不能把别人卡住：广播拿着 userMu 只往队列里放，读的人照样收得到
+func TestBroadcastNotStalledBySlowClient(t *testing.T) {
+	stuck, _ := pipeOutbox(t) // net.Pipe 没人读，直接写就会一直卡着
+	reader, client := pipeOutbox(t)
+	userMu.Lock()
+	oldUsers := UserList
+	UserList = []User{{Name: "stuck", Conn: stuck}, {Name: "reader", Conn: reader}}
+	userMu.Unlock()
+	t.Cleanup(func() { userMu.Lock(); UserList = oldUsers; userMu.Unlock() })
+
+	const n = 10
+	finished := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			broadcast("hello\n")
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast stalled behind a client that is not reading")
+	}
+	for i := 0; i < n; i++ {
+		if got, err := utils.SecureReadFrame(client, aesKey); err != nil || string(got) != "[SYSTEM] hello\n" {
+			t.Fatalf("frame %d = %q, %v", i, got, err)
+		}
+	}
+}
+
+// 对方断了：写出错就关掉队列，在等的 sendData 也跟着返回
+func TestWriteErrorClosesOutbox(t *testing.T) {
+	server, client := pipeOutbox(t)
+	waiting := make(chan error)
+	go func() {
+		for {
+			if err := sendData(server, []byte("chunk"), false, nil); err != nil {
+				waiting <- err
+				return
+			}
+		}
+	}()
+	client.Close()
+	select {
+	case err := <-waiting:
+		if !errors.Is(err, errConnClosed) {
+			t.Fatalf("sendData returned %v, want errConnClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendData still waiting after the peer went away")
+	}
+	if err := send(server, []byte("late")); !errors.Is(err, errConnClosed) {
+		t.Errorf("send after write error returned %v", err)
+	}
+}
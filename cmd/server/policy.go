@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadPolicy 上传策略，所有大小单位都是字节，0 表示不限制
+type UploadPolicy struct {
+	MaxFileSize int64 `json:"maxFileSize"` // 单个文件上限
+	UserQuota   int64 `json:"userQuota"`   // 每个用户在 uploads/ 里的累计上限
+	TotalQuota  int64 `json:"totalQuota"`  // uploads/ 的总上限
+
+	// 类型白名单/黑名单：扩展名写 "png" 或 ".png" 都行，MIME 支持 "image/*"
+	// 黑名单优先；白名单非空时，只有命中白名单的才放行
+	AllowExt  []string `json:"allowExt"`
+	DenyExt   []string `json:"denyExt"`
+	AllowMIME []string `json:"allowMime"`
+	DenyMIME  []string `json:"denyMime"`
+}
+
+const uploadDir = "uploads"
+
+// 文件索引放在 uploads/ 里，以点开头，fileList 不会列出来
+var indexPath = filepath.Join(uploadDir, ".index.json")
+
+// fileMeta 记录每个上传文件是谁传的，用来算每个用户的配额
+type fileMeta struct {
+	Name     string    `json:"name"`
+	Uploader string    `json:"uploader"`        // 上传时的名字，显示用
+	Owner    string    `json:"owner,omitempty"` // 账号或者连接（见 User.owner），配额和权限按它算
+	Room     string    `json:"room,omitempty"`  // 在哪个房间传的，导出聊天记录按它筛，老索引没有的算大厅
+	Size     int64     `json:"size"`
+	Time     time.Time `json:"time"`
+}
+
+// room 文件在哪个房间，老索引没有的算大厅
+func (m fileMeta) room() string {
+	if m.Room == "" {
+		return defaultRoom
+	}
+	return m.Room
+}
+
+// owner 老索引没有 Owner，按名字当账号
+func (m fileMeta) owner() string {
+	if m.Owner == "" {
+		return legacyOwner(m.Uploader)
+	}
+	return m.Owner
+}
+
+var (
+	indexMu sync.Mutex
+	index   = map[string]fileMeta{}
+
+	// 正在上传、还没落盘的字节数也要算进配额，否则并发上传能绕过限制
+	reservedUser  = map[string]int64{} // owner -> 字节数
+	reservedTotal int64
+)
+
+// loadIndex 启动时读取文件索引，读不到就当空的
+func loadIndex() {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return
+	}
+	var metas []fileMeta
+	if err := json.Unmarshal(data, &metas); err != nil {
+		fmt.Println("load index error:", err)
+		return
+	}
+	for _, m := range metas {
+		index[m.Name] = m
+	}
+}
+
+// saveIndexLocked 调用方必须持有 indexMu
+func saveIndexLocked() error {
+	metas := make([]fileMeta, 0, len(index))
+	for _, m := range index {
+		metas = append(metas, m)
+	}
+	data, err := json.MarshalIndent(metas, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(uploadDir, 0755)
+	return os.WriteFile(indexPath, data, 0644)
+}
+
+// fileRooms uploads/ 下可以下载的文件 -> 在哪个房间传的（不在索引里的老文件算大厅）
+func fileRooms() map[string]string {
+	items, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return nil
+	}
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	files := map[string]string{}
+	for _, item := range items {
+		if item.IsDir() || strings.HasPrefix(item.Name(), ".") {
+			continue
+		}
+		files[item.Name()] = index[item.Name()].room()
+	}
+	return files
+}
+
+// canSeeFile 文件跟着房间走：进不去这个房间的人看不到、下不了，连名字都不给
+func canSeeFile(u User, name string) bool {
+	indexMu.Lock()
+	room := index[name].room()
+	indexMu.Unlock()
+	return canEnter(u, room)
+}
+
+// uploadsSize 统计 uploads/ 下所有可见文件的总大小（不在索引里的老文件也算）
+func uploadsSize() int64 {
+	items, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, item := range items {
+		if item.IsDir() || strings.HasPrefix(item.Name(), ".") {
+			continue
+		}
+		if info, err := item.Info(); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// checkType 按扩展名和 MIME 检查文件类型
+func (p UploadPolicy) checkType(filename string) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	mimeType, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+
+	if matchExt(p.DenyExt, ext) || matchMIME(p.DenyMIME, mimeType) {
+		return fmt.Errorf("file type not allowed: %s", filename)
+	}
+	if len(p.AllowExt) == 0 && len(p.AllowMIME) == 0 {
+		return nil
+	}
+	if matchExt(p.AllowExt, ext) || matchMIME(p.AllowMIME, mimeType) {
+		return nil
+	}
+	return fmt.Errorf("file type not allowed: %s", filename)
+}
+
+func matchExt(list []string, ext string) bool {
+	if ext == "" {
+		return false
+	}
+	for _, e := range list {
+		e = strings.ToLower(e)
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMIME(list []string, mimeType string) bool {
+	if mimeType == "" {
+		return false
+	}
+	for _, pattern := range list {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mimeType, prefix+"/") {
+				return true
+			}
+		} else if pattern == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// reservation 一次上传占住的配额
+type reservation struct {
+	owner string
+	size  int64
+
+	// 开始上传时的用量快照（不含正在上传的），避免每收一块数据都扫一遍目录
+	baseUser  int64
+	baseTotal int64
+}
+
+// reserveUpload 根据 FILE| 头里的信息做检查，通过就先把配额占住
+// size 为 -1 表示大小未知（边打包边上传），这时只检查类型，配额随数据到达用 grow 一点点占
+// 返回的 reservation 必须 release（无论上传成功与否）
+// 配额按 u.owner() 算：改名字不会换一份新配额
+func reserveUpload(u User, filename string, size int64) (*reservation, error) {
+	if err := config.Upload.checkType(filename); err != nil {
+		return nil, err
+	}
+
+	indexMu.Lock()
+	r := &reservation{owner: u.owner(), baseTotal: uploadsSize()}
+	for _, m := range index {
+		if u.owns(m.owner()) {
+			r.baseUser += m.Size
+		}
+	}
+	// 同名文件会被覆盖，它原来占的空间要先减掉；别人的文件不能覆盖，不然等于绕过 /rm
+	if info, err := os.Stat(filepath.Join(uploadDir, filename)); err == nil && !info.IsDir() {
+		if m, ok := index[filename]; !u.Admin && (!ok || !u.owns(m.owner())) {
+			indexMu.Unlock()
+			return nil, fmt.Errorf("%s already exists and was uploaded by someone else", filename)
+		}
+		r.baseTotal -= info.Size()
+		if m, ok := index[filename]; ok && u.owns(m.owner()) {
+			r.baseUser -= info.Size()
+		}
+	}
+	indexMu.Unlock()
+
+	if size > 0 {
+		if err := r.grow(size); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// grow 多占 n 字节，超过单文件上限或配额就返回错误
+func (r *reservation) grow(n int64) error {
+	p := config.Upload
+
+	if p.MaxFileSize > 0 && r.size+n > p.MaxFileSize {
+		return fmt.Errorf("file too large: %d bytes (max %d)", r.size+n, p.MaxFileSize)
+	}
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	if p.UserQuota > 0 {
+		used := r.baseUser + reservedUser[r.owner]
+		if used+n > p.UserQuota {
+			return fmt.Errorf("user quota exceeded: %d/%d bytes used", used, p.UserQuota)
+		}
+	}
+	if p.TotalQuota > 0 {
+		if r.baseTotal+reservedTotal+n > p.TotalQuota {
+			return fmt.Errorf("server storage quota exceeded")
+		}
+	}
+
+	r.size += n
+	reservedUser[r.owner] += n
+	reservedTotal += n
+	return nil
+}
+
+func (r *reservation) release() {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	reservedUser[r.owner] -= r.size
+	if reservedUser[r.owner] <= 0 {
+		delete(reservedUser, r.owner)
+	}
+	reservedTotal -= r.size
+	r.size = 0
+}
+
+// recordUpload 上传成功后写索引
+func recordUpload(user, owner, room, filename string, size int64) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	index[filename] = fileMeta{Name: filename, Uploader: user, Owner: owner, Room: room, Size: size, Time: time.Now()}
+	if err := saveIndexLocked(); err != nil {
+		fmt.Println("save index error:", err)
+	}
+}
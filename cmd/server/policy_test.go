@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupUploads 在临时目录里跑，配额和索引都从空的开始
+func setupUploads(t *testing.T, p UploadPolicy) {
+	t.Chdir(t.TempDir())
+	old := config
+	config.Upload = p
+	index = map[string]fileMeta{}
+	reservedUser = map[string]int64{}
+	reservedTotal = 0
+	t.Cleanup(func() { config = old })
+}
+
+func TestCheckType(t *testing.T) {
+	p := UploadPolicy{
+		AllowExt:  []string{"png", ".txt"},
+		AllowMIME: []string{"application/pdf"},
+		DenyExt:   []string{"exe"},
+		DenyMIME:  []string{"image/*"},
+	}
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"notes.txt", true},
+		{"NOTES.TXT", true},
+		{"paper.pdf", true},
+		{"photo.png", false}, // 黑名单优先
+		{"setup.exe", false},
+		{"archive.zip", false},
+		{"README", false},
+	}
+	for _, tt := range tests {
+		if err := p.checkType(tt.name); (err == nil) != tt.ok {
+			t.Errorf("checkType(%q) = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+	if err := (UploadPolicy{}).checkType("anything.bin"); err != nil {
+		t.Errorf("empty policy rejected a file: %v", err)
+	}
+}
+
+func TestUserQuotaFollowsOwnerNotName(t *testing.T) {
+	setupUploads(t, UploadPolicy{UserQuota: 100})
+	alice := User{Name: "alice", Session: "s1"}
+
+	r, err := reserveUpload(alice, "a.txt", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordUpload(alice.Name, alice.owner(), defaultRoom, "a.txt", 80)
+	r.release()
+
+	// 改个名字还是同一个连接，配额不会重新算
+	renamed := alice
+	renamed.Name = "mallory"
+	if _, err := reserveUpload(renamed, "b.txt", 30); err == nil {
+		t.Fatal("rename reset the quota")
+	}
+	// 换一个连接用同样的名字，也不会算到 alice 头上
+	other := User{Name: "alice", Session: "s2"}
+	if _, err := reserveUpload(other, "c.txt", 90); err != nil {
+		t.Fatalf("other connection charged for alice's files: %v", err)
+	}
+}
+
+func TestUserQuotaAcrossLogin(t *testing.T) {
+	setupUploads(t, UploadPolicy{UserQuota: 100})
+	guest := User{Name: "bob", Session: "s1"}
+	recordUpload(guest.Name, guest.owner(), defaultRoom, "a.txt", 60)
+
+	// 登录以后，登录前在这个连接上传的还算自己的
+	bob := guest
+	bob.Account = "bob"
+	if _, err := reserveUpload(bob, "b.txt", 50); err == nil {
+		t.Fatal("files uploaded before login not counted")
+	}
+	// 老索引没有 owner，按名字当同名账号
+	index["old.txt"] = fileMeta{Name: "old.txt", Uploader: "carol", Size: 70}
+	carol := User{Name: "carol", Account: "carol", Session: "s3"}
+	if _, err := reserveUpload(carol, "c.txt", 40); err == nil {
+		t.Fatal("legacy entry not counted for its account")
+	}
+	if _, err := reserveUpload(User{Name: "carol", Session: "s4"}, "c.txt", 40); err != nil {
+		t.Fatalf("guest named carol charged for the account's files: %v", err)
+	}
+}
+
+func TestReservationsCountUntilReleased(t *testing.T) {
+	setupUploads(t, UploadPolicy{UserQuota: 100, TotalQuota: 150, MaxFileSize: 90})
+	u := User{Name: "dave", Session: "s1"}
+
+	if _, err := reserveUpload(u, "big.bin", 91); err == nil {
+		t.Fatal("file over MaxFileSize accepted")
+	}
+	r1, err := reserveUpload(u, "one.bin", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 两个并发上传加起来超了
+	if _, err := reserveUpload(u, "two.bin", 60); err == nil {
+		t.Fatal("concurrent uploads bypassed the user quota")
+	}
+	r1.release()
+	if len(reservedUser) != 0 || reservedTotal != 0 {
+		t.Fatalf("release left %v / %d reserved", reservedUser, reservedTotal)
+	}
+
+	// 大小未知的上传用 grow 一点点占
+	r2, err := reserveUpload(u, "stream.bin", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.grow(50); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.grow(50); err == nil {
+		t.Fatal("grow past MaxFileSize accepted")
+	}
+	r2.release()
+}
+
+func TestTotalQuotaCountsFilesOnDisk(t *testing.T) {
+	setupUploads(t, UploadPolicy{TotalQuota: 100})
+	os.MkdirAll(uploadDir, 0755)
+	os.WriteFile(filepath.Join(uploadDir, "old.bin"), make([]byte, 70), 0644)
+	u := User{Name: "erin", Session: "s1"}
+
+	if _, err := reserveUpload(u, "new.bin", 40); err == nil {
+		t.Fatal("files not in the index were not counted")
+	}
+	// 不在索引里的老文件只有管理员能覆盖
+	if _, err := reserveUpload(u, "old.bin", 10); err == nil {
+		t.Fatal("overwrote a file without an uploader record")
+	}
+	// 覆盖自己的文件，原来的大小先减掉
+	recordUpload(u.Name, u.owner(), defaultRoom, "old.bin", 70)
+	r, err := reserveUpload(u, "old.bin", 90)
+	if err != nil {
+		t.Fatalf("overwrite counted twice: %v", err)
+	}
+	r.release()
+}
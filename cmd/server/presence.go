@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"goLearning/pkg/utils"
+	"net"
+	"sort"
+	"time"
+)
+
+// ROSTER 里最多带多少个最近离开的人
+const maxOffline = 20
+
+// lastSeen 离开的人最后在线的时间，和 UserList 一起用 userMu 保护。
+// ROSTER 只带最近 maxOffline 个，多的没用，leave 的时候就删掉，不然来来去去的访客名字越攒越多
+var lastSeen = map[string]time.Time{}
+
+func (u User) member() utils.Member {
+	return utils.Member{Name: u.Name, Status: u.Status, Reason: u.Reason, Room: u.Room, Key: u.Key, Account: u.Account != ""}
+}
+
+// maskRoom viewer 进不去的房间不告诉他名字
+func maskRoom(m utils.Member, viewer User) utils.Member {
+	if m.Room != "" && !canEnter(viewer, m.Room) {
+		m.Room = ""
+	}
+	return m
+}
+
+// sendRosterLocked 给 conn 发完整的在线列表（后面跟着最近离开的人），调用方必须持有 userMu
+func sendRosterLocked(conn net.Conn, self string) {
+	roster := utils.Roster{Self: self, Users: make([]utils.Member, 0, len(UserList))}
+	var viewer User
+	for _, user := range UserList {
+		if user.Conn == conn {
+			viewer = user
+		}
+	}
+	online := map[string]bool{}
+	for _, user := range UserList {
+		roster.Users = append(roster.Users, maskRoom(user.member(), viewer))
+		online[user.Name] = true
+	}
+	var offline []utils.Member
+	for name, at := range lastSeen {
+		if !online[name] {
+			offline = append(offline, utils.Member{Name: name, Status: utils.StatusOffline, LastSeen: at})
+		}
+	}
+	sort.Slice(offline, func(i, j int) bool { return offline[i].LastSeen.After(offline[j].LastSeen) })
+	if len(offline) > maxOffline {
+		offline = offline[:maxOffline]
+	}
+	roster.Users = append(roster.Users, offline...)
+	if err := send(conn, utils.RosterFrame(roster)); err != nil {
+		fmt.Println("write error:", err)
+	}
+}
+
+// broadcastPresenceLocked 把一次在线状态变化推给 except 以外的所有人，调用方必须持有 userMu
+func broadcastPresenceLocked(ev utils.PresenceEvent, except net.Conn) {
+	for _, user := range UserList {
+		if user.Conn == except {
+			continue
+		}
+		masked := ev
+		masked.Member = maskRoom(ev.Member, user)
+		if err := send(user.Conn, utils.PresenceFrame(masked)); err != nil {
+			fmt.Println("write error:", err)
+		}
+	}
+}
+
+// userRoom conn 现在在哪个房间
+func userRoom(conn net.Conn) string {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if user.Conn == conn {
+			return user.Room
+		}
+	}
+	return defaultRoom
+}
+
+// leave 用户离开：记下最后在线时间，告诉其他人
+func leave(name string) {
+	userMu.Lock()
+	defer userMu.Unlock()
+	now := time.Now()
+	lastSeen[name] = now
+	pruneLastSeenLocked()
+	broadcastPresenceLocked(utils.PresenceEvent{Event: utils.PresenceLeave,
+		Member: utils.Member{Name: name, Status: utils.StatusOffline, LastSeen: now}}, nil)
+}
+
+// pruneLastSeenLocked 只留最近离开的 maxOffline 个，调用方必须持有 userMu
+func pruneLastSeenLocked() {
+	for len(lastSeen) > maxOffline {
+		var oldest string
+		for name, at := range lastSeen {
+			if oldest == "" || at.Before(lastSeen[oldest]) {
+				oldest = name
+			}
+		}
+		delete(lastSeen, oldest)
+	}
+}
+
+// setStatus 改 conn 的在线状态并通知所有人；auto 表示是闲置自动改的，一有动静就改回来
+func setStatus(conn net.Conn, status, reason string, auto bool) {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for i := range UserList {
+		if UserList[i].Conn == conn {
+			setStatusLocked(&UserList[i], status, reason, auto)
+			return
+		}
+	}
+}
+
+func setStatusLocked(u *User, status, reason string, auto bool) {
+	if u.Status == status && u.Reason == reason {
+		u.AutoAway = auto
+		return
+	}
+	u.Status, u.Reason, u.AutoAway = status, reason, auto
+	broadcastPresenceLocked(utils.PresenceEvent{Event: utils.PresenceUpdate, Member: u.member()}, nil)
+}
+
+// touch 收到 conn 发来的东西：记下活跃时间，自动离开的改回在线
+func touch(conn net.Conn) {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for i := range UserList {
+		if u := &UserList[i]; u.Conn == conn {
+			u.LastActive = time.Now()
+			if u.AutoAway {
+				setStatusLocked(u, utils.StatusOnline, "", false)
+			}
+			return
+		}
+	}
+}
+
+// broadcastTyping 把"正在输入"转给同一个房间的其他人，不存
+func broadcastTyping(conn net.Conn, name string) {
+	frame := utils.TypingFrame(name)
+	room := userRoom(conn)
+	userMu.Lock()
+	defer userMu.Unlock()
+	for _, user := range UserList {
+		if user.Conn == conn || user.Room != room {
+			continue
+		}
+		if err := send(user.Conn, frame); err != nil {
+			fmt.Println("write error:", err)
+		}
+	}
+}
+
+// idleWatcher 定期检查，在线的人闲置超过 idleTimeout 就自动改成 away
+func idleWatcher() {
+	idle := config.idleTimeout()
+	if idle <= 0 {
+		return
+	}
+	ticker := time.NewTicker(min(idle/4, 30*time.Second))
+	defer ticker.Stop()
+	for range ticker.C {
+		userMu.Lock()
+		for i := range UserList {
+			if u := &UserList[i]; u.Status == utils.StatusOnline && time.Since(u.LastActive) > idle {
+				setStatusLocked(u, utils.StatusAway, "idle", true)
+			}
+		}
+		userMu.Unlock()
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLastSeenIsCapped(t *testing.T) {
+	oldUsers, oldSeen := UserList, lastSeen
+	UserList, lastSeen = nil, map[string]time.Time{}
+	t.Cleanup(func() { UserList, lastSeen = oldUsers, oldSeen })
+
+	// 很早以前走的，新来的人一多就该被挤掉
+	lastSeen["ancient"] = time.Now().Add(-time.Hour)
+	for i := range 3 * maxOffline {
+		leave(fmt.Sprintf("guest%d", i))
+	}
+	if len(lastSeen) != maxOffline {
+		t.Fatalf("lastSeen has %d entries, want %d", len(lastSeen), maxOffline)
+	}
+	if _, ok := lastSeen["ancient"]; ok {
+		t.Error("oldest entry survived")
+	}
+}
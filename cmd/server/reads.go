@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"goLearning/pkg/utils"
+	"net"
+	"strings"
+	"sync"
+)
+
+// 每个人在每个房间读到了哪条。名字谁都能 /setName 成别人的，所以不按名字记（见 User.owner）：
+// 登录了按账号，存在 reads.json（0600）：{"lobby":{"alice":"17"}}，alice 是账号；
+// 没登录的按连接，只在内存里，断开就没了。发给客户端的时候换成现在显示的名字
+const readsPath = "reads.json"
+
+var (
+	readsMu   sync.Mutex
+	reads     = map[string]map[string]string{} // room -> owner -> 消息 id
+	readNames = map[string]string{}            // owner -> 显示的名字，没有的话账号就用账号名
+)
+
+func loadReads() {
+	readsMu.Lock()
+	defer readsMu.Unlock()
+
+	data, err := readPrivateFile(readsPath)
+	if err != nil {
+		return
+	}
+	var saved map[string]map[string]string // room -> 账号 -> id；老文件里是名字，当账号
+	if err := json.Unmarshal(data, &saved); err != nil {
+		fmt.Println("load reads error:", err)
+		return
+	}
+	for room, cursors := range saved {
+		reads[room] = map[string]string{}
+		for account, id := range cursors {
+			reads[room][legacyOwner(account)] = id
+		}
+	}
+}
+
+// saveReadsLocked 只存账号的，调用方必须持有 readsMu
+func saveReadsLocked() error {
+	saved := map[string]map[string]string{}
+	for room, cursors := range reads {
+		for owner, id := range cursors {
+			if account, ok := strings.CutPrefix(owner, "acct:"); ok {
+				if saved[room] == nil {
+					saved[room] = map[string]string{}
+				}
+				saved[room][account] = id
+			}
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(readsPath, data)
+}
+
+// readNameLocked owner 现在显示成什么名字
+func readNameLocked(owner string) string {
+	if name := readNames[owner]; name != "" {
+		return name
+	}
+	account, _ := strings.CutPrefix(owner, "acct:")
+	return account
+}
+
+// readState 房间里所有人的已读位置（名字 -> id）；同名的取读得最远的
+func readState(room string) utils.ReadState {
+	readsMu.Lock()
+	defer readsMu.Unlock()
+	s := utils.ReadState{Room: room, Cursors: make(map[string]string, len(reads[room]))}
+	for owner, id := range reads[room] {
+		name := readNameLocked(owner)
+		if name == "" {
+			continue
+		}
+		if utils.CompareID(id, s.Cursors[name]) > 0 {
+			s.Cursors[name] = id
+		}
+	}
+	return s
+}
+
+// sendReads 给 conn 发房间里完整的已读位置
+func sendReads(conn net.Conn, room string) {
+	if err := send(conn, utils.ReadStateFrame(readState(room))); err != nil {
+		fmt.Println("write error:", err)
+	}
+}
+
+// advanceRead 处理 u 发的 READ|<id>：只往后走，不存在或者不在这个房间的 id 不理；走了就告诉房间里所有人
+func advanceRead(u User, room, id string) {
+	if !store.inRoom(id, room) {
+		return
+	}
+	owner := u.owner()
+	readsMu.Lock()
+	if utils.CompareID(id, reads[room][owner]) <= 0 {
+		readsMu.Unlock()
+		return
+	}
+	if reads[room] == nil {
+		reads[room] = map[string]string{}
+	}
+	reads[room][owner] = id
+	readNames[owner] = u.Name
+	if strings.HasPrefix(owner, "acct:") {
+		if err := saveReadsLocked(); err != nil {
+			fmt.Println("save reads error:", err)
+		}
+	}
+	readsMu.Unlock()
+
+	broadcastRoomFrame(room, utils.ReadCursorFrame(utils.ReadCursor{Room: room, User: u.Name, ID: id}))
+}
+
+// renameReads 改名或者登录以后：没登录时的已读位置不要了（登录了用账号的），
+// 房间里的人把原来名字的删掉，换成新名字的；自己收一份完整的
+func renameReads(conn net.Conn, before, after User) {
+	room := after.Room
+	readsMu.Lock()
+	if before.owner() != after.owner() {
+		dropReadsLocked(before.owner())
+	}
+	readNames[after.owner()] = after.Name
+	id := reads[room][after.owner()]
+	readsMu.Unlock()
+
+	if before.Name != after.Name {
+		broadcastRoomFrame(room, utils.ReadCursorFrame(utils.ReadCursor{Room: room, User: before.Name}))
+	}
+	if id != "" {
+		broadcastRoomFrame(room, utils.ReadCursorFrame(utils.ReadCursor{Room: room, User: after.Name, ID: id}))
+	}
+	sendReads(conn, room)
+}
+
+// forgetReads 断开的时候：按连接记的已读位置跟着连接一起没了（/register 之前留下的也是），
+// 没登录的话告诉房间里的人
+func forgetReads(u User) {
+	if u.Session == "" {
+		return
+	}
+	readsMu.Lock()
+	_, had := reads[u.Room][u.connOwner()]
+	dropReadsLocked(u.connOwner())
+	readsMu.Unlock()
+
+	if had && u.Account == "" {
+		broadcastRoomFrame(u.Room, utils.ReadCursorFrame(utils.ReadCursor{Room: u.Room, User: u.Name}))
+	}
+}
+
+// dropReadsLocked 删掉 owner 所有房间的已读位置，只在内存里的（没登录的）才删
+func dropReadsLocked(owner string) {
+	if strings.HasPrefix(owner, "acct:") {
+		return
+	}
+	for _, cursors := range reads {
+		delete(cursors, owner)
+	}
+	delete(readNames, owner)
+}
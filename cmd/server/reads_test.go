@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// setupReads 临时目录里一个有 n 条消息的大厅，已读位置从空的开始
+func setupReads(t *testing.T, n int) {
+	t.Helper()
+	store = newTestStore(t)
+	reads = map[string]map[string]string{}
+	readNames = map[string]string{}
+	for range n {
+		post(t, store, User{Name: "x", Session: "sx"}, "msg")
+	}
+}
+
+func TestReadsKeyedByOwner(t *testing.T) {
+	setupReads(t, 3)
+	alice := User{Name: "alice", Account: "alice", Session: "s1", Room: defaultRoom}
+	advanceRead(alice, defaultRoom, "2")
+
+	// 改成 alice 的名字的游客不会把 alice 的位置往回拨，也不会往前推
+	spoof := User{Name: "alice", Session: "s2", Room: defaultRoom}
+	advanceRead(spoof, defaultRoom, "1")
+	if got := reads[defaultRoom][alice.owner()]; got != "2" {
+		t.Fatalf("alice's cursor %q, want 2", got)
+	}
+	advanceRead(alice, defaultRoom, "1") // 只往后走
+	advanceRead(alice, defaultRoom, "9") // 不存在的不理
+	if got := readState(defaultRoom).Cursors["alice"]; got != "2" {
+		t.Fatalf("cursor %q, want 2", got)
+	}
+}
+
+func TestReadsPersistOnlyAccounts(t *testing.T) {
+	setupReads(t, 3)
+	os.WriteFile(readsPath, []byte("{}"), 0644) // 老版本写的
+	advanceRead(User{Name: "bob", Account: "bob", Session: "s1"}, defaultRoom, "3")
+	advanceRead(User{Name: "guest", Session: "s2"}, defaultRoom, "2")
+
+	info, err := os.Stat(readsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("reads.json mode %o, want 600", perm)
+	}
+
+	reads = map[string]map[string]string{}
+	readNames = map[string]string{}
+	loadReads()
+	state := readState(defaultRoom)
+	if state.Cursors["bob"] != "3" || len(state.Cursors) != 1 {
+		t.Fatalf("after reload %v, want only bob", state.Cursors)
+	}
+}
+
+func TestRenameAndLoginMoveCursors(t *testing.T) {
+	setupReads(t, 3)
+	guest := User{Name: "abcde", Session: "s1", Room: defaultRoom}
+	advanceRead(guest, defaultRoom, "1")
+
+	// 游客改名，位置跟着连接走，显示成新名字
+	renamed := guest
+	renamed.Name = "carol"
+	renameReads(nil, guest, renamed)
+	if state := readState(defaultRoom); state.Cursors["carol"] != "1" || state.Cursors["abcde"] != "" {
+		t.Fatalf("after rename %v", state.Cursors)
+	}
+
+	// 登录以后用账号的，游客的不要了
+	reads[defaultRoom]["acct:carol"] = "3"
+	login := renamed
+	login.Account = "carol"
+	renameReads(nil, renamed, login)
+	if state := readState(defaultRoom); state.Cursors["carol"] != "3" || len(state.Cursors) != 1 {
+		t.Fatalf("after login %v", state.Cursors)
+	}
+	if _, ok := reads[defaultRoom][guest.owner()]; ok {
+		t.Fatal("guest cursor kept after login")
+	}
+}
+
+func TestForgetReadsOnDisconnect(t *testing.T) {
+	setupReads(t, 2)
+	guest := User{Name: "dave", Session: "s1", Room: defaultRoom}
+	member := User{Name: "erin", Account: "erin", Session: "s2", Room: defaultRoom}
+	advanceRead(guest, defaultRoom, "2")
+	advanceRead(member, defaultRoom, "2")
+
+	forgetReads(guest)
+	forgetReads(member)
+	state := readState(defaultRoom)
+	if _, ok := state.Cursors["dave"]; ok {
+		t.Fatal("guest cursor kept after disconnect")
+	}
+	if state.Cursors["erin"] != "2" {
+		t.Fatal("account cursor dropped on disconnect")
+	}
+}
+
+func TestLegacyReadsFileBecomesAccounts(t *testing.T) {
+	setupReads(t, 0)
+	os.WriteFile(readsPath, []byte(`{"lobby":{"frank":"5"}}`), 0644)
+	loadReads()
+	if got := reads["lobby"]["acct:frank"]; got != "5" {
+		t.Fatalf("legacy cursor %q", got)
+	}
+	if info, _ := os.Stat(readsPath); info.Mode().Perm() != 0600 {
+		t.Fatalf("legacy file left at %o", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"goLearning/pkg/utils"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 房间和邀请存在 rooms.json（有密码哈希，0600）。大厅不存，谁都能进。
+// 成员按账号记：登录过的人凭密码或邀请进过一次，以后直接 /join；
+// 没登录的人进过的房间只记在这个连接上（User.Guest），断开就没了，不然改个名字就能冒充别人。
+// /join 不建房间，进不去的时候不管是没这个房间、密码错还是邀请不对都回一样的话，免得拿 /join 试出上锁的房间叫什么；
+// 建房间用 /create，名字被占了只能说被占了
+const roomsPath = "rooms.json"
+
+const defaultRoom = utils.DefaultRoom
+
+const maxRoomName = 32
+
+type room struct {
+	Owner      string          `json:"owner,omitempty"` // 建房间的人的账号，没登录建的就没有房主，只有管理员能管
+	Salt       []byte          `json:"salt,omitempty"`
+	Hash       []byte          `json:"hash,omitempty"` // 密码的 PBKDF2，没设密码是空的
+	InviteOnly bool            `json:"inviteOnly,omitempty"`
+	Members    map[string]bool `json:"members,omitempty"` // 账号
+	Created    time.Time       `json:"created"`
+}
+
+// public 没密码也不用邀请，谁都能进、/rooms 里谁都能看到
+func (r *room) public() bool {
+	return len(r.Hash) == 0 && !r.InviteOnly
+}
+
+// invite 一次性的邀请，用完或者过期就没了
+type invite struct {
+	Room    string    `json:"room"`
+	For     string    `json:"for,omitempty"` // /invite <account> 只能登录了这个账号的人用，/invite-link 谁拿到都能用
+	By      string    `json:"by"`
+	Expires time.Time `json:"expires"`
+}
+
+var (
+	roomsMu sync.Mutex
+	rooms   = map[string]*room{}
+	invites = map[string]invite{} // token -> 邀请
+)
+
+type roomsFile struct {
+	Rooms   map[string]*room  `json:"rooms"`
+	Invites map[string]invite `json:"invites"`
+}
+
+func loadRooms() {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	data, err := readPrivateFile(roomsPath)
+	if err != nil {
+		return
+	}
+	var f roomsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		fmt.Println("load rooms error:", err)
+		return
+	}
+	if f.Rooms != nil {
+		rooms = f.Rooms
+	}
+	if f.Invites != nil {
+		invites = f.Invites
+	}
+}
+
+// saveRoomsLocked 调用方必须持有 roomsMu，顺便把过期的邀请清掉
+func saveRoomsLocked() error {
+	now := time.Now()
+	for token, inv := range invites {
+		if now.After(inv.Expires) {
+			delete(invites, token)
+		}
+	}
+	data, err := json.MarshalIndent(roomsFile{Rooms: rooms, Invites: invites}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(roomsPath, data)
+}
+
+// msgRoom 消息在哪个房间，老记录没有房间的算大厅
+func msgRoom(m utils.Message) string {
+	if m.Room == "" {
+		return defaultRoom
+	}
+	return m.Room
+}
+
+// checkRoomName 房间名统一小写，不能有空格和分隔符
+func checkRoomName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimPrefix(name, "#"))
+	if name == "" || len(name) > maxRoomName || strings.ContainsAny(name, " \t|/\\#:") {
+		return "", fmt.Errorf("bad room name %q (up to %d characters, no spaces or | / \\ # :)", name, maxRoomName)
+	}
+	return name, nil
+}
+
+// canEnter u 能不能直接进 name（不用密码和邀请）
+func canEnter(u User, name string) bool {
+	if name == defaultRoom || u.Admin || u.Guest[name] {
+		return true
+	}
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	r := rooms[name]
+	return r != nil && (r.public() || (u.Account != "" && r.Members[u.Account]))
+}
+
+// grantLocked 把 u 加进房间成员，调用方必须持有 userMu
+func grantLocked(u *User, name string) {
+	if u.Account == "" {
+		if u.Guest == nil {
+			u.Guest = map[string]bool{}
+		}
+		u.Guest[name] = true
+		return
+	}
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	if r := rooms[name]; r != nil {
+		if r.Members == nil {
+			r.Members = map[string]bool{}
+		}
+		r.Members[u.Account] = true
+		if err := saveRoomsLocked(); err != nil {
+			fmt.Println("save rooms error:", err)
+		}
+	}
+}
+
+// createRoom 建一个公开的房间，已经有了返回 false
+func createRoom(name, owner string) bool {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	if name == defaultRoom || rooms[name] != nil {
+		return false
+	}
+	rooms[name] = &room{Owner: owner, Created: time.Now()}
+	if err := saveRoomsLocked(); err != nil {
+		fmt.Println("save rooms error:", err)
+	}
+	return true
+}
+
+// noSalt 没有密码的时候也拿它算一遍哈希，回复快慢看不出房间在不在、有没有密码
+var noSalt = make([]byte, 16)
+
+// unlock 用邀请或者密码进 name：secret 先当邀请试（用掉），不是再当密码试。
+// 失败只有一种说法，没这个房间也一样
+func unlock(name string, u User, secret string) error {
+	denied := fmt.Errorf("can't enter #%s: no such room, or the password or invite is wrong", name)
+	roomsMu.Lock()
+	r := rooms[name]
+	if inv, ok := invites[secret]; ok && r != nil && secret != "" && inv.Room == name && time.Now().Before(inv.Expires) &&
+		(inv.For == "" || (u.Account != "" && inv.For == u.Account)) {
+		delete(invites, secret)
+		if err := saveRoomsLocked(); err != nil {
+			fmt.Println("save rooms error:", err)
+		}
+		roomsMu.Unlock()
+		return nil
+	}
+	salt, want := noSalt, []byte(nil)
+	if r != nil && !r.InviteOnly && len(r.Hash) > 0 {
+		salt, want = r.Salt, r.Hash
+	}
+	roomsMu.Unlock()
+
+	hash, err := hashPassword(secret, salt)
+	if err != nil || want == nil || !hmac.Equal(hash, want) {
+		return denied
+	}
+	return nil
+}
+
+// manageRoom 房主或管理员才能改房间设置
+func manageRoom(u User, name string, change func(r *room) error) error {
+	if name == defaultRoom {
+		return fmt.Errorf("the lobby is open to everyone")
+	}
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	r := rooms[name]
+	if r == nil {
+		return fmt.Errorf("no such room: #%s", name)
+	}
+	if !u.Admin && (r.Owner == "" || r.Owner != u.Account) {
+		if r.Owner == "" {
+			return fmt.Errorf("#%s has no owner (it was created without logging in), only an admin can change it", name)
+		}
+		return fmt.Errorf("only the owner (%s) or an admin can change #%s", r.Owner, name)
+	}
+	if err := change(r); err != nil {
+		return err
+	}
+	return saveRoomsLocked()
+}
+
+// setRoomPassword 空密码是去掉密码
+func setRoomPassword(u User, name, password string) error {
+	var salt, hash []byte
+	if password != "" {
+		if len(password) < minPasswordLength {
+			return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+		}
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		var err error
+		if hash, err = hashPassword(password, salt); err != nil {
+			return err
+		}
+	}
+	return manageRoom(u, name, func(r *room) error {
+		r.Salt, r.Hash = salt, hash
+		return nil
+	})
+}
+
+func setInviteOnly(u User, name string, on bool) error {
+	return manageRoom(u, name, func(r *room) error {
+		r.InviteOnly = on
+		return nil
+	})
+}
+
+// isMemberLocked u 是不是 name 的房主或成员，调用方必须持有 roomsMu
+func isMemberLocked(r *room, u User, name string) bool {
+	return u.Admin || u.Guest[name] || (u.Account != "" && (r.Owner == u.Account || r.Members[u.Account]))
+}
+
+// newInvite u 给 name 生成一个邀请，只有房主、成员和管理员能发；
+// forAccount 为空是谁拿到都能用的链接，不为空必须是注册过的账号（名字谁都能改，账号改不了）
+func newInvite(u User, name, forAccount string) (string, invite, error) {
+	if name == defaultRoom {
+		return "", invite{}, fmt.Errorf("the lobby is open to everyone, no invite needed")
+	}
+	if forAccount != "" && !isRegistered(forAccount) {
+		return "", invite{}, fmt.Errorf("%s is not a registered account, use /invite-link and pass the token on yourself", forAccount)
+	}
+	token, err := utils.RandomString(12)
+	if err != nil {
+		return "", invite{}, err
+	}
+	inv := invite{Room: name, For: forAccount, By: u.Name, Expires: time.Now().Add(config.inviteTTL())}
+
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	r := rooms[name]
+	if r == nil {
+		return "", invite{}, fmt.Errorf("no such room: #%s", name)
+	}
+	if !isMemberLocked(r, u, name) {
+		return "", invite{}, fmt.Errorf("only members of #%s can invite people", name)
+	}
+	invites[token] = inv
+	return token, inv, saveRoomsLocked()
+}
+
+// roomList /rooms 的内容：u 能看到的房间（大厅、公开的、是成员的），online 是每个房间在线人数
+func roomList(u User, current string, online map[string]int) string {
+	type entry struct {
+		name string
+		r    *room
+	}
+	var list []entry
+	roomsMu.Lock()
+	for name, r := range rooms {
+		if r.public() || u.Admin || u.Guest[name] || (u.Account != "" && r.Members[u.Account]) {
+			cp := *r
+			list = append(list, entry{name, &cp})
+		}
+	}
+	roomsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	list = append([]entry{{defaultRoom, &room{}}}, list...)
+
+	var sb strings.Builder
+	sb.WriteString("[SYSTEM] rooms:\n")
+	for _, e := range list {
+		var tags []string
+		if len(e.r.Hash) > 0 {
+			tags = append(tags, "password")
+		}
+		if e.r.InviteOnly {
+			tags = append(tags, "invite-only")
+		}
+		if e.r.Owner != "" {
+			tags = append(tags, "owner "+e.r.Owner)
+		}
+		tags = append(tags, fmt.Sprintf("%d online", online[e.name]))
+		mark := " "
+		if e.name == current {
+			mark = "*"
+		}
+		sb.WriteString(fmt.Sprintf("%s #%-16s %s\n", mark, e.name, strings.Join(tags, ", ")))
+	}
+	return sb.String()
+}
+
+// grant 把 conn 加进房间成员
+func grant(conn net.Conn, name string) {
+	userMu.Lock()
+	defer userMu.Unlock()
+	for i := range UserList {
+		if UserList[i].Conn == conn {
+			grantLocked(&UserList[i], name)
+			return
+		}
+	}
+}
+
+// enterRoom 把 conn 换到 name：先发 ROOM|，再发这个房间的已读位置和聊天记录，大家的侧边栏跟着变。
+// 文件目录也重发一份，刚用邀请进来的人能看到这个房间的文件了
+func enterRoom(conn net.Conn, name string) {
+	files := fileRooms()
+	userMu.Lock()
+	defer userMu.Unlock()
+	for i := range UserList {
+		u := &UserList[i]
+		if u.Conn != conn {
+			continue
+		}
+		u.Room = name
+		_ = send(conn, utils.RoomFrame(name))
+		sendReads(conn, name)
+		if n := config.historySize(); n > 0 {
+			_ = send(conn, utils.HistoryFrame(store.recent(n, name)))
+		}
+		_ = send(conn, utils.CatalogFrame(visibleFiles(*u, files)))
+		broadcastPresenceLocked(utils.PresenceEvent{Event: utils.PresenceUpdate, Member: u.member()}, nil)
+		return
+	}
+}
+
+// roomCounts 每个房间在线几个人
+func roomCounts() map[string]int {
+	userMu.Lock()
+	defer userMu.Unlock()
+	counts := map[string]int{}
+	for _, user := range UserList {
+		counts[user.Room]++
+	}
+	return counts
+}
+
+// sendInvite 把邀请发给账号 to：在线直接发，不在线进信箱。注册过的名字只有登录了才能用，按名字发就是发给这个账号
+func sendInvite(conn net.Conn, from, to, token string, inv invite) {
+	expires := inv.Expires.Local().Format("01-02 15:04")
+	text := fmt.Sprintf("invited you to #%s: /join %s %s (single use, valid until %s)", inv.Room, inv.Room, token, expires)
+	reply := fmt.Sprintf("[SYSTEM] 已邀请 %s 进 #%s\n", to, inv.Room)
+	if !unicast(to, fmt.Sprintf("[SYSTEM] %s %s\n", from, text)) {
+		enqueueMail(to, mail{Kind: mailDM, From: from, Text: text, Time: time.Now()})
+		reply = fmt.Sprintf("[SYSTEM] %s 不在线，登录后会收到邀请\n", to)
+	}
+	_ = send(conn, []byte(reply))
+}
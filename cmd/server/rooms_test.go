@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// setupRooms 在临时目录里跑，房间、邀请和账号都从空的开始
+func setupRooms(t *testing.T) {
+	t.Chdir(t.TempDir())
+	rooms = map[string]*room{}
+	invites = map[string]invite{}
+	accounts = map[string]account{}
+}
+
+func TestJoinFailuresLookTheSame(t *testing.T) {
+	setupRooms(t)
+	owner := User{Name: "alice", Account: "alice"}
+	createRoom("locked", owner.Account)
+	if err := setRoomPassword(owner, "locked", "hunter22"); err != nil {
+		t.Fatal(err)
+	}
+	createRoom("closed", owner.Account)
+	if err := setInviteOnly(owner, "closed", true); err != nil {
+		t.Fatal(err)
+	}
+
+	guest := User{Name: "eve", Session: "s1"}
+	// 把房间名换掉以后，没这个房间、密码错、只能邀请进的回复应该一字不差
+	reply := func(room, secret string) string {
+		err := unlock(room, guest, secret)
+		if err == nil {
+			t.Fatalf("unlock(%q, %q) let a stranger in", room, secret)
+		}
+		return strings.ReplaceAll(err.Error(), "#"+room, "#ROOM")
+	}
+	want := reply("nosuch", "guess")
+	for _, c := range [][2]string{{"locked", "guess"}, {"locked", ""}, {"closed", "guess"}, {"nosuch", ""}} {
+		if got := reply(c[0], c[1]); got != want {
+			t.Errorf("unlock(%q, %q) = %q, want %q", c[0], c[1], got, want)
+		}
+	}
+	if err := unlock("locked", guest, "hunter22"); err != nil {
+		t.Errorf("right password rejected: %v", err)
+	}
+	if rooms["nosuch"] != nil {
+		t.Error("unlock created a room")
+	}
+}
+
+func TestInviteNeedsMembership(t *testing.T) {
+	setupRooms(t)
+	owner := User{Name: "alice", Account: "alice"}
+	createRoom("dev", owner.Account)
+	setInviteOnly(owner, "dev", true)
+
+	if _, _, err := newInvite(User{Name: "mallory", Account: "mallory"}, "dev", ""); err == nil {
+		t.Fatal("outsider made an invite")
+	}
+	if _, _, err := newInvite(User{Name: "mallory", Session: "s1"}, "dev", ""); err == nil {
+		t.Fatal("guest outsider made an invite")
+	}
+	token, _, err := newInvite(owner, "dev", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 凭邀请进来的成员也能接着邀请
+	bob := User{Name: "bob", Account: "bob"}
+	if err := unlock("dev", bob, token); err != nil {
+		t.Fatal(err)
+	}
+	grantLocked(&bob, "dev")
+	if _, _, err := newInvite(bob, "dev", ""); err != nil {
+		t.Errorf("member could not invite: %v", err)
+	}
+	guest := User{Name: "carol", Session: "s2", Guest: map[string]bool{"dev": true}}
+	if _, _, err := newInvite(guest, "dev", ""); err != nil {
+		t.Errorf("guest member could not invite: %v", err)
+	}
+}
+
+func TestInviteBoundToAccount(t *testing.T) {
+	setupRooms(t)
+	owner := User{Name: "alice", Account: "alice"}
+	createRoom("dev", owner.Account)
+	setInviteOnly(owner, "dev", true)
+
+	if _, _, err := newInvite(owner, "dev", "bob"); err == nil {
+		t.Fatal("invite for an unregistered name accepted")
+	}
+	if err := register("bob", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	token, inv, err := newInvite(owner, "dev", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.For != "bob" {
+		t.Fatalf("invite for %q, want the account", inv.For)
+	}
+	// 起个一样的名字没用，得登录这个账号
+	if err := unlock("dev", User{Name: "bob", Session: "s1"}, token); err == nil {
+		t.Fatal("guest named bob used bob's invite")
+	}
+	if err := unlock("dev", User{Name: "eve", Account: "eve"}, token); err == nil {
+		t.Fatal("another account used bob's invite")
+	}
+	if err := unlock("dev", User{Name: "bob", Account: "bob"}, token); err != nil {
+		t.Fatalf("bob could not use the invite: %v", err)
+	}
+	if err := unlock("dev", User{Name: "bob", Account: "bob"}, token); err == nil {
+		t.Fatal("invite used twice")
+	}
+}
+
+// rooms.json 里有房间密码的哈希，老文件权限宽也要收紧
+func TestRoomsFileIsPrivate(t *testing.T) {
+	setupRooms(t)
+	os.WriteFile(roomsPath, []byte("{}"), 0644)
+	owner := User{Name: "alice", Account: "alice"}
+	createRoom("locked", owner.Account)
+	if err := setRoomPassword(owner, "locked", "hunter22"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(roomsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("rooms mode = %v, want 0600", info.Mode().Perm())
+	}
+	rooms = map[string]*room{}
+	loadRooms()
+	if rooms["locked"] == nil || len(rooms["locked"].Hash) == 0 {
+		t.Errorf("rooms after reload = %+v", rooms)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"goLearning/pkg/utils"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 搜索用的倒排索引：词 -> 含这个词的消息 id 集合。启动重放日志时顺便建好，之后随新消息、编辑、删除更新：
+// 编辑先把旧内容的词拿掉再加新的，删除把词都拿掉。索引只用来缩小范围，最后还要拿消息现在的内容再核对一遍。
+// 中文这种不用空格分词的按单个字索引
+
+// tokenize 把文本切成小写的词；字母数字连起来算一个词，中日韩的字一个字一个词
+func tokenize(text string) []string {
+	var out []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			out = append(out, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isIdeograph(r):
+			flush()
+			out = append(out, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return out
+}
+
+func isIdeograph(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// indexLocked 把 id 的内容加进索引，调用方必须持有 s.mu
+func (s *messageStore) indexLocked(id, text string) {
+	for _, tok := range tokenize(text) {
+		if s.idx[tok] == nil {
+			s.idx[tok] = map[string]struct{}{}
+		}
+		s.idx[tok][id] = struct{}{}
+	}
+}
+
+// unindexLocked 把 id 原来的内容从索引里拿掉（编辑、删除前调用），调用方必须持有 s.mu
+func (s *messageStore) unindexLocked(id, text string) {
+	for _, tok := range tokenize(text) {
+		delete(s.idx[tok], id)
+		if len(s.idx[tok]) == 0 {
+			delete(s.idx, tok)
+		}
+	}
+}
+
+// searchQuery /search 后面的东西拆出来的条件
+type searchQuery struct {
+	terms         []string // 小写，每个都要出现在消息里
+	room, from    string
+	before, after time.Time
+	page          int
+}
+
+// parseSearch 解析 "/search" 后面的部分，日期按服务器本地时间
+func parseSearch(q string) (searchQuery, error) {
+	sq := searchQuery{page: 1}
+	for _, f := range strings.Fields(q) {
+		key, val, ok := strings.Cut(f, ":")
+		if !ok || val == "" {
+			sq.terms = append(sq.terms, strings.ToLower(f))
+			continue
+		}
+		var err error
+		switch strings.ToLower(key) {
+		case "in":
+			sq.room = strings.TrimPrefix(val, "#")
+		case "from":
+			sq.from = val
+		case "before":
+			sq.before, err = parseDate(val)
+		case "after":
+			sq.after, err = parseDate(val)
+		case "page":
+			sq.page, err = strconv.Atoi(val)
+			if err == nil && sq.page < 1 {
+				err = fmt.Errorf("page must be >= 1")
+			}
+		default: // 正文里带冒号的词，比如 http://
+			sq.terms = append(sq.terms, strings.ToLower(f))
+		}
+		if err != nil {
+			return sq, fmt.Errorf("%s: %v", f, err)
+		}
+	}
+	if len(sq.terms) == 0 && sq.room == "" && sq.from == "" && sq.before.IsZero() && sq.after.IsZero() {
+		return sq, fmt.Errorf("usage: /search <words> [in:room] [from:user] [before:YYYY-MM-DD] [after:YYYY-MM-DD] [page:N]")
+	}
+	return sq, nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad date, use YYYY-MM-DD")
+}
+
+// candidatesLocked 索引里所有词都对得上的 id（按发送顺序）；没有词的话就是全部，调用方必须持有 s.mu
+func (s *messageStore) candidatesLocked(terms []string) []string {
+	var tokens []string
+	for _, t := range terms {
+		tokens = append(tokens, tokenize(t)...)
+	}
+	if len(tokens) == 0 {
+		return s.order
+	}
+	// 从最小的集合开始，挨个看其他词的集合里有没有
+	smallest := s.idx[tokens[0]]
+	for _, tok := range tokens[1:] {
+		if len(s.idx[tok]) < len(smallest) {
+			smallest = s.idx[tok]
+		}
+	}
+	var out []string
+	for id := range smallest {
+		all := true
+		for _, tok := range tokens {
+			if _, ok := s.idx[tok][id]; !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			out = append(out, id)
+		}
+	}
+	slices.SortFunc(out, utils.CompareID)
+	return out
+}
+
+func (q searchQuery) match(m *storedMessage) bool {
+	if m.Deleted {
+		return false
+	}
+	if q.room != "" && !strings.EqualFold(msgRoom(m.Message), q.room) {
+		return false
+	}
+	if q.from != "" && !strings.EqualFold(m.From, q.from) {
+		return false
+	}
+	if !q.before.IsZero() && !m.Time.Before(q.before) {
+		return false
+	}
+	if !q.after.IsZero() && m.Time.Before(q.after) {
+		return false
+	}
+	text := strings.ToLower(m.Text) // 加密的消息没有 text，只能靠 from:、in:、日期找到，客户端自己解开显示
+	for _, t := range q.terms {
+		if !strings.Contains(text, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// search 查一页，从新到旧；allowed 说了算哪些房间能搜（进不去的房间不给看）
+func (s *messageStore) search(raw string, q searchQuery, allowed func(room string) bool) utils.SearchResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hits []*storedMessage
+	ok := map[string]bool{}
+	ids := s.candidatesLocked(q.terms)
+	for i := len(ids) - 1; i >= 0; i-- {
+		m := s.msgs[ids[i]]
+		if m == nil || !q.match(m) {
+			continue
+		}
+		room := msgRoom(m.Message)
+		if _, seen := ok[room]; !seen {
+			ok[room] = allowed(room)
+		}
+		if ok[room] {
+			hits = append(hits, m)
+		}
+	}
+
+	size := utils.SearchPageSize
+	r := utils.SearchResult{Query: raw, Page: q.page, Total: len(hits), Pages: (len(hits) + size - 1) / size}
+	for _, m := range hits[min((q.page-1)*size, len(hits)):min(q.page*size, len(hits))] {
+		r.Results = append(r.Results, m.snapshot())
+	}
+	return r
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"goLearning/pkg/utils"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello, World! foo_bar 42", []string{"hello", "world", "foo_bar", "42"}},
+		{"去吃饭吗", []string{"去", "吃", "饭", "吗"}},
+		{"deploy到prod", []string{"deploy", "到", "prod"}},
+		{"  ", nil},
+	}
+	for _, tt := range tests {
+		if got := tokenize(tt.text); !slices.Equal(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseSearch(t *testing.T) {
+	q, err := parseSearch(" Deploy in:#ops from:alice after:2024-01-02 page:2 http://x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(q.terms, []string{"deploy", "http://x"}) || q.room != "ops" || q.from != "alice" || q.page != 2 {
+		t.Fatalf("got %+v", q)
+	}
+	if want := time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local); !q.after.Equal(want) {
+		t.Fatalf("after %v", q.after)
+	}
+	for _, bad := range []string{"", "page:0", "before:yesterday"} {
+		if _, err := parseSearch(bad); err == nil {
+			t.Errorf("parseSearch(%q) accepted", bad)
+		}
+	}
+}
+
+func searchIDs(s *messageStore, query string) ([]string, utils.SearchResult) {
+	q, _ := parseSearch(query)
+	r := s.search(query, q, func(string) bool { return true })
+	var ids []string
+	for _, m := range r.Results {
+		ids = append(ids, m.ID)
+	}
+	return ids, r
+}
+
+// 改一条老消息不会重复出现，顺序也不乱，Total 是真的条数
+func TestSearchAfterEditingOlderMessage(t *testing.T) {
+	s := newTestStore(t)
+	alice := User{Name: "alice", Session: "s1"}
+	for range 3 {
+		post(t, s, alice, "deploy now")
+	}
+	if err := edit(s, alice, "1", "deploy again"); err != nil {
+		t.Fatal(err)
+	}
+	if err := edit(s, alice, "1", "deploy once more"); err != nil {
+		t.Fatal(err)
+	}
+	ids, r := searchIDs(s, "deploy")
+	if !slices.Equal(ids, []string{"3", "2", "1"}) || r.Total != 3 {
+		t.Fatalf("got %v total=%d", ids, r.Total)
+	}
+}
+
+func TestSearchDropsEditedAndDeletedWords(t *testing.T) {
+	s := newTestStore(t)
+	alice := User{Name: "alice", Session: "s1"}
+	post(t, s, alice, "secret plan")
+	post(t, s, alice, "lunch plan")
+	edit(s, alice, "1", "public plan")
+	s.change(utils.MessageEvent{Op: utils.MessageDelete, ID: "2", By: "alice"}, alice, defaultRoom)
+
+	if _, ok := s.idx["secret"]; ok {
+		t.Fatal("edited-away word still indexed")
+	}
+	if _, ok := s.idx["lunch"]; ok {
+		t.Fatal("deleted message still indexed")
+	}
+	if ids, _ := searchIDs(s, "plan"); !slices.Equal(ids, []string{"1"}) {
+		t.Fatalf("plan: %v", ids)
+	}
+	// 重放日志也一样
+	s = reopen(t, s)
+	if _, ok := s.idx["secret"]; ok {
+		t.Fatal("edited-away word indexed after replay")
+	}
+	if ids, _ := searchIDs(s, "public plan"); !slices.Equal(ids, []string{"1"}) {
+		t.Fatalf("after replay: %v", ids)
+	}
+}
+
+func TestSearchFiltersAndPages(t *testing.T) {
+	s := newTestStore(t)
+	alice := User{Name: "alice", Session: "s1"}
+	for range utils.SearchPageSize + 2 {
+		post(t, s, alice, "大家好 hello")
+	}
+	s.add(utils.Message{From: "bob", Text: "hello from ops", Room: "ops", Time: time.Now()}, "conn:s2")
+
+	_, r := searchIDs(s, "hello")
+	if r.Total != utils.SearchPageSize+3 || r.Pages != 2 || len(r.Results) != utils.SearchPageSize {
+		t.Fatalf("total=%d pages=%d results=%d", r.Total, r.Pages, len(r.Results))
+	}
+	if ids, _ := searchIDs(s, "hello page:2"); len(ids) != 3 || ids[2] != "1" {
+		t.Fatalf("page 2: %v", ids)
+	}
+	if ids, _ := searchIDs(s, "hello in:ops"); len(ids) != 1 {
+		t.Fatalf("in:ops: %v", ids)
+	}
+	if ids, _ := searchIDs(s, "好 from:bob"); len(ids) != 0 {
+		t.Fatalf("from:bob: %v", ids)
+	}
+
+	// 进不去的房间不给看
+	q, _ := parseSearch("hello")
+	r = s.search("hello", q, func(room string) bool { return room != "ops" })
+	if r.Total != utils.SearchPageSize+2 {
+		t.Fatalf("hidden room counted: %d", r.Total)
+	}
+}
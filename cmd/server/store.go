@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goLearning/pkg/utils"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 聊天记录存在一个只追加的日志里，每行一条 JSON：新消息、编辑、删除都是一条记录。
+// 启动时从头重放一遍恢复内存里的状态，编辑前的版本也留着，方便查是谁改了什么。
+const messageLogPath = "messages.log"
+
+// version 被替换掉的旧版本：Text 是改之前的内容（加密的是 KeyID/Cipher，还有作者的 Key/Sig），Op/By/Time 是谁在什么时候做了什么
+type version struct {
+	Text   string    `json:"text"`
+	KeyID  string    `json:"keyId,omitempty"`
+	Cipher string    `json:"cipher,omitempty"`
+	Key    string    `json:"key,omitempty"`
+	Sig    string    `json:"sig,omitempty"`
+	Seq    int64     `json:"seq,omitempty"`
+	Op     string    `json:"op"`
+	By     string    `json:"by"`
+	Time   time.Time `json:"time"`
+}
+
+type storedMessage struct {
+	utils.Message
+	History []version // 审计用，旧的在前
+
+	// 作者是谁：账号或者连接（见 User.owner），不发给客户端。
+	// From 只是显示的名字，/setName 谁都能改成一样的，改消息、点表情都按 owner 认
+	owner    string
+	reactors map[string][]reactor // 表情 -> 谁点的，Reactions 里的名字按它算
+}
+
+// reactor 点表情的人：按 owner 判断是不是点过，name 是显示的名字
+type reactor struct {
+	owner, name string
+}
+
+// logRecord 日志里的一行，Msg、Event、Seq 只有一个有值；Owner 是发消息或者做改动的人（见 User.owner）
+type logRecord struct {
+	Msg   *utils.Message      `json:"msg,omitempty"`
+	Event *utils.MessageEvent `json:"event,omitempty"`
+	Seq   *seqClaim           `json:"seq,omitempty"`
+	Owner string              `json:"owner,omitempty"`
+}
+
+// seqClaim 私信用掉的序号：私信本身不进日志，序号得单独记，不然重启以后能重放
+type seqClaim struct {
+	Key string `json:"key"`
+	Seq int64  `json:"seq"`
+}
+
+type messageStore struct {
+	mu     sync.Mutex
+	f      *os.File
+	nextID int
+	msgs   map[string]*storedMessage
+	order  []string                       // 按发送顺序的 id
+	idx    map[string]map[string]struct{} // 搜索用的倒排索引：词 -> id 集合，见 search.go
+	seqs   map[string]int64               // 签名公钥 -> 用过的最大序号，见 claimSeq
+}
+
+var store *messageStore
+
+// openStore 打开（没有就创建）日志文件并重放
+func openStore(path string) (*messageStore, error) {
+	s := &messageStore{nextID: 1, msgs: map[string]*storedMessage{}, idx: map[string]map[string]struct{}{}, seqs: map[string]int64{}}
+
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), utils.MaxFrameSize)
+		for line := 1; sc.Scan(); line++ {
+			var rec logRecord
+			if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+				fmt.Printf("%s:%d: skip bad record: %v\n", path, line, err)
+				continue
+			}
+			s.replay(rec)
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.f = f
+	return s, nil
+}
+
+func (s *messageStore) replay(rec logRecord) {
+	switch {
+	case rec.Msg != nil:
+		s.insert(*rec.Msg, recordOwner(rec.Owner, rec.Msg.From))
+		if n, err := strconv.Atoi(rec.Msg.ID); err == nil && n >= s.nextID {
+			s.nextID = n + 1
+		}
+	case rec.Event != nil:
+		if m := s.msgs[rec.Event.ID]; m != nil {
+			s.applyLocked(m, *rec.Event, recordOwner(rec.Owner, rec.Event.By))
+		}
+	case rec.Seq != nil:
+		s.noteSeqLocked(rec.Seq.Key, rec.Seq.Seq)
+	}
+}
+
+// recordOwner 老日志没有 owner，按名字当同名账号的
+func recordOwner(owner, name string) string {
+	if owner == "" {
+		return legacyOwner(name)
+	}
+	return owner
+}
+
+func (s *messageStore) insert(msg utils.Message, owner string) {
+	s.msgs[msg.ID] = &storedMessage{Message: msg, owner: owner}
+	s.order = append(s.order, msg.ID)
+	s.indexLocked(msg.ID, msg.Text)
+	s.noteSeqLocked(msg.Key, msg.Seq)
+}
+
+// noteSeqLocked 记下 key 用过 seq，重启以后从日志里恢复，调用方必须持有 s.mu
+func (s *messageStore) noteSeqLocked(key string, seq int64) {
+	if key != "" && seq > s.seqs[key] {
+		s.seqs[key] = seq
+	}
+}
+
+// claimSeq 签过名的消息和私信，序号必须比这把公钥用过的都大，不然就是重放。
+// 房间消息的序号跟着消息进日志；私信不进日志，persist=true 单独写一行，重启以后照样挡得住
+func (s *messageStore) claimSeq(key string, seq int64, persist bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq <= s.seqs[key] {
+		return fmt.Errorf("sequence number %d was already used (replayed, or the clock went back)", seq)
+	}
+	if persist {
+		if err := s.appendLocked(logRecord{Seq: &seqClaim{Key: key, Seq: seq}}); err != nil {
+			return err
+		}
+	}
+	s.seqs[key] = seq
+	return nil
+}
+
+// applyLocked 应用 owner 做的改动，索引跟着换成新内容（删掉的就不在索引里了），调用方必须持有 s.mu
+func (s *messageStore) applyLocked(m *storedMessage, ev utils.MessageEvent, owner string) {
+	if ev.Op == utils.MessageEdit || ev.Op == utils.MessageDelete {
+		s.unindexLocked(m.ID, m.Text)
+	}
+	m.apply(ev, owner)
+	if ev.Op == utils.MessageEdit {
+		s.indexLocked(m.ID, m.Text)
+		s.noteSeqLocked(ev.Key, ev.Seq)
+	}
+}
+
+// apply 应用改动，编辑/删除的话旧版本进历史（表情不算）
+func (m *storedMessage) apply(ev utils.MessageEvent, owner string) {
+	switch ev.Op {
+	case utils.MessageEdit, utils.MessageDelete:
+		m.History = append(m.History, version{Text: m.Text, KeyID: m.KeyID, Cipher: m.Cipher, Key: m.Key, Sig: m.Sig, Seq: m.Seq, Op: ev.Op, By: ev.By, Time: ev.Time})
+		m.Message.Apply(ev)
+	case utils.MessageReact, utils.MessageUnreact:
+		m.applyReaction(ev, owner)
+	default:
+		m.Message.Apply(ev)
+	}
+}
+
+// reacted owner 点过 emoji 没有，返回当时显示的名字
+func (m *storedMessage) reacted(emoji, owner string) (string, bool) {
+	for _, r := range m.reactors[emoji] {
+		if r.owner == owner {
+			return r.name, true
+		}
+	}
+	return "", false
+}
+
+// applyReaction 表情按 owner 记，Reactions 里的名字从 reactors 重新算，同名的只显示一次
+func (m *storedMessage) applyReaction(ev utils.MessageEvent, owner string) {
+	if m.reactors == nil {
+		m.reactors = map[string][]reactor{}
+	}
+	list := m.reactors[ev.Text]
+	i := slices.IndexFunc(list, func(r reactor) bool { return r.owner == owner })
+	switch {
+	case ev.Op == utils.MessageReact && i < 0:
+		list = append(list, reactor{owner: owner, name: ev.By})
+	case ev.Op == utils.MessageUnreact && i >= 0:
+		list = slices.Delete(list, i, i+1)
+	}
+
+	var names []string
+	for _, r := range list {
+		if !slices.Contains(names, r.name) {
+			names = append(names, r.name)
+		}
+	}
+	if len(list) == 0 {
+		delete(m.reactors, ev.Text)
+	} else {
+		m.reactors[ev.Text] = list
+	}
+	if len(names) == 0 {
+		delete(m.Reactions, ev.Text)
+		return
+	}
+	if m.Reactions == nil {
+		m.Reactions = map[string][]string{}
+	}
+	m.Reactions[ev.Text] = names
+}
+
+// snapshot 拷一份给锁外面用，表情的 map 和切片也要拷，不然会和后面的修改抢
+func (m *storedMessage) snapshot() utils.Message {
+	msg := m.Message
+	if m.Reactions != nil {
+		msg.Reactions = make(map[string][]string, len(m.Reactions))
+		for k, users := range m.Reactions {
+			msg.Reactions[k] = append([]string(nil), users...)
+		}
+	}
+	return msg
+}
+
+// appendLocked 写一行日志，调用方必须持有 s.mu
+func (s *messageStore) appendLocked(rec logRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = s.f.Write(append(data, '\n'))
+	return err
+}
+
+// add 分配 id 并保存 owner 发的一条新消息；回复要先检查被回复的消息还在
+func (s *messageStore) add(msg utils.Message, owner string) (utils.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg.Parent != "" {
+		p := s.msgs[msg.Parent]
+		if p == nil || p.Deleted || msgRoom(p.Message) != msgRoom(msg) {
+			return msg, fmt.Errorf("no such message: %s", msg.Parent)
+		}
+		if p.Parent != "" { // 回复的回复挂到线程开头那条下面
+			if msg.Seq != 0 { // 签名里有 parent，改了就验不过了，让客户端自己回线程开头
+				return msg, fmt.Errorf("message %s is a reply, reply to #%s instead", msg.Parent, p.Parent)
+			}
+			msg.Parent = p.Parent
+		}
+	}
+	msg.ID = strconv.Itoa(s.nextID)
+	if err := s.appendLocked(logRecord{Msg: &msg, Owner: owner}); err != nil {
+		return msg, err
+	}
+	s.nextID++
+	s.insert(msg, owner)
+	return msg, nil
+}
+
+// recent room 里最近 n 条消息（进房间时重放用），回复的父消息不在里面也没关系，客户端单独显示
+func (s *messageStore) recent(n int, room string) []utils.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []utils.Message
+	for i := len(s.order) - 1; i >= 0 && len(out) < n; i-- {
+		if m := s.msgs[s.order[i]]; msgRoom(m.Message) == room {
+			out = append(out, m.snapshot())
+		}
+	}
+	slices.Reverse(out)
+	return out
+}
+
+// inRoom id 这条消息存在，而且在 room 里
+func (s *messageStore) inRoom(id, room string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.msgs[id]
+	return m != nil && msgRoom(m.Message) == room
+}
+
+// lookupLocked room 里的 id 这条，没有或者在别的房间都返回 nil，调用方必须持有 s.mu
+func (s *messageStore) lookupLocked(id, room string) *storedMessage {
+	if m := s.msgs[id]; m != nil && msgRoom(m.Message) == room {
+		return m
+	}
+	return nil
+}
+
+// resolveLocked 把 "last" 换成 u 在 room 里最近一条没删的消息的 id
+func (s *messageStore) resolveLocked(id string, u User, room string) string {
+	if id != "last" {
+		return id
+	}
+	for i := len(s.order) - 1; i >= 0; i-- {
+		if m := s.msgs[s.order[i]]; u.owns(m.owner) && !m.Deleted && msgRoom(m.Message) == room {
+			return m.ID
+		}
+	}
+	return ""
+}
+
+// react 点表情，房间里谁都可以点；同一个人（按 owner 认）再点一次同一个表情就是取消
+func (s *messageStore) react(id string, u User, emoji, room string) (utils.MessageEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.lookupLocked(id, room)
+	if m == nil || m.Deleted {
+		return utils.MessageEvent{}, fmt.Errorf("no such message")
+	}
+	owner := u.owner()
+	ev := utils.MessageEvent{Op: utils.MessageReact, ID: id, Text: emoji, By: u.Name, Time: time.Now()}
+	if name, ok := m.reacted(emoji, owner); ok {
+		ev.Op, ev.By = utils.MessageUnreact, name // 取消的是点的时候用的那个名字
+	} else if name, ok := m.reacted(emoji, u.connOwner()); ok { // 登录前点的
+		ev.Op, ev.By, owner = utils.MessageUnreact, name, u.connOwner()
+	}
+	if err := s.appendLocked(logRecord{Event: &ev, Owner: owner}); err != nil {
+		return ev, err
+	}
+	s.applyLocked(m, ev, owner)
+	return ev, nil
+}
+
+// change u 编辑或删除 room 里的一条消息：只有作者（按 owner 认，不按名字）和管理员可以，删掉的不能再改
+func (s *messageStore) change(ev utils.MessageEvent, u User, room string) (utils.MessageEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ev.ID = s.resolveLocked(ev.ID, u, room)
+	m := s.lookupLocked(ev.ID, room)
+	if m == nil || m.Deleted {
+		return ev, fmt.Errorf("no such message")
+	}
+	author := u.owns(m.owner)
+	if !u.Admin && !author {
+		return ev, fmt.Errorf("only the author or an admin can change message %s", ev.ID)
+	}
+	// 加密的消息别人（包括管理员）改不了内容，明文改也不行，不然看着像是作者自己说的
+	if ev.Op == utils.MessageEdit && m.Encrypted() && (!author || ev.Cipher == "") {
+		return ev, fmt.Errorf("message %s is end-to-end encrypted, only its author can edit it from an encrypting client", ev.ID)
+	}
+	ev.Time = time.Now()
+	if err := s.appendLocked(logRecord{Event: &ev, Owner: u.owner()}); err != nil {
+		return ev, err
+	}
+	s.applyLocked(m, ev, u.owner())
+	return ev, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"goLearning/pkg/utils"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *messageStore {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	s, err := openStore(messageLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.f.Close() })
+	return s
+}
+
+// reopen 关掉再从日志重放一遍
+func reopen(t *testing.T, s *messageStore) *messageStore {
+	t.Helper()
+	s.f.Close()
+	s2, err := openStore(messageLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s2.f.Close() })
+	return s2
+}
+
+func post(t *testing.T, s *messageStore, u User, text string) utils.Message {
+	t.Helper()
+	msg, err := s.add(utils.Message{From: u.Name, Text: text, Room: defaultRoom, Time: time.Now()}, u.owner())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func edit(s *messageStore, u User, id, text string) error {
+	_, err := s.change(utils.MessageEvent{Op: utils.MessageEdit, ID: id, Text: text, By: u.Name}, u, defaultRoom)
+	return err
+}
+
+func TestChangeChecksOwnerNotName(t *testing.T) {
+	s := newTestStore(t)
+	alice := User{Name: "alice", Session: "s1"}
+	msg := post(t, s, alice, "hello")
+
+	// 别的连接改成 alice 的名字，改不了也删不了，last 也找不到 alice 的消息
+	spoof := User{Name: "alice", Session: "s2"}
+	if err := edit(s, spoof, msg.ID, "pwned"); err == nil {
+		t.Fatal("edit spoofed by taking the author's name")
+	}
+	if _, err := s.change(utils.MessageEvent{Op: utils.MessageDelete, ID: "last", By: "alice"}, spoof, defaultRoom); err == nil {
+		t.Fatal("/delete last resolved to someone else's message")
+	}
+
+	// 作者改了名字照样能改
+	alice.Name = "alice2"
+	if err := edit(s, alice, "last", "hello again"); err != nil {
+		t.Fatalf("author could not edit after a rename: %v", err)
+	}
+	// 管理员能删
+	admin := User{Name: "root", Session: "s3", Admin: true}
+	if _, err := s.change(utils.MessageEvent{Op: utils.MessageDelete, ID: msg.ID, By: admin.Name}, admin, defaultRoom); err != nil {
+		t.Fatal(err)
+	}
+	if m := s.msgs[msg.ID]; !m.Deleted || len(m.History) != 2 {
+		t.Fatalf("deleted=%v history=%d", m.Deleted, len(m.History))
+	}
+}
+
+func TestChangeAcrossLogin(t *testing.T) {
+	s := newTestStore(t)
+	guest := User{Name: "bob", Session: "s1"}
+	before := post(t, s, guest, "as guest")
+
+	bob := guest
+	bob.Account = "bob"
+	after := post(t, s, bob, "logged in")
+	if err := edit(s, bob, before.ID, "mine"); err != nil {
+		t.Fatalf("message sent before login: %v", err)
+	}
+	// 同一个账号从别的连接登录也能改
+	other := User{Name: "bob", Account: "bob", Session: "s9"}
+	if err := edit(s, other, after.ID, "from laptop"); err != nil {
+		t.Fatalf("same account, other connection: %v", err)
+	}
+	if err := edit(s, other, before.ID, "nope"); err == nil {
+		t.Fatal("guest message editable from another connection")
+	}
+}
+
+func TestEncryptedEditOnlyByAuthor(t *testing.T) {
+	s := newTestStore(t)
+	alice := User{Name: "alice", Session: "s1"}
+	msg, _ := s.add(utils.Message{From: "alice", KeyID: "k", Cipher: "c1", Room: defaultRoom}, alice.owner())
+	admin := User{Name: "root", Session: "s2", Admin: true}
+
+	if _, err := s.change(utils.MessageEvent{Op: utils.MessageEdit, ID: msg.ID, KeyID: "k", Cipher: "c2", By: "alice"}, admin, defaultRoom); err == nil {
+		t.Fatal("admin edited an encrypted message")
+	}
+	if err := edit(s, alice, msg.ID, "plain"); err == nil {
+		t.Fatal("encrypted message edited in plain text")
+	}
+	if _, err := s.change(utils.MessageEvent{Op: utils.MessageEdit, ID: msg.ID, KeyID: "k", Cipher: "c2", By: "alice"}, alice, defaultRoom); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReactTogglesByOwner(t *testing.T) {
+	s := newTestStore(t)
+	msg := post(t, s, User{Name: "alice", Session: "s1"}, "hi")
+	bob := User{Name: "bob", Session: "s2"}
+
+	if ev, _ := s.react(msg.ID, bob, "👍", defaultRoom); ev.Op != utils.MessageReact {
+		t.Fatalf("first react: %s", ev.Op)
+	}
+	// 别人叫 bob 也取消不了 bob 的表情
+	spoof := User{Name: "bob", Session: "s3"}
+	if ev, _ := s.react(msg.ID, spoof, "👍", defaultRoom); ev.Op != utils.MessageReact {
+		t.Fatalf("spoofed react: %s", ev.Op)
+	}
+	if got := s.msgs[msg.ID].Reactions["👍"]; !slices.Equal(got, []string{"bob"}) {
+		t.Fatalf("reactions %v", got)
+	}
+	// bob 改名以后再点，取消的是原来那个名字
+	bob.Name = "robert"
+	ev, _ := s.react(msg.ID, bob, "👍", defaultRoom)
+	if ev.Op != utils.MessageUnreact || ev.By != "bob" {
+		t.Fatalf("unreact %s by %s", ev.Op, ev.By)
+	}
+	// 冒充的那个还在
+	if got := s.msgs[msg.ID].Reactions["👍"]; !slices.Equal(got, []string{"bob"}) {
+		t.Fatalf("reactions %v", got)
+	}
+	s.react(msg.ID, spoof, "👍", defaultRoom)
+	if _, ok := s.msgs[msg.ID].Reactions["👍"]; ok {
+		t.Fatal("reaction left after everyone took it back")
+	}
+}
+
+func TestReplayKeepsOwners(t *testing.T) {
+	s := newTestStore(t)
+	alice := User{Name: "alice", Session: "s1"}
+	msg := post(t, s, alice, "hello")
+	s.react(msg.ID, alice, "🎉", defaultRoom)
+
+	s = reopen(t, s)
+	if err := edit(s, User{Name: "alice", Session: "s2"}, msg.ID, "pwned"); err == nil {
+		t.Fatal("owner lost on replay")
+	}
+	if err := edit(s, alice, msg.ID, "edited"); err != nil {
+		t.Fatal(err)
+	}
+	if ev, _ := s.react(msg.ID, alice, "🎉", defaultRoom); ev.Op != utils.MessageUnreact {
+		t.Fatalf("reaction owner lost on replay: %s", ev.Op)
+	}
+}
+
+// 老日志没有 owner：按名字当同名账号，没登录的同名连接动不了
+func TestLegacyRecordsBelongToAccount(t *testing.T) {
+	t.Chdir(t.TempDir())
+	legacy := `{"msg":{"id":"1","from":"carol","text":"old","time":"2024-01-01T00:00:00Z"}}` + "\n" +
+		`{"event":{"op":"react","id":"1","text":"👍","by":"dave","time":"2024-01-01T00:00:00Z"}}` + "\n"
+	if err := os.WriteFile(messageLogPath, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openStore(messageLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.f.Close()
+
+	if err := edit(s, User{Name: "carol", Session: "s1"}, "1", "pwned"); err == nil {
+		t.Fatal("guest took over a legacy message by name")
+	}
+	if err := edit(s, User{Name: "carol", Account: "carol", Session: "s2"}, "1", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if ev, _ := s.react("1", User{Name: "dave", Account: "dave", Session: "s3"}, "👍", defaultRoom); ev.Op != utils.MessageUnreact {
+		t.Fatalf("legacy reaction: %s", ev.Op)
+	}
+}
+
+func TestRepliesStayInThread(t *testing.T) {
+	s := newTestStore(t)
+	u := User{Name: "alice", Session: "s1"}
+	root := post(t, s, u, "root")
+	reply := func(parent, room string) (utils.Message, error) {
+		return s.add(utils.Message{Parent: parent, From: "alice", Text: "re", Room: room, Time: time.Now()}, u.owner())
+	}
+
+	r1, err := reply(root.ID, defaultRoom)
+	if err != nil || r1.Parent != root.ID {
+		t.Fatalf("reply: parent %q, err %v", r1.Parent, err)
+	}
+	// 回复的回复挂到线程开头
+	r2, err := reply(r1.ID, defaultRoom)
+	if err != nil || r2.Parent != root.ID {
+		t.Fatalf("reply to a reply: parent %q, err %v", r2.Parent, err)
+	}
+	if _, err := reply("999", defaultRoom); err == nil {
+		t.Error("reply to a missing message accepted")
+	}
+	if _, err := reply(root.ID, "dev"); err == nil {
+		t.Error("reply from another room accepted")
+	}
+	if _, err := s.change(utils.MessageEvent{Op: utils.MessageDelete, ID: root.ID, By: "alice"}, u, defaultRoom); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reply(root.ID, defaultRoom); err == nil {
+		t.Error("reply to a deleted message accepted")
+	}
+
+	s = reopen(t, s)
+	if m := s.msgs[r2.ID]; m == nil || m.Parent != root.ID {
+		t.Errorf("thread lost on replay: %+v", m)
+	}
+}
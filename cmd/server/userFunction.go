@@ -1,90 +1,227 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"goLearning/pkg/utils"
 	"io"
+	"io/fs"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-func ReceiveFile(massage string, conn net.Conn, name string) error {
+// incomingFile 一个正在上传到服务器的文件，数据帧由 handle 的读循环按 id 分发过来
+type incomingFile struct {
+	id       string
+	name     string
+	size     int64 // -1 表示大小未知，以 FILE_END|<id> 结束
+	got      int64
+	f        *os.File
+	uploader string // 上传者的名字，广播用
+	owner    string // 上传者的账号或连接，写进索引
+	room     string // 在哪个房间传的
+	res      *reservation
+	conn     net.Conn
+}
+
+// ReceiveFile 处理上传的文件头，检查通过后回 FILE_OK，之后的 DATA 帧交给 write
+// active 是这个连接上正在进行的上传，id 重复的直接拒绝，不然原来那个的临时文件和配额就没人管了
+func ReceiveFile(massage string, conn net.Conn, u User, active map[string]*incomingFile) (*incomingFile, error) {
 	// massage 是 ReadFrame(conn) 读到的那一帧
-	// 格式：FILE|filename|size
+	// 格式：FILE|filename|size|id，size 为 -1 表示边打包边上传，大小未知
 
 	parts := strings.Split(massage, "|")
-	if len(parts) != 3 || parts[0] != "FILE" {
-		return fmt.Errorf("bad file header: %q", massage)
+	if len(parts) != 4 || parts[0] != "FILE" || parts[3] == "" {
+		return nil, fmt.Errorf("bad file header: %q", massage)
 	}
 	filename := filepath.Base(parts[1])
+	id := parts[3]
+
+	reject := func(reason string) {
+		_ = send(conn, []byte(fmt.Sprintf("FILE_REJECT|%s|%s", id, reason)))
+	}
 
+	if active[id] != nil {
+		reject("duplicate id")
+		return nil, fmt.Errorf("duplicate upload id: %q", id)
+	}
 	size, err := strconv.ParseInt(parts[2], 10, 64)
-	if err != nil || size < 0 {
-		return fmt.Errorf("bad size in header: %v", parts[2])
+	if err != nil || size < -1 {
+		reject("bad size")
+		return nil, fmt.Errorf("bad size in header: %v", parts[2])
+	}
+	if filename == "." || filename == "/" || strings.HasPrefix(filename, ".") { // 点开头的是服务器自己的文件
+		reject("bad filename")
+		return nil, fmt.Errorf("bad filename: %q", parts[1])
 	}
 
-	os.MkdirAll("uploads", 0755) //创建目录，不存在就创建，存在就忽略
-	dstPath := filepath.Join("uploads", filename)
+	// 先按上传策略检查文件头，不通过就立刻告诉上传者，客户端不会再发数据帧
+	res, err := reserveUpload(u, filename, size)
+	if err != nil {
+		reject(err.Error())
+		return nil, fmt.Errorf("reject %s: %w", filename, err)
+	}
 
-	//写文件，开一个文件句柄
-	writerHandler, err := os.Create(dstPath)
+	os.MkdirAll(uploadDir, 0755) //创建目录，不存在就创建，存在就忽略
+	// 先写到隐藏的临时文件，收完再改名，失败的上传不会留下半截文件
+	writerHandler, err := os.CreateTemp(uploadDir, "."+filename+".*.part")
 	if err != nil {
-		// 如果创建失败：仍然要把后续 size 字节的“数据帧”消费掉，否则协议会乱
-		// 这里的消费方式：不断 ReadFrame，然后累计丢弃，直到丢弃够 size
-		var discarded int64
-		for discarded < size {
-			chunk, rerr := utils.SecureReadFrame(conn, aesKey)
-			if rerr != nil {
-				return fmt.Errorf("discard chunks err: %w", rerr)
-			}
-			discarded += int64(len(chunk))
-		}
-		return fmt.Errorf("create file err: %w", err)
+		res.release()
+		reject("server cannot store file")
+		return nil, fmt.Errorf("create file err: %w", err)
 	}
-	defer writerHandler.Close()
 
-	// 循环收 chunk，直到写够 size 字节
-	var got int64
-	for got < size {
-		chunk, err := utils.SecureReadFrame(conn, aesKey)
-		if err != nil {
-			return fmt.Errorf("read chunk: %w (got %d/%d)", err, got, size)
-		}
+	in := &incomingFile{id: id, name: filename, size: size, f: writerHandler, uploader: u.Name, owner: u.owner(), room: u.Room, res: res, conn: conn}
+	if err := send(conn, []byte("FILE_OK|"+id)); err != nil {
+		in.abort()
+		return nil, fmt.Errorf("send ack: %w", err)
+	}
+	return in, nil
+}
 
-		n, err := writerHandler.Write(chunk) //写文件内容
-		if err != nil {
-			return fmt.Errorf("write file: %w", err)
+// write 写一块数据，收满 size 字节返回 done=true
+func (in *incomingFile) write(chunk []byte) (done bool, err error) {
+	if in.size < 0 {
+		// 大小未知：边收边占配额，超了就停
+		if err := in.res.grow(int64(len(chunk))); err != nil {
+			return false, err
 		}
-		got += int64(n)
+	} else if in.got+int64(len(chunk)) > in.size {
+		return false, fmt.Errorf("too much data (got %d/%d)", in.got+int64(len(chunk)), in.size)
+	}
+	n, err := in.f.Write(chunk) //写文件内容
+	in.got += int64(n)
+	if err != nil {
+		return false, fmt.Errorf("write file: %w", err)
 	}
+	return in.got == in.size, nil
+}
 
-	broadcast(fmt.Sprintf("%s uploaded a file: %s\n", name, filename))
+// finish 收完了：改名成正式文件、写索引、广播，并告诉上传者结果（FILE_DONE / FILE_CANCEL）
+func (in *incomingFile) finish() error {
+	if err := in.save(); err != nil {
+		_ = send(in.conn, []byte(fmt.Sprintf("FILE_CANCEL|%s|%v", in.id, err)))
+		return err
+	}
+	_ = send(in.conn, []byte("FILE_DONE|"+in.id))
+	broadcastRoomFrame(in.room, []byte(fmt.Sprintf("[SYSTEM] %s uploaded a file: %s\n", in.uploader, in.name))) // 别的房间的人不用知道
+	broadcastCatalog()
+	return nil
+}
+
+func (in *incomingFile) save() error {
+	defer in.res.release()
+	tmpPath := in.f.Name()
+	defer os.Remove(tmpPath) // 改名成功后这里删不到东西，无所谓
+
+	_ = in.f.Chmod(0644) // CreateTemp 建的是 0600
+	if err := in.f.Close(); err != nil {
+		return fmt.Errorf("close file: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(uploadDir, in.name)); err != nil {
+		return fmt.Errorf("rename file: %w", err)
+	}
+	recordUpload(in.uploader, in.owner, in.room, in.name, in.got)
 	return nil
 }
 
-func fileList() (string, error) {
-	items, err := os.ReadDir("uploads")
+// fail 出错：清理并告诉上传者原因
+func (in *incomingFile) fail(reason string) {
+	in.abort()
+	_ = send(in.conn, []byte(fmt.Sprintf("FILE_CANCEL|%s|%s", in.id, reason)))
+}
+
+// abort 取消或出错：删掉半截文件，释放配额
+func (in *incomingFile) abort() {
+	in.f.Close()
+	os.Remove(in.f.Name())
+	in.res.release()
+}
+
+func isArchive(name string) bool {
+	return strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// cancelSet 一个连接上正在进行的下载，/cancel 时关掉对应的 channel
+type cancelSet struct {
+	mu sync.Mutex
+	m  map[string]chan struct{}
+}
+
+func (c *cancelSet) add(id string) <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = map[string]chan struct{}{}
+	}
+	ch := make(chan struct{})
+	c.m[id] = ch
+	return ch
+}
+
+// done 下载结束后从集合里拿掉
+func (c *cancelSet) done(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, id)
+}
+
+// cancel 返回 false 表示没有这个下载（可能已经发完了）
+func (c *cancelSet) cancel(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.m[id]
+	if ok {
+		close(ch)
+		delete(c.m, id)
+	}
+	return ok
+}
+
+func (c *cancelSet) cancelAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, ch := range c.m {
+		close(ch)
+		delete(c.m, id)
+	}
+}
+
+// fileList /fileList 的回复，只列 u 进得去的房间里的文件
+func fileList(u User) (string, error) {
+	items, err := os.ReadDir(uploadDir)
 	if err != nil {
 		return "", err
 	}
+	rooms := fileRooms()
 
 	var sb strings.Builder
 
 	for _, item := range items {
 		name := item.Name()
+		if strings.HasPrefix(name, ".") { // 索引、临时文件等不展示
+			continue
+		}
 
 		if item.IsDir() {
 			sb.WriteString(fmt.Sprintf("[DIR]  %s\n", name))
-		} else {
+		} else if canEnter(u, rooms[name]) {
 			info, err := item.Info()
 			if err != nil {
 				continue // 读不到信息就跳过
 			}
+			tag := "[FILE]"
+			if isArchive(name) { // 目录/多文件上传打成的包
+				tag = "[TAR] "
+			}
 			sb.WriteString(fmt.Sprintf(
-				"[FILE] %-20s %d bytes\n",
+				"%s %-20s %d bytes\n",
+				tag,
 				name,
 				info.Size(),
 			))
@@ -94,13 +231,44 @@ func fileList() (string, error) {
 	return sb.String(), nil
 }
 
-func fileUpload(filename string, conn net.Conn) error {
-	//先发一帧：FILE|<filename>|<size>（这是文件头，文本）
-	//再发若干帧：每帧是一段文件二进制（例如 32KB）
+// fileNames u 能下载的文件名，给客户端做补全
+func fileNames(u User) []string {
+	return visibleFiles(u, fileRooms())
+}
+
+// visibleFiles files（文件名 -> 房间）里 u 进得去的，按名字排
+func visibleFiles(u User, files map[string]string) []string {
+	var names []string
+	for name, room := range files {
+		if canEnter(u, room) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// errCancelled 下载被客户端取消，不算出错
+var errCancelled = errors.New("cancelled by client")
+
+func fileUpload(filename, id string, conn net.Conn, cancel <-chan struct{}) error {
+	//先发一帧：FILE|<filename>|<size>|<id>（这是文件头，文本）
+	//再发若干帧：每帧是 \x00<id>| 加一段文件二进制（例如 32KB），见 utils.DataFrame
 	//接收端按照 size 累计写入，收满结束（不需要 FILE_END）
-	localpath := filepath.Join("uploads", filename)
+	//客户端发 FILE_CANCEL|<id> 会关闭 cancel，这边停下并回一个 FILE_CANCEL|<id>
+	filename = filepath.Base(filename)
+	if strings.HasPrefix(filename, ".") {
+		return fmt.Errorf("bad filename: %q", filename)
+	}
+	localpath := filepath.Join(uploadDir, filename)
+	if !canSeeFile(userOf(conn), filename) { // 别的房间的文件，回的错和不存在一样
+		return fmt.Errorf("no such file: %s", filename)
+	}
 
 	f, err := os.Open(localpath) //只读打开
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("no such file: %s", filename)
+	}
 	if err != nil {
 		return fmt.Errorf("open file: %w", err)
 	}
@@ -118,21 +286,37 @@ func fileUpload(filename string, conn net.Conn) error {
 	if size < 0 {
 		return fmt.Errorf("invalid file size")
 	}
+	return streamFile(filename, size, f, id, conn, cancel)
+}
 
+// streamFile 按下载的格式把 r 里的 size 字节发出去，/download 和 /export 都用它
+func streamFile(filename string, size int64, r io.Reader, id string, conn net.Conn, cancel <-chan struct{}) error {
 	// 1) 发送“文件头”一帧（文本）
-	header := fmt.Sprintf("FILE|%s|%d", filename, size)
-	if err := utils.SecureWriteFrame(conn, aesKey, []byte(header)); err != nil {
+	header := fmt.Sprintf("FILE|%s|%d|%s", filename, size, id)
+	if err := sendData(conn, []byte(header), false, cancel); err != nil {
 		return fmt.Errorf("send header: %w", err)
 	}
 
-	// 2) 分块发送文件内容：每块一个 frame（二进制）
-	buf := make([]byte, 32*1024)
+	// 2) 分块发送文件内容：每块一个 frame（二进制），图片、压缩包之类的不再压缩
+	compressible := utils.Compressible(filename)
+	buf := make([]byte, utils.ChunkSize)
 	var sent int64
 
 	for { //依然循环发送，一大堆异常处理
-		n, rerr := f.Read(buf)
+		select {
+		case <-cancel:
+			_ = send(conn, []byte("FILE_CANCEL|"+id))
+			return errCancelled
+		default:
+		}
+
+		n, rerr := r.Read(buf)
 		if n > 0 {
-			if err := utils.SecureWriteFrame(conn, aesKey, buf[:n]); err != nil {
+			// 队列满了就等着，不会被当成慢客户端断开
+			if err := sendData(conn, utils.DataFrame(id, buf[:n]), compressible, cancel); errors.Is(err, errCancelled) {
+				_ = send(conn, []byte("FILE_CANCEL|"+id))
+				return err
+			} else if err != nil {
 				return fmt.Errorf("send chunk: %w", err)
 			}
 			sent += int64(n)
@@ -141,11 +325,13 @@ func fileUpload(filename string, conn net.Conn) error {
 			break
 		}
 		if rerr != nil {
+			_ = sendData(conn, []byte("FILE_CANCEL|"+id+"|read error"), false, cancel)
 			return fmt.Errorf("read file: %w", rerr)
 		}
 	}
 
 	if sent != size {
+		_ = sendData(conn, []byte("FILE_CANCEL|"+id+"|file changed while sending"), false, cancel)
 		return fmt.Errorf("sent %d bytes, want %d", sent, size)
 	}
 	return nil
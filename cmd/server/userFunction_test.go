@@ -0,0 +1,160 @@
+package main
+
+import (
+	"goLearning/pkg/utils"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// drain 把服务器发到 conn 另一头的帧都读出来
+func drain(t *testing.T, conn net.Conn) <-chan string {
+	t.Helper()
+	out := make(chan string, 64)
+	go func() {
+		for {
+			b, err := utils.SecureReadFrame(conn, aesKey)
+			if err != nil {
+				close(out)
+				return
+			}
+			out <- string(b)
+		}
+	}()
+	return out
+}
+
+func TestReceiveFileRejectsDuplicateID(t *testing.T) {
+	setupUploads(t, UploadPolicy{UserQuota: 100})
+	server, client := pipeOutbox(t)
+	frames := drain(t, client)
+	u := User{Name: "alice", Session: "s1", Conn: server}
+	active := map[string]*incomingFile{}
+
+	in, err := ReceiveFile("FILE|a.txt|60|id1", server, u, active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active[in.id] = in
+	if f := <-frames; f != "FILE_OK|id1" {
+		t.Fatalf("got %q", f)
+	}
+
+	if _, err := ReceiveFile("FILE|b.txt|30|id1", server, u, active); err == nil {
+		t.Fatal("duplicate id accepted")
+	}
+	if f := <-frames; !strings.HasPrefix(f, "FILE_REJECT|id1|") {
+		t.Fatalf("got %q", f)
+	}
+	// 第二个头被拒了，没占配额
+	if reservedUser[u.owner()] != 60 {
+		t.Fatalf("reserved %d, want 60", reservedUser[u.owner()])
+	}
+	in.abort()
+	if len(reservedUser) != 0 {
+		t.Fatalf("abort left %v reserved", reservedUser)
+	}
+}
+
+// setupFileRooms 大厅里一个文件，只能邀请进的 #ops 里一个文件
+func setupFileRooms(t *testing.T) (member, outsider User) {
+	setupRooms(t)
+	setupUploads(t, UploadPolicy{})
+	member = User{Name: "alice", Account: "alice", Session: "s1"}
+	createRoom("ops", member.Account)
+	if err := setInviteOnly(member, "ops", true); err != nil {
+		t.Fatal(err)
+	}
+	rooms["ops"].Members = map[string]bool{member.Account: true}
+	writeUpload(t, "pub.txt", 3)
+	recordUpload(member.Name, member.owner(), defaultRoom, "pub.txt", 3)
+	writeUpload(t, "plan.txt", 5)
+	recordUpload(member.Name, member.owner(), "ops", "plan.txt", 5)
+	return member, User{Name: "eve", Session: "s2"}
+}
+
+func TestFilesFollowRooms(t *testing.T) {
+	member, outsider := setupFileRooms(t)
+
+	if got := fileNames(outsider); !slices.Equal(got, []string{"pub.txt"}) {
+		t.Errorf("outsider sees %v", got)
+	}
+	if got := fileNames(member); !slices.Equal(got, []string{"plan.txt", "pub.txt"}) {
+		t.Errorf("member sees %v", got)
+	}
+	if got := fileNames(User{Name: "root", Admin: true}); len(got) != 2 {
+		t.Errorf("admin sees %v", got)
+	}
+	if list, _ := fileList(outsider); strings.Contains(list, "plan.txt") || !strings.Contains(list, "pub.txt") {
+		t.Errorf("outsider's /fileList:\n%s", list)
+	}
+
+	// 删不了，回的错和文件不存在一样
+	_, hidden := removeFile("plan.txt", outsider)
+	_, missing := removeFile("nope.txt", outsider)
+	if hidden == nil || strings.ReplaceAll(hidden.Error(), "plan.txt", "X") != strings.ReplaceAll(missing.Error(), "nope.txt", "X") {
+		t.Errorf("/rm of a hidden file = %v, of a missing one = %v", hidden, missing)
+	}
+	if room, err := removeFile("plan.txt", member); err != nil || room != "ops" {
+		t.Errorf("member /rm = %q, %v", room, err)
+	}
+}
+
+func TestDownloadHiddenFile(t *testing.T) {
+	server, client := pipeOutbox(t)
+	frames := drain(t, client)
+	onlineAs(t, User{}) // 先换 store，它会换工作目录
+	_, outsider := setupFileRooms(t)
+	outsider.Conn = server
+	UserList = []User{outsider}
+
+	hidden := fileUpload("plan.txt", "d1", server, nil)
+	missing := fileUpload("nope.txt", "d2", server, nil)
+	if hidden == nil || strings.ReplaceAll(hidden.Error(), "plan.txt", "X") != strings.ReplaceAll(missing.Error(), "nope.txt", "X") {
+		t.Fatalf("download of a hidden file = %v, of a missing one = %v", hidden, missing)
+	}
+	select {
+	case f := <-frames:
+		t.Fatalf("sent %.40q for a hidden file", f)
+	default:
+	}
+}
+
+// 删除通知和文件目录只发给进得去那个房间的人
+func TestFileNoticesStayInRoom(t *testing.T) {
+	mConn, mClient := pipeOutbox(t)
+	oConn, oClient := pipeOutbox(t)
+	mFrames, oFrames := drain(t, mClient), drain(t, oClient)
+	onlineAs(t, User{})
+	member, outsider := setupFileRooms(t)
+	member.Conn, member.Room = mConn, defaultRoom
+	outsider.Conn, outsider.Room = oConn, defaultRoom
+	userMu.Lock()
+	UserList = []User{member, outsider}
+	userMu.Unlock()
+
+	broadcastMembers("ops", "alice deleted a file: plan.txt\n")
+	broadcastCatalog()
+
+	next := func(frames <-chan string) string {
+		select {
+		case f := <-frames:
+			return f
+		case <-time.After(time.Second):
+			t.Fatal("no frame")
+			return ""
+		}
+	}
+	if f := next(mFrames); !strings.Contains(f, "plan.txt") {
+		t.Errorf("member got %q", f)
+	}
+	if names, _ := utils.ParseCatalog(next(mFrames)); !slices.Equal(names, []string{"plan.txt", "pub.txt"}) {
+		t.Errorf("member's catalog = %v", names)
+	}
+	// 外人第一帧就是目录，没有删除通知，目录里也没有 plan.txt
+	if names, ok := utils.ParseCatalog(next(oFrames)); !ok || !slices.Equal(names, []string{"pub.txt"}) {
+		t.Errorf("outsider's first frame was not a catalog without plan.txt: %v, %v", names, ok)
+	}
+}
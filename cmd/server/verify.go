@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goLearning/pkg/utils"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// ./server verify <transcript.jsonl>：检查导出记录里每条消息的签名。
+// 签名只能说明"持有这把公钥的人发的"，公钥是不是本人的要拿最后打出来的指纹和 /fingerprint 对一下。
+// 同一把公钥的同一个序号出现在两条消息上，是服务器拿签过名的内容又发了一遍，也算不对
+
+// verifyResult 一份记录的验证结果
+type verifyResult struct {
+	ok, unsigned, legacy int
+	bad                  []string            // "#17 alice" 这样的，签名不对的消息
+	keys                 map[string][]string // 作者 -> 签名用过的公钥
+	seqs                 map[string]string   // "公钥|序号" -> 第一次见到它的消息 id
+}
+
+// runVerify 有签名不对的就返回错误，命令行退出码是 1
+func runVerify(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: ./server verify <transcript.jsonl>")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	res := verifyResult{keys: map[string][]string{}, seqs: map[string]string{}}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), utils.MaxFrameSize)
+	for line := 1; sc.Scan(); line++ {
+		var rec struct {
+			Type string `json:"type"`
+			exportedMessage
+		}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return fmt.Errorf("%s:%d: %v", args[0], line, err)
+		}
+		if line == 1 && rec.Type != "transcript" {
+			return fmt.Errorf("%s is not a jsonl transcript (./server export ... jsonl)", args[0])
+		}
+		if rec.Type == "message" {
+			res.check(rec.exportedMessage)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d signed and valid (%d in the old format without replay protection), %d unsigned, %d invalid\n", res.ok, res.legacy, res.unsigned, len(res.bad))
+	for _, b := range res.bad {
+		fmt.Println("  invalid:", b)
+	}
+	authors := make([]string, 0, len(res.keys))
+	for name := range res.keys {
+		authors = append(authors, name)
+	}
+	sort.Strings(authors)
+	if len(authors) > 0 {
+		fmt.Println("signing keys (compare with /fingerprint <name>):")
+	}
+	for _, name := range authors {
+		for _, key := range res.keys[name] {
+			fmt.Printf("  %-16s %s\n", name, utils.Fingerprint(key))
+		}
+	}
+	if len(res.bad) > 0 {
+		return fmt.Errorf("%d invalid or replayed message(s)", len(res.bad))
+	}
+	return nil
+}
+
+// check 现在的内容和编辑前的版本都验一遍；删掉的和明文的没有签名
+func (r *verifyResult) check(m exportedMessage) {
+	r.checkOne(m.Message, fmt.Sprintf("#%s %s", m.ID, m.From))
+	for i, v := range m.History {
+		if v.Cipher == "" {
+			continue
+		}
+		old := m.Message // 第一个版本是发出来的那条，后面的都是编辑出来的
+		old.KeyID, old.Cipher, old.Key, old.Sig, old.Seq, old.Edited = v.KeyID, v.Cipher, v.Key, v.Sig, v.Seq, i > 0
+		r.checkOne(old, fmt.Sprintf("#%s %s (version %d)", m.ID, m.From, i+1))
+	}
+}
+
+func (r *verifyResult) checkOne(m utils.Message, label string) {
+	switch {
+	case m.Deleted && m.Cipher == "": // 删掉的没什么可验的
+	case m.Sig == "":
+		r.unsigned++
+	case !utils.VerifySignature(m.Key, m.Envelope(), m.Sig):
+		r.bad = append(r.bad, label+" (signature)")
+	case m.Seq == 0:
+		r.ok++
+		r.legacy++
+		r.addKey(m)
+	default:
+		seq := m.Key + "|" + strconv.FormatInt(m.Seq, 10)
+		if first, ok := r.seqs[seq]; ok && first != m.ID {
+			r.bad = append(r.bad, fmt.Sprintf("%s (replay of #%s)", label, first))
+			return
+		}
+		r.seqs[seq] = m.ID
+		r.ok++
+		r.addKey(m)
+	}
+}
+
+func (r *verifyResult) addKey(m utils.Message) {
+	if !slices.Contains(r.keys[m.From], m.Key) {
+		r.keys[m.From] = append(r.keys[m.From], m.Key)
+	}
+}
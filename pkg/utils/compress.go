@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 压缩方式，握手时协商：client 发 "Infernity|zstd,gzip,deflate"（按偏好排序），
+// server 回 "COMPRESS|<mode>"，之后这个连接上的帧都带一个标志字节，文件数据帧按 mode 压缩。
+// 别的帧里有攻击者能控制的文字，和秘密（邀请码、密文、别人的消息）混在一起压缩再加密，
+// 看密文长度就能一个字一个字猜出秘密（CRIME），所以命令、系统消息这些一律不压。
+// 聊天只压"一帧里只有一个人自己的一条消息"的帧（SecureWriteText）：客户端发的 E2E|/DM|、
+// 服务器转发给房间的单条 MSG|。帧里没有秘密，也没有别人的文字，猜不出什么。
+// 端到端加密的消息正文在加密之前自己压一次（PackText），不然密文压不动。
+// 只发 "Infernity" 的老客户端（比如网页）不压缩，帧格式和原来一样。
+const (
+	CompressNone    = "none"
+	CompressGzip    = "gzip"
+	CompressDeflate = "deflate"
+	CompressZstd    = "zstd"
+)
+
+// SupportedCompression 本实现支持的压缩方式，默认偏好顺序
+var SupportedCompression = []string{CompressZstd, CompressGzip, CompressDeflate}
+
+// 开启压缩后，每帧明文前面多一个标志字节（在加密之前加上）
+const (
+	flagRaw        byte = 0
+	flagCompressed byte = 1
+)
+
+// 小帧压缩不划算，直接原样发
+const minCompressSize = 128
+
+// connModes 记录每个连接协商出来的压缩方式，没有记录就是不压缩
+var connModes sync.Map // net.Conn -> string
+
+// SetCompression 设置连接的压缩方式，握手完成后调用；CompressNone 等于清除
+func SetCompression(conn net.Conn, mode string) error {
+	switch mode {
+	case CompressNone, "":
+		connModes.Delete(conn)
+	case CompressGzip, CompressDeflate, CompressZstd:
+		connModes.Store(conn, mode)
+	default:
+		return fmt.Errorf("unknown compression: %q", mode)
+	}
+	return nil
+}
+
+// ClearCompression 连接关闭时调用，避免记录泄漏
+func ClearCompression(conn net.Conn) {
+	connModes.Delete(conn)
+}
+
+func compressionOf(conn net.Conn) string {
+	if v, ok := connModes.Load(conn); ok {
+		return v.(string)
+	}
+	return CompressNone
+}
+
+// NegotiateCompression 按对方的偏好顺序选第一个我们也允许的，都不行就 none
+func NegotiateCompression(offered, allowed []string) string {
+	for _, o := range offered {
+		o = strings.TrimSpace(o)
+		for _, a := range allowed {
+			if o == a {
+				return o
+			}
+		}
+	}
+	return CompressNone
+}
+
+// Compressible 按扩展名判断文件值不值得压缩（图片、压缩包、音视频本来就压缩过了）
+func Compressible(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".heic", ".avif",
+		".zip", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".7z", ".rar", ".jar", ".apk",
+		".mp3", ".aac", ".ogg", ".flac", ".mp4", ".mkv", ".mov", ".webm", ".avi",
+		".pdf", ".docx", ".xlsx", ".pptx":
+		return false
+	}
+	return true
+}
+
+// ---- 统计，给服务器的 /metrics 用 ----
+
+var (
+	statRawBytes  atomic.Int64 // 开启压缩的连接上，压缩前的字节数（收发都算）
+	statWireBytes atomic.Int64 // 同一批数据实际在线路上的字节数（加密前）
+)
+
+// CompressionStats 返回压缩前和压缩后的总字节数
+func CompressionStats() (raw, wire int64) {
+	return statRawBytes.Load(), statWireBytes.Load()
+}
+
+// ---- 编解码 ----
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxFrameSize))
+)
+
+// packFrame 开启压缩时给明文加上标志字节；compress=false 或者压缩后没变小都原样发
+func packFrame(mode string, plaintext []byte, compress bool) []byte {
+	if compress && len(plaintext) >= minCompressSize {
+		if packed, err := compressBytes(mode, plaintext); err == nil && len(packed) < len(plaintext) {
+			statRawBytes.Add(int64(len(plaintext)))
+			statWireBytes.Add(int64(len(packed)) + 1)
+			return append([]byte{flagCompressed}, packed...)
+		}
+	}
+	statRawBytes.Add(int64(len(plaintext)))
+	statWireBytes.Add(int64(len(plaintext)) + 1)
+	return append([]byte{flagRaw}, plaintext...)
+}
+
+// isDataFrame 文件数据帧，内容全是文件本身
+func isDataFrame(plaintext []byte) bool {
+	return len(plaintext) > 0 && plaintext[0] == dataType
+}
+
+// unpackFrame packFrame 的反过程
+func unpackFrame(mode string, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("missing compression flag")
+	}
+	statWireBytes.Add(int64(len(data)))
+	switch data[0] {
+	case flagRaw:
+		statRawBytes.Add(int64(len(data) - 1))
+		return data[1:], nil
+	case flagCompressed:
+		out, err := decompress(mode, data[1:])
+		if err != nil {
+			return nil, err
+		}
+		statRawBytes.Add(int64(len(out)))
+		return out, nil
+	default:
+		return nil, fmt.Errorf("bad compression flag: %d", data[0])
+	}
+}
+
+func compressBytes(mode string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch mode {
+	case CompressZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CompressGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressDeflate:
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		return nil, fmt.Errorf("unknown compression: %q", mode)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(mode string, data []byte) ([]byte, error) {
+	var r io.Reader
+	switch mode {
+	case CompressZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	case CompressGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	case CompressDeflate:
+		fr := flate.NewReader(bytes.NewReader(data))
+		defer fr.Close()
+		r = fr
+	default:
+		return nil, fmt.Errorf("unknown compression: %q", mode)
+	}
+
+	// 解压后也不能超过帧大小上限，防止压缩炸弹
+	out, err := io.ReadAll(io.LimitReader(r, MaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxFrameSize {
+		return nil, fmt.Errorf("decompressed frame too large")
+	}
+	return out, nil
+}
+
+// ---- 端到端加密的正文：加密之前压缩，只有发送者自己的一条消息 ----
+// 压过的正文以 textPacked 开头，后面是 deflate；没压的原样（打出来的字不会以 \x00 开头，
+// 万一真有，就加 textRaw 前缀，解的时候不会认错）
+
+const (
+	textMark   byte = 0
+	textPacked byte = 'z'
+	textRaw    byte = 'r'
+)
+
+// PackText 消息正文加密前调用，长的、压得动的才压
+func PackText(text string) []byte {
+	if len(text) >= minCompressSize {
+		if packed, err := compressBytes(CompressDeflate, []byte(text)); err == nil && len(packed)+2 < len(text) {
+			return append([]byte{textMark, textPacked}, packed...)
+		}
+	}
+	if len(text) > 0 && text[0] == textMark {
+		return append([]byte{textMark, textRaw}, text...)
+	}
+	return []byte(text)
+}
+
+// UnpackText PackText 的反过来，老客户端发的没压过的正文原样返回
+func UnpackText(b []byte) (string, error) {
+	if len(b) < 2 || b[0] != textMark {
+		return string(b), nil
+	}
+	switch b[1] {
+	case textPacked:
+		out, err := decompress(CompressDeflate, b[2:])
+		return string(out), err
+	case textRaw:
+		return string(b[2:]), nil
+	}
+	return "", fmt.Errorf("bad text packing: %d", b[1])
+}
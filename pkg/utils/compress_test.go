@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		offered, allowed []string
+		want             string
+	}{
+		{[]string{"zstd", "gzip"}, SupportedCompression, CompressZstd},
+		{[]string{" gzip", "zstd"}, SupportedCompression, CompressGzip},
+		{[]string{"zstd", "deflate"}, []string{CompressDeflate}, CompressDeflate},
+		{[]string{"brotli"}, SupportedCompression, CompressNone},
+		{nil, SupportedCompression, CompressNone},
+	}
+	for _, tt := range tests {
+		if got := NegotiateCompression(tt.offered, tt.allowed); got != tt.want {
+			t.Errorf("NegotiateCompression(%v, %v) = %q, want %q", tt.offered, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestPackFrameRoundTrip(t *testing.T) {
+	data := DataFrame("id1", bytes.Repeat([]byte("compress me "), 100))
+	for _, mode := range SupportedCompression {
+		packed := packFrame(mode, data, true)
+		if packed[0] != flagCompressed || len(packed) >= len(data) {
+			t.Errorf("%s: data frame not compressed (%d -> %d)", mode, len(data), len(packed))
+		}
+		got, err := unpackFrame(mode, packed)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: round trip failed: %v", mode, err)
+		}
+	}
+}
+
+// 命令、系统消息这些帧不压缩：压缩后的长度会泄露帧里的秘密
+func TestSecureWriteDataNeverCompressesText(t *testing.T) {
+	frames := [][]byte{
+		[]byte(strings.Repeat("[SYSTEM] invite: /join secret abcdef ", 20)),
+		[]byte("MSG|" + strings.Repeat(`{"text":"aaaa"}`, 50)),
+	}
+	for _, f := range frames {
+		if plain := writeAndRead(t, func(c net.Conn, key []byte) error { return SecureWriteData(c, key, f, true) }); plain[0] != flagRaw || !bytes.Equal(plain[1:], f) {
+			t.Errorf("text frame %.20q was compressed", f)
+		}
+	}
+	// 已经压缩过的文件块也不再压
+	data := DataFrame("id1", bytes.Repeat([]byte("x"), 1000))
+	if packFrame(CompressZstd, data, false)[0] != flagRaw {
+		t.Error("incompressible chunk was compressed")
+	}
+}
+
+func TestUnpackFrameRejectsBadFlag(t *testing.T) {
+	for _, data := range [][]byte{nil, {7, 'x'}, {flagCompressed, 'n', 'o', 'p', 'e'}} {
+		if _, err := unpackFrame(CompressGzip, data); err == nil {
+			t.Errorf("unpackFrame(%v) accepted", data)
+		}
+	}
+}
+
+// writeAndRead 开了 zstd 的连接上写一帧，读出来解密，返回带标志字节的明文
+func writeAndRead(t *testing.T, write func(net.Conn, []byte) error) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := SetCompression(a, CompressZstd); err != nil {
+		t.Fatal(err)
+	}
+	defer ClearCompression(a)
+
+	go write(a, key)
+	enc, err := ReadFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := decryptGCM(key, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+func TestSecureWriteFrameSendsTextRaw(t *testing.T) {
+	text := []byte(strings.Repeat("hello hello ", 100))
+	if plain := writeAndRead(t, func(c net.Conn, key []byte) error { return SecureWriteFrame(c, key, text) }); plain[0] != flagRaw || !bytes.Equal(plain[1:], text) {
+		t.Fatal("text frame compressed on the wire")
+	}
+}
+
+// 一个人自己的一条消息可以压
+func TestSecureWriteTextCompresses(t *testing.T) {
+	frame := MessageFrame(Message{From: "alice", Text: strings.Repeat("panic: nil pointer dereference\n", 40)})
+	plain := writeAndRead(t, func(c net.Conn, key []byte) error { return SecureWriteText(c, key, frame) })
+	if plain[0] != flagCompressed || len(plain) >= len(frame) {
+		t.Fatalf("message frame not compressed (%d -> %d)", len(frame), len(plain))
+	}
+	if got, err := unpackFrame(CompressZstd, plain); err != nil || !bytes.Equal(got, frame) {
+		t.Fatalf("round trip failed: %v", err)
+	}
+	// 短消息不值得压
+	short := MessageFrame(Message{From: "alice", Text: "hi"})
+	if plain := writeAndRead(t, func(c net.Conn, key []byte) error { return SecureWriteText(c, key, short) }); plain[0] != flagRaw {
+		t.Error("short message was compressed")
+	}
+}
+
+func TestPackText(t *testing.T) {
+	long := strings.Repeat("2026-10-19 12:00:00 INFO request ok\n", 30)
+	tests := []struct {
+		text   string
+		packed bool
+	}{
+		{"hi", false},
+		{long, true},
+		{"\x00zstarts with the marker", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		b := PackText(tt.text)
+		if packed := len(b) < len(tt.text); packed != tt.packed {
+			t.Errorf("PackText(%.20q) packed=%v, want %v", tt.text, packed, tt.packed)
+		}
+		if got, err := UnpackText(b); err != nil || got != tt.text {
+			t.Errorf("round trip %.20q = %.20q, %v", tt.text, got, err)
+		}
+	}
+	// 老客户端发的正文没有标志，原样返回
+	if got, err := UnpackText([]byte("plain old text")); err != nil || got != "plain old text" {
+		t.Errorf("legacy text = %q, %v", got, err)
+	}
+	if _, err := UnpackText([]byte{0, '?', 'x'}); err == nil {
+		t.Error("unknown packing accepted")
+	}
+}
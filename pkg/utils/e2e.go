@@ -0,0 +1,382 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 端到端加密：传输层的 AES key 大家共用，服务器也有，所以聊天内容还要再加密一层，服务器只转发密文
+//   KEY|<公钥 base64>                               客户端 -> 服务器：自己的身份公钥（X25519 加密用的 32 字节，
+//                                                   后面跟 Ed25519 签名用的 32 字节；老客户端只有前一半），
+//                                                   服务器放在 ROSTER/PRESENCE 的 key 里告诉大家
+//   KEYS|{"name":"bob","key":"..."}                 服务器 -> 客户端：/key <name> 的回复，不在线的注册用户也能查，没有 key 是空串
+//   SKEY|{"room","from","to","keyId","box"}         发送者密钥：发消息的人给房间里每个人各发一份，
+//                                                   box 用两人的共享密钥封着，服务器只转给 to
+//   E2E|{"parent","edit","mentions","keyId","cipher","seq"} 客户端 -> 服务器：加密的聊天消息（edit 不空就是编辑那条），
+//                                                   服务器照常分配 id，包成 MSG| 广播，text 是空的
+//   DM|{"from","key","to","cipher","seq","time"}    加密的私信，直接用两人的共享密钥，from/key/time 由服务器填
+// 房间消息用"发送者密钥"：每个人在每个房间有一把自己的 AES key，发给当时在房间里的人；
+// 有人离开房间就换一把新的，后来的人看不到以前的消息。@ 谁由客户端自己算好带上，服务器看不到内容
+// 消息和私信还带着发送人的签名（sig），签的是密文，服务器和导出的记录不用解密也能验证是谁发的；
+// 服务器存消息的时候把发送人当时的公钥也存上（key），见 MessageEnvelope。
+// seq 是发的人自己的递增序号，也签在里面：服务器不收用过的序号，客户端看到同一个序号出现两次、
+// 或者一条消息的序号变小了（被换回了编辑前的版本）就标出来
+
+const (
+	keyPrefix       = "KEY|"
+	keyInfoPrefix   = "KEYS|"
+	senderKeyPrefix = "SKEY|"
+	sealedPrefix    = "E2E|"
+	directPrefix    = "DM|"
+)
+
+// SenderKey 一个人在一个房间用的消息密钥，Box 是封给 To 的
+type SenderKey struct {
+	Room  string `json:"room"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	KeyID string `json:"keyId"`
+	Box   string `json:"box"`
+}
+
+// Sealed 客户端发的加密消息或编辑
+type Sealed struct {
+	Parent   string   `json:"parent,omitempty"`
+	Edit     string   `json:"edit,omitempty"` // 要编辑的消息 id（或 last）
+	Mentions []string `json:"mentions,omitempty"`
+	KeyID    string   `json:"keyId"`
+	Cipher   string   `json:"cipher"`
+	Sig      string   `json:"sig,omitempty"`
+	Seq      int64    `json:"seq,omitempty"` // 签名里的序号，老客户端没有
+}
+
+// Direct 加密的私信
+type Direct struct {
+	From   string    `json:"from,omitempty"`
+	Key    string    `json:"key,omitempty"` // 发的人的公钥，服务器填上，不在线的人发的也能解
+	To     string    `json:"to"`
+	Cipher string    `json:"cipher"`
+	Sig    string    `json:"sig,omitempty"`
+	Seq    int64     `json:"seq,omitempty"`
+	Time   time.Time `json:"time,omitzero"`
+}
+
+// KeyInfo 某个人的身份公钥
+type KeyInfo struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// ---- 密钥和加解密 ----
+
+// NewIdentity 生成一个身份密钥对
+func NewIdentity() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// PublicIdentity 自己的身份公钥转成 base64：X25519 公钥后面接上 Ed25519 公钥，KEY| 和 roster 里都是这个
+func PublicIdentity(priv *ecdh.PrivateKey) string {
+	raw := append(priv.PublicKey().Bytes(), SigningKey(priv).Public().(ed25519.PublicKey)...)
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// SigningKey 签名用的 Ed25519 私钥，从身份私钥派生，身份文件不用改
+func SigningKey(priv *ecdh.PrivateKey) ed25519.PrivateKey {
+	seed, _ := hkdf.Key(sha256.New, priv.Bytes(), nil, "goLearning signing v1", ed25519.SeedSize)
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// ParsePublicKey 检查别人发来的公钥是不是合法的身份公钥，返回加密用的 X25519 那一半
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || (len(b) != 32 && len(b) != 32+ed25519.PublicKeySize) {
+		return nil, errors.New("bad public key")
+	}
+	return ecdh.X25519().NewPublicKey(b[:32])
+}
+
+// ParseSigningKey 身份公钥里签名用的那一半，老客户端的公钥没有
+func ParseSigningKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != 32+ed25519.PublicKeySize {
+		return nil, errors.New("no signing key")
+	}
+	return ed25519.PublicKey(b[32:]), nil
+}
+
+// Sign 用身份私钥签 envelope，结果是 base64
+func Sign(priv *ecdh.PrivateKey, envelope string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(SigningKey(priv), []byte(envelope)))
+}
+
+// VerifySignature key 是发的人的身份公钥
+func VerifySignature(key, envelope, sig string) bool {
+	pub, err := ParseSigningKey(key)
+	if err != nil {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	return err == nil && ed25519.Verify(pub, []byte(envelope), raw)
+}
+
+// MessageEnvelope 房间消息签的内容：房间、发送人、序号、回复的哪条（parent）或者改的哪条（edit）、密钥 id 和密文。
+// id 和时间是服务器定的，不在里面；序号防的是服务器把签过名的内容换个 id 再发一遍，或者换回旧版本
+func MessageEnvelope(room, from string, seq int64, parent, edit, keyID, cipher string) string {
+	if room == "" {
+		room = DefaultRoom
+	}
+	return envelope("msg", room, from, strconv.FormatInt(seq, 10), parent, edit, keyID, cipher)
+}
+
+// envelope 每个字段前面写上字节长度："goLearning sig v2|msg|5:lobby|5:alice|..."。
+// 名字里可以有 "|"，光用 "|" 隔开的话 "a|b"+"c" 和 "a"+"b|c" 签出来一样
+func envelope(kind string, fields ...string) string {
+	var sb strings.Builder
+	sb.WriteString("goLearning sig v2|" + kind)
+	for _, f := range fields {
+		sb.WriteString("|" + strconv.Itoa(len(f)) + ":" + f)
+	}
+	return sb.String()
+}
+
+// LegacyMessageEnvelope 老客户端（没有 seq）签的内容，验得过也挡不住重放
+func LegacyMessageEnvelope(room, from, keyID, cipher string) string {
+	if room == "" {
+		room = DefaultRoom
+	}
+	return "goLearning sig v1|msg|" + room + "|" + from + "|" + keyID + "|" + cipher
+}
+
+// DirectEnvelope 私信签的内容，seq 和房间消息共用一个序号
+func DirectEnvelope(from, to string, seq int64, cipher string) string {
+	return envelope("dm", from, to, strconv.FormatInt(seq, 10), cipher)
+}
+
+// LegacyDirectEnvelope 老客户端的私信签名
+func LegacyDirectEnvelope(from, to, cipher string) string {
+	return "goLearning sig v1|dm|" + from + "|" + to + "|" + cipher
+}
+
+// Envelope 这条私信签名签的内容
+func (d Direct) Envelope() string {
+	if d.Seq == 0 {
+		return LegacyDirectEnvelope(d.From, d.To, d.Cipher)
+	}
+	return DirectEnvelope(d.From, d.To, d.Seq, d.Cipher)
+}
+
+// Fingerprint 公钥的指纹：SHA-256 的前 16 字节，四个十六进制一组，念给对方听或者并排看都方便
+func Fingerprint(key string) string {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "?"
+	}
+	sum := sha256.Sum256(raw)
+	groups := make([]string, 8)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("%02X%02X", sum[2*i], sum[2*i+1])
+	}
+	return strings.Join(groups, " ")
+}
+
+// SafetyNumber 两个人的安全码：两把公钥排好序一起算，双方看到的一样，12 组 5 位数字
+func SafetyNumber(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	sum := sha512.Sum512([]byte("goLearning safety number v1|" + a + "|" + b))
+	groups := make([]string, 12)
+	for i := range groups {
+		n := binary.BigEndian.Uint64(append([]byte{0, 0, 0}, sum[5*i:5*i+5]...))
+		groups[i] = fmt.Sprintf("%05d", n%100000)
+	}
+	return strings.Join(groups, " ")
+}
+
+// pairKey 两个人的共享密钥：ECDH 以后过一遍 HKDF，双方算出来一样
+func pairKey(priv *ecdh.PrivateKey, peer string) ([]byte, error) {
+	pub, err := ParsePublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Key(sha256.New, shared, nil, "goLearning e2e v1", 32)
+}
+
+// SealFor 用自己和 peer 的共享密钥加密，aad 不加密但是被认证（放房间、收发人，挪作他用就解不开）
+func SealFor(priv *ecdh.PrivateKey, peer string, plaintext []byte, aad string) (string, error) {
+	key, err := pairKey(priv, peer)
+	if err != nil {
+		return "", err
+	}
+	return seal(key, plaintext, aad)
+}
+
+// OpenFrom SealFor 的反过来，peer 是对方的公钥
+func OpenFrom(priv *ecdh.PrivateKey, peer, box, aad string) ([]byte, error) {
+	key, err := pairKey(priv, peer)
+	if err != nil {
+		return nil, err
+	}
+	return open(key, box, aad)
+}
+
+// NewSenderKey 生成一把房间消息密钥和它的 id
+func NewSenderKey() (id string, key []byte, err error) {
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, err
+	}
+	id, err = RandomString(10)
+	return id, key, err
+}
+
+// SealMessage 用发送者密钥加密一条消息，长的正文先压缩（PackText）
+func SealMessage(key []byte, text, aad string) (string, error) {
+	return seal(key, PackText(text), aad)
+}
+
+// OpenMessage 解开一条消息
+func OpenMessage(key []byte, cipher, aad string) (string, error) {
+	b, err := open(key, cipher, aad)
+	if err != nil {
+		return "", err
+	}
+	return UnpackText(b)
+}
+
+// MessageAAD 房间消息绑定房间、发送人和密钥 id，服务器把密文挪到别的房间或者换个发送人都解不开
+func MessageAAD(room, from, keyID string) string {
+	return "msg|" + room + "|" + from + "|" + keyID
+}
+
+// SenderKeyAAD 封发送者密钥用的
+func SenderKeyAAD(room, from, to, keyID string) string {
+	return "skey|" + room + "|" + from + "|" + to + "|" + keyID
+}
+
+// DirectAAD 私信用的
+func DirectAAD(from, to string) string {
+	return "dm|" + from + "|" + to
+}
+
+// seal nonce 放在密文前面，整个转成 base64
+func seal(key, plaintext []byte, aad string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := gcm.Seal(nonce, nonce, plaintext, []byte(aad))
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+func open(key []byte, box, aad string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(box)
+	if err != nil {
+		return nil, errors.New("bad ciphertext")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(aad))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ---- 帧 ----
+
+// KeyFrame 拼一个 KEY| 帧
+func KeyFrame(pub string) []byte {
+	return []byte(keyPrefix + pub)
+}
+
+// ParseKeyFrame 不是 KEY| 帧就返回 ok=false
+func ParseKeyFrame(frame string) (pub string, ok bool) {
+	pub, ok = strings.CutPrefix(frame, keyPrefix)
+	return pub, ok && pub != ""
+}
+
+// KeyInfoFrame 拼一个 KEYS| 帧
+func KeyInfoFrame(k KeyInfo) []byte {
+	return jsonFrame(keyInfoPrefix, k)
+}
+
+// ParseKeyInfo 不是 KEYS| 帧就返回 ok=false
+func ParseKeyInfo(frame string) (k KeyInfo, ok bool) {
+	ok = parseJSONFrame(frame, keyInfoPrefix, &k)
+	return k, ok
+}
+
+// SenderKeyFrame 拼一个 SKEY| 帧
+func SenderKeyFrame(sk SenderKey) []byte {
+	return jsonFrame(senderKeyPrefix, sk)
+}
+
+// ParseSenderKey 不是 SKEY| 帧就返回 ok=false
+func ParseSenderKey(frame string) (sk SenderKey, ok bool) {
+	ok = parseJSONFrame(frame, senderKeyPrefix, &sk)
+	return sk, ok
+}
+
+// SealedFrame 拼一个 E2E| 帧
+func SealedFrame(s Sealed) []byte {
+	return jsonFrame(sealedPrefix, s)
+}
+
+// ParseSealed 不是 E2E| 帧就返回 ok=false
+func ParseSealed(frame string) (s Sealed, ok bool) {
+	ok = parseJSONFrame(frame, sealedPrefix, &s)
+	return s, ok
+}
+
+// DirectFrame 拼一个 DM| 帧
+func DirectFrame(d Direct) []byte {
+	return jsonFrame(directPrefix, d)
+}
+
+// ParseDirect 不是 DM| 帧就返回 ok=false
+func ParseDirect(frame string) (d Direct, ok bool) {
+	ok = parseJSONFrame(frame, directPrefix, &d)
+	return d, ok
+}
+
+func jsonFrame(prefix string, v any) []byte {
+	data, _ := json.Marshal(v)
+	return append([]byte(prefix), data...)
+}
+
+func parseJSONFrame(frame, prefix string, v any) bool {
+	rest, ok := strings.CutPrefix(frame, prefix)
+	return ok && json.Unmarshal([]byte(rest), v) == nil
+}
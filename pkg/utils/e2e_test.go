@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSealForBothWays(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+	eve, _ := NewIdentity()
+	aad := DirectAAD("alice", "bob")
+
+	box, err := SealFor(alice, PublicIdentity(bob), []byte("hi bob"), aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 双方算出来的共享密钥一样，收件人和发件人（回显）都能解
+	if got, err := OpenFrom(bob, PublicIdentity(alice), box, aad); err != nil || string(got) != "hi bob" {
+		t.Fatalf("bob opened %q, %v", got, err)
+	}
+	if got, err := OpenFrom(alice, PublicIdentity(bob), box, aad); err != nil || string(got) != "hi bob" {
+		t.Fatalf("sender opened the echo as %q, %v", got, err)
+	}
+	if _, err := OpenFrom(eve, PublicIdentity(alice), box, aad); err == nil {
+		t.Error("a third party opened the box")
+	}
+	// 换个收发人（服务器把私信挪给别人）就解不开
+	if _, err := OpenFrom(bob, PublicIdentity(alice), box, DirectAAD("carol", "bob")); err == nil {
+		t.Error("box opened with another sender in the aad")
+	}
+}
+
+func TestSealMessage(t *testing.T) {
+	id, key, err := NewSenderKey()
+	if err != nil || id == "" || len(key) != 32 {
+		t.Fatalf("NewSenderKey = %q, %d bytes, %v", id, len(key), err)
+	}
+	aad := MessageAAD("dev", "alice", id)
+	c1, err := SealMessage(key, "hello", aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, _ := SealMessage(key, "hello", aad)
+	if c1 == c2 {
+		t.Error("same ciphertext twice, nonce reused")
+	}
+	if got, err := OpenMessage(key, c1, aad); err != nil || got != "hello" {
+		t.Fatalf("OpenMessage = %q, %v", got, err)
+	}
+	for _, other := range []string{MessageAAD("ops", "alice", id), MessageAAD("dev", "mallory", id)} {
+		if _, err := OpenMessage(key, c1, other); err == nil {
+			t.Errorf("opened with aad %q", other)
+		}
+	}
+	raw, _ := base64.StdEncoding.DecodeString(c1)
+	raw[len(raw)-1] ^= 1
+	if _, err := OpenMessage(key, base64.StdEncoding.EncodeToString(raw), aad); err == nil {
+		t.Error("tampered ciphertext opened")
+	}
+	if _, err := OpenMessage(key, "AAAA", aad); err == nil {
+		t.Error("short ciphertext opened")
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	priv, _ := NewIdentity()
+	full := PublicIdentity(priv)
+	raw, _ := base64.StdEncoding.DecodeString(full)
+	old := base64.StdEncoding.EncodeToString(raw[:32])
+
+	for _, key := range []string{full, old} {
+		pub, err := ParsePublicKey(key)
+		if err != nil || !bytes.Equal(pub.Bytes(), priv.PublicKey().Bytes()) {
+			t.Errorf("ParsePublicKey(%q) = %v", key, err)
+		}
+	}
+	if _, err := ParseSigningKey(old); err == nil {
+		t.Error("old key has no signing half")
+	}
+	for _, bad := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(raw[:31])} {
+		if _, err := ParsePublicKey(bad); err == nil {
+			t.Errorf("ParsePublicKey(%q) accepted", bad)
+		}
+	}
+}
+
+func TestE2EFrames(t *testing.T) {
+	s := Sealed{Parent: "3", Mentions: []string{"bob"}, KeyID: "k", Cipher: "c", Sig: "s", Seq: 7}
+	if got, ok := ParseSealed(string(SealedFrame(s))); !ok || got.Seq != 7 || got.Parent != "3" || got.Cipher != "c" {
+		t.Errorf("sealed round trip = %+v, %v", got, ok)
+	}
+	d := Direct{To: "bob", Cipher: "c", Sig: "s", Seq: 8}
+	if got, ok := ParseDirect(string(DirectFrame(d))); !ok || got != d {
+		t.Errorf("direct round trip = %+v, %v", got, ok)
+	}
+	sk := SenderKey{Room: "dev", From: "alice", To: "bob", KeyID: "k", Box: "b"}
+	if got, ok := ParseSenderKey(string(SenderKeyFrame(sk))); !ok || got != sk {
+		t.Errorf("sender key round trip = %+v, %v", got, ok)
+	}
+	if _, ok := ParseSealed("MSG|{}"); ok {
+		t.Error("MSG| parsed as E2E|")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+	fp := Fingerprint(PublicIdentity(alice))
+	if !regexp.MustCompile(`^[0-9A-F]{4}( [0-9A-F]{4}){7}$`).MatchString(fp) {
+		t.Fatalf("fingerprint %q is not 8 groups of 4 hex digits", fp)
+	}
+	if Fingerprint(PublicIdentity(alice)) != fp {
+		t.Error("fingerprint changed between calls")
+	}
+	if Fingerprint(PublicIdentity(bob)) == fp {
+		t.Error("two keys have the same fingerprint")
+	}
+	if got := Fingerprint("not base64!"); got != "?" {
+		t.Errorf("bad key fingerprint = %q, want ?", got)
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	alice, _ := NewIdentity()
+	bob, _ := NewIdentity()
+	carol, _ := NewIdentity()
+	a, b, c := PublicIdentity(alice), PublicIdentity(bob), PublicIdentity(carol)
+
+	sn := SafetyNumber(a, b)
+	if !regexp.MustCompile(`^[0-9]{5}( [0-9]{5}){11}$`).MatchString(sn) {
+		t.Fatalf("safety number %q is not 12 groups of 5 digits", sn)
+	}
+	// 双方各自算，参数顺序反过来，结果要一样
+	if SafetyNumber(b, a) != sn {
+		t.Error("safety number depends on the argument order")
+	}
+	// 换了一把 key（中间人）就对不上
+	if SafetyNumber(a, c) == sn || SafetyNumber(c, b) == sn {
+		t.Error("a different key gave the same safety number")
+	}
+}
+
+// 长的正文加密前压缩，密文变小，解开还是原文
+func TestSealMessagePacksLongText(t *testing.T) {
+	key := make([]byte, 32)
+	aad := MessageAAD("general", "alice", "k1")
+	text := strings.Repeat("at main.go:42 something went wrong\n", 40)
+	cipher, err := SealMessage(key, text, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cipher) >= len(text) {
+		t.Errorf("cipher is %d bytes for %d bytes of text", len(cipher), len(text))
+	}
+	if got, err := OpenMessage(key, cipher, aad); err != nil || got != text {
+		t.Fatalf("OpenMessage = %.20q, %v", got, err)
+	}
+}
@@ -17,18 +17,16 @@ func WriteFrame(w io.Writer, payload []byte) error {
 		return fmt.Errorf("payload too large: %d", len(payload))
 	}
 
-	//准备 4 字节长度头
-	var lenBuf [4]byte
-	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(payload)))
-
-	if _, err := w.Write(lenBuf[:]); err != nil {
-		return err
-	}
+	//准备 4 字节长度头，和 payload 拼成一块一次写出去
+	//多个 goroutine 同时往一个连接写帧时（广播、后台传文件），一次 Write 保证帧不会交错
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	copy(buf[4:], payload)
 
 	// 这里用 Write 循环确保全部写完（防止短写）
 	total := 0
-	for total < len(payload) {
-		n, err := w.Write(payload[total:])
+	for total < len(buf) {
+		n, err := w.Write(buf[total:])
 		if err != nil {
 			return err
 		}
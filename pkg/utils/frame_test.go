@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	payloads := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{0xff}, 70000)}
+	for _, p := range payloads {
+		if err := WriteFrame(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range payloads {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes, want %d", len(got), len(want))
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Fatalf("read past the end: %v", err)
+	}
+}
+
+func TestReadFrameRejectsBadInput(t *testing.T) {
+	var huge [4]byte
+	binary.BigEndian.PutUint32(huge[:], MaxFrameSize+1)
+	if _, err := ReadFrame(bytes.NewReader(huge[:])); err == nil {
+		t.Error("oversized length accepted")
+	}
+
+	var buf bytes.Buffer
+	WriteFrame(&buf, []byte("truncated"))
+	short := buf.Bytes()[:buf.Len()-2]
+	if _, err := ReadFrame(bytes.NewReader(short)); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated frame: %v", err)
+	}
+	if err := WriteFrame(io.Discard, make([]byte, MaxFrameSize+1)); err == nil {
+		t.Error("oversized payload written")
+	}
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// 口令模式：服务器配置里写了 passphrase，大家就可以拿口令连，不用复制每次启动打印的随机 key。
+// 口令不能直接 sha256 当 key（弱口令一下就穷举出来了），要过一遍 scrypt，参数由服务器发：
+//   客户端连上先发一个明文帧 "KDF"
+//   服务器回明文的 KDF|{"alg":"scrypt","salt":"<base64>","n":32768,"r":8,"p":1}，没配口令就回 KDF|{}
+//   客户端用这些参数从口令算出 AES key，然后照常发加密的 "Infernity" 握手
+// 盐是服务器每次启动随机生成的，算出来的 key 每次启动都不一样，服务器照样把它写进 key 文件，拿 key 连也行。
+// 参数有上下限：太小的不接受（假服务器故意降低难度好穷举口令），太大的也不接受（拖死客户端）
+
+// KDFRequest 客户端要 KDF 参数的明文帧
+const KDFRequest = "KDF"
+
+const kdfPrefix = "KDF|"
+
+const (
+	kdfScrypt = "scrypt"
+
+	scryptN = 1 << 15 // 32MB 内存，网页里也算得动
+	scryptR = 8
+	scryptP = 1
+
+	minScryptN   = 1 << 14
+	maxScryptNR  = 1 << 21 // N*r*128 字节，最多 256MB
+	maxScryptP   = 4
+	minSaltBytes = 16
+)
+
+// ErrPassphrase ParseKey 遇到的不是 base64/hex 的 key，要当口令用
+var ErrPassphrase = errors.New("not a base64/hex key, use it as a passphrase")
+
+// KDFParams 口令模式的参数，Alg 是空的表示服务器没开口令模式
+type KDFParams struct {
+	Alg  string `json:"alg,omitempty"`
+	Salt string `json:"salt,omitempty"`
+	N    int    `json:"n,omitempty"`
+	R    int    `json:"r,omitempty"`
+	P    int    `json:"p,omitempty"`
+}
+
+// NewKDFParams 服务器启动时生成：随机盐加上默认参数
+func NewKDFParams() (KDFParams, error) {
+	salt := make([]byte, minSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return KDFParams{}, err
+	}
+	return KDFParams{Alg: kdfScrypt, Salt: base64.StdEncoding.EncodeToString(salt), N: scryptN, R: scryptR, P: scryptP}, nil
+}
+
+// Check 参数在不在能接受的范围里
+func (p KDFParams) Check() error {
+	if p.Alg == "" {
+		return errors.New("the server has no passphrase set, use the key from its key file")
+	}
+	if p.Alg != kdfScrypt {
+		return fmt.Errorf("unsupported key derivation %q", p.Alg)
+	}
+	salt, err := base64.StdEncoding.DecodeString(p.Salt)
+	if err != nil || len(salt) < minSaltBytes {
+		return errors.New("bad salt")
+	}
+	if p.N < minScryptN || p.N&(p.N-1) != 0 || p.R < 8 || p.P < 1 || p.P > maxScryptP || p.N*p.R > maxScryptNR {
+		return fmt.Errorf("scrypt parameters out of range: N=%d r=%d p=%d", p.N, p.R, p.P)
+	}
+	return nil
+}
+
+// DeriveKey 从口令算出 32 字节的 AES key
+func (p KDFParams) DeriveKey(passphrase string) ([]byte, error) {
+	if err := p.Check(); err != nil {
+		return nil, err
+	}
+	salt, _ := base64.StdEncoding.DecodeString(p.Salt)
+	return scrypt.Key([]byte(passphrase), salt, p.N, p.R, p.P, 32)
+}
+
+func (p KDFParams) String() string {
+	return fmt.Sprintf("%s N=%d r=%d p=%d", p.Alg, p.N, p.R, p.P)
+}
+
+// KDFFrame 拼一个 KDF| 帧（明文）
+func KDFFrame(p KDFParams) []byte {
+	data, _ := json.Marshal(p)
+	return append([]byte(kdfPrefix), data...)
+}
+
+// ParseKDFFrame 不是 KDF| 帧就返回 ok=false
+func ParseKDFFrame(frame string) (p KDFParams, ok bool) {
+	rest, ok := strings.CutPrefix(frame, kdfPrefix)
+	return p, ok && json.Unmarshal([]byte(rest), &p) == nil
+}
+
+// FetchKDF 客户端握手之前向服务器要口令模式的参数
+func FetchKDF(conn net.Conn) (KDFParams, error) {
+	if err := WriteFrame(conn, []byte(KDFRequest)); err != nil {
+		return KDFParams{}, err
+	}
+	reply, err := ReadFrame(conn)
+	if err != nil { // 老服务器解不开明文帧，直接断开
+		return KDFParams{}, fmt.Errorf("no answer to the passphrase request (server too old?): %w", err)
+	}
+	p, ok := ParseKDFFrame(string(reply))
+	if !ok {
+		return p, errors.New("the server does not support passphrases, use the key from its key file")
+	}
+	return p, p.Check()
+}
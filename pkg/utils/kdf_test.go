@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+)
+
+// testKDF 用最小的 N，测试跑得快一点
+func testKDF(t *testing.T) KDFParams {
+	p, err := NewKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.N = minScryptN
+	return p
+}
+
+func TestDeriveKey(t *testing.T) {
+	p := testKDF(t)
+	k1, err := p.DeriveKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k1) != 32 {
+		t.Fatalf("derived %d bytes, want 32", len(k1))
+	}
+	// 同样的参数同样的口令，客户端和服务器算出来一样
+	if k2, _ := p.DeriveKey("correct horse"); !bytes.Equal(k1, k2) {
+		t.Error("same passphrase gave different keys")
+	}
+	if k3, _ := p.DeriveKey("correct horsE"); bytes.Equal(k1, k3) {
+		t.Error("wrong passphrase gave the same key")
+	}
+	// 换了盐（服务器重启）key 就变了
+	other := testKDF(t)
+	if k4, _ := other.DeriveKey("correct horse"); bytes.Equal(k1, k4) {
+		t.Error("different salt gave the same key")
+	}
+}
+
+func TestKDFCheckRejectsBadParams(t *testing.T) {
+	good := testKDF(t)
+	shortSalt := base64.StdEncoding.EncodeToString(make([]byte, minSaltBytes-1))
+	tests := []struct {
+		name string
+		edit func(p *KDFParams)
+	}{
+		{"no passphrase", func(p *KDFParams) { *p = KDFParams{} }},
+		{"unknown alg", func(p *KDFParams) { p.Alg = "md5" }},
+		{"bad salt", func(p *KDFParams) { p.Salt = "!!" }},
+		{"short salt", func(p *KDFParams) { p.Salt = shortSalt }},
+		{"N too small", func(p *KDFParams) { p.N = minScryptN / 2 }},
+		{"N not a power of two", func(p *KDFParams) { p.N = minScryptN + 1 }},
+		{"r too small", func(p *KDFParams) { p.R = 1 }},
+		{"p zero", func(p *KDFParams) { p.P = 0 }},
+		{"p too big", func(p *KDFParams) { p.P = maxScryptP + 1 }},
+		{"too much memory", func(p *KDFParams) { p.N = 1 << 20; p.R = 8 }},
+	}
+	if err := good.Check(); err != nil {
+		t.Fatalf("default params rejected: %v", err)
+	}
+	for _, tt := range tests {
+		p := good
+		tt.edit(&p)
+		if err := p.Check(); err == nil {
+			t.Errorf("%s: accepted %+v", tt.name, p)
+		}
+		if _, err := p.DeriveKey("pw"); err == nil {
+			t.Errorf("%s: derived a key anyway", tt.name)
+		}
+	}
+}
+
+func TestKDFFrame(t *testing.T) {
+	p := testKDF(t)
+	got, ok := ParseKDFFrame(string(KDFFrame(p)))
+	if !ok || got != p {
+		t.Fatalf("round trip = %+v, %v; want %+v", got, ok, p)
+	}
+	// 没开口令模式的服务器回 KDF|{}
+	if got, ok := ParseKDFFrame(string(KDFFrame(KDFParams{}))); !ok || got.Alg != "" {
+		t.Errorf("empty params = %+v, %v", got, ok)
+	}
+	for _, frame := range []string{"KDF", "KDF|not json", "Infernity", `E2E|{"alg":"scrypt"}`} {
+		if _, ok := ParseKDFFrame(frame); ok {
+			t.Errorf("ParseKDFFrame(%q) ok", frame)
+		}
+	}
+}
+
+func TestFetchKDF(t *testing.T) {
+	serve := func(reply []byte) (net.Conn, <-chan string) {
+		client, server := net.Pipe()
+		asked := make(chan string, 1)
+		go func() {
+			defer server.Close()
+			req, err := ReadFrame(server)
+			if err != nil {
+				return
+			}
+			asked <- string(req)
+			if reply != nil {
+				WriteFrame(server, reply)
+			}
+		}()
+		t.Cleanup(func() { client.Close() })
+		return client, asked
+	}
+
+	p := testKDF(t)
+	conn, asked := serve(KDFFrame(p))
+	got, err := FetchKDF(conn)
+	if err != nil || got != p {
+		t.Fatalf("FetchKDF = %+v, %v", got, err)
+	}
+	if req := <-asked; req != KDFRequest {
+		t.Errorf("client asked with %q", req)
+	}
+
+	// 服务器没配口令
+	conn, _ = serve(KDFFrame(KDFParams{}))
+	if _, err := FetchKDF(conn); err == nil {
+		t.Error("no passphrase on the server but FetchKDF succeeded")
+	}
+	// 假服务器降低难度
+	weak := p
+	weak.N = 1 << 10
+	conn, _ = serve(KDFFrame(weak))
+	if _, err := FetchKDF(conn); err == nil {
+		t.Error("accepted downgraded parameters")
+	}
+	// 老服务器不认识，直接断开
+	conn, _ = serve(nil)
+	if _, err := FetchKDF(conn); err == nil {
+		t.Error("old server closed the connection but FetchKDF succeeded")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key, b64, err := NewRandomKeyBase64(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ParseKey(b64); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("base64 key = %x, %v", got, err)
+	}
+	if got, err := ParseKey(hex.EncodeToString(key)); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("hex key = %x, %v", got, err)
+	}
+	// 别的都当口令
+	for _, s := range []string{"correct horse battery staple", base64.StdEncoding.EncodeToString(key[:20]), "abcd"} {
+		if _, err := ParseKey(s); !errors.Is(err, ErrPassphrase) {
+			t.Errorf("ParseKey(%q) = %v, want ErrPassphrase", s, err)
+		}
+	}
+	if _, err := ParseKey(""); err == nil || errors.Is(err, ErrPassphrase) {
+		t.Errorf("empty key = %v", err)
+	}
+}
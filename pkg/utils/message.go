@@ -0,0 +1,239 @@
+package utils
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 聊天消息（服务器 -> 客户端）：
+//   MSG|{"id":"17","from":"alice","text":"hi @bob","time":"...","mentions":["bob"]}
+//   MSG_EVENT|{"op":"edit","id":"17","text":"...","by":"alice","time":"..."}
+//   MSG_EVENT|{"op":"delete","id":"17","by":"alice","time":"..."}
+//   MSG_EVENT|{"op":"react","id":"17","text":"👍","by":"bob","time":"..."}   unreact 是取消
+//   HISTORY|[{...},{...}]   连上时发一次最近的消息（已经应用了编辑/删除），不用再提醒
+// 回复带 parent（被回复的消息 id），回复的回复也挂在最上面那条下面，线程只有一层
+// 客户端发的还是纯文本，服务器分配 id、包成这个再广播；mentions 由服务器解析，
+// 客户端不用自己猜哪些词是名字。编辑/删除用 MSG_EVENT 通知，客户端按 id 原地更新
+// 端到端加密的消息 text 是空的，内容在 cipher 里，keyId 是用的哪把发送者密钥（见 e2e.go），
+// mentions 是发送的客户端自己算的，sig 是作者签的名，key 是服务器记下的作者当时的公钥
+
+const (
+	messagePrefix      = "MSG|"
+	messageEventPrefix = "MSG_EVENT|"
+	historyPrefix      = "HISTORY|"
+)
+
+const (
+	MessageEdit    = "edit"
+	MessageDelete  = "delete"
+	MessageReact   = "react"
+	MessageUnreact = "unreact"
+)
+
+// MentionAll @all 提醒所有人
+const MentionAll = "all"
+
+// Message 一条聊天消息
+type Message struct {
+	ID       string    `json:"id"`
+	Parent   string    `json:"parent,omitempty"` // 回复的是哪条
+	Room     string    `json:"room,omitempty"`   // 发在哪个房间，老记录没有的就是大厅
+	From     string    `json:"from"`
+	Text     string    `json:"text"`
+	KeyID    string    `json:"keyId,omitempty"`
+	Cipher   string    `json:"cipher,omitempty"` // 加密的消息内容在这里，Text 是空的
+	Key      string    `json:"key,omitempty"`    // 发的时候作者的身份公钥，验签名用
+	Sig      string    `json:"sig,omitempty"`    // 作者对 MessageEnvelope 的签名
+	Seq      int64     `json:"seq,omitempty"`    // 签名里作者的序号，老客户端签的没有
+	Time     time.Time `json:"time"`
+	Mentions []string  `json:"mentions,omitempty"`
+	Edited   bool      `json:"edited,omitempty"`
+	Deleted  bool      `json:"deleted,omitempty"`
+
+	Reactions map[string][]string `json:"reactions,omitempty"` // 表情 -> 谁点的
+}
+
+// MessageEvent 对一条已经发出的消息的改动
+type MessageEvent struct {
+	Op       string    `json:"op"`
+	ID       string    `json:"id"`
+	Text     string    `json:"text,omitempty"`
+	KeyID    string    `json:"keyId,omitempty"`
+	Cipher   string    `json:"cipher,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	Sig      string    `json:"sig,omitempty"`
+	Seq      int64     `json:"seq,omitempty"`
+	Mentions []string  `json:"mentions,omitempty"`
+	By       string    `json:"by"`
+	Time     time.Time `json:"time"`
+}
+
+// Apply 把改动应用到消息上
+func (m *Message) Apply(ev MessageEvent) {
+	switch ev.Op {
+	case MessageEdit:
+		m.Text, m.KeyID, m.Cipher, m.Sig, m.Seq, m.Mentions, m.Edited = ev.Text, ev.KeyID, ev.Cipher, ev.Sig, ev.Seq, ev.Mentions, true
+		if ev.Key != "" {
+			m.Key = ev.Key
+		}
+	case MessageDelete:
+		m.Text, m.KeyID, m.Cipher, m.Sig, m.Seq, m.Mentions, m.Deleted = "", "", "", "", 0, nil, true
+	case MessageReact:
+		if !m.ReactedBy(ev.Text, ev.By) {
+			if m.Reactions == nil {
+				m.Reactions = map[string][]string{}
+			}
+			m.Reactions[ev.Text] = append(m.Reactions[ev.Text], ev.By)
+		}
+	case MessageUnreact:
+		users := m.Reactions[ev.Text]
+		for i, u := range users {
+			if u == ev.By {
+				users = append(users[:i:i], users[i+1:]...)
+				break
+			}
+		}
+		if len(users) == 0 {
+			delete(m.Reactions, ev.Text)
+		} else {
+			m.Reactions[ev.Text] = users
+		}
+	}
+}
+
+// Envelope 这条消息签名签的内容：编辑过的签的是"改 ID 这条"，没编辑过的签的是回复的哪条
+func (m Message) Envelope() string {
+	switch {
+	case m.Seq == 0:
+		return LegacyMessageEnvelope(m.Room, m.From, m.KeyID, m.Cipher)
+	case m.Edited:
+		return MessageEnvelope(m.Room, m.From, m.Seq, "", m.ID, m.KeyID, m.Cipher)
+	}
+	return MessageEnvelope(m.Room, m.From, m.Seq, m.Parent, "", m.KeyID, m.Cipher)
+}
+
+// Encrypted 是端到端加密的消息
+func (m Message) Encrypted() bool {
+	return m.Cipher != ""
+}
+
+// ReactedBy user 有没有点过这个表情
+func (m Message) ReactedBy(emoji, user string) bool {
+	for _, u := range m.Reactions[emoji] {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// ReactionKeys 表情按点的人数从多到少排，一样多的按表情本身排，显示顺序稳定
+func (m Message) ReactionKeys() []string {
+	keys := make([]string, 0, len(m.Reactions))
+	for k := range m.Reactions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := len(m.Reactions[keys[i]]), len(m.Reactions[keys[j]])
+		if a != b {
+			return a > b
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// MessageFrame 拼一个 MSG| 帧
+func MessageFrame(m Message) []byte {
+	data, _ := json.Marshal(m)
+	return append([]byte(messagePrefix), data...)
+}
+
+// ParseMessage 不是 MSG| 帧就返回 ok=false
+func ParseMessage(frame string) (m Message, ok bool) {
+	rest, ok := strings.CutPrefix(frame, messagePrefix)
+	if !ok || json.Unmarshal([]byte(rest), &m) != nil {
+		return Message{}, false
+	}
+	return m, true
+}
+
+// MessageEventFrame 拼一个 MSG_EVENT| 帧
+func MessageEventFrame(ev MessageEvent) []byte {
+	data, _ := json.Marshal(ev)
+	return append([]byte(messageEventPrefix), data...)
+}
+
+// ParseMessageEvent 不是 MSG_EVENT| 帧就返回 ok=false
+func ParseMessageEvent(frame string) (ev MessageEvent, ok bool) {
+	rest, ok := strings.CutPrefix(frame, messageEventPrefix)
+	if !ok || json.Unmarshal([]byte(rest), &ev) != nil {
+		return MessageEvent{}, false
+	}
+	return ev, true
+}
+
+// HistoryFrame 拼一个 HISTORY| 帧
+func HistoryFrame(msgs []Message) []byte {
+	if msgs == nil {
+		msgs = []Message{}
+	}
+	data, _ := json.Marshal(msgs)
+	return append([]byte(historyPrefix), data...)
+}
+
+// ParseHistory 不是 HISTORY| 帧就返回 ok=false
+func ParseHistory(frame string) (msgs []Message, ok bool) {
+	rest, ok := strings.CutPrefix(frame, historyPrefix)
+	if !ok || json.Unmarshal([]byte(rest), &msgs) != nil {
+		return nil, false
+	}
+	return msgs, true
+}
+
+// MentionsName 提到 name 了吗（点名或者 @all），不区分大小写
+func (m Message) MentionsName(name string) bool {
+	for _, n := range m.Mentions {
+		if n == MentionAll || strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMentions 找出 text 里 @ 了 names 中的谁；名字里可能有空格，所以拿名单去匹配，
+// 不是按空格拆词。@ 后面的名字要完整（后面不能紧跟字母数字），不区分大小写
+func ParseMentions(text string, names []string) []string {
+	lower := strings.ToLower(text)
+	var out []string
+	seen := map[string]bool{}
+	candidates := append(append([]string{}, names...), MentionAll)
+	for _, name := range candidates {
+		key := strings.ToLower(name)
+		if name == "" || seen[key] {
+			continue
+		}
+		for i := 0; ; {
+			j := strings.Index(lower[i:], "@"+key)
+			if j < 0 {
+				break
+			}
+			end := i + j + 1 + len(key)
+			if end == len(lower) || !isWordByte(lower[end]) {
+				out = append(out, name)
+				seen[key] = true
+				break
+			}
+			i += j + 1
+		}
+	}
+	return out
+}
+
+// isWordByte 字母数字下划线；中文之类的多字节字符不算，"@小明你好" 也能匹配
+func isWordByte(b byte) bool {
+	return b < 0x80 && (unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b)) || b == '_')
+}
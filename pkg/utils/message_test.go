@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	names := []string{"bob", "bobby", "Mary Jane", "小明", ""}
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"@bob hi", []string{"bob"}},
+		{"@bobby hi", []string{"bobby"}}, // bob 后面紧跟字母，不算 @bob
+		{"hi @BOB, @bob again", []string{"bob"}},
+		{"@bobx @bob", []string{"bob"}},
+		{"ping @Mary Jane please", []string{"Mary Jane"}},
+		{"@小明你好", []string{"小明"}},
+		{"@all standup", []string{MentionAll}},
+		{"bob@ no mention", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got := ParseMentions(tt.text, names)
+		slices.Sort(got)
+		want := slices.Clone(tt.want)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("ParseMentions(%q) = %q, want %q", tt.text, got, want)
+		}
+	}
+}
+
+func TestReactionsApply(t *testing.T) {
+	var m Message
+	react := func(op, emoji, by string) { m.Apply(MessageEvent{Op: op, Text: emoji, By: by}) }
+	react(MessageReact, "👍", "alice")
+	react(MessageReact, "👍", "alice") // 点两次只算一次
+	react(MessageReact, "👍", "bob")
+	react(MessageReact, "🎉", "carol")
+	react(MessageReact, "❤", "dave")
+	if got := m.Reactions["👍"]; !slices.Equal(got, []string{"alice", "bob"}) {
+		t.Fatalf("👍 = %q", got)
+	}
+	if !m.ReactedBy("👍", "bob") || m.ReactedBy("🎉", "bob") {
+		t.Error("ReactedBy wrong")
+	}
+	// 人多的在前，一样多的按表情排
+	if got, want := m.ReactionKeys(), []string{"👍", "❤", "🎉"}; !slices.Equal(got, want) {
+		t.Errorf("ReactionKeys = %q, want %q", got, want)
+	}
+
+	react(MessageUnreact, "🎉", "carol")
+	react(MessageUnreact, "👍", "nobody")
+	if _, ok := m.Reactions["🎉"]; ok {
+		t.Error("empty reaction kept")
+	}
+	if len(m.Reactions["👍"]) != 2 {
+		t.Error("unreact by someone who never reacted removed a reaction")
+	}
+}
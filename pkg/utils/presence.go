@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// 在线状态推送（服务器 -> 客户端），客户端用来维护用户列表：
+//   ROSTER|{"self":"<你的名字>","users":[...]}          连上时发一次完整列表
+//   PRESENCE|{"event":"join","name":...,"status":...}   之后有变化只发增量
+// event 是 join / leave / update；改名时 update 带上 old（原来的名字）
+// leave 带 status=offline 和 lastSeen，ROSTER 里也有最近离开的人，客户端显示"最后在线"
+// 用 JSON 是因为名字里什么字符都可能有，按 | 拆不靠谱
+//
+// 正在输入（不存，只转发）：
+//   客户端 -> 服务器：\x01TYPING               输入框不空时每 TypingInterval 发一次
+//   服务器 -> 其他人：TYPING|{"name":"alice"}  超过 TypingTimeout 没再收到就当停了
+
+const (
+	rosterPrefix   = "ROSTER|"
+	presencePrefix = "PRESENCE|"
+	typingPrefix   = "TYPING|"
+)
+
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusBusy    = "busy"
+	StatusOffline = "offline"
+)
+
+// TypingPing 客户端发的"我在输入"。第一个字节是 0x01，和数据帧的 0x00 一样键盘敲不出来；
+// 以前是 "TYPING" 和 "TYPING|"，有人发一条这样的聊天就被当成 ping 吞了
+const TypingPing = "\x01TYPING"
+
+const (
+	TypingInterval = 3 * time.Second
+	TypingTimeout  = 6 * time.Second
+)
+
+const (
+	PresenceJoin   = "join"
+	PresenceLeave  = "leave"
+	PresenceUpdate = "update"
+)
+
+// Member 用户列表里的一个人
+type Member struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Reason   string    `json:"reason,omitempty"` // /away 后面写的原因，自动离开是 "idle"
+	Room     string    `json:"room"`
+	Key      string    `json:"key,omitempty"`     // 身份公钥，端到端加密用，老客户端没有
+	Account  bool      `json:"account,omitempty"` // 登录了账号：这个名字只有他能用，游客的名字谁都能拿
+	LastSeen time.Time `json:"lastSeen,omitzero"` // 只有 offline 的有
+}
+
+// Roster 完整的在线用户列表，Self 是收到这一帧的人自己
+type Roster struct {
+	Self  string   `json:"self"`
+	Users []Member `json:"users"`
+}
+
+// PresenceEvent 用户列表的一次变化
+type PresenceEvent struct {
+	Event string `json:"event"`
+	Old   string `json:"old,omitempty"` // 改名前的名字
+	Member
+}
+
+// RosterFrame 拼一个 ROSTER| 帧
+func RosterFrame(r Roster) []byte {
+	data, _ := json.Marshal(r)
+	return append([]byte(rosterPrefix), data...)
+}
+
+// PresenceFrame 拼一个 PRESENCE| 帧
+func PresenceFrame(ev PresenceEvent) []byte {
+	data, _ := json.Marshal(ev)
+	return append([]byte(presencePrefix), data...)
+}
+
+// TypingFrame 拼一个 TYPING| 帧
+func TypingFrame(name string) []byte {
+	data, _ := json.Marshal(struct {
+		Name string `json:"name"`
+	}{name})
+	return append([]byte(typingPrefix), data...)
+}
+
+// ParseTyping 不是 TYPING| 帧就返回 ok=false
+func ParseTyping(frame string) (name string, ok bool) {
+	rest, ok := strings.CutPrefix(frame, typingPrefix)
+	var v struct {
+		Name string `json:"name"`
+	}
+	if !ok || json.Unmarshal([]byte(rest), &v) != nil {
+		return "", false
+	}
+	return v.Name, true
+}
+
+// ParseRoster 不是 ROSTER| 帧就返回 ok=false
+func ParseRoster(frame string) (r Roster, ok bool) {
+	rest, ok := strings.CutPrefix(frame, rosterPrefix)
+	if !ok || json.Unmarshal([]byte(rest), &r) != nil {
+		return Roster{}, false
+	}
+	return r, true
+}
+
+// ParsePresence 不是 PRESENCE| 帧就返回 ok=false
+func ParsePresence(frame string) (ev PresenceEvent, ok bool) {
+	rest, ok := strings.CutPrefix(frame, presencePrefix)
+	if !ok || json.Unmarshal([]byte(rest), &ev) != nil {
+		return PresenceEvent{}, false
+	}
+	return ev, true
+}
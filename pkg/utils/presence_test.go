@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+)
+
+func TestTypingFrames(t *testing.T) {
+	name, ok := ParseTyping(string(TypingFrame("al|ice")))
+	if !ok || name != "al|ice" {
+		t.Fatalf("got %q ok=%v", name, ok)
+	}
+	// 客户端发的 ping 和聊天分得开：键盘敲得出来的都是聊天
+	for _, chat := range []string{"TYPING", "TYPING|", "TYPING|{}"} {
+		if chat == TypingPing {
+			t.Errorf("chat message %q is taken for a typing ping", chat)
+		}
+	}
+	if !strings.ContainsFunc(TypingPing[:1], unicode.IsControl) {
+		t.Errorf("TypingPing %q starts with a printable byte", TypingPing)
+	}
+	for _, frame := range []string{"TYPING", "TYPING|not json", "hello"} {
+		if _, ok := ParseTyping(frame); ok {
+			t.Errorf("ParseTyping(%q) = ok", frame)
+		}
+	}
+}
+
+func TestPresenceFrames(t *testing.T) {
+	seen := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := Roster{Self: "bob", Users: []Member{
+		{Name: "bob", Status: StatusOnline, Room: "lobby"},
+		{Name: "carol", Status: StatusOffline, LastSeen: seen},
+	}}
+	got, ok := ParseRoster(string(RosterFrame(r)))
+	if !ok || got.Self != "bob" || len(got.Users) != 2 || !got.Users[1].LastSeen.Equal(seen) {
+		t.Fatalf("roster round trip: %+v ok=%v", got, ok)
+	}
+
+	ev := PresenceEvent{Event: PresenceUpdate, Old: "b0b", Member: Member{Name: "bob", Status: StatusAway, Reason: "lunch"}}
+	gotEv, ok := ParsePresence(string(PresenceFrame(ev)))
+	if !ok || gotEv.Old != "b0b" || gotEv.Name != "bob" || gotEv.Reason != "lunch" {
+		t.Fatalf("presence round trip: %+v ok=%v", gotEv, ok)
+	}
+	if _, ok := ParsePresence("ROSTER|{}"); ok {
+		t.Fatal("roster parsed as presence")
+	}
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// 已读位置（每个人在每个房间看到了哪条）：
+//   客户端 -> 服务器：READ|17                                         看到了 17（以及之前的）
+//   服务器 -> 客户端：READS|{"room":"lobby","cursors":{"alice":"17"}}  连上、改名时发一次完整的
+//   服务器 -> 房间里所有人：READ|{"room":"lobby","user":"alice","id":"17"}  有人往后读了，id 为空是删了
+// 只会往后走，发一个比现在小的 id 不起作用
+
+const (
+	readPrefix  = "READ|"
+	readsPrefix = "READS|"
+)
+
+// ReadCursor 一个人在一个房间的已读位置
+type ReadCursor struct {
+	Room string `json:"room"`
+	User string `json:"user"`
+	ID   string `json:"id"`
+}
+
+// ReadState 一个房间里所有人的已读位置，user -> 消息 id
+type ReadState struct {
+	Room    string            `json:"room"`
+	Cursors map[string]string `json:"cursors"`
+}
+
+// ReadAck 客户端发的 READ|<id>
+func ReadAck(id string) []byte {
+	return []byte(readPrefix + id)
+}
+
+// ParseReadAck 服务器解析客户端的 READ|<id>
+func ParseReadAck(frame string) (id string, ok bool) {
+	id, ok = strings.CutPrefix(frame, readPrefix)
+	id = strings.TrimSpace(id)
+	return id, ok && id != ""
+}
+
+// ReadCursorFrame 拼一个 READ| 帧（服务器 -> 客户端）
+func ReadCursorFrame(c ReadCursor) []byte {
+	data, _ := json.Marshal(c)
+	return append([]byte(readPrefix), data...)
+}
+
+// ParseReadCursor 不是服务器发的 READ| 帧就返回 ok=false
+func ParseReadCursor(frame string) (c ReadCursor, ok bool) {
+	rest, ok := strings.CutPrefix(frame, readPrefix)
+	if !ok || json.Unmarshal([]byte(rest), &c) != nil {
+		return ReadCursor{}, false
+	}
+	return c, true
+}
+
+// ReadStateFrame 拼一个 READS| 帧
+func ReadStateFrame(s ReadState) []byte {
+	if s.Cursors == nil {
+		s.Cursors = map[string]string{}
+	}
+	data, _ := json.Marshal(s)
+	return append([]byte(readsPrefix), data...)
+}
+
+// ParseReadState 不是 READS| 帧就返回 ok=false
+func ParseReadState(frame string) (s ReadState, ok bool) {
+	rest, ok := strings.CutPrefix(frame, readsPrefix)
+	if !ok || json.Unmarshal([]byte(rest), &s) != nil {
+		return ReadState{}, false
+	}
+	if s.Cursors == nil {
+		s.Cursors = map[string]string{}
+	}
+	return s, true
+}
+
+// CompareID 比较两个消息 id：id 是递增的数字，位数少的小；空串最小
+func CompareID(a, b string) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
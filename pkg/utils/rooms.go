@@ -0,0 +1,25 @@
+package utils
+
+import "strings"
+
+// 房间：
+//   /join <room> [password|token]   进房间，没有就建一个（建的人是房主）
+//   ROOM|ops                         服务器 -> 客户端：你现在在 #ops，后面跟着这个房间的 READS 和 HISTORY，
+//                                    客户端收到就把消息区清空重来
+// 大厅 DefaultRoom 谁都能进；房主可以给房间设密码或者改成只能凭邀请进，
+// 这样的房间不在 /rooms 里显示，除非你已经是成员
+
+const roomPrefix = "ROOM|"
+
+const DefaultRoom = "lobby"
+
+// RoomFrame 拼一个 ROOM| 帧
+func RoomFrame(room string) []byte {
+	return []byte(roomPrefix + room)
+}
+
+// ParseRoom 不是 ROOM| 帧就返回 ok=false
+func ParseRoom(frame string) (room string, ok bool) {
+	room, ok = strings.CutPrefix(frame, roomPrefix)
+	return room, ok && room != ""
+}
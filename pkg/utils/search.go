@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// 搜索（客户端发 /search，服务器回一帧）：
+//   /search <词...> [in:room] [from:user] [before:2026-01-02] [after:2026-01-01] [page:2]
+//   SEARCH|{"query":"...","page":1,"pages":3,"total":23,"results":[{...消息...}]}
+// 结果从新到旧，一页 SearchPageSize 条
+
+const searchPrefix = "SEARCH|"
+
+const SearchPageSize = 10
+
+// SearchResult 一页搜索结果
+type SearchResult struct {
+	Query   string    `json:"query"`
+	Page    int       `json:"page"`
+	Pages   int       `json:"pages"`
+	Total   int       `json:"total"`
+	Results []Message `json:"results"`
+}
+
+// SearchFrame 拼一个 SEARCH| 帧
+func SearchFrame(r SearchResult) []byte {
+	if r.Results == nil {
+		r.Results = []Message{}
+	}
+	data, _ := json.Marshal(r)
+	return append([]byte(searchPrefix), data...)
+}
+
+// ParseSearch 不是 SEARCH| 帧就返回 ok=false
+func ParseSearch(frame string) (r SearchResult, ok bool) {
+	rest, ok := strings.CutPrefix(frame, searchPrefix)
+	if !ok || json.Unmarshal([]byte(rest), &r) != nil {
+		return SearchResult{}, false
+	}
+	return r, true
+}
@@ -4,7 +4,6 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
@@ -12,9 +11,9 @@ import (
 	"net"
 )
 
-// ParseKey ：把命令行传入的 key 转成 AES key bytes
-// 约定：server 打印 base64(32字节)；client 也传这个 base64。
-// 兼容：如果不是合法 base64/hex，就用 sha256(keyStr) 得到 32 字节。
+// ParseKey ：把用户给的 key 转成 AES key bytes
+// 约定：server 打印 base64(32字节)；client 也传这个 base64，hex 也行。
+// 都不是的话返回 ErrPassphrase，当口令用，要先向服务器要 KDF 参数（见 kdf.go）
 func ParseKey(keyStr string) ([]byte, error) {
 	if keyStr == "" {
 		return nil, errors.New("empty key")
@@ -34,9 +33,7 @@ func ParseKey(keyStr string) ([]byte, error) {
 		}
 	}
 
-	// 3) fallback sha256
-	sum := sha256.Sum256([]byte(keyStr))
-	return sum[:], nil
+	return nil, ErrPassphrase
 }
 
 func NewRandomKeyBase64(nBytes int) (key []byte, keyB64 string, err error) {
@@ -92,8 +89,27 @@ func decryptGCM(key, data []byte) ([]byte, error) {
 	return gcm.Open(nil, nonce, ct, nil)
 }
 
-// SecureWriteFrame ：plaintext -> AESGCM -> WriteFrame
+// SecureWriteFrame ：plaintext -> AESGCM -> WriteFrame，控制帧和聊天不压缩（见 compress.go）
 func SecureWriteFrame(conn net.Conn, key []byte, plaintext []byte) error {
+	return SecureWriteData(conn, key, plaintext, false)
+}
+
+// SecureWriteData 发文件数据帧：plaintext -> (压缩) -> AESGCM -> WriteFrame
+// compressible=false 表示内容已经压缩过（图片、zip 的文件块），不用再压；不是数据帧的永远不压
+func SecureWriteData(conn net.Conn, key []byte, plaintext []byte, compressible bool) error {
+	return secureWrite(conn, key, plaintext, compressible && isDataFrame(plaintext))
+}
+
+// SecureWriteText 发一帧只有一个人自己的一条消息的帧（E2E|、DM|、单条 MSG|），可以压缩；
+// 帧里有别人的文字或者秘密的不要用这个（见 compress.go）
+func SecureWriteText(conn net.Conn, key []byte, plaintext []byte) error {
+	return secureWrite(conn, key, plaintext, true)
+}
+
+func secureWrite(conn net.Conn, key []byte, plaintext []byte, compress bool) error {
+	if mode := compressionOf(conn); mode != CompressNone {
+		plaintext = packFrame(mode, plaintext, compress)
+	}
 	enc, err := encryptGCM(key, plaintext)
 	if err != nil {
 		return err
@@ -101,11 +117,23 @@ func SecureWriteFrame(conn net.Conn, key []byte, plaintext []byte) error {
 	return WriteFrame(conn, enc)
 }
 
-// SecureReadFrame ：ReadFrame -> AESGCM解密 -> plaintext
+// OpenFrame 解开一个已经读出来的加密帧：握手的第一帧要先看是不是明文的 KDF 请求
+func OpenFrame(key, enc []byte) ([]byte, error) {
+	return decryptGCM(key, enc)
+}
+
+// SecureReadFrame ：ReadFrame -> AESGCM解密 -> (解压) -> plaintext
 func SecureReadFrame(conn net.Conn, key []byte) ([]byte, error) {
 	enc, err := ReadFrame(conn)
 	if err != nil {
 		return nil, err
 	}
-	return decryptGCM(key, enc)
+	plaintext, err := decryptGCM(key, enc)
+	if err != nil {
+		return nil, err
+	}
+	if mode := compressionOf(conn); mode != CompressNone {
+		return unpackFrame(mode, plaintext)
+	}
+	return plaintext, nil
 }
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestSignatureCoversSeqAndTarget(t *testing.T) {
+	priv, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := PublicIdentity(priv)
+	env := MessageEnvelope("dev", "alice", 7, "3", "", "k1", "c1")
+	sig := Sign(priv, env)
+	if !VerifySignature(pub, env, sig) {
+		t.Fatal("own signature rejected")
+	}
+	// 换个序号、回复对象、改的哪条、房间都验不过
+	for _, other := range []string{
+		MessageEnvelope("dev", "alice", 8, "3", "", "k1", "c1"),
+		MessageEnvelope("dev", "alice", 7, "4", "", "k1", "c1"),
+		MessageEnvelope("dev", "alice", 7, "", "3", "k1", "c1"),
+		MessageEnvelope("ops", "alice", 7, "3", "", "k1", "c1"),
+		LegacyMessageEnvelope("dev", "alice", "k1", "c1"),
+	} {
+		if VerifySignature(pub, other, sig) {
+			t.Errorf("signature accepted for %q", other)
+		}
+	}
+	// 老客户端的公钥没有签名的那一半
+	raw, _ := base64.StdEncoding.DecodeString(pub)
+	if VerifySignature(base64.StdEncoding.EncodeToString(raw[:32]), env, sig) {
+		t.Error("key without a signing half verified a signature")
+	}
+}
+
+func TestMessageEnvelope(t *testing.T) {
+	m := Message{ID: "9", Parent: "3", Room: "", From: "alice", KeyID: "k1", Cipher: "c1", Seq: 5}
+	if got, want := m.Envelope(), MessageEnvelope(DefaultRoom, "alice", 5, "3", "", "k1", "c1"); got != want {
+		t.Errorf("new message envelope = %q, want %q", got, want)
+	}
+	// 编辑过的签的是改哪条，不是回复哪条
+	m.Apply(MessageEvent{Op: MessageEdit, ID: "9", KeyID: "k2", Cipher: "c2", Seq: 6})
+	if got, want := m.Envelope(), MessageEnvelope(DefaultRoom, "alice", 6, "", "9", "k2", "c2"); got != want {
+		t.Errorf("edited envelope = %q, want %q", got, want)
+	}
+	m.Seq = 0
+	if got, want := m.Envelope(), LegacyMessageEnvelope(DefaultRoom, "alice", "k2", "c2"); got != want {
+		t.Errorf("legacy envelope = %q, want %q", got, want)
+	}
+	m.Apply(MessageEvent{Op: MessageDelete, ID: "9"})
+	if m.Seq != 0 || m.Sig != "" {
+		t.Error("delete kept the signature")
+	}
+
+	d := Direct{From: "alice", To: "bob", Cipher: "c", Seq: 4}
+	if d.Envelope() != DirectEnvelope("alice", "bob", 4, "c") {
+		t.Error("direct envelope ignores seq")
+	}
+	d.Seq = 0
+	if d.Envelope() != LegacyDirectEnvelope("alice", "bob", "c") {
+		t.Error("direct message without seq is not the legacy envelope")
+	}
+}
+
+// 名字里有 "|"，字段换个切法不能签出一样的内容
+func TestEnvelopeFieldsCannotShift(t *testing.T) {
+	pairs := [][2]string{
+		{MessageEnvelope("a|b", "c", 1, "", "", "k", "x"), MessageEnvelope("a", "b|c", 1, "", "", "k", "x")},
+		{MessageEnvelope("r", "alice", 1, "p|", "", "k", "x"), MessageEnvelope("r", "alice", 1, "p", "|", "k", "x")},
+		{MessageEnvelope("r", "alice", 1, "", "", "k|x", ""), MessageEnvelope("r", "alice", 1, "", "", "k", "x")},
+		{DirectEnvelope("a|b", "c", 1, "x"), DirectEnvelope("a", "b|c", 1, "x")},
+	}
+	for _, p := range pairs {
+		if p[0] == p[1] {
+			t.Errorf("two different messages share the envelope %q", p[0])
+		}
+	}
+	if got, want := MessageEnvelope("", "bob", 7, "", "", "k1", "ct"), "goLearning sig v2|msg|5:lobby|3:bob|1:7|0:|0:|2:k1|2:ct"; got != want {
+		t.Errorf("MessageEnvelope = %q, want %q", got, want)
+	}
+	// 长度按字节算，网页那边用 TextEncoder 算的也是字节
+	if got := DirectEnvelope("小明", "bob", 1, "ct"); got != "goLearning sig v2|dm|6:小明|3:bob|1:1|2:ct" {
+		t.Errorf("DirectEnvelope = %q", got)
+	}
+}
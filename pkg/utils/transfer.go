@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// 文件传输协议（两个方向一样）：
+//   FILE|<filename>|<size>|<id>    文件头，id 由发送方生成；size 为 -1 表示大小未知
+//   FILE_OK|<id>                   接收方同意（只有上传需要等这一帧）
+//   FILE_REJECT|<id>|<reason>      接收方拒绝
+//   \x00<id>|<bytes>               一块文件数据，收满 size 字节就结束
+//                                  第一个字节是 0，键盘敲不出来，聊天消息不会被当成数据帧
+//   FILE_END|<id>                  大小未知时（边打包边发）用它表示发完了
+//   FILE_DONE|<id>                 服务器收完并保存了上传的文件
+//   FILE_CANCEL|<id>[|<reason>]    任意一方取消，收到的一方清理半截文件
+//   FILES|<json 文件名数组>          服务器文件目录，客户端发 /files 时回，文件增删时也主动推
+// 数据帧带 id，传文件的同时聊天消息照样能收发，不会被当成文件内容
+
+// dataType 数据帧的第一个字节。别的帧都是文本，以前用 "DATA|" 开头，
+// 结果有人发一条 "DATA|..." 的聊天就被当成文件数据吞掉了
+const dataType = 0x00
+
+// ChunkSize 每个数据帧里放多少文件内容
+const ChunkSize = 32 * 1024
+
+// DataFrame 拼一个数据帧：\x00<id>|<chunk>
+func DataFrame(id string, chunk []byte) []byte {
+	out := make([]byte, 0, 1+len(id)+1+len(chunk))
+	out = append(out, dataType)
+	out = append(out, id...)
+	out = append(out, '|')
+	return append(out, chunk...)
+}
+
+const catalogPrefix = "FILES|"
+
+// CatalogFrame 拼一个文件目录帧：FILES|["a.txt","b.png"]
+func CatalogFrame(names []string) []byte {
+	if names == nil {
+		names = []string{}
+	}
+	data, _ := json.Marshal(names)
+	return append([]byte(catalogPrefix), data...)
+}
+
+// ParseCatalog 不是文件目录帧就返回 ok=false
+func ParseCatalog(frame string) (names []string, ok bool) {
+	rest, ok := strings.CutPrefix(frame, catalogPrefix)
+	if !ok || json.Unmarshal([]byte(rest), &names) != nil {
+		return nil, false
+	}
+	return names, true
+}
+
+// ParseDataFrame 拆数据帧，不是数据帧就返回 ok=false
+func ParseDataFrame(frame []byte) (id string, chunk []byte, ok bool) {
+	if len(frame) == 0 || frame[0] != dataType {
+		return "", nil, false
+	}
+	rest := frame[1:]
+	i := bytes.IndexByte(rest, '|')
+	if i <= 0 {
+		return "", nil, false
+	}
+	return string(rest[:i]), rest[i+1:], true
+}
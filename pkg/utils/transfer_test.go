@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestDataFrameRoundTrip(t *testing.T) {
+	chunk := []byte("binary|data\x00with|pipes")
+	id, got, ok := ParseDataFrame(DataFrame("abc123", chunk))
+	if !ok || id != "abc123" || !bytes.Equal(got, chunk) {
+		t.Fatalf("got id=%q chunk=%q ok=%v", id, got, ok)
+	}
+	if _, got, ok := ParseDataFrame(DataFrame("x", nil)); !ok || len(got) != 0 {
+		t.Fatal("empty chunk not parsed")
+	}
+}
+
+// 能敲出来的文本都不能被当成数据帧
+func TestParseDataFrameIgnoresText(t *testing.T) {
+	for _, frame := range []string{
+		"DATA|abc|hello", // 老格式，现在就是一条普通聊天
+		"hello",
+		"",
+		"FILE|a.txt|3|id",
+		"\x00nopipe",
+		"\x00|noid",
+	} {
+		if _, _, ok := ParseDataFrame([]byte(frame)); ok {
+			t.Errorf("ParseDataFrame(%q) = ok", frame)
+		}
+	}
+}
+
+func TestCatalogFrame(t *testing.T) {
+	names, ok := ParseCatalog(string(CatalogFrame([]string{"a.txt", "b|c.png"})))
+	if !ok || !slices.Equal(names, []string{"a.txt", "b|c.png"}) {
+		t.Fatalf("got %v ok=%v", names, ok)
+	}
+	if names, ok := ParseCatalog(string(CatalogFrame(nil))); !ok || len(names) != 0 {
+		t.Fatalf("empty catalog: %v ok=%v", names, ok)
+	}
+	if _, ok := ParseCatalog("FILES|not json"); ok {
+		t.Fatal("bad json accepted")
+	}
+}
@@ -8,10 +8,47 @@ const messagesEl = document.getElementById("messages");
 const composer = document.getElementById("composer");
 const inputEl = document.getElementById("input");
 const disconnectBtn = document.getElementById("disconnect");
+const gridEl = document.querySelector(".grid");
+const threadPanel = document.getElementById("thread");
+const threadTitleEl = document.getElementById("thread-title");
+const threadMessagesEl = document.getElementById("thread-messages");
+const threadComposer = document.getElementById("thread-composer");
+const threadInputEl = document.getElementById("thread-input");
+const threadCloseBtn = document.getElementById("thread-close");
+const peopleEl = document.getElementById("people");
+const typingEl = document.getElementById("typing");
+const roomTitleEl = document.getElementById("room-title");
+const searchForm = document.getElementById("search-form");
+const searchInput = document.getElementById("search-input");
+const searchInfoEl = document.getElementById("search-info");
+const searchResultsEl = document.getElementById("search-results");
+const searchPrevBtn = document.getElementById("search-prev");
+const searchNextBtn = document.getElementById("search-next");
 
 let ws = null;
 let cryptoKey = null;
+let passphrase = ""; // set until the server's KDF| answer lets us derive cryptoKey
+let unconfirmedKey = false; // derived from a passphrase, nothing decrypted with it yet
 let pendingName = "";
+let selfName = ""; // our name on the server, from ROSTER| and rename events
+// message id -> { msg, el, threadEl, replies }; el is the line in the main
+// feed (null for replies), threadEl the line in the open thread panel
+const messagesById = new Map();
+let currentThread = ""; // parent id of the thread shown in the side panel
+const people = new Map(); // name -> member from ROSTER|/PRESENCE|
+const typingUntil = new Map(); // name -> ms timestamp when the indicator expires
+let lastTypingSent = 0;
+// Same timing as TypingInterval / TypingTimeout on the Go side.
+const TYPING_INTERVAL = 3000;
+const TYPING_TIMEOUT = 6000;
+// Read receipts: the server keeps how far everyone has read (READS|/READ|).
+let cursors = {}; // name -> last message id read
+let dividerAfter = ""; // "new messages" goes before the first message after this id
+let lastRead = ""; // the cursor we last reported
+let dividerEl = null;
+let seenEl = null;
+let searchQuery = ""; // the last query without page:, for the pager buttons
+let searchPage = 1;
 const textEncoder = new TextEncoder();
 const textDecoder = new TextDecoder();
 
@@ -23,11 +60,16 @@ function setStatus(text, ok) {
 }
 
 function appendMessage(text, className) {
+  return appendTo(messagesEl, text, className);
+}
+
+function appendTo(container, text, className) {
   const div = document.createElement("div");
   div.className = `msg ${className || ""}`.trim();
   div.textContent = text;
-  messagesEl.appendChild(div);
-  messagesEl.scrollTop = messagesEl.scrollHeight;
+  container.appendChild(div);
+  container.scrollTop = container.scrollHeight;
+  return div;
 }
 
 function wsUrl() {
@@ -45,11 +87,9 @@ async function connect() {
     appendMessage("[SYSTEM] AES key is required", "system");
     return;
   }
-  cryptoKey = await deriveKey(keyStr);
-  if (!cryptoKey) {
-    appendMessage("[SYSTEM] Invalid AES key", "system");
-    return;
-  }
+  // Not a base64/hex key: it is a passphrase, derived once connected.
+  cryptoKey = await deriveKey(keyStr, null);
+  passphrase = cryptoKey ? "" : keyStr;
   pendingName = nameInput.value.trim();
 
   ws = new WebSocket(wsUrl());
@@ -75,11 +115,15 @@ async function connect() {
     if (msg.type === "status") {
       setStatus(msg.text, msg.text === "connected");
       appendMessage(`[SYSTEM] ${msg.text}`, "system");
-      if (msg.text === "connected") {
-        await sendEncrypted("Infernity");
-        if (pendingName) {
-          await sendEncrypted(`/setName ${pendingName}`);
-        }
+      if (msg.text === "disconnected" && unconfirmedKey) {
+        // The server drops a handshake it cannot decrypt without a word.
+        appendMessage("[SYSTEM] Wrong passphrase?", "system");
+      }
+      if (msg.text === "connected" && passphrase) {
+        // Plain text request before the handshake; the answer is KDF|{...}.
+        ws.send(JSON.stringify({ type: "frame", data: bytesToBase64(textEncoder.encode("KDF")) }));
+      } else if (msg.text === "connected") {
+        await startSession();
       }
       return;
     }
@@ -96,11 +140,22 @@ async function connect() {
         appendMessage("[SYSTEM] Bad frame data", "system");
         return;
       }
+      if (passphrase) {
+        await usePassphrase(textDecoder.decode(raw));
+        return;
+      }
       const text = await decryptMessage(raw);
       if (text === null) {
         appendMessage("[SYSTEM] Decrypt failed", "system");
         return;
       }
+      unconfirmedKey = false;
+      if (await handleTransferFrame(text)) {
+        return;
+      }
+      if (handleChatFrame(text)) {
+        return;
+      }
       const isSystem = text.startsWith("[SYSTEM]");
       appendMessage(text, isSystem ? "system" : "");
     }
@@ -111,8 +166,41 @@ async function connect() {
   });
 }
 
+async function startSession() {
+  await sendEncrypted("Infernity");
+  if (pendingName) {
+    await sendEncrypted(`/setName ${pendingName}`);
+  }
+}
+
+// usePassphrase handles the server's plain text KDF| answer: derive the key
+// with its salt and parameters, then run the normal handshake.
+async function usePassphrase(text) {
+  const kdf = text.startsWith("KDF|") ? parseJSON(text.slice("KDF|".length)) : null;
+  const problem = kdfProblem(kdf);
+  if (problem) {
+    appendMessage(`[SYSTEM] ${problem}`, "system");
+    ws.close();
+    return;
+  }
+  appendMessage(`[SYSTEM] Deriving key from passphrase (scrypt N=${kdf.n} r=${kdf.r} p=${kdf.p})...`, "system");
+  cryptoKey = await deriveKey(passphrase, kdf);
+  passphrase = "";
+  unconfirmedKey = true;
+  if (!cryptoKey) {
+    appendMessage("[SYSTEM] Key derivation failed", "system");
+    ws.close();
+    return;
+  }
+  await startSession();
+}
+
 connectForm.addEventListener("submit", (event) => {
   event.preventDefault();
+  // Ask here because browsers only allow the prompt from a user gesture.
+  if ("Notification" in window && Notification.permission === "default") {
+    Notification.requestPermission();
+  }
   connect();
 });
 
@@ -128,10 +216,39 @@ composer.addEventListener("submit", async (event) => {
   }
   await sendEncrypted(text);
   appendMessage(`You: ${text}`, "mine");
+  lastTypingSent = 0;
   inputEl.value = "";
   inputEl.focus();
 });
 
+threadComposer.addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const text = threadInputEl.value.trim();
+  if (!text || !currentThread) {
+    return;
+  }
+  await sendEncrypted(`/reply ${currentThread} ${text}`);
+  lastTypingSent = 0;
+  threadInputEl.value = "";
+});
+
+// Tell the server we're typing while there's non-command text, at most once
+// per TYPING_INTERVAL.
+function sendTyping(value) {
+  const text = value.trim();
+  const now = Date.now();
+  if (!text || text.startsWith("/") || now - lastTypingSent < TYPING_INTERVAL) {
+    return;
+  }
+  lastTypingSent = now;
+  sendEncrypted("\x01TYPING");
+}
+
+inputEl.addEventListener("input", () => sendTyping(inputEl.value));
+threadInputEl.addEventListener("input", () => sendTyping(threadInputEl.value));
+
+threadCloseBtn.addEventListener("click", closeThread);
+
 disconnectBtn.addEventListener("click", () => {
   if (ws) {
     ws.close();
@@ -142,6 +259,646 @@ disconnectBtn.addEventListener("click", () => {
 
 setStatus("Disconnected", false);
 
+// File transfer frames are not supported here: cancel downloads right away
+// and drop their data frames instead of printing binary as chat.
+async function handleTransferFrame(text) {
+  // Data frames start with a 0x00 byte (see utils.DataFrame).
+  if (text.startsWith("\u0000") || text.startsWith("FILE_")) {
+    return true;
+  }
+  if (text.startsWith("FILE|")) {
+    const parts = text.split("|");
+    if (parts.length === 4) {
+      await sendEncrypted(`FILE_CANCEL|${parts[3]}`);
+    }
+    appendMessage(`[SYSTEM] File transfer is not available in the web UI (${parts[1] || ""})`, "system");
+    return true;
+  }
+  return false;
+}
+
+// Structured frames from the server: chat messages (MSG|) are rendered,
+// presence and typing fill the people list and the typing line, the file
+// catalog is ignored.
+function handleChatFrame(text) {
+  if (text.startsWith("MSG|")) {
+    const msg = parseJSON(text.slice("MSG|".length));
+    if (!msg) {
+      return false;
+    }
+    typingUntil.delete(msg.from);
+    renderTyping();
+    // We just spoke, or we're watching and nothing is pending: no divider.
+    if (msg.from === selfName || (!dividerEl && document.hasFocus() && atBottom())) {
+      dividerAfter = "";
+      placeDivider();
+    }
+    addChat(msg, true);
+    markRead();
+    return true;
+  }
+  if (text.startsWith("ROOM|")) {
+    // We moved to another room; its READS| and HISTORY| follow.
+    enterRoom(text.slice("ROOM|".length));
+    return true;
+  }
+  if (text.startsWith("HISTORY|")) {
+    // Replayed on connect: render only, no notifications.
+    for (const msg of parseJSON(text.slice("HISTORY|".length)) || []) {
+      addChat(msg, false);
+    }
+    markRead();
+    return true;
+  }
+  if (text.startsWith("READS|")) {
+    // Sent on connect and after a rename: place the divider after our own cursor.
+    const state = parseJSON(text.slice("READS|".length));
+    if (state) {
+      cursors = state.cursors || {};
+      dividerAfter = cursors[selfName] || "";
+      lastRead = "";
+      placeDivider();
+      renderSeen();
+      markRead();
+    }
+    return true;
+  }
+  if (text.startsWith("READ|")) {
+    const cursor = parseJSON(text.slice("READ|".length));
+    if (cursor && !cursor.id) {
+      delete cursors[cursor.user];
+      renderSeen();
+    } else if (cursor) {
+      cursors[cursor.user] = cursor.id;
+      renderSeen();
+    }
+    return true;
+  }
+  if (text.startsWith("MSG_EVENT|")) {
+    const ev = parseJSON(text.slice("MSG_EVENT|".length));
+    const entry = ev && messagesById.get(ev.id);
+    if (entry) {
+      if (ev.op === "edit") {
+        Object.assign(entry.msg, {
+          text: ev.text,
+          keyId: ev.keyId,
+          cipher: ev.cipher,
+          key: ev.key || entry.msg.key,
+          sig: ev.sig,
+          seq: ev.seq || 0,
+          mentions: ev.mentions,
+          edited: true,
+        });
+        checkSignature(entry);
+      } else if (ev.op === "delete") {
+        Object.assign(entry.msg, { text: "", cipher: "", sig: "", seq: 0, mentions: [], deleted: true });
+        checkSignature(entry);
+      } else if (ev.op === "react" || ev.op === "unreact") {
+        applyReaction(entry.msg, ev);
+      }
+      renderChat(entry);
+    }
+    return true;
+  }
+  if (text.startsWith("ROSTER|")) {
+    const roster = parseJSON(text.slice("ROSTER|".length));
+    if (roster) {
+      selfName = roster.self || "";
+      people.clear();
+      for (const member of roster.users || []) {
+        people.set(member.name, member);
+      }
+      renderPeople();
+    }
+    return true;
+  }
+  if (text.startsWith("PRESENCE|")) {
+    const ev = parseJSON(text.slice("PRESENCE|".length));
+    if (ev) {
+      applyPresence(ev);
+    }
+    return true;
+  }
+  if (text.startsWith("TYPING|")) {
+    const ev = parseJSON(text.slice("TYPING|".length));
+    if (ev && ev.name && ev.name !== selfName) {
+      typingUntil.set(ev.name, Date.now() + TYPING_TIMEOUT);
+      renderTyping();
+      setTimeout(renderTyping, TYPING_TIMEOUT + 100);
+    }
+    return true;
+  }
+  if (text.startsWith("DM|")) {
+    // End-to-end encrypted direct message: the browser has no identity key,
+    // so all we can show is who wrote to whom.
+    const dm = parseJSON(text.slice("DM|".length));
+    if (dm) {
+      const label = dm.from === selfName ? `[DM] -> ${dm.to}` : `[DM] ${dm.from}`;
+      appendMessage(`${label}: ${ENCRYPTED_TEXT}`, "");
+    }
+    return true;
+  }
+  if (text.startsWith("SEARCH|")) {
+    const result = parseJSON(text.slice("SEARCH|".length));
+    if (result) {
+      renderSearch(result);
+    }
+    return true;
+  }
+  // Sender keys and key lookups are only useful to encrypting clients.
+  return text.startsWith("FILES|") || text.startsWith("SKEY|") || text.startsWith("KEYS|");
+}
+
+// Messages from the terminal client are end-to-end encrypted and the web UI
+// cannot read them; what it sends itself stays plain text.
+const ENCRYPTED_TEXT = "🔒 end-to-end encrypted (open the terminal client to read it)";
+
+function messageText(msg) {
+  return msg.cipher && !msg.text ? ENCRYPTED_TEXT : msg.text;
+}
+
+// The terminal client signs what it sends with the Ed25519 half of its
+// identity key, over the ciphertext, so we can check who wrote a message
+// without reading it. Unsigned (plain text) and invalid messages get a tag.
+// Signatures also cover a per-sender sequence number: the same number on a
+// second message is a replay, and a lower one on a message we have already
+// shown means the server rolled an edit back.
+const SIG_NOTES = {
+  unsigned: "unsigned",
+  unknown: "signature not checked",
+  server: "signed with a key only the server vouches for",
+  legacy: "old signature format, replays not detected",
+  other: "signed with another key",
+  replayed: "⚠ replayed",
+  rolledback: "⚠ rolled back",
+  invalid: "⚠ invalid signature",
+};
+const SIG_WARNINGS = new Set(["invalid", "replayed", "rolledback"]);
+
+// "key|seq" -> message id, and message id -> highest seq seen, for this page load.
+const seenSeqs = new Map();
+const newestSeq = new Map();
+
+// checkSignature sets entry.sig: "" (deleted or still checking), "valid" or
+// one of SIG_NOTES. Checking is async; the entry is re-rendered when done.
+async function checkSignature(entry) {
+  const msg = entry.msg;
+  const sig = msg.sig;
+  entry.sig = msg.deleted ? "" : sig ? "" : "unsigned";
+  if (!entry.sig && !msg.deleted) {
+    const state = await signatureState(msg);
+    if (entry.msg.sig === sig) {
+      entry.sig = state;
+      renderChat(entry);
+    }
+  }
+}
+
+// signatureState prefers the key from the roster; the one the server stored
+// with the message only counts when we have nothing else, like the TUI.
+async function signatureState(msg) {
+  const trusted = (people.get(msg.from) || {}).key || "";
+  const envelope = messageEnvelope(msg);
+  try {
+    if (trusted && (await verifySignature(trusted, envelope, msg.sig))) {
+      return freshness("valid", trusted, msg);
+    }
+    if (!msg.key || msg.key === trusted) {
+      return trusted ? "invalid" : "unknown";
+    }
+    if (!(await verifySignature(msg.key, envelope, msg.sig))) {
+      return "invalid";
+    }
+    return freshness(trusted ? "other" : "server", msg.key, msg);
+  } catch (err) {
+    return "unknown"; // this browser has no Ed25519 in WebCrypto
+  }
+}
+
+// messageEnvelope matches utils.Message.Envelope: an edited message signs the
+// id it replaced, anything else signs the message it replied to.
+function messageEnvelope(msg) {
+  const room = msg.room || "lobby";
+  if (!msg.seq) {
+    return `goLearning sig v1|msg|${room}|${msg.from}|${msg.keyId || ""}|${msg.cipher || ""}`;
+  }
+  const parent = msg.edited ? "" : msg.parent || "";
+  const edit = msg.edited ? msg.id : "";
+  const fields = [room, msg.from, String(msg.seq), parent, edit, msg.keyId || "", msg.cipher || ""];
+  // each field carries its UTF-8 byte length, so a "|" inside a name cannot shift the others
+  return "goLearning sig v2|msg" + fields.map((f) => `|${textEncoder.encode(f).length}:${f}`).join("");
+}
+
+// freshness runs once a signature checks out with signer.
+function freshness(state, signer, msg) {
+  if (!msg.seq) {
+    return state === "valid" ? "legacy" : state;
+  }
+  const key = `${signer}|${msg.seq}`;
+  if (seenSeqs.has(key) && seenSeqs.get(key) !== msg.id) {
+    return "replayed";
+  }
+  if (msg.seq < (newestSeq.get(msg.id) || 0)) {
+    return "rolledback";
+  }
+  seenSeqs.set(key, msg.id);
+  newestSeq.set(msg.id, msg.seq);
+  return state;
+}
+
+// verifySignature: identity keys are 32 bytes of X25519 followed by 32 bytes
+// of Ed25519; older clients publish only the first half and cannot sign.
+async function verifySignature(key, envelope, sig) {
+  const raw = base64ToBytes(key);
+  const signature = base64ToBytes(sig);
+  if (!raw || raw.length !== 64 || !signature) {
+    return false;
+  }
+  const pub = await crypto.subtle.importKey("raw", raw.slice(32), { name: "Ed25519" }, false, ["verify"]);
+  return crypto.subtle.verify({ name: "Ed25519" }, pub, signature, textEncoder.encode(envelope));
+}
+
+function enterRoom(room) {
+  closeThread();
+  messagesById.clear();
+  messagesEl.replaceChildren();
+  dividerEl = null;
+  seenEl = null;
+  cursors = {};
+  dividerAfter = "";
+  lastRead = "";
+  roomTitleEl.textContent = `#${room}`;
+  appendMessage(`[SYSTEM] Now in #${room}`, "system");
+}
+
+// Message ids are increasing decimal numbers.
+function compareIds(a, b) {
+  a = a || "";
+  b = b || "";
+  if (a.length !== b.length) {
+    return a.length - b.length;
+  }
+  return a < b ? -1 : a > b ? 1 : 0;
+}
+
+// Entries shown in the main feed, oldest first.
+function feedEntries() {
+  return [...messagesById.values()].filter((entry) => entry.el);
+}
+
+function placeDivider() {
+  if (dividerEl) {
+    dividerEl.remove();
+    dividerEl = null;
+  }
+  if (!dividerAfter) {
+    return;
+  }
+  const first = feedEntries().find(
+    (entry) => entry.msg.from !== selfName && compareIds(entry.msg.id, dividerAfter) > 0
+  );
+  if (first) {
+    dividerEl = document.createElement("div");
+    dividerEl.className = "divider";
+    dividerEl.textContent = "new messages";
+    messagesEl.insertBefore(dividerEl, first.el);
+  }
+}
+
+// "seen by" under the newest message in the feed.
+function renderSeen() {
+  if (seenEl) {
+    seenEl.remove();
+    seenEl = null;
+  }
+  const entries = feedEntries();
+  const last = entries[entries.length - 1];
+  if (!last) {
+    return;
+  }
+  const names = Object.keys(cursors)
+    .filter((name) => name !== last.msg.from && name !== selfName && compareIds(cursors[name], last.msg.id) >= 0)
+    .sort();
+  if (names.length === 0) {
+    return;
+  }
+  seenEl = document.createElement("div");
+  seenEl.className = "seen";
+  seenEl.textContent = names.length <= 3 ? `✓ seen by ${names.join(", ")}` : `✓ seen by ${names.length}`;
+  seenEl.title = names.join(", ");
+  last.el.after(seenEl);
+}
+
+// Report the newest message as read once the feed is scrolled to the bottom
+// of a focused window.
+function markRead() {
+  if (!ws || !document.hasFocus()) {
+    return;
+  }
+  if (!atBottom()) {
+    return;
+  }
+  let latest = "";
+  for (const id of messagesById.keys()) {
+    if (compareIds(id, latest) > 0) {
+      latest = id;
+    }
+  }
+  if (compareIds(latest, lastRead) > 0) {
+    lastRead = latest;
+    sendEncrypted(`READ|${latest}`);
+  }
+}
+
+function atBottom() {
+  return messagesEl.scrollHeight - messagesEl.scrollTop - messagesEl.clientHeight <= 4;
+}
+
+messagesEl.addEventListener("scroll", markRead);
+window.addEventListener("focus", markRead);
+// Whatever arrives after we look away gets the divider.
+window.addEventListener("blur", () => {
+  if (!dividerEl) {
+    dividerAfter = lastRead;
+  }
+});
+
+// Search runs on the server (/search, answered with a SEARCH| frame); the
+// results list lives in the side panel and clicking one jumps to it.
+function runSearch(page) {
+  if (!searchQuery) {
+    return;
+  }
+  sendEncrypted(`/search ${searchQuery} page:${page}`);
+}
+
+function withoutPage(query) {
+  return query
+    .split(/\s+/)
+    .filter((word) => word && !word.toLowerCase().startsWith("page:"))
+    .join(" ");
+}
+
+function renderSearch(result) {
+  searchQuery = withoutPage(result.query);
+  searchPage = result.page;
+  searchResultsEl.textContent = "";
+  searchInfoEl.textContent = result.total
+    ? `${result.total} results, page ${result.page}/${result.pages}`
+    : "No results";
+  for (const msg of result.results || []) {
+    const li = document.createElement("li");
+    const when = new Date(msg.time).toLocaleString();
+    li.textContent = `#${msg.id} ${msg.from} in #${msg.room || "lobby"} · ${when}: ${messageText(msg)}`;
+    li.addEventListener("click", () => jumpTo(msg.id));
+    searchResultsEl.appendChild(li);
+  }
+  searchPrevBtn.disabled = result.page <= 1;
+  searchNextBtn.disabled = result.page >= result.pages;
+}
+
+// Scroll to a message and flash it; replies open their thread first.
+function jumpTo(id) {
+  const entry = messagesById.get(id);
+  if (!entry) {
+    searchInfoEl.textContent = `#${id} is older than the loaded history`;
+    return;
+  }
+  if (!entry.el) {
+    openThread(entry.msg.parent);
+  }
+  const el = entry.el || entry.threadEl;
+  if (!el) {
+    return;
+  }
+  el.scrollIntoView({ block: "center" });
+  el.classList.add("found");
+  setTimeout(() => el.classList.remove("found"), 2000);
+}
+
+searchForm.addEventListener("submit", (event) => {
+  event.preventDefault();
+  searchQuery = withoutPage(searchInput.value.trim());
+  runSearch(1);
+});
+searchPrevBtn.addEventListener("click", () => runSearch(searchPage - 1));
+searchNextBtn.addEventListener("click", () => runSearch(searchPage + 1));
+
+// Leave keeps the member around as offline with its last-seen time.
+function applyPresence(ev) {
+  const member = { name: ev.name, status: ev.status, reason: ev.reason, room: ev.room, lastSeen: ev.lastSeen };
+  if (ev.event === "update" && ev.old) {
+    if (ev.old === selfName) {
+      selfName = ev.name;
+    }
+    people.delete(ev.old);
+    typingUntil.delete(ev.old);
+  }
+  if (ev.event === "leave") {
+    typingUntil.delete(ev.name);
+  }
+  people.set(ev.name, member);
+  renderPeople();
+  renderTyping();
+}
+
+function renderPeople() {
+  peopleEl.textContent = "";
+  // Online first; offline ones most recently seen first.
+  const members = [...people.values()].sort(
+    (a, b) =>
+      (a.status === "offline") - (b.status === "offline") ||
+      (Date.parse(b.lastSeen) || 0) - (Date.parse(a.lastSeen) || 0)
+  );
+  for (const member of members) {
+    const li = document.createElement("li");
+    let detail = member.status;
+    if (member.status === "offline") {
+      detail = member.lastSeen ? `last seen ${new Date(member.lastSeen).toLocaleString()}` : "offline";
+    } else if (member.reason) {
+      detail += `: ${member.reason}`;
+    }
+    const you = member.name === selfName ? " (you)" : "";
+    li.textContent = `${member.name}${you} — ${detail}`;
+    li.className = member.status === "offline" ? "offline" : "";
+    peopleEl.appendChild(li);
+  }
+}
+
+function renderTyping() {
+  const now = Date.now();
+  for (const [name, until] of typingUntil) {
+    if (until <= now) {
+      typingUntil.delete(name);
+    }
+  }
+  const names = [...typingUntil.keys()].sort();
+  if (names.length === 0) {
+    typingEl.textContent = "";
+  } else if (names.length === 1) {
+    typingEl.textContent = `${names[0]} is typing…`;
+  } else if (names.length === 2) {
+    typingEl.textContent = `${names[0]} and ${names[1]} are typing…`;
+  } else {
+    typingEl.textContent = `${names[0]} and ${names.length - 1} others are typing…`;
+  }
+}
+
+// Replies go under their parent (only a counter shows in the feed); a reply
+// whose parent is older than the replayed history is shown in the feed.
+function addChat(msg, notify) {
+  const entry = { msg, el: null, threadEl: null, replies: [] };
+  const parent = msg.parent && messagesById.get(msg.parent);
+  const mentioned = isMentioned(msg);
+  const className = mentioned ? "mention" : "";
+  messagesById.set(msg.id, entry);
+  checkSignature(entry);
+
+  if (parent) {
+    parent.replies.push(msg.id);
+    renderChat(parent);
+    if (currentThread === msg.parent) {
+      entry.threadEl = appendTo(threadMessagesEl, "", className);
+    }
+  } else {
+    entry.el = appendMessage("", className);
+  }
+  renderChat(entry);
+  if (!dividerEl) {
+    placeDivider();
+  }
+  renderSeen();
+  if (mentioned && notify) {
+    notifyMention(msg);
+  }
+}
+
+function renderChat(entry) {
+  if (entry.el) {
+    fillChat(entry.el, entry, !entry.msg.parent);
+  }
+  if (entry.threadEl) {
+    fillChat(entry.threadEl, entry, false);
+  }
+}
+
+// reactions maps emoji -> names of who reacted; an emoji with nobody left is dropped.
+function applyReaction(msg, ev) {
+  const reactions = (msg.reactions = msg.reactions || {});
+  const users = (reactions[ev.text] || []).filter((u) => u !== ev.by);
+  if (ev.op === "react") {
+    users.push(ev.by);
+  }
+  if (users.length) {
+    reactions[ev.text] = users;
+  } else {
+    delete reactions[ev.text];
+  }
+}
+
+// Most reacted first, ties by emoji, the same order as the TUI.
+function reactionKeys(msg) {
+  const reactions = msg.reactions || {};
+  return Object.keys(reactions).sort(
+    (a, b) => reactions[b].length - reactions[a].length || (a < b ? -1 : a > b ? 1 : 0)
+  );
+}
+
+// The #id prefix is what /edit and /delete take.
+function fillChat(el, entry, withThreadLink) {
+  const msg = entry.msg;
+  const reply = msg.parent ? ` ↳#${msg.parent}` : "";
+  el.textContent = msg.deleted
+    ? `#${msg.id}${reply} ${msg.from}: [message deleted]`
+    : `#${msg.id}${reply} ${msg.from}: ${messageText(msg)}${msg.edited ? " (edited)" : ""}`;
+  el.classList.toggle("deleted", !!msg.deleted);
+  el.classList.toggle("encrypted", !msg.deleted && !!msg.cipher);
+  if (SIG_NOTES[entry.sig]) {
+    const tag = document.createElement("span");
+    tag.className = SIG_WARNINGS.has(entry.sig) ? "sig bad" : "sig";
+    tag.textContent = SIG_NOTES[entry.sig];
+    el.appendChild(tag);
+  }
+  if (!msg.deleted) {
+    for (const emoji of reactionKeys(msg)) {
+      const users = msg.reactions[emoji];
+      const chip = document.createElement("button");
+      chip.type = "button";
+      chip.className = users.includes(selfName) ? "reaction mine" : "reaction";
+      chip.textContent = `${emoji} ${users.length}`;
+      chip.title = users.join(", ");
+      chip.addEventListener("click", () => sendEncrypted(`/react ${msg.id} ${emoji}`));
+      el.appendChild(chip);
+    }
+  }
+  if (withThreadLink) {
+    const link = document.createElement("button");
+    link.type = "button";
+    link.className = "ghost thread-link";
+    link.textContent = entry.replies.length ? `${entry.replies.length} replies` : "Reply";
+    link.addEventListener("click", () => openThread(msg.id));
+    el.appendChild(link);
+  }
+}
+
+function openThread(id) {
+  const parent = messagesById.get(id);
+  if (!parent) {
+    return;
+  }
+  closeThread();
+  currentThread = id;
+  threadTitleEl.textContent = `Thread #${id}`;
+  for (const entry of [parent, ...parent.replies.map((r) => messagesById.get(r))]) {
+    entry.threadEl = appendTo(threadMessagesEl, "", isMentioned(entry.msg) ? "mention" : "");
+    renderChat(entry);
+  }
+  threadPanel.hidden = false;
+  gridEl.classList.add("with-thread");
+  threadInputEl.focus();
+}
+
+function closeThread() {
+  const parent = messagesById.get(currentThread);
+  if (parent) {
+    for (const entry of [parent, ...parent.replies.map((r) => messagesById.get(r))]) {
+      entry.threadEl = null;
+    }
+  }
+  currentThread = "";
+  threadMessagesEl.replaceChildren();
+  threadPanel.hidden = true;
+  gridEl.classList.remove("with-thread");
+}
+
+function parseJSON(text) {
+  try {
+    return JSON.parse(text);
+  } catch (err) {
+    return null;
+  }
+}
+
+function isMentioned(msg) {
+  if (!selfName || msg.from === selfName) {
+    return false;
+  }
+  const me = selfName.toLowerCase();
+  return (msg.mentions || []).some((n) => n === "all" || n.toLowerCase() === me);
+}
+
+// Only pop a desktop notification when the page is not being looked at;
+// the highlighted line is enough otherwise.
+function notifyMention(msg) {
+  if (!("Notification" in window) || Notification.permission !== "granted") {
+    return;
+  }
+  if (!document.hidden && document.hasFocus()) {
+    return;
+  }
+  new Notification(`${msg.from} mentioned you`, { body: messageText(msg) });
+}
+
 async function sendEncrypted(text) {
   if (!cryptoKey || !ws || ws.readyState !== WebSocket.OPEN) {
     return;
@@ -159,7 +916,10 @@ async function sendEncrypted(text) {
   );
 }
 
-async function deriveKey(keyStr) {
+// deriveKey follows utils.ParseKey: base64 or hex keys are used as they
+// are; anything else is a passphrase, run through scrypt with the parameters
+// the server published (kdf). Without kdf a passphrase gives null.
+async function deriveKey(keyStr, kdf) {
   const base = tryDecodeBase64(keyStr);
   if (base && isValidKeyLength(base.length)) {
     return importKey(base);
@@ -168,8 +928,102 @@ async function deriveKey(keyStr) {
   if (hex && isValidKeyLength(hex.length)) {
     return importKey(hex);
   }
-  const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", textEncoder.encode(keyStr)));
-  return importKey(hash);
+  if (!kdf) {
+    return null;
+  }
+  const salt = base64ToBytes(kdf.salt);
+  return importKey(await scrypt(textEncoder.encode(keyStr), salt, kdf.n, kdf.r, kdf.p, 32));
+}
+
+// kdfProblem applies the same bounds as KDFParams.Check: too weak would let a
+// fake server brute-force the passphrase, too strong would hang the tab.
+function kdfProblem(kdf) {
+  if (!kdf) {
+    return "The server does not support passphrases, use the key it printed";
+  }
+  if (!kdf.alg) {
+    return "The server has no passphrase set, use the key it printed";
+  }
+  const salt = base64ToBytes(kdf.salt || "");
+  const { n, r, p } = kdf;
+  if (kdf.alg !== "scrypt" || !salt || salt.length < 16) {
+    return `Unsupported key derivation ${kdf.alg}`;
+  }
+  if (!(n >= 1 << 14) || (n & (n - 1)) !== 0 || !(r >= 8) || !(p >= 1 && p <= 4) || n * r > 1 << 21) {
+    return `scrypt parameters out of range: N=${n} r=${r} p=${p}`;
+  }
+  return "";
+}
+
+// scrypt (RFC 7914). WebCrypto has PBKDF2-HMAC-SHA256 but no scrypt, so
+// ROMix and Salsa20/8 are done here on little-endian 32-bit words.
+async function scrypt(password, salt, N, r, p, dkLen) {
+  const pwKey = await crypto.subtle.importKey("raw", password, "PBKDF2", false, ["deriveBits"]);
+  const pbkdf2 = async (s, len) =>
+    new Uint8Array(
+      await crypto.subtle.deriveBits({ name: "PBKDF2", hash: "SHA-256", salt: s, iterations: 1 }, pwKey, len * 8)
+    );
+  const B = await pbkdf2(salt, p * 128 * r);
+  const view = new DataView(B.buffer);
+  const words = 32 * r;
+  const X = new Uint32Array(words);
+  const Y = new Uint32Array(words);
+  const V = new Uint32Array(words * N);
+  for (let i = 0; i < p; i++) {
+    const off = i * 128 * r;
+    for (let k = 0; k < words; k++) {
+      X[k] = view.getUint32(off + 4 * k, true);
+    }
+    for (let n = 0; n < N; n++) {
+      V.set(X, n * words);
+      blockMix(X, Y, r);
+    }
+    for (let n = 0; n < N; n++) {
+      const j = X[(2 * r - 1) * 16] & (N - 1);
+      for (let k = 0; k < words; k++) {
+        X[k] ^= V[j * words + k];
+      }
+      blockMix(X, Y, r);
+    }
+    for (let k = 0; k < words; k++) {
+      view.setUint32(off + 4 * k, X[k], true);
+    }
+  }
+  return pbkdf2(B, dkLen);
+}
+
+// blockMix works on B in place, Y is scratch: even output blocks go to the
+// first half, odd ones to the second.
+const salsaBlock = new Uint32Array(16);
+function blockMix(B, Y, r) {
+  salsaBlock.set(B.subarray((2 * r - 1) * 16, 2 * r * 16));
+  for (let i = 0; i < 2 * r; i++) {
+    for (let k = 0; k < 16; k++) {
+      salsaBlock[k] ^= B[i * 16 + k];
+    }
+    salsa208(salsaBlock);
+    Y.set(salsaBlock, ((i >> 1) + (i & 1) * r) * 16);
+  }
+  B.set(Y);
+}
+
+function salsa208(B) {
+  let [x0, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12, x13, x14, x15] = B;
+  const R = (a, b) => (a << b) | (a >>> (32 - b));
+  for (let i = 0; i < 8; i += 2) {
+    x4 ^= R(x0 + x12, 7); x8 ^= R(x4 + x0, 9); x12 ^= R(x8 + x4, 13); x0 ^= R(x12 + x8, 18);
+    x9 ^= R(x5 + x1, 7); x13 ^= R(x9 + x5, 9); x1 ^= R(x13 + x9, 13); x5 ^= R(x1 + x13, 18);
+    x14 ^= R(x10 + x6, 7); x2 ^= R(x14 + x10, 9); x6 ^= R(x2 + x14, 13); x10 ^= R(x6 + x2, 18);
+    x3 ^= R(x15 + x11, 7); x7 ^= R(x3 + x15, 9); x11 ^= R(x7 + x3, 13); x15 ^= R(x11 + x7, 18);
+    x1 ^= R(x0 + x3, 7); x2 ^= R(x1 + x0, 9); x3 ^= R(x2 + x1, 13); x0 ^= R(x3 + x2, 18);
+    x6 ^= R(x5 + x4, 7); x7 ^= R(x6 + x5, 9); x4 ^= R(x7 + x6, 13); x5 ^= R(x4 + x7, 18);
+    x11 ^= R(x10 + x9, 7); x8 ^= R(x11 + x10, 9); x9 ^= R(x8 + x11, 13); x10 ^= R(x9 + x8, 18);
+    x12 ^= R(x15 + x14, 7); x13 ^= R(x12 + x15, 9); x14 ^= R(x13 + x12, 13); x15 ^= R(x14 + x13, 18);
+  }
+  const x = [x0, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12, x13, x14, x15];
+  for (let i = 0; i < 16; i++) {
+    B[i] += x[i];
+  }
 }
 
 function isValidKeyLength(len) {